@@ -0,0 +1,133 @@
+package main
+
+import (
+	"cmpserve/pkg/cmpserve"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// archiveJSON is an indexed archive as listed by GET /admin/archives
+type archiveJSON struct {
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	Modified  time.Time `json:"modified"`
+	Entries   int       `json:"entries"`
+	IndexedAt time.Time `json:"indexed_at"`
+	Rejected  string    `json:"rejected,omitempty"`
+}
+
+// newAdminHandler serves the archive index maintenance endpoints of the -dir handler.
+// Archive paths are given as ?path=/docs.zip, relative to -dir. Reindexing with
+// ?if-changed only reindexes archives that a strict check finds changed, and pinning keeps
+// the index of an archive in memory.
+func newAdminHandler(server *cmpserve.Handler, logger *slog.Logger) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/reindex", func(w http.ResponseWriter, r *http.Request) {
+		name, ok := adminArchivePath(w, r)
+		if !ok {
+			return
+		}
+		var entries int
+		var err error
+		reindexed := true
+		if r.URL.Query().Has("if-changed") {
+			entries, reindexed, err = server.ReindexIfChanged(r.Context(), name)
+		} else {
+			entries, err = server.Reindex(r.Context(), name)
+		}
+		if err != nil {
+			adminError(w, r, logger, "Failed to reindex archive", err)
+			return
+		}
+		if reindexed {
+			logger.InfoContext(r.Context(), "Reindexed archive", "path", name, "entries", entries)
+		}
+		writeJSON(w, map[string]any{"path": name, "entries": entries, "reindexed": reindexed})
+	})
+	mux.HandleFunc("/admin/invalidate", func(w http.ResponseWriter, r *http.Request) {
+		name, ok := adminArchivePath(w, r)
+		if !ok {
+			return
+		}
+		invalidated, err := server.Invalidate(r.Context(), name)
+		if err != nil {
+			adminError(w, r, logger, "Failed to invalidate archive", err)
+			return
+		}
+		writeJSON(w, map[string]any{"path": name, "invalidated": invalidated})
+	})
+	mux.HandleFunc("/admin/pin", func(w http.ResponseWriter, r *http.Request) {
+		name, ok := adminArchivePath(w, r)
+		if !ok {
+			return
+		}
+		entries, size, err := server.Pin(r.Context(), name)
+		if err != nil {
+			adminError(w, r, logger, "Failed to pin archive", err)
+			return
+		}
+		writeJSON(w, map[string]any{"path": name, "entries": entries, "bytes": size})
+	})
+	mux.HandleFunc("/admin/archives", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		archives, err := server.Archives(r.Context())
+		if err != nil {
+			adminError(w, r, logger, "Failed to list archives", err)
+			return
+		}
+		list := make([]archiveJSON, 0, len(archives))
+		for _, archive := range archives {
+			list = append(list, archiveJSON(archive))
+		}
+		writeJSON(w, list)
+	})
+	return mux
+}
+
+// adminArchivePath checks that a request is a POST and returns its archive path, answering
+// it with an error otherwise
+func adminArchivePath(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return "", false
+	}
+	name := strings.TrimPrefix(r.URL.Query().Get("path"), "/")
+	if name == "" {
+		http.Error(w, "missing path parameter", http.StatusBadRequest)
+		return "", false
+	}
+	return name, true
+}
+
+// adminError answers a request with the status matching err, logging unexpected errors
+func adminError(w http.ResponseWriter, r *http.Request, logger *slog.Logger, msg string, err error) {
+	switch {
+	case errors.Is(err, fs.ErrInvalid):
+		http.Error(w, "invalid archive path", http.StatusBadRequest)
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "archive not found", http.StatusNotFound)
+	case errors.Is(err, cmpserve.ErrArchiveRejected):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		if r.Context().Err() == nil {
+			logger.ErrorContext(r.Context(), msg, "path", r.URL.Query().Get("path"), "error", err)
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// writeJSON answers a request with v encoded as JSON
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
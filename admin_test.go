@@ -0,0 +1,197 @@
+package main
+
+import (
+	"archive/zip"
+	"cmpserve/pkg/cmpserve"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeZip writes an archive of stored entries, whose size only depends on their names and
+// lengths, and sets its modification time.
+func writeZip(t *testing.T, zipPath string, modTime time.Time, files map[string]string) {
+	t.Helper()
+	file, err := os.Create(zipPath)
+	require.NoError(t, err)
+	writer := zip.NewWriter(file)
+	for name, content := range files {
+		w, err := writer.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+	require.NoError(t, file.Close())
+	require.NoError(t, os.Chtimes(zipPath, modTime, modTime))
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	root := t.TempDir()
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	zipPath := filepath.Join(root, "docs.zip")
+	writeZip(t, zipPath, modTime, map[string]string{"index.html": "old", "a.txt": "a"})
+	logger := slog.New(slog.DiscardHandler)
+	server, err := cmpserve.New(cmpserve.Options{Root: root, CacheDir: t.TempDir(), Logger: logger})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, server.Close()) })
+
+	site := httptest.NewServer(server)
+	t.Cleanup(site.Close)
+	admin := httptest.NewServer(newAdminHandler(server, logger))
+	t.Cleanup(admin.Close)
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(site.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+	post := func(path string, v any) int {
+		resp, err := http.Post(admin.URL+path, "", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+		}
+		return resp.StatusCode
+	}
+	listArchives := func() []archiveJSON {
+		resp, err := http.Get(admin.URL + "/admin/archives")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var archives []archiveJSON
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&archives))
+		return archives
+	}
+
+	assert.Empty(t, listArchives())
+	_, body := get("/docs/")
+	assert.Equal(t, "old", body)
+	archives := listArchives()
+	require.Len(t, archives, 1)
+	assert.Equal(t, "docs.zip", archives[0].Path)
+	assert.Equal(t, 2, archives[0].Entries)
+	assert.True(t, modTime.Equal(archives[0].Modified))
+
+	// Replaced with the same size and modification time, the archive looks unchanged
+	writeZip(t, zipPath, modTime, map[string]string{"index.html": "new", "b.txt": "b"})
+	status, _ := get("/docs/b.txt")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	var reindexed struct {
+		Path      string `json:"path"`
+		Entries   int    `json:"entries"`
+		Reindexed bool   `json:"reindexed"`
+	}
+	assert.Equal(t, http.StatusOK, post("/admin/reindex?path=/docs.zip", &reindexed))
+	assert.Equal(t, "docs.zip", reindexed.Path)
+	assert.Equal(t, 2, reindexed.Entries)
+	assert.True(t, reindexed.Reindexed)
+	status, body = get("/docs/b.txt")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "b", body)
+	_, body = get("/docs/")
+	assert.Equal(t, "new", body)
+	status, _ = get("/docs/a.txt")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// Unless asked to check it first, which strictly tells replacements apart
+	reindexed.Reindexed = true
+	assert.Equal(t, http.StatusOK, post("/admin/reindex?path=/docs.zip&if-changed", &reindexed))
+	assert.False(t, reindexed.Reindexed)
+	assert.Equal(t, 2, reindexed.Entries)
+	writeZip(t, zipPath, modTime, map[string]string{"index.html": "NEW", "d.txt": "d"})
+	assert.Equal(t, http.StatusOK, post("/admin/reindex?path=/docs.zip&if-changed", &reindexed))
+	assert.True(t, reindexed.Reindexed)
+	_, body = get("/docs/d.txt")
+	assert.Equal(t, "d", body)
+
+	// Invalidated archives drop out of the index until requested again
+	writeZip(t, zipPath, modTime, map[string]string{"index.html": "one", "c.txt": "c"})
+	var invalidated struct {
+		Invalidated bool `json:"invalidated"`
+	}
+	assert.Equal(t, http.StatusOK, post("/admin/invalidate?path=docs.zip", &invalidated))
+	assert.True(t, invalidated.Invalidated)
+	assert.Empty(t, listArchives())
+	assert.Equal(t, http.StatusOK, post("/admin/invalidate?path=docs.zip", &invalidated))
+	assert.False(t, invalidated.Invalidated)
+	status, body = get("/docs/c.txt")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "c", body)
+	assert.Len(t, listArchives(), 1)
+
+	// Pinned archives are still reindexed once they change
+	var pinned struct {
+		Entries int   `json:"entries"`
+		Bytes   int64 `json:"bytes"`
+	}
+	assert.Equal(t, http.StatusOK, post("/admin/pin?path=/docs.zip", &pinned))
+	assert.Equal(t, 2, pinned.Entries)
+	assert.Positive(t, pinned.Bytes)
+	writeZip(t, zipPath, modTime.Add(time.Minute), map[string]string{"index.html": "two", "e.txt": "e"})
+	_, body = get("/docs/e.txt")
+	assert.Equal(t, "e", body)
+	assert.Equal(t, http.StatusNotFound, post("/admin/pin?path=missing.zip", nil))
+
+	assert.Equal(t, http.StatusBadRequest, post("/admin/reindex", nil))
+	assert.Equal(t, http.StatusBadRequest, post("/admin/reindex?path=../docs.zip", nil))
+	assert.Equal(t, http.StatusBadRequest, post("/admin/reindex?path=docs", nil))
+	assert.Equal(t, http.StatusNotFound, post("/admin/reindex?path=missing.zip", nil))
+
+	resp, err := http.Get(admin.URL + "/admin/reindex?path=docs.zip")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, http.MethodPost, resp.Header.Get("Allow"))
+	resp, err = http.Post(admin.URL+"/admin/archives", "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	// The site itself has no admin endpoints
+	status, _ = get("/admin/archives")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestAdminRejectedArchive(t *testing.T) {
+	root := t.TempDir()
+	writeZip(t, filepath.Join(root, "upload.zip"), time.Now(), map[string]string{"a.txt": "a", "b.txt": "b"})
+	logger := slog.New(slog.DiscardHandler)
+	server, err := cmpserve.New(cmpserve.Options{Root: root, CacheDir: t.TempDir(), Logger: logger, ArchiveLimits: cmpserve.ArchiveLimits{MaxEntries: 1}})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, server.Close()) })
+	admin := httptest.NewServer(newAdminHandler(server, logger))
+	t.Cleanup(admin.Close)
+
+	resp, err := http.Post(admin.URL+"/admin/reindex?path=/upload.zip", "", nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.Contains(t, string(body), "2 entries declared, more than 1")
+
+	resp, err = http.Get(admin.URL + "/admin/archives")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var archives []archiveJSON
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&archives))
+	require.Len(t, archives, 1)
+	assert.Equal(t, "2 entries declared, more than 1", archives[0].Rejected)
+	assert.Equal(t, 0, archives[0].Entries)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envNames lists the environment variables that don't follow the CMPSERVE_<FLAG> pattern.
+var envNames = map[string]string{
+	"vhost":           "CMPSERVE_VHOSTS",
+	"header":          "CMPSERVE_HEADERS",
+	"header-override": "CMPSERVE_HEADER_OVERRIDES",
+}
+
+// envName returns the environment variable setting the flag name
+func envName(name string) string {
+	if env, ok := envNames[name]; ok {
+		return env
+	}
+	return "CMPSERVE_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadConfig applies a YAML config file mapping flag names to values to the flags of fs
+// that were neither given on the command line nor set through their environment
+// variable. Repeatable flags take lists. Unknown options and invalid values are errors
+// naming the line they are on.
+func loadConfig(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if len(document.Content) == 0 {
+		return nil
+	}
+	options := document.Content[0]
+	if options.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s:%d: expected a mapping of option names to values", path, options.Line)
+	}
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(options.Content); i += 2 {
+		key, value := options.Content[i], options.Content[i+1]
+		name := key.Value
+		f := fs.Lookup(name)
+		if f == nil || name == "config" {
+			return fmt.Errorf("%s:%d: unknown option %q", path, key.Line, name)
+		}
+		if seen[name] {
+			return fmt.Errorf("%s:%d: option %q given twice", path, key.Line, name)
+		}
+		seen[name] = true
+		if given[name] {
+			continue
+		}
+		if _, set := os.LookupEnv(envName(name)); set {
+			continue
+		}
+
+		values, err := configValues(f, value)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", path, value.Line, name, err)
+		}
+		for _, item := range values {
+			if err := fs.Set(name, item.Value); err != nil {
+				return fmt.Errorf("%s:%d: invalid value %q for %s: %w", path, item.Line, item.Value, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configValues returns the scalars given to a flag: a single one, or a list for
+// repeatable flags.
+func configValues(f *flag.Flag, value *yaml.Node) ([]*yaml.Node, error) {
+	switch {
+	case value.Kind == yaml.ScalarNode && value.Tag != "!!null":
+		return []*yaml.Node{value}, nil
+	case value.Kind == yaml.SequenceNode:
+		if _, repeatable := f.Value.(*stringList); !repeatable {
+			return nil, errors.New("takes a single value, not a list")
+		}
+		for _, item := range value.Content {
+			if item.Kind != yaml.ScalarNode || item.Tag == "!!null" {
+				return nil, fmt.Errorf("line %d: list items must be plain values", item.Line)
+			}
+		}
+		return value.Content, nil
+	default:
+		return nil, errors.New("expected a value")
+	}
+}
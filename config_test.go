@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testFlags defines flags the way main does, with defaults from the environment.
+func testFlags() (*flag.FlagSet, *string, *bool, *time.Duration, *stringList) {
+	fs := flag.NewFlagSet("cmpserve", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	port := fs.String("port", getEnvWithDefault("CMPSERVE_PORT", "8080"), "")
+	indexes := fs.Bool("indexes", os.Getenv("CMPSERVE_INDEXES") == "true", "")
+	timeout := fs.Duration("write-timeout", getEnvDurationWithDefault("CMPSERVE_WRITE_TIMEOUT", 30*time.Second), "")
+	headers := stringList{values: splitLines(os.Getenv("CMPSERVE_HEADERS"))}
+	fs.Var(&headers, "header", "")
+	fs.String("config", "", "")
+	return fs, port, indexes, timeout, &headers
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	config := "port: 9000\nindexes: true\nwrite-timeout: 1m\nheader:\n  - 'X-Frame-Options: DENY'\n  - 'X-Team: web'\n"
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		config  string
+		port    string
+		indexes bool
+		timeout time.Duration
+		headers []string
+	}{
+		{name: "defaults", port: "8080", timeout: 30 * time.Second},
+		{name: "config", config: config, port: "9000", indexes: true, timeout: time.Minute, headers: []string{"X-Frame-Options: DENY", "X-Team: web"}},
+		{
+			name:    "environment over config",
+			env:     map[string]string{"CMPSERVE_PORT": "9100", "CMPSERVE_INDEXES": "false", "CMPSERVE_HEADERS": "X-Env: 1"},
+			config:  config,
+			port:    "9100",
+			timeout: time.Minute,
+			headers: []string{"X-Env: 1"},
+		},
+		{
+			name:    "flags over environment and config",
+			args:    []string{"-port", "9200", "-indexes=false", "-header", "X-Flag: 1"},
+			env:     map[string]string{"CMPSERVE_PORT": "9100"},
+			config:  config,
+			port:    "9200",
+			timeout: time.Minute,
+			headers: []string{"X-Flag: 1"},
+		},
+		{
+			name:    "repeated flags over environment",
+			args:    []string{"-header", "X-Flag: 1", "-header", "X-Flag: 2"},
+			env:     map[string]string{"CMPSERVE_HEADERS": "X-Env: 1\nX-Env: 2"},
+			port:    "8080",
+			timeout: 30 * time.Second,
+			headers: []string{"X-Flag: 1", "X-Flag: 2"},
+		},
+		{
+			name:    "environment alone",
+			env:     map[string]string{"CMPSERVE_HEADERS": "X-Env: 1\nX-Env: 2"},
+			port:    "8080",
+			timeout: 30 * time.Second,
+			headers: []string{"X-Env: 1", "X-Env: 2"},
+		},
+		{name: "empty config", config: "# nothing yet\n", port: "8080", timeout: 30 * time.Second},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for key, value := range tc.env {
+				t.Setenv(key, value)
+			}
+			fs, port, indexes, timeout, headers := testFlags()
+			require.NoError(t, fs.Parse(tc.args))
+			if tc.config != "" {
+				require.NoError(t, loadConfig(fs, writeConfig(t, tc.config)))
+			}
+			assert.Equal(t, tc.port, *port)
+			assert.Equal(t, tc.indexes, *indexes)
+			assert.Equal(t, tc.timeout, *timeout)
+			assert.Equal(t, tc.headers, headers.values)
+		})
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	for _, tc := range []struct{ config, err string }{
+		{"port: 9000\nindexs: true\n", `config.yaml:2: unknown option "indexs"`},
+		{"config: other.yaml\n", `config.yaml:1: unknown option "config"`},
+		{"port: 9000\nport: 9001\n", `config.yaml:2: option "port" given twice`},
+		{"\nindexes: maybe\n", `config.yaml:2: invalid value "maybe" for indexes`},
+		{"write-timeout: soon\n", `config.yaml:1: invalid value "soon" for write-timeout`},
+		{"port:\n  - 9000\n", `config.yaml:2: port: takes a single value, not a list`},
+		{"port:\n", `config.yaml:1: port: expected a value`},
+		{"header:\n  - {a: b}\n", `list items must be plain values`},
+		{"- port\n", `config.yaml:1: expected a mapping`},
+		{"port: [9000\n", `config.yaml: yaml:`},
+	} {
+		fs, _, _, _, _ := testFlags()
+		require.NoError(t, fs.Parse(nil))
+		err := loadConfig(fs, writeConfig(t, tc.config))
+		require.Error(t, err, tc.config)
+		assert.Contains(t, err.Error(), tc.err, tc.config)
+	}
+
+	fs, _, _, _, _ := testFlags()
+	assert.Error(t, loadConfig(fs, filepath.Join(t.TempDir(), "missing.yaml")))
+}
+
+// TestEnvNames checks envName against the environment variables main reads for each flag,
+// so that config files can't override a variable that is set.
+func TestEnvNames(t *testing.T) {
+	source, err := os.ReadFile("main.go")
+	require.NoError(t, err)
+	plain := regexp.MustCompile(`flag\.\w+\("([a-z0-9-]+)", [^\n]*?"(CMPSERVE_[A-Z_]+)"`)
+	repeatable := regexp.MustCompile(`os\.Getenv\("(CMPSERVE_[A-Z_]+)"\)\)}\n\s*flag\.Var\(&\w+, "([a-z0-9-]+)"`)
+
+	checked := 0
+	for _, match := range plain.FindAllStringSubmatch(string(source), -1) {
+		assert.Equal(t, match[2], envName(match[1]), match[1])
+		checked++
+	}
+	for _, match := range repeatable.FindAllStringSubmatch(string(source), -1) {
+		assert.Equal(t, match[1], envName(match[2]), match[2])
+		checked++
+	}
+	flagCount := strings.Count(string(source), "flag.String(") + strings.Count(string(source), "flag.Bool(") +
+		strings.Count(string(source), "flag.Int(") + strings.Count(string(source), "flag.Duration(") + strings.Count(string(source), "flag.Var(")
+	assert.Equal(t, flagCount, checked, "every flag reads an environment variable")
+}
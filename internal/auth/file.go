@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// watchedFile is a file that is parsed again whenever its modification time or size changes.
+type watchedFile struct {
+	path   string
+	kind   string
+	parse  func(data []byte) error
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+// load reads and parses the file.
+func (f *watchedFile) load() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s file: %w", f.kind, err)
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s file: %w", f.kind, err)
+	}
+	if err := f.parse(data); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return nil
+}
+
+// reloadIfChanged reloads the file if it was modified since it was last loaded. If it
+// can't be read, the previously parsed contents stay in effect.
+func (f *watchedFile) reloadIfChanged() {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		f.logger.Warn("Failed to check "+f.kind+" file", "path", f.path, "error", err)
+		return
+	}
+	f.mu.Lock()
+	unchanged := info.ModTime().Equal(f.modTime) && info.Size() == f.size
+	f.mu.Unlock()
+	if unchanged {
+		return
+	}
+	if err := f.load(); err != nil {
+		f.logger.Warn("Failed to reload "+f.kind+" file", "path", f.path, "error", err)
+		return
+	}
+	f.logger.Info("Reloaded "+f.kind+" file", "path", f.path)
+}
@@ -0,0 +1,122 @@
+// Package auth authenticates clients of the server.
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against for unknown users, so that they take as long to reject
+// as wrong passwords and can't be told apart by timing.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("cmpserve"), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
+
+// Htpasswd checks credentials against an Apache htpasswd file with bcrypt ($2y$) or
+// SHA-crypt ($5$, $6$) hashes. The file is reloaded whenever it changes.
+type Htpasswd struct {
+	// file is nil for lines parsed by ParseHtpasswd.
+	file   *watchedFile
+	path   string
+	logger *slog.Logger
+
+	mu    sync.RWMutex
+	users map[string]string
+}
+
+// NewHtpasswd loads the htpasswd file at path. Lines that can't be parsed or use an
+// unsupported hash are skipped with a warning.
+func NewHtpasswd(path string, logger *slog.Logger) (*Htpasswd, error) {
+	h := &Htpasswd{path: path, logger: logger}
+	h.file = &watchedFile{path: path, kind: "htpasswd", logger: logger, parse: h.parse}
+	if err := h.file.load(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// ParseHtpasswd parses htpasswd lines kept in another file, such as an access file at
+// path. Unlike those of NewHtpasswd, they are never reloaded.
+func ParseHtpasswd(data []byte, path string, logger *slog.Logger) (*Htpasswd, error) {
+	h := &Htpasswd{path: path, logger: logger}
+	if err := h.parse(data); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Authenticate reports whether password is valid for user.
+func (h *Htpasswd) Authenticate(user, password string) bool {
+	if h.file != nil {
+		h.file.reloadIfChanged()
+	}
+
+	h.mu.RLock()
+	hash, ok := h.users[user]
+	h.mu.RUnlock()
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false
+	}
+
+	if strings.HasPrefix(hash, "$5$") || strings.HasPrefix(hash, "$6$") {
+		match, err := compareSHACrypt(hash, password)
+		return err == nil && match
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (h *Htpasswd) parse(data []byte) error {
+	logger, path := h.logger, h.path
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" || hash == "" {
+			logger.Warn("Skipping malformed htpasswd line", "path", path, "line", lineNumber)
+			continue
+		}
+		if !supportedHash(hash) {
+			logger.Warn("Skipping htpasswd entry with unsupported hash, use bcrypt or SHA-crypt", "path", path, "line", lineNumber, "user", user)
+			continue
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read htpasswd file: %w", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.users = users
+	return nil
+}
+
+// supportedHash reports whether hash is a well-formed bcrypt or SHA-crypt hash.
+func supportedHash(hash string) bool {
+	for _, prefix := range []string{"$2y$", "$2a$", "$2b$"} {
+		if strings.HasPrefix(hash, prefix) {
+			_, err := bcrypt.Cost([]byte(hash))
+			return err == nil
+		}
+	}
+	if strings.HasPrefix(hash, "$5$") || strings.HasPrefix(hash, "$6$") {
+		_, err := parseSHACrypt(hash)
+		return err == nil
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdBcrypt hashes password the way htpasswd -B does.
+func htpasswdBcrypt(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+	return "$2y$" + strings.TrimPrefix(string(hash), "$2a$")
+}
+
+func writeHtpasswd(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600))
+}
+
+func TestHtpasswd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".htpasswd")
+	writeHtpasswd(t, path,
+		"# deploy users",
+		"alice:"+htpasswdBcrypt(t, "wonderland"),
+		"bob:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5",
+		"carol:$6$rounds=10000$abc$3DDOWZMNRRKDT142bUtYQRY52ycK/xshRXOQgIyt2QRXzLDnoPq6v4lO9bA3f/JhGz1mHrAh.QUDGHmaE5RxP.",
+	)
+	htpasswd, err := NewHtpasswd(path, slog.New(slog.DiscardHandler))
+	require.NoError(t, err)
+
+	assert.True(t, htpasswd.Authenticate("alice", "wonderland"))
+	assert.True(t, htpasswd.Authenticate("bob", "Hello world!"))
+	assert.True(t, htpasswd.Authenticate("carol", "secret"))
+
+	assert.False(t, htpasswd.Authenticate("alice", "Wonderland"))
+	assert.False(t, htpasswd.Authenticate("bob", "Hello world"))
+	assert.False(t, htpasswd.Authenticate("mallory", "wonderland"))
+	assert.False(t, htpasswd.Authenticate("", ""))
+}
+
+func TestHtpasswdMalformedLines(t *testing.T) {
+	var logs bytes.Buffer
+	path := filepath.Join(t.TempDir(), ".htpasswd")
+	writeHtpasswd(t, path,
+		"no-separator",
+		":"+htpasswdBcrypt(t, "nobody"),
+		"empty:",
+		"md5:$apr1$salt$hash",
+		"plain:password",
+		"broken:$2y$05$short",
+		"sha:$5$salt",
+		"alice:"+htpasswdBcrypt(t, "wonderland"),
+	)
+	htpasswd, err := NewHtpasswd(path, slog.New(slog.NewTextHandler(&logs, nil)))
+	require.NoError(t, err)
+
+	// Valid entries still work, broken ones never match
+	assert.True(t, htpasswd.Authenticate("alice", "wonderland"))
+	assert.False(t, htpasswd.Authenticate("plain", "password"))
+	assert.False(t, htpasswd.Authenticate("md5", ""))
+	assert.Equal(t, 7, strings.Count(logs.String(), "level=WARN"), logs.String())
+	assert.NotContains(t, logs.String(), "wonderland")
+
+	_, err = NewHtpasswd(filepath.Join(t.TempDir(), "missing"), slog.New(slog.DiscardHandler))
+	assert.Error(t, err)
+}
+
+func TestHtpasswdReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".htpasswd")
+	writeHtpasswd(t, path, "alice:"+htpasswdBcrypt(t, "wonderland"))
+	htpasswd, err := NewHtpasswd(path, slog.New(slog.DiscardHandler))
+	require.NoError(t, err)
+	assert.False(t, htpasswd.Authenticate("bob", "builder"))
+
+	writeHtpasswd(t, path, "alice:"+htpasswdBcrypt(t, "wonderland"), "bob:"+htpasswdBcrypt(t, "builder"))
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, future, future))
+	assert.True(t, htpasswd.Authenticate("bob", "builder"))
+
+	// Users stay in effect if the file disappears
+	require.NoError(t, os.Remove(path))
+	assert.True(t, htpasswd.Authenticate("alice", "wonderland"))
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	var logs bytes.Buffer
+	data := "\nalice:" + htpasswdBcrypt(t, "wonderland") + "\nplain:password\n"
+	htpasswd, err := ParseHtpasswd([]byte(data), "/srv/.cmpserve-access", slog.New(slog.NewTextHandler(&logs, nil)))
+	require.NoError(t, err)
+
+	assert.True(t, htpasswd.Authenticate("alice", "wonderland"))
+	assert.False(t, htpasswd.Authenticate("plain", "password"))
+	assert.Equal(t, 1, strings.Count(logs.String(), "level=WARN"), logs.String())
+	assert.Contains(t, logs.String(), "path=/srv/.cmpserve-access line=3")
+}
+
+func TestSHACrypt(t *testing.T) {
+	// Generated with openssl passwd -5/-6
+	for _, tc := range []struct{ hash, password string }{
+		{"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "Hello world!"},
+		{"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!"},
+		{"$5$toolongsaltstrin$37tCxOq5xshRncIKBOJ8buhNCuZ0PBFBUwb3XaEPn08", "secret"},
+		{"$6$rounds=10000$abc$3DDOWZMNRRKDT142bUtYQRY52ycK/xshRXOQgIyt2QRXzLDnoPq6v4lO9bA3f/JhGz1mHrAh.QUDGHmaE5RxP.", "secret"},
+	} {
+		match, err := compareSHACrypt(tc.hash, tc.password)
+		require.NoError(t, err, tc.hash)
+		assert.True(t, match, tc.hash)
+
+		match, err = compareSHACrypt(tc.hash, tc.password+"x")
+		require.NoError(t, err, tc.hash)
+		assert.False(t, match, tc.hash)
+	}
+
+	for _, hash := range []string{"", "$5$", "$5$salt", "$7$salt$hash", "$6$rounds=x$salt$hash", "$5$sa:lt$hash"} {
+		_, err := compareSHACrypt(hash, "secret")
+		assert.Error(t, err, hash)
+	}
+}
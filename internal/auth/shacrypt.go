@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SHA-crypt ($5$ and $6$ hashes), as specified by Ulrich Drepper's "Unix crypt using
+// SHA-256 and SHA-512" and produced by htpasswd -2/-5 and openssl passwd -5/-6.
+
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSalt       = 16
+	cryptAlphabet         = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+var errMalformedHash = errors.New("malformed SHA-crypt hash")
+
+// Byte order in which the final digest is encoded, three bytes at a time.
+var (
+	sha256CryptOrder = []int{0, 10, 20, 21, 1, 11, 12, 22, 2, 3, 13, 23, 24, 4, 14, 15, 25, 5, 6, 16, 26, 27, 7, 17, 18, 28, 8, 9, 19, 29, 31, 30}
+	sha512CryptOrder = []int{0, 21, 42, 22, 43, 1, 44, 2, 23, 3, 24, 45, 25, 46, 4, 47, 5, 26, 6, 27, 48, 28, 49, 7, 50, 8, 29, 9, 30, 51, 31, 52, 10,
+		53, 11, 32, 12, 33, 54, 34, 55, 13, 56, 14, 35, 15, 36, 57, 37, 58, 16, 59, 17, 38, 18, 39, 60, 40, 61, 19, 62, 20, 41, 63}
+)
+
+// shaCryptHash holds the parameters of a parsed SHA-crypt hash.
+type shaCryptHash struct {
+	prefix      string
+	newHash     func() hash.Hash
+	order       []int
+	salt        string
+	rounds      int
+	roundsGiven bool
+}
+
+// parseSHACrypt parses a $5$ or $6$ hash, optionally with an explicit rounds= field.
+func parseSHACrypt(encoded string) (*shaCryptHash, error) {
+	parsed := &shaCryptHash{prefix: encoded[:min(len(encoded), 3)], rounds: shaCryptDefaultRounds}
+	switch parsed.prefix {
+	case "$5$":
+		parsed.newHash, parsed.order = sha256.New, sha256CryptOrder
+	case "$6$":
+		parsed.newHash, parsed.order = sha512.New, sha512CryptOrder
+	default:
+		return nil, errMalformedHash
+	}
+
+	fields := strings.Split(encoded[len(parsed.prefix):], "$")
+	if len(fields) == 3 && strings.HasPrefix(fields[0], "rounds=") {
+		n, err := strconv.Atoi(strings.TrimPrefix(fields[0], "rounds="))
+		if err != nil {
+			return nil, errMalformedHash
+		}
+		parsed.rounds = min(max(n, shaCryptMinRounds), shaCryptMaxRounds)
+		parsed.roundsGiven = true
+		fields = fields[1:]
+	}
+	if len(fields) != 2 || fields[1] == "" || strings.Trim(fields[0]+fields[1], cryptAlphabet) != "" {
+		return nil, errMalformedHash
+	}
+	parsed.salt = fields[0]
+	return parsed, nil
+}
+
+// compareSHACrypt reports whether password matches a $5$ or $6$ hash.
+func compareSHACrypt(encoded, password string) (bool, error) {
+	parsed, err := parseSHACrypt(encoded)
+	if err != nil {
+		return false, err
+	}
+	computed := parsed.compute([]byte(password))
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(encoded)) == 1, nil
+}
+
+// compute returns the encoded hash of password with the parameters of p, in the same format
+// it was parsed from.
+func (p *shaCryptHash) compute(password []byte) string {
+	salt := []byte(p.salt)
+	if len(salt) > shaCryptMaxSalt {
+		salt = salt[:shaCryptMaxSalt]
+	}
+
+	h := p.newHash()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	alternate := h.Sum(nil)
+
+	h.Reset()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(repeatTo(alternate, len(password)))
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(alternate)
+		} else {
+			h.Write(password)
+		}
+	}
+	digest := h.Sum(nil)
+
+	h.Reset()
+	for range password {
+		h.Write(password)
+	}
+	passwordSeq := repeatTo(h.Sum(nil), len(password))
+
+	h.Reset()
+	for i := 0; i < 16+int(digest[0]); i++ {
+		h.Write(salt)
+	}
+	saltSeq := repeatTo(h.Sum(nil), len(salt))
+
+	for i := 0; i < p.rounds; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(passwordSeq)
+		} else {
+			h.Write(digest)
+		}
+		if i%3 != 0 {
+			h.Write(saltSeq)
+		}
+		if i%7 != 0 {
+			h.Write(passwordSeq)
+		}
+		if i&1 != 0 {
+			h.Write(digest)
+		} else {
+			h.Write(passwordSeq)
+		}
+		digest = h.Sum(digest[:0])
+	}
+
+	var b strings.Builder
+	b.WriteString(p.prefix)
+	if p.roundsGiven {
+		b.WriteString("rounds=" + strconv.Itoa(p.rounds) + "$")
+	}
+	b.Write(salt)
+	b.WriteByte('$')
+	order := p.order
+	for i := 0; i < len(order); i += 3 {
+		var w uint32
+		n := 4
+		switch len(order) - i {
+		case 1:
+			w, n = uint32(digest[order[i]]), 2
+		case 2:
+			w, n = uint32(digest[order[i]])<<8|uint32(digest[order[i+1]]), 3
+		default:
+			w = uint32(digest[order[i]])<<16 | uint32(digest[order[i+1]])<<8 | uint32(digest[order[i+2]])
+		}
+		for ; n > 0; n-- {
+			b.WriteByte(cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	return b.String()
+}
+
+// repeatTo repeats block until it is n bytes long.
+func repeatTo(block []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, block[:min(len(block), n-len(out))]...)
+	}
+	return out
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// Tokens checks bearer tokens against a fixed set and, optionally, a file with one token
+// per line that is reloaded whenever it changes.
+type Tokens struct {
+	static [][sha256.Size]byte
+	file   *watchedFile
+
+	mu       sync.RWMutex
+	fromFile [][sha256.Size]byte
+}
+
+// NewTokens accepts the given tokens and those listed in path, if not empty. Blank lines
+// and lines starting with # are ignored.
+func NewTokens(tokens []string, path string, logger *slog.Logger) (*Tokens, error) {
+	t := &Tokens{}
+	for _, token := range tokens {
+		if token == "" {
+			continue
+		}
+		t.static = append(t.static, sha256.Sum256([]byte(token)))
+	}
+	if path != "" {
+		t.file = &watchedFile{path: path, kind: "token", logger: logger, parse: t.parse}
+		if err := t.file.load(); err != nil {
+			return nil, err
+		}
+	}
+	if len(t.static) == 0 && t.file == nil {
+		return nil, errors.New("no tokens given")
+	}
+	return t, nil
+}
+
+// Valid reports whether token is one of the accepted tokens. Tokens are compared through
+// their digests in constant time, and every accepted token is compared, so neither the
+// length nor the position of a match leaks through timing.
+func (t *Tokens) Valid(token string) bool {
+	if t.file != nil {
+		t.file.reloadIfChanged()
+	}
+	digest := sha256.Sum256([]byte(token))
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	match := 0
+	for _, accepted := range t.static {
+		match |= subtle.ConstantTimeCompare(digest[:], accepted[:])
+	}
+	for _, accepted := range t.fromFile {
+		match |= subtle.ConstantTimeCompare(digest[:], accepted[:])
+	}
+	return match == 1
+}
+
+func (t *Tokens) parse(data []byte) error {
+	var tokens [][sha256.Size]byte
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, sha256.Sum256([]byte(line)))
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read token file: %w", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fromFile = tokens
+	return nil
+}
@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(path, []byte("# CI\nci-token\n\n  deploy-token  \n"), 0o600))
+	tokens, err := NewTokens([]string{"static-token", ""}, path, slog.New(slog.DiscardHandler))
+	require.NoError(t, err)
+
+	assert.True(t, tokens.Valid("static-token"))
+	assert.True(t, tokens.Valid("ci-token"))
+	assert.True(t, tokens.Valid("deploy-token"))
+	assert.False(t, tokens.Valid(""))
+	assert.False(t, tokens.Valid("# CI"))
+	assert.False(t, tokens.Valid("ci-token2"))
+
+	// Rotating the file takes effect without a restart
+	require.NoError(t, os.WriteFile(path, []byte("rotated-token\n"), 0o600))
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, future, future))
+	assert.True(t, tokens.Valid("rotated-token"))
+	assert.False(t, tokens.Valid("ci-token"))
+	assert.True(t, tokens.Valid("static-token"))
+
+	_, err = NewTokens([]string{""}, "", slog.New(slog.DiscardHandler))
+	assert.Error(t, err)
+	_, err = NewTokens(nil, filepath.Join(t.TempDir(), "missing"), slog.New(slog.DiscardHandler))
+	assert.Error(t, err)
+}
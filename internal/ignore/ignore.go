@@ -0,0 +1,170 @@
+// Package ignore matches slash-separated paths against gitignore-style patterns.
+package ignore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// Matcher holds compiled patterns. The zero value matches nothing.
+type Matcher struct {
+	// FoldCase matches patterns regardless of case. It must be set before adding patterns.
+	FoldCase bool
+
+	patterns []pattern
+}
+
+type pattern struct {
+	// segments are matched against consecutive path segments; ** matches any number.
+	segments []segment
+	// dirOnly patterns end with a slash and only match directories.
+	dirOnly bool
+}
+
+type segment struct {
+	glob string
+	// literal segments have no wildcards and compare as strings.
+	literal bool
+}
+
+// Add compiles a pattern. As in .gitignore files:
+//   - a pattern without a slash, such as *.map or node_modules, matches a name at any depth;
+//   - a pattern with a leading or inner slash, such as /private or docs/*.tmp, is anchored
+//     to the root;
+//   - a trailing slash, as in build/, only matches directories;
+//   - * and ? don't cross slashes, and a ** segment matches any number of directories.
+//
+// A path matches if it or one of its parent directories does, so ignoring a directory
+// ignores everything in it. Negated patterns aren't supported.
+func (m *Matcher) Add(spec string) error {
+	glob := spec
+	if strings.HasPrefix(glob, "!") {
+		return fmt.Errorf("invalid ignore pattern %q: negation isn't supported", spec)
+	}
+	var p pattern
+	glob, p.dirOnly = strings.CutSuffix(glob, "/")
+	if m.FoldCase {
+		glob = strings.ToLower(glob)
+	}
+	anchored := strings.Contains(glob, "/")
+	glob = strings.TrimPrefix(glob, "/")
+	if glob == "" {
+		return fmt.Errorf("invalid ignore pattern %q", spec)
+	}
+	if !anchored {
+		p.segments = append(p.segments, segment{glob: "**"})
+	}
+	for _, part := range strings.Split(glob, "/") {
+		if part == "" {
+			return fmt.Errorf("invalid ignore pattern %q: empty segment", spec)
+		}
+		if _, err := path.Match(part, ""); err != nil {
+			return fmt.Errorf("invalid ignore pattern %q: %w", spec, err)
+		}
+		p.segments = append(p.segments, segment{glob: part, literal: !strings.ContainsAny(part, `*?[\`)})
+	}
+	// Parents are matched too, so a trailing ** adds nothing and would only slow matching
+	for len(p.segments) > 1 && p.segments[len(p.segments)-1].glob == "**" {
+		p.segments = p.segments[:len(p.segments)-1]
+	}
+	m.patterns = append(m.patterns, p)
+	return nil
+}
+
+// AddFile compiles the patterns of a file in .gitignore format, one per line, skipping
+// blank lines and # comments.
+func (m *Matcher) AddFile(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		spec := strings.TrimSpace(scanner.Text())
+		if spec == "" || strings.HasPrefix(spec, "#") {
+			continue
+		}
+		if err := m.Add(spec); err != nil {
+			return fmt.Errorf("%s:%d: %w", filePath, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", filePath, err)
+	}
+	return nil
+}
+
+// Match reports whether a path relative to the root, or one of its parent directories,
+// matches a pattern. Paths of directories end with a slash.
+func (m *Matcher) Match(name string) bool {
+	if len(m.patterns) == 0 {
+		return false
+	}
+	name, isDir := strings.CutSuffix(strings.TrimPrefix(name, "/"), "/")
+	if name == "" {
+		return false
+	}
+	if m.FoldCase {
+		name = strings.ToLower(name)
+	}
+	parts := strings.Split(name, "/")
+	for _, p := range m.patterns {
+		// The common single name patterns, such as *.map, just check every segment
+		if len(p.segments) == 2 && p.segments[0].glob == "**" && p.segments[1].glob != "**" {
+			for i, part := range parts {
+				if p.dirOnly && i == len(parts)-1 && !isDir {
+					continue
+				}
+				if p.segments[1].match(part) {
+					return true
+				}
+			}
+			continue
+		}
+		for n := 1; n <= len(parts); n++ {
+			if p.dirOnly && n == len(parts) && !isDir {
+				continue
+			}
+			if matchSegments(p.segments, parts[:n]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchSegments matches path segments against pattern segments, where ** matches zero or
+// more segments.
+func matchSegments(segments []segment, parts []string) bool {
+	for len(segments) > 0 {
+		if segments[0].glob == "**" {
+			for skip := 0; skip <= len(parts); skip++ {
+				if matchSegments(segments[1:], parts[skip:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if !segments[0].match(parts[0]) {
+			return false
+		}
+		segments, parts = segments[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+func (seg segment) match(part string) bool {
+	if seg.literal {
+		return seg.glob == part
+	}
+	ok, _ := path.Match(seg.glob, part)
+	return ok
+}
@@ -0,0 +1,98 @@
+package ignore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		match   []string
+		noMatch []string
+	}{
+		// Patterns without a slash match at any depth
+		{"*.map", []string{"app.js.map", "static/js/app.js.map", "maps.map/inner.txt"}, []string{"app.js", "map", "app.map.js"}},
+		{"node_modules", []string{"node_modules", "node_modules/", "web/node_modules/react/index.js"}, []string{"node_modules_old/a", "web/modules"}},
+		// A leading or inner slash anchors to the root
+		{"/private/**", []string{"private", "private/", "private/keys/id.pem"}, []string{"docs/private/a.txt", "privates/a"}},
+		{"/build", []string{"build", "build/out.js"}, []string{"src/build"}},
+		{"docs/*.tmp", []string{"docs/a.tmp"}, []string{"docs/sub/a.tmp", "other/docs/a.tmp"}},
+		{"**/node_modules/**", []string{"node_modules/a", "a/b/node_modules/c.js"}, []string{"a/node_modulesx/c.js"}},
+		{"a/**/b", []string{"a/b", "a/x/b", "a/x/y/b/file"}, []string{"x/a/b", "a/bb"}},
+		// A trailing slash only matches directories, including the parents of a path
+		{"cache/", []string{"cache/", "cache/data.bin", "x/cache/"}, []string{"cache", "x/cache"}},
+		{"?.txt", []string{"a.txt"}, []string{"ab.txt"}},
+		{"[ab].txt", []string{"a.txt", "b.txt"}, []string{"c.txt"}},
+	} {
+		var m Matcher
+		require.NoError(t, m.Add(tc.pattern))
+		for _, name := range tc.match {
+			assert.True(t, m.Match(name), "%s should match %s", tc.pattern, name)
+			assert.True(t, m.Match("/"+name), "%s should match /%s", tc.pattern, name)
+		}
+		for _, name := range tc.noMatch {
+			assert.False(t, m.Match(name), "%s shouldn't match %s", tc.pattern, name)
+		}
+	}
+
+	var m Matcher
+	assert.False(t, m.Match("anything"))
+	require.NoError(t, m.Add("*"))
+	assert.False(t, m.Match(""))
+	assert.False(t, m.Match("/"))
+}
+
+func TestMatchFoldCase(t *testing.T) {
+	m := Matcher{FoldCase: true}
+	require.NoError(t, m.Add("/Private/**"))
+	require.NoError(t, m.Add("*.MAP"))
+	for _, name := range []string{"private/keys", "PRIVATE/", "js/app.js.map", "JS/APP.JS.Map"} {
+		assert.True(t, m.Match(name), name)
+	}
+	assert.False(t, m.Match("public/app.js"))
+
+	var exact Matcher
+	require.NoError(t, exact.Add("*.map"))
+	assert.False(t, exact.Match("app.js.MAP"))
+}
+
+func TestAddErrors(t *testing.T) {
+	var m Matcher
+	for _, pattern := range []string{"", "/", "!keep.txt", "a//b", "[a-", "docs/[x"} {
+		assert.Error(t, m.Add(pattern), pattern)
+	}
+	assert.False(t, m.Match("keep.txt"))
+}
+
+func TestAddFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".cmpserveignore")
+	require.NoError(t, os.WriteFile(path, []byte("# source maps\n*.map\n\n  /private/  \n"), 0o644))
+	var m Matcher
+	require.NoError(t, m.AddFile(path))
+	assert.True(t, m.Match("js/app.js.map"))
+	assert.True(t, m.Match("private/notes.txt"))
+	assert.False(t, m.Match("# source maps"))
+	assert.False(t, m.Match("public/notes.txt"))
+
+	require.NoError(t, os.WriteFile(path, []byte("*.map\n!*.keep\n"), 0o644))
+	err := m.AddFile(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), ".cmpserveignore:2:")
+
+	assert.ErrorIs(t, m.AddFile(filepath.Join(t.TempDir(), "missing")), os.ErrNotExist)
+}
+
+func BenchmarkMatch(b *testing.B) {
+	var m Matcher
+	for _, pattern := range []string{"*.map", "**/node_modules/**", "/private/**", "build/", ".cmpserveignore"} {
+		require.NoError(b, m.Add(pattern))
+	}
+	for b.Loop() {
+		m.Match("static/assets/js/vendor/app.bundle.js")
+	}
+}
@@ -0,0 +1,190 @@
+// Package metrics collects Prometheus metrics about served requests and the archive index.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cmpserve/internal/readers/zipfast"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Request sources, telling whether a response came from the filesystem or from an archive.
+const (
+	SourceFilesystem = "filesystem"
+	SourceArchive    = "archive"
+)
+
+// Metrics holds the collectors of a server. It is registered on its own registry, so
+// several instances (e.g. in tests) don't interfere.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	responseBytes   *prometheus.CounterVec
+	inFlight        prometheus.Gauge
+	rateLimited     prometheus.Counter
+
+	indexDuration  prometheus.Summary
+	indexEntries   prometheus.Summary
+	indexLookups   *prometheus.CounterVec
+	databaseErrors prometheus.Counter
+	evictions      prometheus.Counter
+
+	extractionsInFlight prometheus.Gauge
+	extractionsQueued   prometheus.Gauge
+	extractionsRejected prometheus.Counter
+}
+
+var _ zipfast.Observer = (*Metrics)(nil)
+
+// New creates the collectors, along with the standard Go runtime and process collectors.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cmpserve_http_requests_total",
+			Help: "HTTP requests served, by status class and source.",
+		}, []string{"code", "source"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "cmpserve_http_request_duration_seconds",
+			Help:    "Time taken to serve HTTP requests, by status class and source.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"code", "source"}),
+		responseBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cmpserve_http_response_bytes_total",
+			Help: "Response body bytes served, by source.",
+		}, []string{"source"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cmpserve_http_requests_in_flight",
+			Help: "HTTP requests currently being served.",
+		}),
+		rateLimited: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cmpserve_http_rate_limited_total",
+			Help: "HTTP requests refused because the client exceeded its rate limit.",
+		}),
+		indexDuration: prometheus.NewSummary(prometheus.SummaryOpts{
+			Name:       "cmpserve_archive_index_duration_seconds",
+			Help:       "Time taken to index an archive.",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		}),
+		indexEntries: prometheus.NewSummary(prometheus.SummaryOpts{
+			Name:       "cmpserve_archive_index_entries",
+			Help:       "Number of entries in indexed archives.",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		}),
+		indexLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cmpserve_archive_index_lookups_total",
+			Help: "Archive index lookups, by whether the index was cached (hit) or had to be built (miss).",
+		}, []string{"result"}),
+		databaseErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cmpserve_sqlite_errors_total",
+			Help: "Failed operations on the archive index database.",
+		}),
+		evictions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cmpserve_archive_index_evictions_total",
+			Help: "Archive indexes evicted to stay within -cache-max-archives.",
+		}),
+		extractionsInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cmpserve_archive_extractions_in_flight",
+			Help: "Archive requests currently being served.",
+		}),
+		extractionsQueued: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cmpserve_archive_extractions_queued",
+			Help: "Archive requests waiting for an extraction slot.",
+		}),
+		extractionsRejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cmpserve_archive_extractions_rejected_total",
+			Help: "Archive requests answered with 503 after waiting too long for an extraction slot.",
+		}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests, m.requestDuration, m.responseBytes, m.inFlight, m.rateLimited,
+		m.indexDuration, m.indexEntries, m.indexLookups, m.databaseErrors, m.evictions,
+		m.extractionsInFlight, m.extractionsQueued, m.extractionsRejected,
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// RequestStarted marks a request as in flight.
+func (m *Metrics) RequestStarted() {
+	m.inFlight.Inc()
+}
+
+// RequestFinished records a served request and marks it as no longer in flight.
+func (m *Metrics) RequestFinished(source string, status int, written int64, duration time.Duration) {
+	m.inFlight.Dec()
+	code := strconv.Itoa(status/100) + "xx"
+	m.requests.WithLabelValues(code, source).Inc()
+	m.requestDuration.WithLabelValues(code, source).Observe(duration.Seconds())
+	m.responseBytes.WithLabelValues(source).Add(float64(written))
+}
+
+// RateLimited records a request refused by the rate limiter.
+func (m *Metrics) RateLimited() {
+	m.rateLimited.Inc()
+}
+
+// ArchiveIndexed implements zipfast.Observer.
+func (m *Metrics) ArchiveIndexed(entries int, duration time.Duration) {
+	m.indexDuration.Observe(duration.Seconds())
+	m.indexEntries.Observe(float64(entries))
+}
+
+// IndexLookup implements zipfast.Observer.
+func (m *Metrics) IndexLookup(hit bool) {
+	if hit {
+		m.indexLookups.WithLabelValues("hit").Inc()
+	} else {
+		m.indexLookups.WithLabelValues("miss").Inc()
+	}
+}
+
+// DatabaseError implements zipfast.Observer.
+func (m *Metrics) DatabaseError(error) {
+	m.databaseErrors.Inc()
+}
+
+// ArchivesEvicted implements zipfast.Observer.
+func (m *Metrics) ArchivesEvicted(count int) {
+	m.evictions.Add(float64(count))
+}
+
+// ExtractionsChanged implements service.ExtractionObserver.
+func (m *Metrics) ExtractionsChanged(inFlight, queued int) {
+	m.extractionsInFlight.Set(float64(inFlight))
+	m.extractionsQueued.Set(float64(queued))
+}
+
+// ExtractionRejected implements service.ExtractionObserver.
+func (m *Metrics) ExtractionRejected() {
+	m.extractionsRejected.Inc()
+}
+
+type sourceKey struct{}
+
+// WithSource returns a context in which SetSource records the source of the request.
+func WithSource(ctx context.Context, source *string) context.Context {
+	return context.WithValue(ctx, sourceKey{}, source)
+}
+
+// SetSource records where the response to r comes from. It does nothing unless the
+// request passed through the metrics middleware.
+func SetSource(r *http.Request, source string) {
+	if target, ok := r.Context().Value(sourceKey{}).(*string); ok {
+		*target = source
+	}
+}
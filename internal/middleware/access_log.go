@@ -0,0 +1,163 @@
+package middleware
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AccessLog logs every request in Combined Log Format, followed by the time taken to serve
+// it in microseconds and, in quotes, the ID RequestID gave it, if any. Behind proxies, the
+// client address is taken from X-Forwarded-For.
+func AccessLog(out io.Writer, proxies TrustedProxies) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			recorder := NewResponseRecorder(w)
+			next.ServeHTTP(recorder, r)
+
+			line := formatAccessLogLine(r, recorder.Status(), recorder.Written(), start, time.Since(start), clientAddr(r, proxies))
+			_, _ = out.Write(line)
+		})
+	}
+}
+
+// clientAddr returns the client address for the access log.
+func clientAddr(r *http.Request, proxies TrustedProxies) string {
+	if addr, ok := proxies.ClientAddr(r); ok {
+		return addr.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if host == "" || host == "@" {
+		// Unix domain socket peers have no address
+		return "-"
+	}
+	return host
+}
+
+func formatAccessLogLine(r *http.Request, status int, written int64, start time.Time, duration time.Duration, addr string) []byte {
+	user := "-"
+	if username, _, ok := r.BasicAuth(); ok && username != "" {
+		user = escapeLogValue(username)
+	}
+	size := "-"
+	if written > 0 {
+		size = strconv.FormatInt(written, 10)
+	}
+
+	var b strings.Builder
+	b.WriteString(escapeLogValue(addr))
+	b.WriteString(" - ")
+	b.WriteString(user)
+	b.WriteString(" [")
+	b.WriteString(start.Format("02/Jan/2006:15:04:05 -0700"))
+	b.WriteString(`] "`)
+	b.WriteString(escapeLogValue(r.Method + " " + r.RequestURI + " " + r.Proto))
+	b.WriteString(`" `)
+	b.WriteString(strconv.Itoa(status))
+	b.WriteByte(' ')
+	b.WriteString(size)
+	b.WriteString(` "`)
+	b.WriteString(escapeLogValue(r.Referer()))
+	b.WriteString(`" "`)
+	b.WriteString(escapeLogValue(r.UserAgent()))
+	b.WriteString(`" `)
+	b.WriteString(strconv.FormatInt(duration.Microseconds(), 10))
+	if id := RequestIDFromContext(r.Context()); id != "" {
+		b.WriteString(` "`)
+		b.WriteString(escapeLogValue(id))
+		b.WriteByte('"')
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+// escapeLogValue escapes quotes, backslashes and non-printable bytes the way Apache does,
+// so client-supplied values can't forge log lines.
+func escapeLogValue(value string) string {
+	const hex = "0123456789abcdef"
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			b.WriteString(`\x`)
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&0xf])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// AsyncWriter decouples log writes from request handling. Lines are queued and written
+// by a background goroutine through a buffer that is flushed periodically; when the queue
+// is full because the destination is too slow, lines are dropped instead of blocking.
+type AsyncWriter struct {
+	queue   chan []byte
+	done    chan struct{}
+	dropped atomic.Int64
+	closed  sync.Once
+}
+
+// NewAsyncWriter starts writing queued lines to out, flushing at least every flushInterval.
+func NewAsyncWriter(out io.Writer, queueSize int, flushInterval time.Duration) *AsyncWriter {
+	a := &AsyncWriter{queue: make(chan []byte, queueSize), done: make(chan struct{})}
+	go a.run(bufio.NewWriter(out), flushInterval)
+	return a
+}
+
+func (a *AsyncWriter) run(out *bufio.Writer, flushInterval time.Duration) {
+	defer close(a.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case line, ok := <-a.queue:
+			if !ok {
+				_ = out.Flush()
+				return
+			}
+			_, _ = out.Write(line)
+		case <-ticker.C:
+			_ = out.Flush()
+		}
+	}
+}
+
+// Write queues p without blocking. It must not be called after Close.
+func (a *AsyncWriter) Write(p []byte) (int, error) {
+	line := make([]byte, len(p))
+	copy(line, p)
+	select {
+	case a.queue <- line:
+	default:
+		a.dropped.Add(1)
+	}
+	return len(p), nil
+}
+
+// Dropped returns the number of lines discarded because the queue was full.
+func (a *AsyncWriter) Dropped() int64 {
+	return a.dropped.Load()
+}
+
+// Close writes out the queued lines and stops the background goroutine.
+func (a *AsyncWriter) Close() error {
+	a.closed.Do(func() { close(a.queue) })
+	<-a.done
+	return nil
+}
@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var combinedLogLine = regexp.MustCompile(`^(\S+) - (\S+) \[([^\]]+)\] "((?:[^"\\]|\\.)*)" (\d{3}) (\S+) "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)" (\d+)(?: "([^"]*)")?\n$`)
+
+func TestAccessLog(t *testing.T) {
+	var out bytes.Buffer
+	handler := AccessLog(&out, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = w.Write([]byte("hello"))
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/some/path?q=1", nil)
+	req.RemoteAddr = "192.0.2.10:5555"
+	req.Header.Set("Referer", "https://example.com/")
+	req.Header.Set("User-Agent", `agent "quoted"`)
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.SetBasicAuth("alice", "secret")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	match := combinedLogLine.FindStringSubmatch(out.String())
+	require.NotNil(t, match, out.String())
+	assert.Equal(t, "192.0.2.10", match[1])
+	assert.Equal(t, "alice", match[2])
+	_, err := time.Parse("02/Jan/2006:15:04:05 -0700", match[3])
+	assert.NoError(t, err)
+	assert.Equal(t, "GET /some/path?q=1 HTTP/1.1", match[4])
+	assert.Equal(t, "418", match[5])
+	assert.Equal(t, "5", match[6])
+	assert.Equal(t, "https://example.com/", match[7])
+	assert.NotContains(t, out.String(), "secret")
+	assert.Contains(t, out.String(), `"agent \"quoted\""`)
+}
+
+func TestAccessLogTrustProxy(t *testing.T) {
+	var out bytes.Buffer
+	handler := AccessLog(&out, privateNetworks)(http.NotFoundHandler())
+
+	req := httptest.NewRequest(http.MethodHead, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.2")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	match := combinedLogLine.FindStringSubmatch(out.String())
+	require.NotNil(t, match, out.String())
+	assert.Equal(t, "203.0.113.7", match[1])
+	assert.Equal(t, "404", match[5])
+}
+
+func TestAccessLogEscapesControlCharacters(t *testing.T) {
+	var out bytes.Buffer
+	handler := AccessLog(&out, nil)(http.NotFoundHandler())
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("User-Agent", "evil\n127.0.0.1 - - forged")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, 1, strings.Count(out.String(), "\n"))
+	assert.Contains(t, out.String(), `evil\x0a127.0.0.1`)
+}
+
+func TestResponseRecorderKeepsInterfaces(t *testing.T) {
+	server := httptest.NewServer(AccessLog(io.Discard, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, isFlusher := w.(http.Flusher)
+		_, isHijacker := w.(http.Hijacker)
+		assert.True(t, isFlusher)
+		assert.True(t, isHijacker)
+		assert.NoError(t, http.NewResponseController(w).Flush())
+	})))
+	t.Cleanup(server.Close)
+
+	resp, err := server.Client().Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+// blockingWriter simulates a destination that never completes its writes.
+type blockingWriter struct {
+	release chan struct{}
+	mu      sync.Mutex
+	data    bytes.Buffer
+}
+
+func (b *blockingWriter) Write(p []byte) (int, error) {
+	<-b.release
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.data.Write(p)
+}
+
+func TestAsyncWriterDoesNotBlock(t *testing.T) {
+	out := &blockingWriter{release: make(chan struct{})}
+	writer := NewAsyncWriter(out, 2, 10*time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			_, _ = writer.Write(bytes.Repeat([]byte("x"), 8192))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes blocked on a stalled destination")
+	}
+	assert.Positive(t, writer.Dropped())
+
+	close(out.release)
+	require.NoError(t, writer.Close())
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	assert.Positive(t, out.data.Len())
+}
+
+func TestAccessLogUnixSocketPeer(t *testing.T) {
+	var out bytes.Buffer
+	handler := AccessLog(&out, nil)(http.NotFoundHandler())
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "@"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	match := combinedLogLine.FindStringSubmatch(out.String())
+	require.NotNil(t, match, out.String())
+	assert.Equal(t, "-", match[1])
+}
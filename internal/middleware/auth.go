@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Authenticator checks HTTP Basic credentials.
+type Authenticator interface {
+	Authenticate(user, password string) bool
+}
+
+// TokenValidator checks bearer tokens.
+type TokenValidator interface {
+	Valid(token string) bool
+}
+
+// AuthOptions configures Auth. At least one of Basic and Tokens must be set; when both
+// are, either kind of credential is accepted.
+type AuthOptions struct {
+	// Basic checks HTTP Basic credentials.
+	Basic Authenticator
+	// Tokens checks "Authorization: Bearer" tokens, and those moved out of the URL by QueryToken.
+	Tokens TokenValidator
+	// Realm is presented to clients in the authentication challenge.
+	Realm string
+	// Exempt lists paths served without credentials.
+	Exempt []string
+	// Logger receives failed attempts.
+	Logger *slog.Logger
+}
+
+var realmEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// Auth requires valid credentials on every request except those for the exempt paths,
+// answering 401 with a challenge for each accepted scheme otherwise. Failed attempts are
+// logged with the username and client address, never the password or token.
+func Auth(options AuthOptions) func(http.Handler) http.Handler {
+	realm := `realm="` + realmEscaper.Replace(options.Realm) + `"`
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if slices.Contains(options.Exempt, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			user, password, hasBasic := r.BasicAuth()
+			if hasBasic && options.Basic != nil && options.Basic.Authenticate(user, password) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			token, hasToken := bearerToken(r)
+			if hasToken && options.Tokens != nil && options.Tokens.Valid(token) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			switch {
+			case hasBasic:
+				options.Logger.WarnContext(r.Context(), "Authentication failed", "user", user, "remote", r.RemoteAddr, "path", r.URL.Path)
+			case hasToken:
+				options.Logger.WarnContext(r.Context(), "Authentication failed", "token", true, "remote", r.RemoteAddr, "path", r.URL.Path)
+			}
+			if options.Basic != nil {
+				w.Header().Add("WWW-Authenticate", `Basic `+realm+`, charset="UTF-8"`)
+			}
+			if options.Tokens != nil {
+				w.Header().Add("WWW-Authenticate", `Bearer `+realm)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		})
+	}
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header, or the one taken
+// from the query string by QueryToken.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token), true
+	}
+	if token, ok := r.Context().Value(queryTokenKey{}).(string); ok {
+		return token, true
+	}
+	return "", false
+}
+
+type queryTokenKey struct{}
+
+// QueryToken moves a token given as the param query parameter out of the URL, for clients
+// that can't set headers, and hands it to Auth. It must wrap every other middleware, so
+// that the token never reaches access logs or the service.
+func QueryToken(param string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query, err := url.ParseQuery(r.URL.RawQuery)
+			if err != nil && strings.Contains(r.URL.RawQuery, param) {
+				// The token may be hiding in a pair that can't be parsed, e.g. "token=x;y"
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			if !query.Has(param) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			token := query.Get(param)
+			query.Del(param)
+
+			r = r.WithContext(context.WithValue(r.Context(), queryTokenKey{}, token))
+			stripped := *r.URL
+			stripped.RawQuery = query.Encode()
+			r.URL = &stripped
+			r.RequestURI = stripped.RequestURI()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
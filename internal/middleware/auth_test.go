@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// staticAuthenticator accepts a single user.
+type staticAuthenticator struct{ user, password string }
+
+func (s staticAuthenticator) Authenticate(user, password string) bool {
+	return user == s.user && password == s.password
+}
+
+// staticTokens accepts a single token.
+type staticTokens string
+
+func (s staticTokens) Valid(token string) bool {
+	return token == string(s)
+}
+
+var protected = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte("protected " + r.URL.RawQuery))
+})
+
+func TestBasicAuth(t *testing.T) {
+	var logs bytes.Buffer
+	handler := Auth(AuthOptions{
+		Basic:  staticAuthenticator{"alice", "wonderland"},
+		Realm:  `Pre-release "builds"`,
+		Exempt: []string{"/metrics"},
+		Logger: slog.New(slog.NewTextHandler(&logs, nil)),
+	})(protected)
+
+	serve := func(target, user, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = "192.0.2.10:5555"
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("/secret.zip", "alice", "wonderland")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "protected")
+
+	for _, creds := range [][2]string{{"", ""}, {"alice", "wrong"}, {"mallory", "wonderland"}} {
+		rec := serve("/secret.zip", creds[0], creds[1])
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, creds[0])
+		assert.Equal(t, []string{`Basic realm="Pre-release \"builds\"", charset="UTF-8"`}, rec.Header().Values("WWW-Authenticate"))
+		assert.NotContains(t, rec.Body.String(), "protected")
+	}
+	assert.Contains(t, logs.String(), "user=alice remote=192.0.2.10:5555")
+	assert.Contains(t, logs.String(), "user=mallory")
+	assert.NotContains(t, logs.String(), "wrong")
+	assert.NotContains(t, logs.String(), "wonderland")
+
+	// Exempt paths are served without credentials, but only exact matches
+	assert.Equal(t, http.StatusOK, serve("/metrics", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("/metrics/x", "", "").Code)
+}
+
+func TestBearerAuth(t *testing.T) {
+	var logs bytes.Buffer
+	handler := Auth(AuthOptions{
+		Basic:  staticAuthenticator{"alice", "wonderland"},
+		Tokens: staticTokens("ci-token"),
+		Realm:  "cmpserve",
+		Logger: slog.New(slog.NewTextHandler(&logs, nil)),
+	})(protected)
+
+	serve := func(authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/artifact.zip", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, serve("Bearer ci-token").Code)
+	assert.Equal(t, http.StatusOK, serve("bearer ci-token").Code)
+	// Basic credentials are still accepted alongside tokens
+	assert.Equal(t, http.StatusOK, serve("Basic YWxpY2U6d29uZGVybGFuZA==").Code)
+
+	rec := serve("Bearer stale-token")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, []string{`Basic realm="cmpserve", charset="UTF-8"`, `Bearer realm="cmpserve"`}, rec.Header().Values("WWW-Authenticate"))
+	assert.Equal(t, http.StatusUnauthorized, serve("").Code)
+	assert.Contains(t, logs.String(), "token=true")
+	assert.NotContains(t, logs.String(), "stale-token")
+}
+
+func TestQueryToken(t *testing.T) {
+	var accessLog bytes.Buffer
+	auth := Auth(AuthOptions{Tokens: staticTokens("ci-token"), Logger: slog.New(slog.DiscardHandler)})
+	handler := QueryToken("token")(AccessLog(&accessLog, nil)(auth(protected)))
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	rec := serve("/artifact.zip?sort=size&token=ci-token")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "protected sort=size", rec.Body.String(), "the token must not reach the service")
+
+	assert.Equal(t, http.StatusUnauthorized, serve("/artifact.zip?token=wrong").Code)
+	assert.Equal(t, http.StatusBadRequest, serve("/artifact.zip?token=ci-token;x").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("/artifact.zip").Code)
+
+	assert.Contains(t, accessLog.String(), `"GET /artifact.zip?sort=size HTTP/1.1"`)
+	assert.NotContains(t, accessLog.String(), "ci-token")
+	assert.NotContains(t, accessLog.String(), "wrong")
+}
@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// CacheRule sets Cache-Control on responses for request paths matching one of its globs.
+type CacheRule struct {
+	// Globs are matched against the request path. * and ? don't cross slashes, a ** segment
+	// matches any number of directories.
+	Globs []string
+	// Value is the Cache-Control header value.
+	Value string
+}
+
+// ParseCacheRule parses a rule such as "glob=**/*.js,**/*.css;max-age=31536000;immutable":
+// a comma-separated list of globs, followed by the Cache-Control directives.
+func ParseCacheRule(spec string) (CacheRule, error) {
+	var rule CacheRule
+	var directives []string
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if globs, ok := strings.CutPrefix(part, "glob="); ok {
+			for _, glob := range strings.Split(globs, ",") {
+				if glob = strings.TrimSpace(glob); glob != "" {
+					if err := checkGlob(glob); err != nil {
+						return CacheRule{}, fmt.Errorf("invalid cache rule %q: %w", spec, err)
+					}
+					rule.Globs = append(rule.Globs, glob)
+				}
+			}
+		} else if part != "" {
+			directives = append(directives, part)
+		}
+	}
+	if len(rule.Globs) == 0 || len(directives) == 0 {
+		return CacheRule{}, fmt.Errorf("invalid cache rule %q, use glob=<globs>;<directives>", spec)
+	}
+	rule.Value = strings.Join(directives, ", ")
+	if err := checkHeaderValue(rule.Value); err != nil {
+		return CacheRule{}, fmt.Errorf("invalid cache rule %q: %w", spec, err)
+	}
+	return rule, nil
+}
+
+// ParseCacheDirectives turns directives separated by semicolons or commas into a
+// Cache-Control header value.
+func ParseCacheDirectives(value string) (string, error) {
+	var directives []string
+	for _, directive := range strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == ',' }) {
+		if directive = strings.TrimSpace(directive); directive != "" {
+			directives = append(directives, directive)
+		}
+	}
+	joined := strings.Join(directives, ", ")
+	if err := checkHeaderValue(joined); err != nil {
+		return "", fmt.Errorf("invalid cache directives %q: %w", value, err)
+	}
+	return joined, nil
+}
+
+func checkHeaderValue(value string) error {
+	for i := 0; i < len(value); i++ {
+		if value[i] < 0x20 || value[i] == 0x7f {
+			return fmt.Errorf("control character in %q", value)
+		}
+	}
+	return nil
+}
+
+// checkGlob reports malformed character classes, which path.Match would only notice
+// when a name reaches them.
+func checkGlob(glob string) error {
+	for _, segment := range strings.Split(strings.TrimPrefix(glob, "/"), "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("glob %q: %w", glob, err)
+		}
+	}
+	return nil
+}
+
+// CacheControl sets Cache-Control on successful and 304 responses from the first rule
+// matching the request path, or to fallback if none does. Responses that already carry the
+// header, and error responses, are left alone. An empty fallback sets nothing.
+func CacheControl(rules []CacheRule, fallback string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			value := fallback
+			for _, rule := range rules {
+				if matchAnyGlob(rule.Globs, r.URL.Path) {
+					value = rule.Value
+					break
+				}
+			}
+			if value == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(newHeaderHook(w, func(status int) {
+				header := w.Header()
+				if (status < http.StatusMultipleChoices || status == http.StatusNotModified) && header.Get("Cache-Control") == "" {
+					header.Set("Cache-Control", value)
+				}
+			}), r)
+		})
+	}
+}
+
+func matchAnyGlob(globs []string, urlPath string) bool {
+	name := strings.Split(strings.TrimPrefix(urlPath, "/"), "/")
+	for _, glob := range globs {
+		if matchSegments(strings.Split(strings.TrimPrefix(glob, "/"), "/"), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments matches path segments against glob segments, where ** matches zero or
+// more segments.
+func matchSegments(glob, name []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			for skip := 0; skip <= len(name); skip++ {
+				if matchSegments(glob[1:], name[skip:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], name[0]); !ok {
+			return false
+		}
+		glob, name = glob[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchGlob(t *testing.T) {
+	for _, tc := range []struct {
+		glob, path string
+		match      bool
+	}{
+		{"**/*.js", "/app.3f2a1c.js", true},
+		{"**/*.js", "/static/js/app.js", true},
+		{"**/*.js", "/build.zip/assets/app.js", true},
+		{"**/*.js", "/app.json", false},
+		{"*.js", "/app.js", true},
+		{"*.js", "/static/app.js", false},
+		{"/static/**", "/static/a/b/c.png", true},
+		{"static/**", "/static/", true},
+		{"static/**", "/other/a.png", false},
+		{"static/**/*.css", "/static/site.css", true},
+		{"static/**/*.css", "/static/a/b/site.css", true},
+		{"static/**/*.css", "/static/a/b/site.js", false},
+		{"**/assets/*", "/site/assets/logo.svg", true},
+		{"**/assets/*", "/site/assets/icons/logo.svg", false},
+		{"**/app.?.js", "/x/app.1.js", true},
+		{"**/[a-c]*.txt", "/docs/b.txt", true},
+		{"**/[a-c]*.txt", "/docs/d.txt", false},
+		{"**", "/", true},
+		{"**", "/any/thing", true},
+	} {
+		assert.Equal(t, tc.match, matchAnyGlob([]string{tc.glob}, tc.path), "%s %s", tc.glob, tc.path)
+	}
+}
+
+func TestParseCacheRule(t *testing.T) {
+	rule, err := ParseCacheRule("glob=**/*.js, **/*.css;max-age=31536000;immutable")
+	require.NoError(t, err)
+	assert.Equal(t, CacheRule{Globs: []string{"**/*.js", "**/*.css"}, Value: "max-age=31536000, immutable"}, rule)
+
+	rule, err = ParseCacheRule("no-cache;glob=**/*.html")
+	require.NoError(t, err)
+	assert.Equal(t, CacheRule{Globs: []string{"**/*.html"}, Value: "no-cache"}, rule)
+
+	for _, spec := range []string{"", "no-cache", "glob=**/*.js", "glob=;no-cache", "glob=[a-;no-cache", "glob=*.js;no\x01cache"} {
+		_, err := ParseCacheRule(spec)
+		assert.Error(t, err, spec)
+	}
+
+	value, err := ParseCacheDirectives("public; max-age=60")
+	require.NoError(t, err)
+	assert.Equal(t, "public, max-age=60", value)
+}
+
+func TestCacheControl(t *testing.T) {
+	rules := []CacheRule{
+		{Globs: []string{"**/*.js", "**/*.css"}, Value: "max-age=31536000, immutable"},
+		{Globs: []string{"**/*.html", "**/*.js"}, Value: "no-cache"},
+	}
+	handler := CacheControl(rules, "max-age=60")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing.js":
+			http.NotFound(w, r)
+		case "/unchanged.js":
+			w.WriteHeader(http.StatusNotModified)
+		case "/private.html":
+			w.Header().Set("Cache-Control", "private")
+			_, _ = w.Write([]byte("private"))
+		default:
+			w.Header().Set("Last-Modified", "Mon, 12 Oct 2026 10:00:00 GMT")
+			_, _ = w.Write([]byte("body"))
+		}
+	}))
+
+	for target, want := range map[string]string{
+		"/static/app.3f2a1c.js": "max-age=31536000, immutable", // first match wins
+		"/build.zip/site.css":   "max-age=31536000, immutable",
+		"/docs/index.html":      "no-cache",
+		"/docs/readme.txt":      "max-age=60",
+		"/unchanged.js":         "max-age=31536000, immutable",
+		"/missing.js":           "",
+		"/private.html":         "private",
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, want, rec.Header().Get("Cache-Control"), target)
+		if target == "/docs/readme.txt" {
+			assert.NotEmpty(t, rec.Header().Get("Last-Modified"), "validators are kept")
+		}
+	}
+
+	// Without a fallback, unmatched paths get no header
+	rec := httptest.NewRecorder()
+	CacheControl(rules, "")(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/a.txt", nil))
+	assert.Empty(t, rec.Header().Values("Cache-Control"))
+}
@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies lists the networks of proxies whose X-Forwarded-For entries are believed.
+type TrustedProxies []netip.Prefix
+
+// ClientAddr returns the address of the client behind r. X-Forwarded-For is only followed
+// while the hops are trusted proxies: the result is the rightmost hop that isn't one, so a
+// client can't spoof its address by sending the header itself. Peers on a Unix domain
+// socket count as trusted, since they are local. ok is false when there is no address,
+// e.g. for a Unix domain socket peer without the header.
+func (p TrustedProxies) ClientAddr(r *http.Request) (addr netip.Addr, ok bool) {
+	addr, ok = parseHop(r.RemoteAddr)
+	if len(p) == 0 || (ok && !containsAddr(p, addr)) {
+		return addr, ok
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		if strings.TrimSpace(hops[i]) == "" {
+			continue
+		}
+		hop, valid := parseHop(hops[i])
+		if !valid {
+			// Whatever is left of a malformed entry can't be trusted
+			return addr, ok
+		}
+		addr, ok = hop, true
+		if !containsAddr(p, addr) {
+			break
+		}
+	}
+	return addr, ok
+}
+
+// fromProxy reports whether r comes straight from a trusted proxy, or a Unix domain socket
+// peer while proxies are trusted, so that the headers it added can be believed.
+func (p TrustedProxies) fromProxy(r *http.Request) bool {
+	if len(p) == 0 {
+		return false
+	}
+	addr, ok := parseHop(r.RemoteAddr)
+	return !ok || containsAddr(p, addr)
+}
+
+// containsAddr reports whether addr is in any of networks.
+func containsAddr(networks []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range networks {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHop parses an address with or without a port, as found in RemoteAddr and X-Forwarded-For.
+func parseHop(value string) (netip.Addr, bool) {
+	value = strings.TrimSpace(value)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(value, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
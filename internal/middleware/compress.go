@@ -0,0 +1,205 @@
+package middleware
+
+import (
+	"bufio"
+	"compress/gzip"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cmpserve/internal/negotiate"
+)
+
+// DefaultCompressTypes are the media types compressed unless configured otherwise.
+var DefaultCompressTypes = []string{"text/*", "application/json", "application/javascript", "application/xml", "image/svg+xml"}
+
+// CompressOptions configures Compress.
+type CompressOptions struct {
+	// Types lists the media types to compress; "type/*" matches all subtypes.
+	Types []string
+	// MinSize is the smallest response body compressed, in bytes. Smaller bodies gain
+	// little and may grow.
+	MinSize int
+}
+
+// Compress gzips responses of the configured types and sizes for clients accepting it.
+// Responses that already have a Content-Encoding, such as precompressed files, and
+// partial responses are passed through unchanged.
+func Compress(options CompressOptions) func(http.Handler) http.Handler {
+	pool := &sync.Pool{New: func() any {
+		return gzip.NewWriter(nil)
+	}}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cw := &compressWriter{
+				ResponseWriter: w,
+				options:        &options,
+				pool:           pool,
+				accepted:       negotiate.EncodingQuality(r.Header.Get("Accept-Encoding"), "gzip") > 0,
+				head:           r.Method == http.MethodHead,
+			}
+			defer cw.finish()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// compressWriter holds back the start of the body until it knows whether the response is
+// worth compressing: once MinSize bytes were written, on a flush, or at the end.
+type compressWriter struct {
+	http.ResponseWriter
+	options  *CompressOptions
+	pool     *sync.Pool
+	accepted bool
+	head     bool
+
+	status  int
+	decided bool
+	buffer  []byte
+	gz      *gzip.Writer
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if status < http.StatusOK {
+		c.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if c.status != 0 {
+		return
+	}
+	c.status = status
+	// The size is known up front, or there is no body to wait for. HEAD responses of
+	// unknown length are announced like those to GET, which would likely be compressed.
+	if c.head || c.Header().Get("Content-Length") != "" || !bodyAllowed(status) {
+		_ = c.decide(c.head)
+	}
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.decided {
+		c.buffer = append(c.buffer, p...)
+		if len(c.buffer) >= c.options.MinSize {
+			if err := c.decide(false); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	}
+	if c.gz != nil {
+		return c.gz.Write(p)
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+func (c *compressWriter) Flush() {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.decided {
+		// A response streamed in pieces is likely to grow past MinSize
+		_ = c.decide(true)
+	}
+	if c.gz != nil {
+		_ = c.gz.Flush()
+	}
+	_ = http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+func (c *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(c.ResponseWriter).Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the wrapped writer.
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// decide sends the header, compressed or not, followed by the buffered body.
+// Without a Content-Length, unknownSize assumes the body is large enough.
+func (c *compressWriter) decide(unknownSize bool) error {
+	c.decided = true
+	header := c.Header()
+	if header.Get("Content-Type") == "" && len(c.buffer) > 0 && header.Get("Content-Encoding") == "" {
+		// What the server would sniff anyway, needed here to pick the response type
+		header.Set("Content-Type", http.DetectContentType(c.buffer))
+	}
+
+	eligible := bodyAllowed(c.status) && c.status != http.StatusPartialContent &&
+		header.Get("Content-Encoding") == "" && header.Get("Content-Range") == "" &&
+		c.compressible(header.Get("Content-Type"))
+	if eligible {
+		header.Add("Vary", "Accept-Encoding")
+	}
+	size := len(c.buffer)
+	if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil {
+		size = length
+	} else if unknownSize {
+		size = c.options.MinSize
+	}
+
+	if eligible && c.accepted && size >= c.options.MinSize {
+		header.Del("Content-Length")
+		header.Del("Accept-Ranges")
+		header.Set("Content-Encoding", "gzip")
+		c.ResponseWriter.WriteHeader(c.status)
+		if c.head {
+			return nil
+		}
+		c.gz = c.pool.Get().(*gzip.Writer)
+		c.gz.Reset(c.ResponseWriter)
+		_, err := c.gz.Write(c.buffer)
+		c.buffer = nil
+		return err
+	}
+
+	c.ResponseWriter.WriteHeader(c.status)
+	if len(c.buffer) == 0 {
+		return nil
+	}
+	_, err := c.ResponseWriter.Write(c.buffer)
+	c.buffer = nil
+	return err
+}
+
+// finish writes out whatever is still held back once the handler returned.
+func (c *compressWriter) finish() {
+	if c.status == 0 {
+		// The handler wrote nothing at all
+		return
+	}
+	if !c.decided {
+		_ = c.decide(false)
+	}
+	if c.gz != nil {
+		_ = c.gz.Close()
+		c.gz.Reset(nil)
+		c.pool.Put(c.gz)
+		c.gz = nil
+	}
+}
+
+// compressible reports whether contentType is one of the configured types.
+func (c *compressWriter) compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, candidate := range c.options.Types {
+		if prefix, ok := strings.CutSuffix(candidate, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyAllowed reports whether a response with status may have a body.
+func bodyAllowed(status int) bool {
+	return status != http.StatusNoContent && status != http.StatusNotModified
+}
@@ -0,0 +1,174 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gunzip(t *testing.T, body io.Reader) string {
+	t.Helper()
+	gz, err := gzip.NewReader(body)
+	require.NoError(t, err)
+	data, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestCompress(t *testing.T) {
+	large := strings.Repeat("compressible text ", 100)
+	modTime := time.Date(2026, 10, 12, 10, 0, 0, 0, time.UTC)
+	handler := Compress(CompressOptions{Types: DefaultCompressTypes, MinSize: 1024})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large.txt", "/small.txt", "/image.png", "/app.js.gz":
+			body := large
+			switch r.URL.Path {
+			case "/small.txt":
+				body = "small"
+			case "/image.png":
+				w.Header().Set("Content-Type", "image/png")
+			case "/app.js.gz":
+				w.Header().Set("Content-Type", "text/javascript")
+				w.Header().Set("Content-Encoding", "gzip")
+			}
+			http.ServeContent(w, r, r.URL.Path, modTime, strings.NewReader(body))
+		case "/unsized.json":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			for range 10 {
+				_, _ = w.Write([]byte(`{"name": "entry"},`))
+			}
+			_, _ = w.Write([]byte(large))
+		case "/sniffed":
+			_, _ = w.Write([]byte("<html>" + large + "</html>"))
+		}
+	}))
+
+	serve := func(method, target string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Accept-Encoding", "gzip, br")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Twice, so that pooled writers are reused
+	for range 2 {
+		rec := serve(http.MethodGet, "/large.txt")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+		assert.Empty(t, rec.Header().Get("Content-Length"))
+		assert.Empty(t, rec.Header().Get("Accept-Ranges"))
+		assert.Less(t, rec.Body.Len(), len(large))
+		assert.Equal(t, large, gunzip(t, rec.Body))
+	}
+
+	for target, want := range map[string]string{
+		"/unsized.json": strings.Repeat(`{"name": "entry"},`, 10) + large,
+		"/sniffed":      "<html>" + large + "</html>",
+	} {
+		rec := serve(http.MethodGet, target)
+		assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"), target)
+		assert.Equal(t, want, gunzip(t, rec.Body), target)
+	}
+	assert.Equal(t, "text/html; charset=utf-8", serve(http.MethodGet, "/sniffed").Header().Get("Content-Type"))
+
+	// Below the threshold, of other types, or already encoded, bodies pass unchanged
+	rec := serve(http.MethodGet, "/small.txt")
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+	assert.Equal(t, "small", rec.Body.String())
+	rec = serve(http.MethodGet, "/image.png")
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Empty(t, rec.Header().Get("Vary"))
+	assert.Equal(t, large, rec.Body.String())
+	rec = serve(http.MethodGet, "/app.js.gz")
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Empty(t, rec.Header().Get("Vary"))
+	assert.Equal(t, large, rec.Body.String(), "already encoded bodies aren't compressed again")
+
+	// Partial and unmodified responses are never compressed
+	rec = serve(http.MethodGet, "/large.txt", "Range", "bytes=0-9")
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, large[:10], rec.Body.String())
+	rec = serve(http.MethodGet, "/large.txt", "If-Modified-Since", modTime.Format(http.TimeFormat))
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Empty(t, rec.Body.String())
+
+	// Clients that don't accept gzip get the plain body
+	req := httptest.NewRequest(http.MethodGet, "/large.txt", nil)
+	req.Header.Set("Accept-Encoding", "gzip;q=0")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+	assert.Equal(t, large, rec.Body.String())
+}
+
+func TestCompressHead(t *testing.T) {
+	handler := Compress(CompressOptions{Types: DefaultCompressTypes, MinSize: 1024})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := strings.Repeat("x", 2048)
+		if r.URL.Path == "/small.txt" {
+			body = "small"
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, strings.NewReader(body))
+	}))
+
+	for target, encoding := range map[string]string{"/large.txt": "gzip", "/small.txt": ""} {
+		req := httptest.NewRequest(http.MethodHead, target, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code, target)
+		assert.Equal(t, encoding, rec.Header().Get("Content-Encoding"), target)
+		assert.Empty(t, rec.Body.String(), target)
+		if encoding != "" {
+			assert.Empty(t, rec.Header().Get("Content-Length"), target)
+		}
+	}
+}
+
+func TestCompressFlush(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(Compress(CompressOptions{Types: DefaultCompressTypes, MinSize: 1024})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<ul>"))
+		http.NewResponseController(w).Flush()
+		<-release
+		_, _ = w.Write([]byte("</ul>"))
+	})))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := server.Client().Transport.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+	// The first part arrives while the handler is still running
+	gz, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	first := make([]byte, 4)
+	_, err = io.ReadFull(gz, first)
+	require.NoError(t, err)
+	assert.Equal(t, "<ul>", string(first))
+
+	close(release)
+	rest, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, "</ul>", string(rest))
+}
@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Header is a custom response header.
+type Header struct {
+	Name  string
+	Value string
+	// Override replaces the value set by the handler instead of yielding to it.
+	Override bool
+}
+
+// serverHeaders are set by the server itself on some responses.
+var serverHeaders = map[string]bool{
+	"Accept-Ranges":    true,
+	"Allow":            true,
+	"Cache-Control":    true,
+	"Content-Encoding": true,
+	"Content-Length":   true,
+	"Content-Range":    true,
+	"Content-Type":     true,
+	"Date":             true,
+	"Etag":             true,
+	"Last-Modified":    true,
+	"Location":         true,
+	"Retry-After":      true,
+	"Vary":             true,
+	"Www-Authenticate": true,
+}
+
+// ServerHeader reports whether the server sets the named header itself, so that a custom
+// header of that name needs Override to have a defined effect.
+func ServerHeader(name string) bool {
+	return serverHeaders[http.CanonicalHeaderKey(name)]
+}
+
+// ParseHeader parses a "Name: value" header.
+func ParseHeader(spec string, override bool) (Header, error) {
+	name, value, ok := strings.Cut(spec, ":")
+	value = strings.TrimSpace(value)
+	if !ok || !validHeaderName(name) || value == "" {
+		return Header{}, fmt.Errorf("invalid header %q, use \"Name: value\"", spec)
+	}
+	for i := 0; i < len(value); i++ {
+		if (value[i] < 0x20 && value[i] != '\t') || value[i] == 0x7f {
+			return Header{}, fmt.Errorf("invalid header %q: control character in value", spec)
+		}
+	}
+	return Header{Name: http.CanonicalHeaderKey(name), Value: value, Override: override}, nil
+}
+
+// validHeaderName reports whether name is an RFC 9110 token.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Headers adds custom headers to every response, including error responses. Headers the
+// handler set itself are kept unless the custom header overrides them.
+func Headers(headers []Header) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(headers) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(newHeaderHook(w, func(int) {
+				header := w.Header()
+				set := make(map[string]bool, len(headers))
+				for _, custom := range headers {
+					if _, exists := header[custom.Name]; exists && !custom.Override && !set[custom.Name] {
+						continue
+					}
+					if !set[custom.Name] {
+						header.Del(custom.Name)
+						set[custom.Name] = true
+					}
+					header.Add(custom.Name, custom.Value)
+				}
+			}), r)
+		})
+	}
+}
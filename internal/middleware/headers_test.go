@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaders(t *testing.T) {
+	modTime := time.Date(2026, 10, 12, 10, 0, 0, 0, time.UTC)
+	handler := Headers([]Header{
+		{Name: "X-Frame-Options", Value: "DENY"},
+		{Name: "Content-Security-Policy", Value: "default-src 'self'"},
+		{Name: "Link", Value: "</a.css>; rel=preload"},
+		{Name: "Link", Value: "</b.css>; rel=preload"},
+		{Name: "X-Backend", Value: "cmpserve"},
+		{Name: "X-Served-By", Value: "cmpserve", Override: true},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Served-By", "handler")
+		w.Header().Set("X-Backend", "handler")
+		http.ServeContent(w, r, "page.html", modTime, strings.NewReader("<html></html>"))
+	}))
+
+	serve := func(target string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, rec := range []*httptest.ResponseRecorder{
+		serve("/page.html", nil),
+		serve("/missing", nil),
+		serve("/page.html", http.Header{"If-Modified-Since": {modTime.Format(http.TimeFormat)}}),
+	} {
+		assert.Equal(t, "DENY", rec.Header().Get("X-Frame-Options"), rec.Code)
+		assert.Equal(t, "default-src 'self'", rec.Header().Get("Content-Security-Policy"), rec.Code)
+		assert.Equal(t, []string{"</a.css>; rel=preload", "</b.css>; rel=preload"}, rec.Header().Values("Link"), rec.Code)
+		assert.Equal(t, "cmpserve", rec.Header().Get("X-Served-By"), rec.Code)
+	}
+
+	rec := serve("/page.html", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "handler", rec.Header().Get("X-Backend"), "the handler's header wins without Override")
+	assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+	rec = serve("/missing", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "cmpserve", rec.Header().Get("X-Backend"))
+	rec = serve("/page.html", http.Header{"If-Modified-Since": {modTime.Format(http.TimeFormat)}})
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+}
+
+func TestParseHeader(t *testing.T) {
+	header, err := ParseHeader("x-content-type-options:  nosniff ", false)
+	require.NoError(t, err)
+	assert.Equal(t, Header{Name: "X-Content-Type-Options", Value: "nosniff"}, header)
+
+	header, err = ParseHeader("Content-Security-Policy: default-src 'self'; img-src *", true)
+	require.NoError(t, err)
+	assert.Equal(t, Header{Name: "Content-Security-Policy", Value: "default-src 'self'; img-src *", Override: true}, header)
+
+	for _, spec := range []string{"", "X-Frame-Options", "X-Frame-Options:", ": DENY", "X Frame: DENY", "X-Frame(Options): DENY", "X-Frame-Options: DE\rNY", "X-Frame-Options: DE\x00NY"} {
+		_, err := ParseHeader(spec, false)
+		assert.Error(t, err, spec)
+	}
+
+	assert.True(t, ServerHeader("content-type"))
+	assert.True(t, ServerHeader("ETag"))
+	assert.False(t, ServerHeader("X-Frame-Options"))
+}
@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"net/netip"
+)
+
+// IPFilterOptions configures IPFilter.
+type IPFilterOptions struct {
+	// Allow lists the networks clients may connect from; empty allows every client.
+	Allow []netip.Prefix
+	// Deny lists networks that are refused even when allowed.
+	Deny []netip.Prefix
+	// Proxies are trusted to report the client address in X-Forwarded-For.
+	Proxies TrustedProxies
+	// Logger receives refused requests.
+	Logger *slog.Logger
+}
+
+// IPFilter answers 403 to clients outside the allowed networks or inside the denied ones.
+// Clients without an address are refused when an allow list is given.
+func IPFilter(options IPFilterOptions) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addr, ok := options.Proxies.ClientAddr(r)
+			allowed := len(options.Allow) == 0 || (ok && containsAddr(options.Allow, addr))
+			if ok && containsAddr(options.Deny, addr) {
+				allowed = false
+			}
+			if !allowed {
+				client := "-"
+				if ok {
+					client = addr.String()
+				}
+				options.Logger.WarnContext(r.Context(), "Request refused by IP filter", "client", client, "remote", r.RemoteAddr, "path", r.URL.Path)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
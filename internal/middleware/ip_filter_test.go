@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var privateNetworks = TrustedProxies{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("fc00::/7"),
+}
+
+func TestIPFilter(t *testing.T) {
+	var logs bytes.Buffer
+	handler := IPFilter(IPFilterOptions{
+		Allow:  []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("2001:db8::/32")},
+		Deny:   []netip.Prefix{netip.MustParsePrefix("192.0.2.66/32"), netip.MustParsePrefix("2001:db8:bad::/48")},
+		Logger: slog.New(slog.NewTextHandler(&logs, nil)),
+	})(http.NotFoundHandler())
+
+	for remote, want := range map[string]int{
+		"192.0.2.10:5555":          http.StatusNotFound,
+		"192.0.2.66:5555":          http.StatusForbidden,
+		"198.51.100.1:5555":        http.StatusForbidden,
+		"[2001:db8::1]:5555":       http.StatusNotFound,
+		"[2001:db8:bad::1]:5555":   http.StatusForbidden,
+		"[2001:db9::1]:5555":       http.StatusForbidden,
+		"[::ffff:192.0.2.10]:5555": http.StatusNotFound,
+		"[fe80::1%eth0]:5555":      http.StatusForbidden,
+		"@":                        http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, want, rec.Code, remote)
+	}
+	assert.Contains(t, logs.String(), "client=198.51.100.1")
+	assert.Contains(t, logs.String(), "client=2001:db8:bad::1")
+
+	// Without an allow list, only denied networks are refused
+	handler = IPFilter(IPFilterOptions{
+		Deny:   []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		Logger: slog.New(slog.DiscardHandler),
+	})(http.NotFoundHandler())
+	for remote, want := range map[string]int{"192.0.2.10:5555": http.StatusForbidden, "198.51.100.1:5555": http.StatusNotFound, "@": http.StatusNotFound} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, want, rec.Code, remote)
+	}
+}
+
+func TestIPFilterBehindProxy(t *testing.T) {
+	handler := IPFilter(IPFilterOptions{
+		Allow:   []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("2001:db8::/32")},
+		Proxies: privateNetworks,
+		Logger:  slog.New(slog.DiscardHandler),
+	})(http.NotFoundHandler())
+
+	for _, tc := range []struct {
+		name, remote string
+		forwarded    []string
+		want         int
+	}{
+		{"forwarded client", "10.0.0.1:1234", []string{"192.0.2.10"}, http.StatusNotFound},
+		{"forwarded v6 client", "[fd00::1]:1234", []string{"2001:db8::7"}, http.StatusNotFound},
+		{"chain of proxies", "10.0.0.1:1234", []string{"192.0.2.10, 10.0.0.2"}, http.StatusNotFound},
+		{"repeated headers", "10.0.0.1:1234", []string{"192.0.2.10", "10.0.0.2"}, http.StatusNotFound},
+		{"refused client", "10.0.0.1:1234", []string{"198.51.100.1"}, http.StatusForbidden},
+		{"spoofed entry", "10.0.0.1:1234", []string{"192.0.2.10, 198.51.100.1"}, http.StatusForbidden},
+		{"malformed entry", "10.0.0.1:1234", []string{"192.0.2.10, garbage"}, http.StatusForbidden},
+		{"untrusted peer", "198.51.100.1:1234", []string{"192.0.2.10"}, http.StatusForbidden},
+		{"only proxies", "10.0.0.1:1234", nil, http.StatusForbidden},
+		{"unix socket peer", "@", []string{"192.0.2.10"}, http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.remote
+		for _, forwarded := range tc.forwarded {
+			req.Header.Add("X-Forwarded-For", forwarded)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, tc.want, rec.Code, tc.name)
+	}
+}
@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"cmpserve/internal/metrics"
+)
+
+// Metrics records the count, duration and size of every request, labeled with the source
+// the handler reported through metrics.SetSource (the filesystem unless told otherwise).
+func Metrics(m *metrics.Metrics) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			m.RequestStarted()
+			recorder := NewResponseRecorder(w)
+			source := metrics.SourceFilesystem
+			next.ServeHTTP(recorder, r.WithContext(metrics.WithSource(r.Context(), &source)))
+
+			m.RequestFinished(source, recorder.Status(), recorder.Written(), time.Since(start))
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cmpserve/internal/metrics"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func scrape(t *testing.T, m *metrics.Metrics) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	body, err := io.ReadAll(rec.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	m := metrics.New()
+	handler := Metrics(m)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/bundle/") {
+			metrics.SetSource(r, metrics.SourceArchive)
+		}
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("hello"))
+	}))
+
+	for _, target := range []string{"/plain.txt", "/bundle/a.txt", "/bundle/b.txt", "/missing"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+
+	out := scrape(t, m)
+	assert.Contains(t, out, `cmpserve_http_requests_total{code="2xx",source="filesystem"} 1`)
+	assert.Contains(t, out, `cmpserve_http_requests_total{code="2xx",source="archive"} 2`)
+	assert.Contains(t, out, `cmpserve_http_requests_total{code="4xx",source="filesystem"} 1`)
+	assert.Contains(t, out, `cmpserve_http_request_duration_seconds_count{code="2xx",source="archive"} 2`)
+	assert.Contains(t, out, `cmpserve_http_response_bytes_total{source="archive"} 10`)
+	assert.Contains(t, out, "cmpserve_http_requests_in_flight 0")
+}
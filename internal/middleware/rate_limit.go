@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"cmpserve/internal/metrics"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitSweepInterval is how often idle buckets are evicted.
+const rateLimitSweepInterval = time.Minute
+
+// RateLimitOptions configures RateLimit.
+type RateLimitOptions struct {
+	// Rate is the sustained number of requests per second allowed to each client.
+	Rate rate.Limit
+	// Burst is the number of requests a client may make at once.
+	Burst int
+	// Exempt lists networks that aren't limited, e.g. health checkers.
+	Exempt []netip.Prefix
+	// Proxies are trusted to report the client address in X-Forwarded-For.
+	Proxies TrustedProxies
+	// Metrics counts limited requests, if set.
+	Metrics *metrics.Metrics
+}
+
+// RateLimit answers 429 with Retry-After to clients exceeding their rate, keeping a token
+// bucket per client address. Clients without an address share a bucket.
+func RateLimit(options RateLimitOptions) func(http.Handler) http.Handler {
+	limiter := newRateLimiter(options, time.Now)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addr, ok := options.Proxies.ClientAddr(r)
+			if ok && containsAddr(options.Exempt, addr) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if wait := limiter.take(addr); wait > 0 {
+				if options.Metrics != nil {
+					options.Metrics.RateLimited()
+				}
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimiter holds the buckets of the clients seen recently. Buckets that have refilled
+// are evicted, which loses nothing since a new bucket starts full, so memory is bounded
+// by the clients active within the refill time.
+type rateLimiter struct {
+	rate  rate.Limit
+	burst int
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[netip.Addr]*rate.Limiter
+	lastSweep time.Time
+}
+
+func newRateLimiter(options RateLimitOptions, now func() time.Time) *rateLimiter {
+	return &rateLimiter{
+		rate:      options.Rate,
+		burst:     max(options.Burst, 1),
+		now:       now,
+		buckets:   make(map[netip.Addr]*rate.Limiter),
+		lastSweep: now(),
+	}
+}
+
+// take spends a token of the bucket of addr, returning how long to wait for one if empty.
+func (l *rateLimiter) take(addr netip.Addr) time.Duration {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		for key, bucket := range l.buckets {
+			if bucket.TokensAt(now) >= float64(l.burst) {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	bucket, ok := l.buckets[addr]
+	if !ok {
+		bucket = rate.NewLimiter(l.rate, l.burst)
+		l.buckets[addr] = bucket
+	}
+	if bucket.AllowN(now, 1) {
+		return 0
+	}
+	missing := 1 - bucket.TokensAt(now)
+	return time.Duration(missing / float64(l.rate) * float64(time.Second))
+}
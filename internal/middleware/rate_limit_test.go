@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"cmpserve/internal/metrics"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimit(t *testing.T) {
+	m := metrics.New()
+	handler := RateLimit(RateLimitOptions{
+		Rate:    0.5,
+		Burst:   5,
+		Exempt:  []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		Proxies: privateNetworks,
+		Metrics: m,
+	})(http.NotFoundHandler())
+
+	serve := func(remote, forwarded string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/build.zip/app.js", nil)
+		req.RemoteAddr = remote
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := range 5 {
+		assert.Equal(t, http.StatusNotFound, serve("198.51.100.1:1234", "").Code, i)
+	}
+	for range 3 {
+		rec := serve("198.51.100.1:1234", "")
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+	}
+
+	// Other clients keep their own bucket, including those behind a trusted proxy
+	assert.Equal(t, http.StatusNotFound, serve("[2001:db8::1]:1234", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve("10.0.0.1:1234", "203.0.113.7").Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve("10.0.0.1:1234", "198.51.100.1").Code)
+
+	for range 10 {
+		assert.Equal(t, http.StatusNotFound, serve("192.0.2.10:1234", "").Code)
+	}
+	assert.Contains(t, scrape(t, m), "cmpserve_http_rate_limited_total 4")
+}
+
+func TestRateLimitEviction(t *testing.T) {
+	now := time.Now()
+	limiter := newRateLimiter(RateLimitOptions{Rate: 1, Burst: 2}, func() time.Time { return now })
+	busy, idle := netip.MustParseAddr("198.51.100.1"), netip.MustParseAddr("198.51.100.2")
+
+	assert.Zero(t, limiter.take(idle))
+	for range 2 {
+		assert.Zero(t, limiter.take(busy))
+	}
+	assert.Equal(t, time.Second, limiter.take(busy))
+
+	// Refilled buckets are dropped at the next sweep, only those in use remain
+	now = now.Add(rateLimitSweepInterval)
+	for range 100 {
+		limiter.take(busy)
+	}
+	assert.Len(t, limiter.buckets, 1)
+	assert.Contains(t, limiter.buckets, busy)
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+)
+
+// RequestIDHeader carries request IDs, in responses and from proxies.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds the request IDs accepted from proxies.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// RequestID gives every request an ID, set as the X-Request-Id response header and added to
+// its context for RequestIDFromContext and the log lines of LogRequestIDs. IDs are taken
+// from the X-Request-Id header of requests coming from proxies, which are only trusted when
+// given, and only if they are made of at most 128 letters, digits and -_.:+/= characters;
+// other requests get a random one.
+func RequestID(proxies TrustedProxies) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(RequestIDHeader)
+			if !proxies.fromProxy(r) || !validRequestID(id) {
+				id = newRequestID()
+			}
+			w.Header().Set(RequestIDHeader, id)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+		})
+	}
+}
+
+// RequestIDFromContext returns the ID RequestID gave the request of ctx, or "".
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID returns a random ID of 32 hex digits.
+func newRequestID() string {
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// validRequestID reports whether id is safe to write to logs unescaped, as UUIDs and the
+// IDs of common proxies are.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':' || c == '+' || c == '/' || c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// LogRequestIDs wraps a log handler to add the request_id attribute to records logged with
+// the context of a request that RequestID gave an ID.
+func LogRequestIDs(h slog.Handler) slog.Handler {
+	return requestIDHandler{h}
+}
+
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestIDFromContext(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var generatedRequestID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	record := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestIDFromContext(r.Context())
+	})
+	handler := RequestID(privateNetworks)(record)
+	serve := func(remoteAddr, id string) string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		if id != "" {
+			req.Header.Set(RequestIDHeader, id)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, seen, rec.Header().Get(RequestIDHeader))
+		return seen
+	}
+
+	// Generated for every request without one
+	first := serve("203.0.113.7:1234", "")
+	assert.Regexp(t, generatedRequestID, first)
+	assert.NotEqual(t, first, serve("203.0.113.7:1234", ""))
+
+	// Taken from trusted proxies, Unix domain socket peers included
+	assert.Equal(t, "f81d4fae-7dec-11d0-a765-00a0c91e6bf6", serve("10.0.0.1:1234", "f81d4fae-7dec-11d0-a765-00a0c91e6bf6"))
+	assert.Equal(t, "Root=1-67891233-abcdef012345678912345678", serve("@", "Root=1-67891233-abcdef012345678912345678"))
+
+	// but not from clients
+	assert.Regexp(t, generatedRequestID, serve("203.0.113.7:1234", "chosen-by-client"))
+
+	// nor in a format that could forge log lines
+	for _, id := range []string{"evil\n127.0.0.1 - - forged", `id" "quoted`, "with space", "caf\xc3\xa9", strings.Repeat("a", 129)} {
+		assert.Regexp(t, generatedRequestID, serve("10.0.0.1:1234", id), id)
+	}
+	assert.Equal(t, strings.Repeat("a", 128), serve("10.0.0.1:1234", strings.Repeat("a", 128)))
+
+	// Without trusted proxies, every ID is generated
+	handler = RequestID(nil)(record)
+	assert.Regexp(t, generatedRequestID, serve("10.0.0.1:1234", "f81d4fae-7dec-11d0-a765-00a0c91e6bf6"))
+}
+
+func TestRequestIDLogs(t *testing.T) {
+	var logs, accessLog bytes.Buffer
+	logger := slog.New(LogRequestIDs(slog.NewJSONHandler(&logs, nil))).With("component", "test")
+	handler := RequestID(privateNetworks)(AccessLog(&accessLog, privateNetworks)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger.WarnContext(r.Context(), "Failed to stream archive entry")
+		logger.Info("Not about a request")
+	})))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set(RequestIDHeader, "abc-123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	require.Len(t, lines, 2)
+	var record map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, "abc-123", record["request_id"])
+	assert.Equal(t, "test", record["component"])
+	assert.NotContains(t, lines[1], "request_id")
+
+	match := combinedLogLine.FindStringSubmatch(accessLog.String())
+	require.NotNil(t, match, accessLog.String())
+	assert.Equal(t, "abc-123", match[10])
+}
@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// ResponseRecorder wraps a ResponseWriter to record the status code and the number of
+// body bytes written, while still exposing the Flusher and Hijacker of the wrapped writer.
+type ResponseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+// NewResponseRecorder wraps w, reusing it when it is already a ResponseRecorder.
+func NewResponseRecorder(w http.ResponseWriter) *ResponseRecorder {
+	if recorder, ok := w.(*ResponseRecorder); ok {
+		return recorder
+	}
+	return &ResponseRecorder{ResponseWriter: w}
+}
+
+// Status returns the response status, 200 if the handler wrote a body without a header.
+func (r *ResponseRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// Written returns the number of body bytes written.
+func (r *ResponseRecorder) Written() int64 {
+	return r.written
+}
+
+func (r *ResponseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *ResponseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.written += int64(n)
+	return n, err
+}
+
+func (r *ResponseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		if r.status == 0 {
+			r.status = http.StatusOK
+		}
+		flusher.Flush()
+	}
+}
+
+func (r *ResponseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the wrapped writer.
+func (r *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// headerHook calls before with the status right before the response header is written,
+// so that headers can be adjusted depending on the status and on what the handler set.
+type headerHook struct {
+	http.ResponseWriter
+	before      func(status int)
+	wroteHeader bool
+}
+
+func newHeaderHook(w http.ResponseWriter, before func(status int)) *headerHook {
+	return &headerHook{ResponseWriter: w, before: before}
+}
+
+func (h *headerHook) WriteHeader(status int) {
+	// Informational responses are followed by the final one
+	if !h.wroteHeader && status >= http.StatusOK {
+		h.wroteHeader = true
+		h.before(status)
+	}
+	h.ResponseWriter.WriteHeader(status)
+}
+
+func (h *headerHook) Write(p []byte) (int, error) {
+	if !h.wroteHeader {
+		h.WriteHeader(http.StatusOK)
+	}
+	return h.ResponseWriter.Write(p)
+}
+
+func (h *headerHook) Flush() {
+	if !h.wroteHeader {
+		h.WriteHeader(http.StatusOK)
+	}
+	_ = http.NewResponseController(h.ResponseWriter).Flush()
+}
+
+func (h *headerHook) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(h.ResponseWriter).Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the wrapped writer.
+func (h *headerHook) Unwrap() http.ResponseWriter {
+	return h.ResponseWriter
+}
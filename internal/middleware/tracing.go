@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing starts a server span for every request, continuing the trace of the
+// W3C traceparent header if the request has one, so the spans of the handler become its
+// children.
+func Tracing(tracer trace.Tracer) func(http.Handler) http.Handler {
+	propagator := propagation.TraceContext{}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				semconv.UserAgentOriginal(r.UserAgent()),
+			))
+			defer span.End()
+			recorder := NewResponseRecorder(w)
+			next.ServeHTTP(recorder, r.WithContext(ctx))
+
+			span.SetAttributes(semconv.HTTPResponseStatusCode(recorder.Status()), semconv.HTTPResponseBodySize(int(recorder.Written())))
+			if recorder.Status() >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(recorder.Status()))
+			}
+		})
+	}
+}
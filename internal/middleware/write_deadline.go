@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"time"
+)
+
+// WriteDeadline pushes the connection's write deadline timeout into the future before
+// every write of the response body, so that the timeout bounds how long a client may stall
+// rather than how long a transfer may take in total. A zero timeout disables it.
+func WriteDeadline(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if timeout <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&deadlineWriter{ResponseWriter: w, controller: http.NewResponseController(w), timeout: timeout}, r)
+		})
+	}
+}
+
+// deadlineWriter extends the write deadline ahead of each write.
+type deadlineWriter struct {
+	http.ResponseWriter
+	controller *http.ResponseController
+	timeout    time.Duration
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	// Writers that can't set deadlines keep the server-wide WriteTimeout
+	_ = d.controller.SetWriteDeadline(time.Now().Add(d.timeout))
+	return d.ResponseWriter.Write(p)
+}
+
+func (d *deadlineWriter) Flush() {
+	_ = d.controller.SetWriteDeadline(time.Now().Add(d.timeout))
+	_ = d.controller.Flush()
+}
+
+func (d *deadlineWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return d.controller.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the wrapped writer.
+func (d *deadlineWriter) Unwrap() http.ResponseWriter {
+	return d.ResponseWriter
+}
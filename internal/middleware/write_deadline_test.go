@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowBody writes chunks with pauses, taking well over timeout in total but never
+// stalling longer than a fraction of it.
+func slowBody(timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 10; i++ {
+			if _, err := w.Write([]byte(strings.Repeat("x", 1024))); err != nil {
+				return
+			}
+			http.NewResponseController(w).Flush()
+			time.Sleep(timeout / 4)
+		}
+	})
+}
+
+func fetch(t *testing.T, handler http.Handler, timeout time.Duration) (int, error) {
+	t.Helper()
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.WriteTimeout = timeout
+	server.Start()
+	t.Cleanup(server.Close)
+
+	resp, err := server.Client().Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return len(body), err
+}
+
+func TestWriteDeadline(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+
+	// The transfer outlives the write timeout as long as it keeps making progress
+	n, err := fetch(t, WriteDeadline(timeout)(slowBody(timeout)), timeout)
+	require.NoError(t, err)
+	assert.Equal(t, 10*1024, n)
+
+	// Without it, the server-wide timeout cuts the transfer off
+	n, err = fetch(t, slowBody(timeout), timeout)
+	assert.True(t, err != nil || n < 10*1024, "transfer should have been interrupted")
+}
+
+func TestWriteDeadlineKeepsInterfaces(t *testing.T) {
+	server := httptest.NewServer(WriteDeadline(time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, http.NewResponseController(w).Flush())
+		_, isHijacker := w.(http.Hijacker)
+		assert.True(t, isHijacker)
+	})))
+	t.Cleanup(server.Close)
+
+	resp, err := server.Client().Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,45 @@
+// Package negotiate implements HTTP content negotiation helpers.
+package negotiate
+
+import (
+	"strconv"
+	"strings"
+)
+
+// EncodingQuality returns the quality value an Accept-Encoding header gives encoding, 0
+// when it isn't acceptable.
+func EncodingQuality(header, encoding string) float64 {
+	wildcard := 0.0
+	for _, item := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(item, ";")
+		name = strings.TrimSpace(name)
+		quality := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(param, "=")
+			if ok && strings.EqualFold(strings.TrimSpace(key), "q") {
+				if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		switch {
+		case strings.EqualFold(name, encoding):
+			return quality
+		case name == "*":
+			wildcard = quality
+		}
+	}
+	return wildcard
+}
+
+// Accepts reports whether an Accept header names mediaType explicitly, rather than
+// through a wildcard.
+func Accepts(header, mediaType string) bool {
+	for _, item := range strings.Split(header, ",") {
+		name, _, _ := strings.Cut(item, ";")
+		if strings.EqualFold(strings.TrimSpace(name), mediaType) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package negotiate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodingQuality(t *testing.T) {
+	for _, tc := range []struct {
+		header, encoding string
+		want             float64
+	}{
+		{"gzip, deflate, br", "gzip", 1},
+		{"gzip, deflate, br", "br", 1},
+		{"GZIP", "gzip", 1},
+		{"br;q=0.5, gzip;q=0.8", "br", 0.5},
+		{"br; q=0, gzip", "br", 0},
+		{"*;q=0.3", "gzip", 0.3},
+		{"gzip;q=0, *", "gzip", 0},
+		{"identity", "gzip", 0},
+		{"", "gzip", 0},
+	} {
+		assert.Equal(t, tc.want, EncodingQuality(tc.header, tc.encoding), "%s %s", tc.header, tc.encoding)
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   bool
+	}{
+		{"application/json", true},
+		{"text/html, Application/JSON;q=0.9", true},
+		{"text/html,application/xhtml+xml,*/*;q=0.8", false},
+		{"application/*", false},
+		{"", false},
+	} {
+		assert.Equal(t, tc.want, Accepts(tc.header, "application/json"), tc.header)
+	}
+}
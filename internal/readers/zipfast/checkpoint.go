@@ -0,0 +1,94 @@
+package zipfast
+
+import (
+	"bufio"
+	"compress/flate"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// deleteCheckpoints deletes the checkpoints of the entries of an archive, by id.
+const deleteCheckpoints = "DELETE FROM lookup_zip_checkpoints WHERE entry_id IN (SELECT id FROM lookup_zip_contents WHERE zip_id = ?)"
+
+// checkpoint is a place deflated data can be decompressed from: the start of a block,
+// with the window of output preceding it.
+type checkpoint struct {
+	// output is the offset of the block in the decompressed data, and input its offset in
+	// bits in the compressed data.
+	output     int64
+	input      int64
+	dictionary []byte
+}
+
+// checkpoint returns the checkpoint of an entry closest before offset, or the start of
+// the data, and the offset of the last checkpoint recorded.
+func (zi *FastZipReader) checkpoint(ctx context.Context, entryID int, offset int64) (cp checkpoint, last int64, err error) {
+	err = zi.db.QueryRowContext(ctx, "SELECT output_offset, input_offset, dictionary FROM lookup_zip_checkpoints WHERE entry_id = ? AND output_offset <= ? ORDER BY output_offset DESC LIMIT 1", entryID, offset).Scan(&cp.output, &cp.input, &cp.dictionary)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return checkpoint{}, 0, zi.dbError(fmt.Errorf("failed to look up checkpoint: %w", err))
+	}
+	var maxOutput sql.NullInt64
+	if err := zi.db.QueryRowContext(ctx, "SELECT MAX(output_offset) FROM lookup_zip_checkpoints WHERE entry_id = ?", entryID).Scan(&maxOutput); err != nil {
+		return checkpoint{}, 0, zi.dbError(fmt.Errorf("failed to look up checkpoint: %w", err))
+	}
+	return cp, maxOutput.Int64, nil
+}
+
+// saveCheckpoint records a checkpoint of an entry. Readers decompressing the same entry
+// at once find the same blocks, and the second one is ignored.
+func (zi *FastZipReader) saveCheckpoint(ctx context.Context, entryID int, cp checkpoint) error {
+	_, err := zi.db.ExecContext(ctx, "INSERT OR IGNORE INTO lookup_zip_checkpoints (entry_id, output_offset, input_offset, dictionary) VALUES (?, ?, ?, ?)", entryID, cp.output, cp.input, cp.dictionary)
+	if err != nil {
+		return zi.dbError(fmt.Errorf("failed to record checkpoint: %w", err))
+	}
+	return nil
+}
+
+// resume positions the decompressor of a deflated entry at the checkpoint closest before
+// the offset sought, or at the start of the data, unless it already is closer. Past the
+// last checkpoint recorded, at least CheckpointInterval before the offset, it decompresses
+// with an inflater recording more on the way.
+func (er *EntryReader) resume() {
+	var cp checkpoint
+	var record bool
+	if interval := er.zi.checkpointInterval; interval > 0 {
+		found, last, err := er.zi.checkpoint(er.ctx, er.entryID, er.seek)
+		if err != nil {
+			// Checkpoints only save time
+			er.zi.logger.WarnContext(er.ctx, "Failed to look up checkpoint", "archive", er.file.Name(), "file", er.Info.Name, "error", err)
+		}
+		cp, record = found, err == nil && found.output == last && er.seek-found.output >= interval
+	}
+	if er.r != nil && er.pos <= er.seek && er.pos >= cp.output {
+		return
+	}
+	if er.r != nil {
+		er.r.Close()
+	}
+
+	compressed := bufio.NewReaderSize(io.NewSectionReader(er.file, er.offset+cp.input/8, int64(er.Info.CompressedSize)-cp.input/8), 32<<10)
+	er.pos = cp.output
+	if cp.output == 0 && !record {
+		er.r = flate.NewReader(compressed)
+		return
+	}
+	// Blocks don't start on a byte, nor do the stored ones following them once shifted,
+	// so compress/flate can't resume from them
+	f := newInflater(compressed, cp.input, cp.output, cp.dictionary)
+	if record {
+		next := cp.output + er.zi.checkpointInterval
+		f.onBlock = func(input, output int64) {
+			if output < next {
+				return
+			}
+			next = output + er.zi.checkpointInterval
+			if err := er.zi.saveCheckpoint(er.ctx, er.entryID, checkpoint{output: output, input: input, dictionary: f.dictionary()}); err != nil {
+				er.zi.logger.WarnContext(er.ctx, "Failed to record checkpoint", "archive", er.file.Name(), "file", er.Info.Name, "error", err)
+			}
+		}
+	}
+	er.r = io.NopCloser(f)
+}
@@ -0,0 +1,147 @@
+package zipfast
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createDeflatedZipFile creates an archive holding data as the deflated entry data.bin.
+func createDeflatedZipFile(t testing.TB, zipPath string, data []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	w, err := zipWriter.CreateHeader(&zip.FileHeader{Name: "data.bin", Method: zip.Deflate})
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zipWriter.Close())
+	require.NoError(t, os.WriteFile(zipPath, buf.Bytes(), 0o644))
+}
+
+func countCheckpoints(t *testing.T, reader *FastZipReader) int {
+	t.Helper()
+	var count int
+	require.NoError(t, reader.db.QueryRow("SELECT COUNT(*) FROM lookup_zip_checkpoints").Scan(&count))
+	return count
+}
+
+func TestCheckpoints(t *testing.T) {
+	tempDir := t.TempDir()
+	zipPath := filepath.Join(tempDir, "test.zip")
+	data := inflateTestData(4 << 20)
+	createDeflatedZipFile(t, zipPath, data)
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{CheckpointInterval: 256 << 10})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+	ctx := context.Background()
+
+	readAt := func(offset int64, length int) []byte {
+		t.Helper()
+		entry, err := reader.OpenEntry(ctx, zipPath, "data.bin")
+		require.NoError(t, err)
+		defer entry.Close()
+		_, err = entry.Seek(offset, io.SeekStart)
+		require.NoError(t, err)
+		output := make([]byte, length)
+		_, err = io.ReadFull(entry, output)
+		require.NoError(t, err, "offset %d", offset)
+		require.NoError(t, entry.Err())
+		return output
+	}
+
+	// The first late range records checkpoints up to it, and later ones resume from them
+	offsets := []int64{3 << 20, 1 << 20, 4<<20 - 100, 0, 2<<20 + 12345, 3<<20 + 1}
+	for i, offset := range offsets {
+		assert.True(t, bytes.Equal(data[offset:offset+100], readAt(offset, 100)), "offset %d", offset)
+		if i == 0 {
+			assert.Greater(t, countCheckpoints(t, reader), 8)
+		}
+	}
+	recorded := countCheckpoints(t, reader)
+	assert.Greater(t, recorded, 10)
+	assert.True(t, bytes.Equal(data[3<<20:], readAt(3<<20, len(data)-3<<20)))
+	assert.Equal(t, recorded, countCheckpoints(t, reader))
+
+	// Seeking on within one reader resumes from the checkpoints too
+	entry, err := reader.OpenEntry(ctx, zipPath, "data.bin")
+	require.NoError(t, err)
+	for _, offset := range []int64{100, 2 << 20, 1 << 20, 1<<20 + 10} {
+		_, err = entry.Seek(offset, io.SeekStart)
+		require.NoError(t, err)
+		output := make([]byte, 10)
+		_, err = io.ReadFull(entry, output)
+		require.NoError(t, err)
+		assert.Equal(t, data[offset:offset+10], output)
+	}
+	require.NoError(t, entry.Close())
+
+	// The checkpoints of stale entries go with them
+	require.NoError(t, createTestZipFile(zipPath, map[string]string{"other.txt": "other"}))
+	_, err = reader.Reindex(ctx, zipPath)
+	require.NoError(t, err)
+	assert.Zero(t, countCheckpoints(t, reader))
+	createDeflatedZipFile(t, zipPath, data)
+	_, err = reader.Reindex(ctx, zipPath)
+	require.NoError(t, err)
+	readAt(3<<20, 10)
+	assert.NotZero(t, countCheckpoints(t, reader))
+	_, err = reader.Invalidate(ctx, zipPath)
+	require.NoError(t, err)
+	assert.Zero(t, countCheckpoints(t, reader))
+}
+
+func TestCheckpointsDisabled(t *testing.T) {
+	tempDir := t.TempDir()
+	zipPath := filepath.Join(tempDir, "test.zip")
+	data := inflateTestData(1 << 20)
+	createDeflatedZipFile(t, zipPath, data)
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+
+	entry, err := reader.OpenEntry(context.Background(), zipPath, "data.bin")
+	require.NoError(t, err)
+	defer entry.Close()
+	_, err = entry.Seek(1<<20-10, io.SeekStart)
+	require.NoError(t, err)
+	rest, err := io.ReadAll(entry)
+	require.NoError(t, err)
+	assert.Equal(t, data[1<<20-10:], rest)
+	assert.Zero(t, countCheckpoints(t, reader))
+}
+
+// BenchmarkLateRange reads 64 KiB from the end of a deflated 16 MiB entry.
+func BenchmarkLateRange(b *testing.B) {
+	tempDir := b.TempDir()
+	zipPath := filepath.Join(tempDir, "bench.zip")
+	data := inflateTestData(16 << 20)
+	createDeflatedZipFile(b, zipPath, data)
+	for _, interval := range []int64{0, 1 << 20} {
+		b.Run(fmt.Sprintf("interval=%d", interval), func(b *testing.B) {
+			reader, err := NewFastZipReader(filepath.Join(b.TempDir(), "bench.db"), Options{Logger: slog.New(slog.DiscardHandler), CheckpointInterval: interval})
+			require.NoError(b, err)
+			defer reader.Close()
+			ctx := context.Background()
+			output := make([]byte, 64<<10)
+			for b.Loop() {
+				entry, err := reader.OpenEntry(ctx, zipPath, "data.bin")
+				require.NoError(b, err)
+				_, err = entry.Seek(int64(len(data)-len(output)), io.SeekStart)
+				require.NoError(b, err)
+				_, err = io.ReadFull(entry, output)
+				require.NoError(b, err)
+				require.NoError(b, entry.Close())
+			}
+		})
+	}
+}
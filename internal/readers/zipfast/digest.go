@@ -0,0 +1,96 @@
+package zipfast
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// EntrySHA256 returns the SHA-256 digest of the decompressed data of a file entry. It is
+// computed on first use by streaming the entry through the hasher and then recorded in the
+// index along with the entry, so later calls read it back, until the archive is reindexed.
+// The archive gets indexed automatically. It fails with ErrNotFound for missing entries
+// and directory entries.
+func (zi *FastZipReader) EntrySHA256(ctx context.Context, zipPath, filename string) ([]byte, error) {
+	defer zi.pin(zipPath)()
+	if isDirEntry(filename) {
+		return nil, fmt.Errorf("file %s: %w", filename, ErrNotFound)
+	}
+	zipID, done, err := zi.lookup(ctx, zipPath)
+	if err != nil {
+		return nil, err
+	}
+	var entryID int
+	var digest []byte
+	err = zi.db.QueryRowContext(ctx, "SELECT id, sha256 FROM lookup_zip_contents WHERE zip_id = ? AND file_name = ?", zipID, filename).Scan(&entryID, &digest)
+	done()
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("file %s: %w", filename, ErrNotFound)
+		}
+		return nil, zi.dbError(fmt.Errorf("failed to look up file %s: %w", filename, err))
+	}
+	if len(digest) == sha256.Size {
+		return digest, nil
+	}
+
+	reader, err := zi.OpenEntry(ctx, zipPath, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", filename, err)
+	}
+	digest = hash.Sum(nil)
+	// An archive reindexed meanwhile has new entries, which this leaves alone
+	if _, err := zi.db.ExecContext(ctx, "UPDATE lookup_zip_contents SET sha256 = ? WHERE id = ?", digest, entryID); err != nil {
+		zi.logger.WarnContext(ctx, "Failed to record digest", "archive", zipPath, "file", filename, "error", zi.dbError(err))
+	}
+	zi.logger.DebugContext(ctx, "Computed digest of archive entry", "archive", zipPath, "file", filename)
+	return digest, nil
+}
+
+// FileSHA256 returns the SHA-256 digest of a regular file. Digests are recorded in the
+// index by path, along with the size and modification time of the file they were computed
+// from, and computed again once either changed.
+func (zi *FastZipReader) FileSHA256(ctx context.Context, path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s: not a regular file", path)
+	}
+
+	var digest []byte
+	err = zi.db.QueryRowContext(ctx, "SELECT sha256 FROM lookup_file_digests WHERE path = ? AND size = ? AND modification_time_ns = ?", path, info.Size(), info.ModTime().UnixNano()).Scan(&digest)
+	switch {
+	case err == nil && len(digest) == sha256.Size:
+		return digest, nil
+	case err != nil && !errors.Is(err, sql.ErrNoRows):
+		return nil, zi.dbError(fmt.Errorf("failed to look up digest of %s: %w", path, err))
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, &contextReader{ctx: ctx, r: file}); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	digest = hash.Sum(nil)
+	_, err = zi.db.ExecContext(ctx, "INSERT OR REPLACE INTO lookup_file_digests (path, size, modification_time_ns, sha256) VALUES (?, ?, ?, ?)", path, info.Size(), info.ModTime().UnixNano(), digest)
+	if err != nil {
+		zi.logger.WarnContext(ctx, "Failed to record digest", "path", path, "error", zi.dbError(err))
+	}
+	zi.logger.DebugContext(ctx, "Computed digest of file", "path", path)
+	return digest, nil
+}
@@ -0,0 +1,102 @@
+package zipfast
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sha256Of(content string) []byte {
+	digest := sha256.Sum256([]byte(content))
+	return digest[:]
+}
+
+func TestEntrySHA256(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+	zipPath := filepath.Join(tempDir, "site.zip")
+	require.NoError(t, createTestZipFile(zipPath, map[string]string{"index.html": "version 1", "docs/": ""}))
+	ctx := context.Background()
+
+	reader, err := NewFastZipReader(dbPath, Options{})
+	require.NoError(t, err)
+	digest, err := reader.EntrySHA256(ctx, zipPath, "index.html")
+	require.NoError(t, err)
+	assert.Equal(t, sha256Of("version 1"), digest)
+	_, err = reader.EntrySHA256(ctx, zipPath, "missing.html")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = reader.EntrySHA256(ctx, zipPath, "docs/")
+	assert.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, reader.Close())
+
+	// The digest recorded survives restarts, and is read back rather than computed, as an
+	// archive replaced unnoticed shows
+	replaceUnnoticed(t, zipPath, map[string]string{"index.html": "version 2", "docs/": ""})
+	reader, err = NewFastZipReader(dbPath, Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+	queries := countQueries(t, reader, dbPath)
+	digest, err = reader.EntrySHA256(ctx, zipPath, "index.html")
+	require.NoError(t, err)
+	assert.Equal(t, sha256Of("version 1"), digest)
+	assert.Equal(t, int64(2), queries.Load())
+
+	// Reindexing drops it
+	_, err = reader.Reindex(ctx, zipPath)
+	require.NoError(t, err)
+	digest, err = reader.EntrySHA256(ctx, zipPath, "index.html")
+	require.NoError(t, err)
+	assert.Equal(t, sha256Of("version 2"), digest)
+
+	// As does a change found by validation
+	require.NoError(t, createTestZipFile(zipPath, map[string]string{"index.html": "version three"}))
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(zipPath, later, later))
+	digest, err = reader.EntrySHA256(ctx, zipPath, "index.html")
+	require.NoError(t, err)
+	assert.Equal(t, sha256Of("version three"), digest)
+}
+
+func TestFileSHA256(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+	path := filepath.Join(tempDir, "release.tar")
+	require.NoError(t, os.WriteFile(path, []byte("release 1"), 0o644))
+	ctx := context.Background()
+
+	reader, err := NewFastZipReader(dbPath, Options{})
+	require.NoError(t, err)
+	digest, err := reader.FileSHA256(ctx, path)
+	require.NoError(t, err)
+	assert.Equal(t, sha256Of("release 1"), digest)
+	_, err = reader.FileSHA256(ctx, tempDir)
+	assert.Error(t, err)
+	_, err = reader.FileSHA256(ctx, filepath.Join(tempDir, "missing"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	require.NoError(t, reader.Close())
+
+	// Digests are kept across restarts for the same size and modification time
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, []byte("release 2"), 0o644))
+	require.NoError(t, os.Chtimes(path, info.ModTime(), info.ModTime()))
+	reader, err = NewFastZipReader(dbPath, Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+	digest, err = reader.FileSHA256(ctx, path)
+	require.NoError(t, err)
+	assert.Equal(t, sha256Of("release 1"), digest)
+
+	// and computed again once the file changed
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(path, later, later))
+	digest, err = reader.FileSHA256(ctx, path)
+	require.NoError(t, err)
+	assert.Equal(t, sha256Of("release 2"), digest)
+}
@@ -0,0 +1,137 @@
+package zipfast
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// EntryReader reads the data of a file entry, decompressed, as opened by OpenEntry. It
+// implements io.ReadSeeker, as http.ServeContent needs for ranges: stored entries seek
+// within the archive, deflated ones by decompressing from their start, their checkpoint
+// closest before the offset, or from where reading stopped, up to the offset, and
+// discarding what comes before it. Reads fail with the error of ctx once it is done.
+type EntryReader struct {
+	Info FileInfo
+
+	zi      *FastZipReader
+	ctx     context.Context
+	entryID int
+	file    *archiveFile
+	offset  int64
+	// r reads the data from pos on, and is reopened to seek backwards in deflated data.
+	r    io.ReadCloser
+	pos  int64
+	seek int64
+	err  error
+	// span traces reading, from the first read to Close.
+	span trace.Span
+}
+
+// OpenEntry opens a file entry of the archive for reading. The archive gets indexed
+// automatically. It fails with ErrNotFound for missing entries and directory entries.
+func (zi *FastZipReader) OpenEntry(ctx context.Context, zipPath, filename string) (*EntryReader, error) {
+	defer zi.pin(zipPath)()
+	entry, err := zi.findEntry(ctx, zipPath, filename)
+	if err != nil {
+		return nil, err
+	}
+	er := &EntryReader{Info: entry.info, zi: zi, ctx: ctx, entryID: entry.id, offset: entry.offset}
+	if er.Info.CompressionMethod != zip.Store && er.Info.CompressionMethod != zip.Deflate {
+		return nil, fmt.Errorf("unsupported compression method: %d", er.Info.CompressionMethod)
+	}
+
+	er.file, err = zi.openArchive(zipPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ZIP file: %w", err)
+	}
+	return er, nil
+}
+
+func (er *EntryReader) Read(p []byte) (int, error) {
+	if err := er.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if er.seek >= int64(er.Info.UncompressedSize) {
+		return 0, io.EOF
+	}
+	if er.span == nil {
+		_, er.span = er.zi.startSpan(er.ctx, "archive.entry.copy")
+	}
+	if er.r == nil || er.seek != er.pos {
+		if err := er.skip(); err != nil {
+			er.fail(err)
+			return 0, err
+		}
+	}
+	// Reads stop at the declared size, even if the data goes on
+	n, err := er.r.Read(p[:min(int64(len(p)), int64(er.Info.UncompressedSize)-er.pos)])
+	er.pos += int64(n)
+	er.seek = er.pos
+	if err == io.EOF && er.pos < int64(er.Info.UncompressedSize) {
+		err = io.ErrUnexpectedEOF
+	}
+	er.fail(err)
+	return n, err
+}
+
+// skip positions r at the offset last sought.
+func (er *EntryReader) skip() error {
+	if er.Info.CompressionMethod == zip.Store {
+		er.r = io.NopCloser(io.NewSectionReader(er.file, er.offset+er.seek, int64(er.Info.CompressedSize)-er.seek))
+		er.pos = er.seek
+		return nil
+	}
+	if er.r == nil || er.seek < er.pos || (er.zi.checkpointInterval > 0 && er.seek-er.pos >= er.zi.checkpointInterval) {
+		er.resume()
+	}
+	n, err := io.CopyN(io.Discard, &contextReader{ctx: er.ctx, r: er.r}, er.seek-er.pos)
+	er.pos += n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// fail records the first error reading failed with, other than the end of the data or ctx
+// being done.
+func (er *EntryReader) fail(err error) {
+	if err != nil && err != io.EOF && er.err == nil && er.ctx.Err() == nil {
+		er.err = err
+	}
+}
+
+func (er *EntryReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += er.seek
+	case io.SeekEnd:
+		offset += int64(er.Info.UncompressedSize)
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the entry")
+	}
+	er.seek = offset
+	return offset, nil
+}
+
+// Err returns the first error reading the data failed with, other than the end of the
+// data or ctx being done, for callers such as http.ServeContent that don't report them.
+func (er *EntryReader) Err() error {
+	return er.err
+}
+
+// Close closes the archive.
+func (er *EntryReader) Close() error {
+	if er.span != nil {
+		endSpan(er.span, er.err)
+	}
+	if er.r != nil {
+		er.r.Close()
+	}
+	return er.file.Close()
+}
@@ -0,0 +1,107 @@
+package zipfast
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntryReader(t *testing.T) {
+	tempDir := t.TempDir()
+	zipPath := filepath.Join(tempDir, "test.zip")
+	content := strings.Repeat("0123456789abcdef", 10_000)
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for _, header := range []zip.FileHeader{{Name: "stored.txt", Method: zip.Store}, {Name: "deflated.txt", Method: zip.Deflate}} {
+		w, err := zipWriter.CreateHeader(&header)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	_, err := zipWriter.Create("dir/")
+	require.NoError(t, err)
+	require.NoError(t, zipWriter.Close())
+	require.NoError(t, os.WriteFile(zipPath, buf.Bytes(), 0o644))
+
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+	ctx := context.Background()
+
+	for _, name := range []string{"stored.txt", "deflated.txt"} {
+		entry, err := reader.OpenEntry(ctx, zipPath, name)
+		require.NoError(t, err, name)
+		assert.Equal(t, uint64(len(content)), entry.Info.UncompressedSize, name)
+		assert.True(t, entry.Info.HasCRC32, name)
+
+		size, err := entry.Seek(0, io.SeekEnd)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(content)), size, name)
+		// Forward, backward and relative seeks, as ranges of a multipart response need
+		for _, offset := range []int64{150_000, 17, 159_990, 0} {
+			_, err = entry.Seek(offset, io.SeekStart)
+			require.NoError(t, err)
+			data := make([]byte, 10)
+			_, err = io.ReadFull(entry, data)
+			require.NoError(t, err, name)
+			assert.Equal(t, content[offset:offset+10], string(data), name)
+		}
+		pos, err := entry.Seek(5, io.SeekCurrent)
+		require.NoError(t, err)
+		assert.Equal(t, int64(15), pos)
+		rest, err := io.ReadAll(entry)
+		require.NoError(t, err)
+		assert.Equal(t, content[15:], string(rest), name)
+		_, err = entry.Seek(-1, io.SeekStart)
+		assert.Error(t, err)
+		assert.NoError(t, entry.Err())
+		require.NoError(t, entry.Close())
+	}
+
+	// Reading stops once the context is done, which Err doesn't report
+	canceled, cancel := context.WithCancel(ctx)
+	entry, err := reader.OpenEntry(canceled, zipPath, "deflated.txt")
+	require.NoError(t, err)
+	t.Cleanup(func() { entry.Close() })
+	cancel()
+	_, err = entry.Read(make([]byte, 10))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NoError(t, entry.Err())
+
+	_, err = reader.OpenEntry(ctx, zipPath, "dir/")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = reader.OpenEntry(ctx, zipPath, "missing.txt")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestEntryReaderTruncated(t *testing.T) {
+	tempDir := t.TempDir()
+	zipPath := filepath.Join(tempDir, "test.zip")
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	w, err := zipWriter.CreateRaw(&zip.FileHeader{Name: "short.txt", Method: zip.Store, CompressedSize64: 4, UncompressedSize64: 8})
+	require.NoError(t, err)
+	_, err = w.Write([]byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, zipWriter.Close())
+	require.NoError(t, os.WriteFile(zipPath, buf.Bytes(), 0o644))
+
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+	entry, err := reader.OpenEntry(context.Background(), zipPath, "short.txt")
+	require.NoError(t, err)
+	t.Cleanup(func() { entry.Close() })
+	data, err := io.ReadAll(entry)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, "data", string(data))
+	assert.ErrorIs(t, entry.Err(), io.ErrUnexpectedEOF)
+}
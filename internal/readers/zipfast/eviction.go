@@ -0,0 +1,217 @@
+package zipfast
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// accessFlushInterval is how long access times of cache hits are kept in memory before
+// they are written, in one transaction, rather than with a write per lookup.
+const accessFlushInterval = 30 * time.Second
+
+// pin marks an archive as in use until the returned function is called, so it isn't
+// evicted while it is indexed or its entries are read. An archive being evicted is pinned
+// once its index is gone, so it misses and is indexed again.
+func (zi *FastZipReader) pin(zipPath string) func() {
+	if zi.maxArchives == 0 {
+		return func() {}
+	}
+	zi.mu.Lock()
+	for done := zi.evicting[zipPath]; done != nil; done = zi.evicting[zipPath] {
+		zi.mu.Unlock()
+		<-done
+		zi.mu.Lock()
+	}
+	zi.pinned[zipPath]++
+	zi.mu.Unlock()
+	return func() {
+		zi.mu.Lock()
+		if zi.pinned[zipPath]--; zi.pinned[zipPath] == 0 {
+			delete(zi.pinned, zipPath)
+		}
+		zi.mu.Unlock()
+	}
+}
+
+// touch records a cache hit of an archive, writing the access times recorded so far
+// once accessFlushInterval has passed since they were last written.
+func (zi *FastZipReader) touch(zipID int) {
+	if zi.maxArchives == 0 {
+		return
+	}
+	now := time.Now()
+	zi.mu.Lock()
+	zi.touched[zipID] = now.UnixNano()
+	flush := now.Sub(zi.lastFlush) >= accessFlushInterval
+	zi.mu.Unlock()
+	if flush {
+		zi.flushAccesses()
+	}
+}
+
+// flushAccesses writes the recorded access times of cache hits.
+func (zi *FastZipReader) flushAccesses() {
+	zi.mu.Lock()
+	touched := zi.touched
+	zi.touched = make(map[int]int64)
+	zi.lastFlush = time.Now()
+	zi.mu.Unlock()
+	if len(touched) == 0 {
+		return
+	}
+	if err := zi.writeAccesses(touched); err != nil {
+		zi.logger.Warn("Failed to record archive access times", "error", err)
+	}
+}
+
+// writeAccesses records access times in a transaction of their own.
+func (zi *FastZipReader) writeAccesses(touched map[int]int64) error {
+	tx, err := zi.db.Begin()
+	if err != nil {
+		return zi.dbError(fmt.Errorf("failed to begin transaction: %w", err))
+	}
+	defer tx.Rollback()
+	if err := zi.recordAccesses(tx, touched); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return zi.dbError(fmt.Errorf("failed to commit transaction: %w", err))
+	}
+	return nil
+}
+
+// recordAccesses updates the access times of archives, in Unix nanoseconds, by index ID.
+func (zi *FastZipReader) recordAccesses(tx *sql.Tx, touched map[int]int64) error {
+	for zipID, accessed := range touched {
+		if _, err := tx.Exec("UPDATE lookup_zip_files SET last_accessed = ? WHERE id = ?", accessed, zipID); err != nil {
+			return zi.dbError(fmt.Errorf("failed to record access time: %w", err))
+		}
+	}
+	return nil
+}
+
+// evict removes the indexes of the least recently used archives beyond MaxArchives, leaving
+// pinned ones alone. zi.mu is only held to pick the archives, which are marked as being
+// evicted so that they can't be pinned until their index is gone; their next lookup then
+// misses and indexes them again. The pending access times are written along, and kept for
+// the next flush if that fails. It logs with ctx, that of the call that indexed an archive.
+func (zi *FastZipReader) evict(ctx context.Context) {
+	if zi.maxArchives == 0 {
+		return
+	}
+	zi.mu.Lock()
+	touched := zi.touched
+	zi.touched = make(map[int]int64)
+	zi.lastFlush = time.Now()
+	zi.mu.Unlock()
+
+	evicted, err := zi.evictArchives(touched)
+	if err != nil {
+		zi.mu.Lock()
+		for zipID, accessed := range touched {
+			if accessed > zi.touched[zipID] {
+				zi.touched[zipID] = accessed
+			}
+		}
+		zi.mu.Unlock()
+		zi.logger.WarnContext(ctx, "Failed to evict archive indexes", "error", err)
+		return
+	}
+	if evicted > 0 {
+		zi.observer.ArchivesEvicted(evicted)
+		zi.logger.InfoContext(ctx, "Evicted archive indexes", "archives", evicted, "max_archives", zi.maxArchives)
+	}
+}
+
+// evictionCandidate is an indexed archive, which eviction may remove.
+type evictionCandidate struct {
+	id   int
+	path string
+}
+
+// evictArchives records the pending access times and deletes the indexes of the least
+// recently used archives beyond MaxArchives in one transaction.
+func (zi *FastZipReader) evictArchives(touched map[int]int64) (int, error) {
+	tx, err := zi.db.Begin()
+	if err != nil {
+		return 0, zi.dbError(fmt.Errorf("failed to begin transaction: %w", err))
+	}
+	defer tx.Rollback()
+	if err := zi.recordAccesses(tx, touched); err != nil {
+		return 0, err
+	}
+
+	// Archives indexed before access times were recorded sort first
+	rows, err := tx.Query("SELECT id, zip_path FROM lookup_zip_files ORDER BY last_accessed, id")
+	if err != nil {
+		return 0, zi.dbError(fmt.Errorf("failed to list archives: %w", err))
+	}
+	var archives []evictionCandidate
+	for rows.Next() {
+		var a evictionCandidate
+		if err := rows.Scan(&a.id, &a.path); err != nil {
+			rows.Close()
+			return 0, zi.dbError(fmt.Errorf("failed to list archives: %w", err))
+		}
+		archives = append(archives, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, zi.dbError(fmt.Errorf("failed to list archives: %w", err))
+	}
+
+	victims, done := zi.markEvicting(archives)
+	defer zi.unmarkEvicting(victims, done)
+	for _, a := range victims {
+		if _, err := tx.Exec(deleteCheckpoints, a.id); err != nil {
+			return 0, zi.dbError(fmt.Errorf("failed to evict %s: %w", a.path, err))
+		}
+		if _, err := tx.Exec("DELETE FROM lookup_zip_contents WHERE zip_id = ?", a.id); err != nil {
+			return 0, zi.dbError(fmt.Errorf("failed to evict %s: %w", a.path, err))
+		}
+		if _, err := tx.Exec("DELETE FROM lookup_zip_files WHERE id = ?", a.id); err != nil {
+			return 0, zi.dbError(fmt.Errorf("failed to evict %s: %w", a.path, err))
+		}
+		zi.logger.Debug("Evicted archive index", "archive", a.path)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, zi.dbError(fmt.Errorf("failed to commit transaction: %w", err))
+	}
+	return len(victims), nil
+}
+
+// markEvicting picks the archives to evict beyond MaxArchives, least recently used first,
+// and marks them as being evicted until unmarkEvicting is called with the returned channel.
+// Archives pinned, resident or being evicted already are left alone, the latter counting
+// as evicted.
+func (zi *FastZipReader) markEvicting(archives []evictionCandidate) ([]evictionCandidate, chan struct{}) {
+	zi.mu.Lock()
+	defer zi.mu.Unlock()
+	done := make(chan struct{})
+	excess := len(archives) - zi.maxArchives - len(zi.evicting)
+	var victims []evictionCandidate
+	for _, a := range archives {
+		if len(victims) >= excess {
+			break
+		}
+		if zi.pinned[a.path] > 0 || zi.evicting[a.path] != nil || zi.isResident(a.path) {
+			continue
+		}
+		zi.evicting[a.path] = done
+		victims = append(victims, a)
+	}
+	return victims, done
+}
+
+// unmarkEvicting ends the eviction of the archives marked by markEvicting, letting those
+// waiting to pin them through.
+func (zi *FastZipReader) unmarkEvicting(victims []evictionCandidate, done chan struct{}) {
+	zi.mu.Lock()
+	for _, a := range victims {
+		delete(zi.evicting, a.path)
+	}
+	zi.mu.Unlock()
+	close(done)
+}
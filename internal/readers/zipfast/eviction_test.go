@@ -0,0 +1,145 @@
+package zipfast
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEviction(t *testing.T) {
+	const maxArchives = 10
+	tempDir := t.TempDir()
+	observer := &recordingObserver{}
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{Observer: observer, MaxArchives: maxArchives})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+
+	archives := make([]string, maxArchives+5)
+	for i := range archives {
+		archives[i] = filepath.Join(tempDir, fmt.Sprintf("archive%02d.zip", i))
+		require.NoError(t, createTestZipFile(archives[i], map[string]string{"index.html": fmt.Sprintf("archive %d", i)}))
+	}
+	indexed := func() []string {
+		rows, err := reader.db.Query("SELECT zip_path FROM lookup_zip_files ORDER BY zip_path")
+		require.NoError(t, err)
+		defer rows.Close()
+		var paths []string
+		for rows.Next() {
+			var path string
+			require.NoError(t, rows.Scan(&path))
+			paths = append(paths, path)
+		}
+		require.NoError(t, rows.Err())
+		return paths
+	}
+	read := func(zipPath string) string {
+		var output bytes.Buffer
+		require.NoError(t, reader.StreamFile(context.Background(), zipPath, "index.html", &output))
+		return output.String()
+	}
+
+	for i, zipPath := range archives[:maxArchives] {
+		assert.Equal(t, fmt.Sprintf("archive %d", i), read(zipPath))
+	}
+	// A hit keeps the first archive warm, even before its access time is written
+	read(archives[0])
+	// An archive in use isn't evicted, however cold
+	release := reader.pin(archives[1])
+	for _, zipPath := range archives[maxArchives:] {
+		read(zipPath)
+	}
+	release()
+
+	want := append([]string{archives[0], archives[1]}, archives[7:]...)
+	assert.Equal(t, want, indexed())
+	assert.Equal(t, 5, observer.evicted)
+	var entries int
+	require.NoError(t, reader.db.QueryRow("SELECT count(*) FROM lookup_zip_contents").Scan(&entries))
+	assert.Equal(t, maxArchives, entries)
+
+	// Evicted archives are indexed again when requested
+	misses := observer.misses
+	assert.Equal(t, "archive 2", read(archives[2]))
+	assert.Equal(t, misses+1, observer.misses)
+	assert.Len(t, indexed(), maxArchives)
+	assert.Contains(t, indexed(), archives[2])
+	assert.Empty(t, reader.pinned)
+}
+
+func TestEvictionDisabled(t *testing.T) {
+	tempDir := t.TempDir()
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+
+	for i := range 20 {
+		zipPath := filepath.Join(tempDir, fmt.Sprintf("archive%02d.zip", i))
+		require.NoError(t, createTestZipFile(zipPath, map[string]string{"a.txt": "a"}))
+		_, err := reader.Stat(context.Background(), zipPath, "a.txt")
+		require.NoError(t, err)
+	}
+	var archives int
+	require.NoError(t, reader.db.QueryRow("SELECT count(*) FROM lookup_zip_files").Scan(&archives))
+	assert.Equal(t, 20, archives)
+}
+
+func TestEvictionFailureKeepsAccessTimes(t *testing.T) {
+	tempDir := t.TempDir()
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{MaxArchives: 1})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+	ctx := context.Background()
+	first, second := filepath.Join(tempDir, "first.zip"), filepath.Join(tempDir, "second.zip")
+	require.NoError(t, createTestZipFile(first, map[string]string{"a.txt": "a"}))
+	require.NoError(t, createTestZipFile(second, map[string]string{"b.txt": "b"}))
+
+	_, err = reader.Stat(ctx, first, "a.txt")
+	require.NoError(t, err)
+	_, err = reader.Stat(ctx, first, "a.txt")
+	require.NoError(t, err)
+	require.Len(t, reader.touched, 1)
+	_, err = reader.db.Exec("DROP TABLE lookup_zip_checkpoints")
+	require.NoError(t, err)
+
+	// Indexing the second archive fails to evict the first, whose hit is still to be written
+	_, err = reader.Stat(ctx, second, "b.txt")
+	require.NoError(t, err)
+	assert.Len(t, reader.touched, 1)
+	assert.Empty(t, reader.evicting)
+	var archives int
+	require.NoError(t, reader.db.QueryRow("SELECT count(*) FROM lookup_zip_files").Scan(&archives))
+	assert.Equal(t, 2, archives)
+}
+
+func TestPinWaitsForEviction(t *testing.T) {
+	tempDir := t.TempDir()
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{MaxArchives: 1})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+	zipPath := filepath.Join(tempDir, "archive.zip")
+
+	victims, done := []evictionCandidate{{path: zipPath}}, make(chan struct{})
+	reader.mu.Lock()
+	reader.evicting[zipPath] = done
+	reader.mu.Unlock()
+	pinned := make(chan func())
+	go func() { pinned <- reader.pin(zipPath) }()
+	// Other archives are pinned meanwhile
+	reader.pin(filepath.Join(tempDir, "other.zip"))()
+
+	select {
+	case <-pinned:
+		t.Fatal("archive being evicted was pinned")
+	case <-time.After(50 * time.Millisecond):
+	}
+	reader.unmarkEvicting(victims, done)
+	release := <-pinned
+	assert.Equal(t, 1, reader.pinned[zipPath])
+	release()
+}
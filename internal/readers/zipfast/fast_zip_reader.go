@@ -2,22 +2,158 @@ package zipfast
 
 import (
 	"archive/zip"
-	"bytes"
 	"compress/flate"
+	"context"
 	"database/sql"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	_ "github.com/glebarez/go-sqlite"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
 	"io"
+	"log/slog"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrNotFound is returned when a requested entry does not exist in the archive index.
+var ErrNotFound = errors.New("entry not found in archive")
+
+// ErrAmbiguous is returned by Resolve for names matching several entries once case is
+// ignored.
+var ErrAmbiguous = errors.New("name matches several entries")
+
+// DatabaseName is the file name of the archive index in a cache directory.
+const DatabaseName = ".zip_reader_cache.db"
+
+// ErrNotGzippable is returned by StreamGzip for entries that can't be sent as gzip as they are.
+var ErrNotGzippable = errors.New("entry can't be streamed as gzip")
+
 type FastZipReader struct {
-	db *sql.DB
+	db           *sql.DB
+	logger       *slog.Logger
+	observer     Observer
+	maxArchives  int
+	nameEncoding encoding.Encoding
+	tracer       trace.Tracer
+	validate     Validation
+	limits       limits
+	// checkpointInterval is the output between checkpoints of deflated entries, zero if
+	// none are recorded.
+	checkpointInterval int64
+
+	// indexLock is held for reading between looking an archive up and reading its index,
+	// and for writing by Invalidate.
+	indexLock sync.RWMutex
+	// indexing serializes indexing, so concurrent misses of an archive index it once.
+	indexing sync.Mutex
+	// mu guards the usage of archives, for eviction.
+	mu sync.Mutex
+	// pinned counts the operations using each archive, which eviction leaves alone.
+	pinned map[string]int
+	// evicting holds the archives whose indexes are being deleted, with a channel closed
+	// once they are, which pinning them waits for.
+	evicting map[string]chan struct{}
+	// touched holds the access times of cache hits not yet written to the database.
+	touched   map[int]int64
+	lastFlush time.Time
+
+	// residentMu guards resident, the archives kept in memory by KeepResident, with a nil
+	// index until it is loaded, and residentGeneration, which changes whenever one is
+	// dropped so that loads racing with it aren't kept.
+	residentMu         sync.RWMutex
+	resident           map[string]*residentArchive
+	residentGeneration uint64
+
+	// hits and misses count archive lookups, and open the archive files currently open,
+	// for Stats.
+	hits   atomic.Int64
+	misses atomic.Int64
+	open   atomic.Int64
+}
+
+// Options holds the optional settings of a FastZipReader.
+type Options struct {
+	// Logger receives indexing and lookup events. Defaults to slog.Default().
+	Logger *slog.Logger
+	// Observer is notified of indexing, lookups and database errors, e.g. to export metrics.
+	Observer Observer
+	// MaxArchives bounds the number of indexed archives. Indexing one more evicts the
+	// indexes of the least recently used archives, which get indexed again when they are
+	// next requested. Zero means no limit.
+	MaxArchives int
+	// NameEncoding decodes the names of entries lacking the UTF-8 flag, which are indexed
+	// under their UTF-8 name. Defaults to CP437, see ParseNameEncoding.
+	NameEncoding encoding.Encoding
+	// Tracer traces indexing, lookups and reading entries, in spans that are children of
+	// those in the contexts of calls. Nil turns tracing off.
+	Tracer trace.Tracer
+	// Validation decides how lookups check that archives haven't changed since they were
+	// indexed. Defaults to ValidateStat.
+	Validation Validation
+	// CheckpointInterval is how much decompressed data of deflated entries separates the
+	// checkpoints recorded while seeking into them, from which later reads resume instead
+	// of decompressing from the start. Each takes 32 KiB in the database. Zero records
+	// none.
+	CheckpointInterval int64
+	// Limits bound the archives indexed, rejecting those beyond them. Zero fields mean
+	// their defaults.
+	Limits Limits
+}
+
+// Observer receives events from a FastZipReader.
+type Observer interface {
+	// ArchiveIndexed is called after an archive has been (re)indexed.
+	ArchiveIndexed(entries int, duration time.Duration)
+	// IndexLookup is called on every archive lookup, reporting whether its index was cached.
+	IndexLookup(hit bool)
+	// DatabaseError is called when an operation on the index database fails.
+	DatabaseError(err error)
+	// ArchivesEvicted is called after the indexes of archives were evicted to stay within
+	// MaxArchives.
+	ArchivesEvicted(count int)
+}
+
+type noopObserver struct{}
+
+func (noopObserver) ArchiveIndexed(int, time.Duration) {}
+func (noopObserver) IndexLookup(bool)                  {}
+func (noopObserver) DatabaseError(error)               {}
+func (noopObserver) ArchivesEvicted(int)               {}
+
+// FileInfo describes a file entry inside an archive.
+type FileInfo struct {
+	Name              string
+	CompressedSize    uint64
+	UncompressedSize  uint64
+	CompressionMethod uint16
+	// CRC32 is the checksum of the uncompressed data, if HasCRC32. Archives indexed
+	// before checksums were recorded lack it until they are reindexed.
+	CRC32    uint32
+	HasCRC32 bool
+	// Modified is the modification time of the entry, or zero if the archive doesn't
+	// record one or was indexed before they were.
+	Modified time.Time
+}
+
+// DirEntry describes an immediate child of a directory inside an archive.
+type DirEntry struct {
+	Name  string
+	IsDir bool
+	Size  uint64
+	// Modified is the modification time of files, if recorded.
+	Modified time.Time
 }
 
 // NewFastZipReader Initialize the database and tables if needed.
-func NewFastZipReader(dbPath string) (*FastZipReader, error) {
+func NewFastZipReader(dbPath string, options Options) (*FastZipReader, error) {
 	db, err := sql.Open("sqlite", dbPath)
 	if err != nil {
 		return nil, err
@@ -28,23 +164,70 @@ func NewFastZipReader(dbPath string) (*FastZipReader, error) {
 		return nil, err
 	}
 
-	return &FastZipReader{db: db}, nil
+	logger := options.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	observer := options.Observer
+	if observer == nil {
+		observer = noopObserver{}
+	}
+	nameEncoding := options.NameEncoding
+	if nameEncoding == nil {
+		nameEncoding = charmap.CodePage437
+	}
+	return &FastZipReader{
+		db:                 db,
+		logger:             logger,
+		observer:           observer,
+		maxArchives:        options.MaxArchives,
+		nameEncoding:       nameEncoding,
+		tracer:             options.Tracer,
+		validate:           options.Validation,
+		limits:             newLimits(options.Limits),
+		checkpointInterval: options.CheckpointInterval,
+		pinned:             make(map[string]int),
+		evicting:           make(map[string]chan struct{}),
+		touched:            make(map[int]int64),
+		lastFlush:          time.Now(),
+		resident:           make(map[string]*residentArchive),
+	}, nil
 }
 
-// Close the database connection.
+// Close the database connection, after recording pending access times.
 func (zi *FastZipReader) Close() error {
+	zi.flushAccesses()
 	return zi.db.Close()
 }
 
+// dbError reports a failed database operation to the observer and returns err. Operations
+// given up on because their context is done aren't failures of the database.
+func (zi *FastZipReader) dbError(err error) error {
+	if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		zi.observer.DatabaseError(err)
+	}
+	return err
+}
+
 // Initialize database tables.
 func initDB(db *sql.DB) error {
+	// Pages of 16 KiB, four times the default, split less often while indexing, without
+	// slowing lookups down. Databases created with smaller pages keep them
 	query := `
+	PRAGMA page_size = 16384;
+
 	CREATE TABLE IF NOT EXISTS lookup_zip_files (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		zip_path TEXT UNIQUE NOT NULL,
 		size INTEGER NOT NULL,
 		modification_time INTEGER NOT NULL,
-		indexed_at DATETIME NOT NULL
+		modification_time_ns INTEGER,
+		fingerprint BLOB,
+		indexed_at DATETIME NOT NULL,
+		index_duration_ns INTEGER,
+		last_accessed INTEGER,
+		rejected TEXT,
+		rejected_limits TEXT
 	);
 
 	CREATE TABLE IF NOT EXISTS lookup_zip_contents (
@@ -55,148 +238,724 @@ func initDB(db *sql.DB) error {
 		compressed_size INTEGER NOT NULL,
 		uncompressed_size INTEGER NOT NULL,
 		compression_method INTEGER NOT NULL,
+		crc32 INTEGER,
+		modified INTEGER,
+		raw_name BLOB,
+		sha256 BLOB,
 		FOREIGN KEY(zip_id) REFERENCES lookup_zip_files(id),
 		UNIQUE(zip_id, file_name)
 	);
+
+	CREATE TABLE IF NOT EXISTS lookup_zip_checkpoints (
+		entry_id INTEGER NOT NULL,
+		output_offset INTEGER NOT NULL,
+		input_offset INTEGER NOT NULL,
+		dictionary BLOB NOT NULL,
+		FOREIGN KEY(entry_id) REFERENCES lookup_zip_contents(id),
+		PRIMARY KEY(entry_id, output_offset)
+	);
+
+	CREATE TABLE IF NOT EXISTS lookup_file_digests (
+		path TEXT PRIMARY KEY,
+		size INTEGER NOT NULL,
+		modification_time_ns INTEGER NOT NULL,
+		sha256 BLOB NOT NULL
+	);
 	`
-	_, err := db.Exec(query)
+	if _, err := db.Exec(query); err != nil {
+		return err
+	}
+
+	// Indexes created before checksums, modification times, access times, raw names,
+	// fingerprints, indexing durations, digests and rejections were recorded get the
+	// columns, left empty
+	for _, column := range []struct{ table, name, kind string }{
+		{"lookup_zip_contents", "crc32", "INTEGER"},
+		{"lookup_zip_contents", "modified", "INTEGER"},
+		{"lookup_zip_files", "last_accessed", "INTEGER"},
+		{"lookup_zip_contents", "raw_name", "BLOB"},
+		{"lookup_zip_files", "modification_time_ns", "INTEGER"},
+		{"lookup_zip_files", "fingerprint", "BLOB"},
+		{"lookup_zip_files", "index_duration_ns", "INTEGER"},
+		{"lookup_zip_contents", "sha256", "BLOB"},
+		{"lookup_zip_files", "rejected", "TEXT"},
+		{"lookup_zip_files", "rejected_limits", "TEXT"},
+	} {
+		var exists bool
+		if err := db.QueryRow("SELECT count(*) > 0 FROM pragma_table_info(?) WHERE name = ?", column.table, column.name).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			if _, err := db.Exec("ALTER TABLE " + column.table + " ADD COLUMN " + column.name + " " + column.kind); err != nil {
+				return err
+			}
+		}
+	}
+	// Case-insensitive lookups by Resolve
+	_, err := db.Exec("CREATE INDEX IF NOT EXISTS lookup_zip_contents_nocase ON lookup_zip_contents (zip_id, file_name COLLATE NOCASE)")
+	return err
+}
+
+// Indexes a ZIP file, reindexing if it has changed, as checked by the validation of ctx.
+func (zi *FastZipReader) indexZip(ctx context.Context, zipPath string) error {
+	_, err := zi.indexIfChanged(ctx, zipPath, zi.validation(ctx))
 	return err
 }
 
-// Indexes a ZIP file, reindexing if it has changed.
-func (zi *FastZipReader) indexZip(zipPath string) error {
+// indexIfChanged indexes a ZIP file that isn't indexed, or that changed as checked by v,
+// reporting whether it was indexed.
+func (zi *FastZipReader) indexIfChanged(ctx context.Context, zipPath string, v Validation) (bool, error) {
+	zi.indexing.Lock()
+	defer zi.indexing.Unlock()
 	fileInfo, err := os.Stat(zipPath)
 	if err != nil {
-		return fmt.Errorf("failed to get file info: %w", err)
+		return false, fmt.Errorf("failed to get file info: %w", err)
 	}
 
-	var zipID int
-	var existingSize int64
-	var existingModTime int64
-	row := zi.db.QueryRow("SELECT id, size, modification_time FROM lookup_zip_files WHERE zip_path = ?", zipPath)
-	err = row.Scan(&zipID, &existingSize, &existingModTime)
-	if err == nil && (existingSize != fileInfo.Size() || existingModTime != fileInfo.ModTime().Unix()) {
-		// File changed, reindex
-		_, _ = zi.db.Exec("DELETE FROM lookup_zip_contents WHERE zip_id = ?", zipID)
-		_, _ = zi.db.Exec("DELETE FROM lookup_zip_files WHERE id = ?", zipID)
-	} else if err == nil {
-		// File unchanged, skip indexing
-		return nil
+	var state archiveState
+	err = state.scan(zi.db.QueryRowContext(ctx, selectArchiveState, zipPath))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return false, zi.dbError(fmt.Errorf("failed to look up archive %s: %w", zipPath, err))
+	default:
+		changed, err := state.changed(zipPath, fileInfo, v)
+		if err != nil {
+			return false, err
+		}
+		retry, rejected := state.rejection(zipPath, zi.limits)
+		switch {
+		case changed:
+			zi.logger.DebugContext(ctx, "Archive changed, reindexing", "archive", zipPath)
+		case retry:
+			zi.logger.DebugContext(ctx, "Archive rejected under other limits, reindexing", "archive", zipPath)
+		default:
+			// Unchanged, or indexed meanwhile
+			return false, rejected
+		}
 	}
 
-	return zi.indexZipFile(zipPath, fileInfo)
+	if _, err := zi.indexZipFile(ctx, zipPath, fileInfo, state.id); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-// Internal function to index a ZIP file.
-func (zi *FastZipReader) indexZipFile(zipPath string, fileInfo os.FileInfo) error {
-	file, err := os.Open(zipPath)
+// Internal function to index a ZIP file, returning its number of entries. A stale index
+// staleID, if not zero, is replaced in place, under the same ID. Everything happens in one
+// transaction, rolled back if ctx is done before it commits, so an archive is either fully
+// indexed or left as it was, and operations that looked up its ID find either index.
+func (zi *FastZipReader) indexZipFile(ctx context.Context, zipPath string, fileInfo os.FileInfo, staleID int) (entries int, err error) {
+	ctx, span := zi.startSpan(ctx, "archive.index")
+	defer func() { endSpan(span, err) }()
+	if span.IsRecording() {
+		span.SetAttributes(AttrArchive.String(zipPath), AttrArchiveSize.Int64(fileInfo.Size()))
+	}
+	start := time.Now()
+	zi.logger.DebugContext(ctx, "Indexing archive", "archive", zipPath, "size", fileInfo.Size())
+
+	file, err := zi.openArchive(zipPath)
 	if err != nil {
-		return fmt.Errorf("failed to open ZIP file: %w", err)
+		return 0, fmt.Errorf("failed to open ZIP file: %w", err)
 	}
 	defer file.Close()
 
-	zipReader, err := zip.NewReader(file, fileInfo.Size())
+	sum, err := fingerprint(file, fileInfo.Size())
+	if err != nil {
+		return 0, err
+	}
+	files, refused, reason, err := zi.limits.archiveFiles(file, fileInfo.Size(), zi.nameEncoding.NewDecoder())
+	if err != nil {
+		return 0, fmt.Errorf("failed to create ZIP reader: %w", err)
+	}
+	if reason != "" {
+		return 0, zi.reject(ctx, zipPath, fileInfo, staleID, sum, reason)
+	}
+	if len(refused) > 0 {
+		zi.logger.WarnContext(ctx, "Left archive entries beyond limits out of the index", "archive", zipPath, "entries", len(refused), "first", refused[0].name, "reason", refused[0].reason)
+	}
+	offsets, err := dataOffsets(ctx, files)
 	if err != nil {
-		return fmt.Errorf("failed to create ZIP reader: %w", err)
+		return 0, err
 	}
 
-	tx, err := zi.db.Begin()
+	tx, err := zi.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+		return 0, zi.txError(ctx, fmt.Errorf("failed to begin transaction: %w", err))
 	}
 	defer tx.Rollback()
 
-	result, err := tx.Exec(
-		"INSERT INTO lookup_zip_files (zip_path, size, modification_time, indexed_at) VALUES (?, ?, ?, ?)",
-		zipPath, fileInfo.Size(), fileInfo.ModTime().Unix(), time.Now().Format(time.RFC3339),
-	)
-	if err != nil {
-		return fmt.Errorf("failed to insert ZIP file metadata: %w", err)
+	now := time.Now()
+	zipID := int64(staleID)
+	if staleID != 0 {
+		if _, err := tx.ExecContext(ctx, deleteCheckpoints, staleID); err != nil {
+			return 0, zi.txError(ctx, fmt.Errorf("failed to delete stale index: %w", err))
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM lookup_zip_contents WHERE zip_id = ?", staleID); err != nil {
+			return 0, zi.txError(ctx, fmt.Errorf("failed to delete stale index: %w", err))
+		}
+		_, err = tx.ExecContext(ctx,
+			"UPDATE lookup_zip_files SET size = ?, modification_time = ?, modification_time_ns = ?, fingerprint = ?, indexed_at = ?, last_accessed = ?, rejected = NULL, rejected_limits = NULL WHERE id = ?",
+			fileInfo.Size(), fileInfo.ModTime().Unix(), fileInfo.ModTime().UnixNano(), sum, now.Format(time.RFC3339), now.UnixNano(), staleID,
+		)
+		if err != nil {
+			return 0, zi.txError(ctx, fmt.Errorf("failed to update ZIP file metadata: %w", err))
+		}
+	} else {
+		result, err := tx.ExecContext(ctx,
+			"INSERT INTO lookup_zip_files (zip_path, size, modification_time, modification_time_ns, fingerprint, indexed_at, last_accessed) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			zipPath, fileInfo.Size(), fileInfo.ModTime().Unix(), fileInfo.ModTime().UnixNano(), sum, now.Format(time.RFC3339), now.UnixNano(),
+		)
+		if err != nil {
+			return 0, zi.txError(ctx, fmt.Errorf("failed to insert ZIP file metadata: %w", err))
+		}
+		zipID, err = result.LastInsertId()
+		if err != nil {
+			return 0, zi.txError(ctx, fmt.Errorf("failed to get last insert ID: %w", err))
+		}
 	}
 
-	zipID, err := result.LastInsertId()
-	if err != nil {
-		return fmt.Errorf("failed to get last insert ID: %w", err)
+	// Entries are inserted in batches, as every statement is parsed anew, and by name,
+	// which appends to the indexes on names rather than splitting their pages
+	var records, names []byte
+	for from := 0; from < len(files); from += indexBatchSize {
+		// The deferred rollback undoes the entries inserted so far
+		if err := ctx.Err(); err != nil {
+			return 0, fmt.Errorf("indexing interrupted: %w", err)
+		}
+		records, names = records[:0], names[:0]
+		batch := files[from:min(from+indexBatchSize, len(files))]
+		for i, f := range batch {
+			records, names = appendEntry(records, names, f, offsets[from+i])
+		}
+		if _, err := tx.ExecContext(ctx, insertEntriesQuery, zipID, len(batch), records, names); err != nil {
+			return 0, zi.txError(ctx, fmt.Errorf("failed to insert records: %w", err))
+		}
 	}
 
-	stmt, err := tx.Prepare("INSERT INTO lookup_zip_contents (zip_id, file_name, offset, compressed_size, uncompressed_size, compression_method) VALUES (?, ?, ?, ?, ?, ?)")
-	if err != nil {
-		return fmt.Errorf("failed to prepare statement: %w", err)
+	// Committing is left out of the recorded duration, which is written in the transaction
+	if _, err := tx.ExecContext(ctx, "UPDATE lookup_zip_files SET index_duration_ns = ? WHERE id = ?", time.Since(start).Nanoseconds(), zipID); err != nil {
+		return 0, zi.txError(ctx, fmt.Errorf("failed to update ZIP file metadata: %w", err))
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, zi.txError(ctx, fmt.Errorf("failed to commit transaction: %w", err))
 	}
-	defer stmt.Close()
+	zi.forgetResident(zipPath)
+	duration := time.Since(start)
+	zi.observer.ArchiveIndexed(len(files), duration)
+	if span.IsRecording() {
+		span.SetAttributes(AttrArchiveEntries.Int(len(files)))
+	}
+	zi.logger.DebugContext(ctx, "Indexed archive", "archive", zipPath, "entries", len(files), "duration", duration)
+	return len(files), nil
+}
 
-	for _, f := range zipReader.File {
-		offset, err := f.DataOffset()
-		if err != nil {
-			return fmt.Errorf("failed to get data offset for %s: %w", f.Name, err)
+// indexBatchSize is the number of entries inserted per statement while indexing.
+const indexBatchSize = 1000
+
+// entryFields are the widths of the fields of the record appendEntry writes for an entry:
+// the position and length of its name among the names of the batch, its data offset,
+// sizes, compression method, checksum and modification time, and the length of the name
+// it is stored under if it was decoded, which follows its name. Fields are decimal numbers
+// padded with spaces, and the modification time is left blank when unknown.
+var entryFields = [...]int{10, 10, 20, 20, 20, 5, 10, 20, 10}
+
+// modifiedField is the field of entryFields holding the modification time.
+const modifiedField = 7
+
+// insertEntriesQuery inserts a batch of entries of an archive, given its ID, the number of
+// entries, their appendEntry records and the names the records point into. Rows are
+// counted by a recursive query and their fields cut out of the records by position, which
+// takes SQLite much less than decoding them from JSON, and names are copied as bytes,
+// whether valid UTF-8 or not.
+var insertEntriesQuery = func() string {
+	size := 0
+	for _, width := range entryFields {
+		size += width
+	}
+	var fields [len(entryFields)]string
+	position := 1
+	for i, width := range entryFields {
+		fields[i] = fmt.Sprintf("substr(?3, i * %d + %d, %d)", size, position, width)
+		if i == modifiedField {
+			fields[i] = fmt.Sprintf("nullif(%s, x'%s')", fields[i], strings.Repeat("20", width))
 		}
+		fields[i] = "CAST(" + fields[i] + " AS INTEGER)"
+		position += width
+	}
+	return fmt.Sprintf(`WITH RECURSIVE entries(i) AS (SELECT 0 UNION ALL SELECT i + 1 FROM entries WHERE i + 1 < ?2)
+	INSERT INTO lookup_zip_contents (zip_id, file_name, offset, compressed_size, uncompressed_size, compression_method, crc32, modified, raw_name)
+	SELECT ?1, CAST(substr(?4, %[1]s + 1, %[2]s) AS TEXT), %[3]s, %[4]s, %[5]s, %[6]s, %[7]s, %[8]s, nullif(substr(?4, %[1]s + %[2]s + 1, %[9]s), x'') FROM entries`,
+		fields[0], fields[1], fields[2], fields[3], fields[4], fields[5], fields[6], fields[7], fields[8])
+}()
+
+// offsetWorkers is the number of goroutines reading the local headers of entries for
+// their data offsets, each a read of its own.
+const offsetWorkers = 4
 
-		_, err = stmt.Exec(zipID, f.Name, offset, f.CompressedSize64, f.UncompressedSize64, f.Method)
+// dataOffsets returns the data offsets of entries, reading them indexBatchSize at a time
+// with offsetWorkers goroutines. Errors are reported for the first entry failing, however
+// the reads were scheduled.
+func dataOffsets(ctx context.Context, files []archiveEntry) ([]int64, error) {
+	offsets := make([]int64, len(files))
+	errs := make([]error, (len(files)+indexBatchSize-1)/indexBatchSize)
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range min(offsetWorkers, len(errs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				chunk := int(next.Add(1) - 1)
+				if chunk >= len(errs) {
+					return
+				}
+				for i := chunk * indexBatchSize; i < min((chunk+1)*indexBatchSize, len(files)); i++ {
+					offset, err := files[i].file.DataOffset()
+					if err != nil {
+						errs[chunk] = fmt.Errorf("failed to get data offset for %s: %w", files[i].name, err)
+						break
+					}
+					offsets[i] = offset
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("indexing interrupted: %w", err)
+	}
+	for _, err := range errs {
 		if err != nil {
-			return fmt.Errorf("failed to insert record for %s: %w", f.Name, err)
+			return nil, err
 		}
 	}
+	return offsets, nil
+}
 
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+// appendEntry appends the record of an entry for insertEntriesQuery to records, and its
+// name to names, followed by the name it is stored under if it was decoded.
+func appendEntry(records, names []byte, entry archiveEntry, offset int64) ([]byte, []byte) {
+	f := entry.file
+	var rawName string
+	if entry.name != f.Name {
+		rawName = f.Name
+	}
+	values := [len(entryFields)]int64{
+		int64(len(names)), int64(len(entry.name)), offset, int64(f.CompressedSize64), int64(f.UncompressedSize64),
+		int64(f.Method), int64(f.CRC32), f.Modified.Unix(), int64(len(rawName)),
+	}
+	for i, width := range entryFields {
+		records = append(records, "                    "[:width]...)
+		if i == modifiedField && f.Modified.IsZero() {
+			continue
+		}
+		var digits [20]byte
+		number := strconv.AppendInt(digits[:0], values[i], 10)
+		copy(records[len(records)-len(number):], number)
 	}
-	return nil
+	names = append(names, entry.name...)
+	return records, append(names, rawName...)
 }
 
-// StreamFile Streams a file from the ZIP archive. The archive gets indexed automatically.
-func (zi *FastZipReader) StreamFile(zipPath, filename string, writer io.Writer) error {
-	var zipID int
-	var row *sql.Row
-	row = zi.db.QueryRow("SELECT id FROM lookup_zip_files WHERE zip_path = ?", zipPath)
-	if err := row.Scan(&zipID); err != nil {
-		err = zi.indexZip(zipPath)
+// txError reports a failed operation of the indexing transaction, unless it failed because
+// ctx is done, which rolls the transaction back.
+func (zi *FastZipReader) txError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("indexing interrupted: %w", ctxErr)
+	}
+	return zi.dbError(err)
+}
+
+// lookup returns the index ID of the archive like lookupZipID, along with a function to
+// call once done reading its index. Until then, Invalidate can't remove the index.
+func (zi *FastZipReader) lookup(ctx context.Context, zipPath string) (int, func(), error) {
+	zi.indexLock.RLock()
+	zipID, err := zi.lookupZipID(ctx, zipPath)
+	if err != nil {
+		zi.indexLock.RUnlock()
+		return 0, nil, err
+	}
+	return zipID, zi.indexLock.RUnlock, nil
+}
+
+// lookupZipID Returns the index ID of the archive, indexing it first if needed, or again if
+// its validation finds it changed.
+func (zi *FastZipReader) lookupZipID(ctx context.Context, zipPath string) (zipID int, err error) {
+	ctx, span := zi.startSpan(ctx, "archive.lookup")
+	defer func() { endSpan(span, err) }()
+	var state archiveState
+	hit := state.scan(zi.db.QueryRowContext(ctx, selectArchiveState, zipPath)) == nil
+	if v := zi.validation(ctx); hit && v != ValidateNone {
+		fileInfo, err := os.Stat(zipPath)
 		if err != nil {
-			return err
+			return 0, fmt.Errorf("failed to get file info: %w", err)
+		}
+		changed, err := state.changed(zipPath, fileInfo, v)
+		if err != nil {
+			return 0, err
+		}
+		hit = !changed
+	}
+	retry, rejected := state.rejection(zipPath, zi.limits)
+	if !hit || retry {
+		zi.misses.Add(1)
+		zi.observer.IndexLookup(false)
+		if span.IsRecording() {
+			span.SetAttributes(AttrArchive.String(zipPath), AttrIndexHit.Bool(false))
 		}
-		row = zi.db.QueryRow("SELECT id FROM lookup_zip_files WHERE zip_path = ?", zipPath)
+		zi.logger.DebugContext(ctx, "Archive index cache miss", "archive", zipPath)
+		err = zi.indexZip(ctx, zipPath)
+		if err != nil {
+			return 0, err
+		}
+		row := zi.db.QueryRowContext(ctx, "SELECT id FROM lookup_zip_files WHERE zip_path = ?", zipPath)
 		if err := row.Scan(&zipID); err != nil {
-			return fmt.Errorf("database error for file %s", filename)
+			return 0, zi.dbError(fmt.Errorf("database error for archive %s: %w", zipPath, err))
+		}
+		zi.evict(ctx)
+	} else {
+		zi.hits.Add(1)
+		zi.observer.IndexLookup(true)
+		if span.IsRecording() {
+			span.SetAttributes(AttrArchive.String(zipPath), AttrIndexHit.Bool(true))
+		}
+		zi.logger.DebugContext(ctx, "Archive index cache hit", "archive", zipPath)
+		zipID = state.id
+		zi.touch(zipID)
+		if rejected != nil {
+			return 0, rejected
 		}
 	}
+	return zipID, nil
+}
 
-	var metadata struct {
-		Offset            int64
-		CompressedSize    uint64
-		UncompressedSize  uint64
-		CompressionMethod uint16
+// Stat Returns the metadata of a file inside the ZIP archive. The archive gets indexed automatically.
+// Directory entries, whose names end in a slash, aren't files and aren't found.
+func (zi *FastZipReader) Stat(ctx context.Context, zipPath, filename string) (FileInfo, error) {
+	defer zi.pin(zipPath)()
+	entry, err := zi.findEntry(ctx, zipPath, filename)
+	if err != nil {
+		return FileInfo{}, err
 	}
+	return entry.info, nil
+}
+
+// fileEntry is what the index records of a file entry.
+type fileEntry struct {
+	id     int
+	offset int64
+	info   FileInfo
+}
+
+// selectEntry reads the fileEntry of an entry by archive ID and name.
+const selectEntry = "SELECT id, offset, compressed_size, uncompressed_size, compression_method, crc32, modified FROM lookup_zip_contents WHERE zip_id = ? AND file_name = ?"
+
+// findEntry looks up a file entry of an archive, indexing the archive if needed. Resident
+// archives are looked up in memory, others in the index.
+func (zi *FastZipReader) findEntry(ctx context.Context, zipPath, filename string) (fileEntry, error) {
+	if isDirEntry(filename) {
+		return fileEntry{}, fmt.Errorf("file %s: %w", filename, ErrNotFound)
+	}
+	resident, err := zi.residentIndex(ctx, zipPath)
+	if err != nil {
+		return fileEntry{}, err
+	}
+	if resident != nil {
+		entry, ok := resident.entries[filename]
+		if !ok {
+			return fileEntry{}, fmt.Errorf("file %s: %w", filename, ErrNotFound)
+		}
+		return entry, nil
+	}
+
+	zipID, done, err := zi.lookup(ctx, zipPath)
+	if err != nil {
+		return fileEntry{}, err
+	}
+	_, span := zi.startSpan(ctx, "archive.entry.lookup")
+	entry := fileEntry{info: FileInfo{Name: filename}}
+	var crc, modified sql.NullInt64
+	err = zi.db.QueryRowContext(ctx, selectEntry, zipID, filename).Scan(&entry.id, &entry.offset, &entry.info.CompressedSize, &entry.info.UncompressedSize, &entry.info.CompressionMethod, &crc, &modified)
+	done()
+	endEntryLookup(span, zipPath, entry.info, err)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fileEntry{}, fmt.Errorf("file %s: %w", filename, ErrNotFound)
+		}
+		return fileEntry{}, zi.dbError(fmt.Errorf("failed to look up file %s: %w", filename, err))
+	}
+	entry.info.CRC32, entry.info.HasCRC32 = uint32(crc.Int64), crc.Valid
+	entry.info.Modified = modifiedTime(modified)
+	return entry, nil
+}
+
+// modifiedTime converts a recorded modification time, in Unix seconds.
+func modifiedTime(modified sql.NullInt64) time.Time {
+	if !modified.Valid {
+		return time.Time{}
+	}
+	return time.Unix(modified.Int64, 0)
+}
 
-	err := zi.db.QueryRow("SELECT offset, compressed_size, uncompressed_size, compression_method FROM lookup_zip_contents WHERE zip_id = ? AND file_name = ?", zipID, filename).Scan(&metadata.Offset, &metadata.CompressedSize, &metadata.UncompressedSize, &metadata.CompressionMethod)
+// StreamFile Streams a file from the ZIP archive. The archive gets indexed automatically.
+// Streaming stops with the error of ctx once it is done, such as when the client goes away,
+// and with an error at the declared size of entries whose data goes on.
+func (zi *FastZipReader) StreamFile(ctx context.Context, zipPath, filename string, writer io.Writer) error {
+	defer zi.pin(zipPath)()
+	entry, err := zi.findEntry(ctx, zipPath, filename)
 	if err != nil {
-		return fmt.Errorf("file %s not found in index: %w", filename, err)
+		return err
 	}
 
-	file, err := os.Open(zipPath)
+	file, err := zi.openArchive(zipPath)
 	if err != nil {
 		return fmt.Errorf("failed to open ZIP file: %w", err)
 	}
 	defer file.Close()
 
-	compressedData := make([]byte, metadata.CompressedSize)
-	_, err = file.Seek(metadata.Offset, 0)
+	// Stream the entry in chunks rather than buffering it, so large entries don't sit in memory
+	r, err := entryReader(file, entry.offset, entry.info.CompressedSize, entry.info.CompressionMethod)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, span := zi.startSpan(ctx, "archive.entry.copy")
+	// Writing stops at the declared size, however much data follows
+	_, err = io.Copy(writer, &contextReader{ctx: ctx, r: io.LimitReader(r, int64(entry.info.UncompressedSize))})
+	if err == nil {
+		if n, _ := r.Read(make([]byte, 1)); n > 0 {
+			err = fmt.Errorf("file %s: data longer than its declared size %d", filename, entry.info.UncompressedSize)
+		}
+	}
+	endSpan(span, err)
+	return err
+}
+
+// entryReader decompresses the data of an entry stored at offset in an archive.
+func entryReader(file io.ReaderAt, offset int64, compressedSize uint64, method uint16) (io.ReadCloser, error) {
+	compressedData := io.NewSectionReader(file, offset, int64(compressedSize))
+	switch method {
+	case zip.Store:
+		return io.NopCloser(compressedData), nil
+	case zip.Deflate:
+		return flate.NewReader(compressedData), nil
+	}
+	return nil, fmt.Errorf("unsupported compression method: %d", method)
+}
+
+// Gzippable reports whether StreamGzip can send the entry.
+func (info FileInfo) Gzippable() bool {
+	return info.CompressionMethod == zip.Deflate && info.HasCRC32
+}
+
+// GzipSize returns the size of the gzip stream StreamGzip writes for the entry.
+func (info FileInfo) GzipSize() int64 {
+	return int64(len(gzipHeader)) + int64(info.CompressedSize) + 8
+}
+
+// gzipHeader is a minimal gzip member header: deflate, no flags, no modification time,
+// unknown OS. The entry's deflate stream follows it unchanged.
+var gzipHeader = []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255}
+
+// StreamGzip streams a Deflate entry as a gzip stream, copying the compressed data as it
+// is stored rather than decompressing it. It fails with ErrNotGzippable for entries with
+// another compression method or without a recorded checksum.
+func (zi *FastZipReader) StreamGzip(ctx context.Context, zipPath, filename string, writer io.Writer) error {
+	defer zi.pin(zipPath)()
+	entry, err := zi.findEntry(ctx, zipPath, filename)
 	if err != nil {
-		return fmt.Errorf("failed to seek to file offset: %w", err)
+		return err
+	}
+	if !entry.info.Gzippable() {
+		return fmt.Errorf("file %s: %w", filename, ErrNotGzippable)
 	}
 
-	_, err = io.ReadFull(file, compressedData)
+	file, err := zi.openArchive(zipPath)
 	if err != nil {
-		return fmt.Errorf("failed to read compressed data: %w", err)
+		return fmt.Errorf("failed to open ZIP file: %w", err)
 	}
+	defer file.Close()
 
-	if metadata.CompressionMethod == zip.Store {
-		_, err = writer.Write(compressedData)
+	_, span := zi.startSpan(ctx, "archive.entry.copy")
+	err = copyGzip(ctx, writer, io.NewSectionReader(file, entry.offset, int64(entry.info.CompressedSize)), entry.info.CRC32, entry.info.UncompressedSize)
+	endSpan(span, err)
+	return err
+}
+
+// copyGzip writes deflated data as a gzip stream, its header and trailer around it.
+func copyGzip(ctx context.Context, writer io.Writer, deflated io.Reader, crc uint32, size uint64) error {
+	if _, err := writer.Write(gzipHeader); err != nil {
 		return err
-	} else if metadata.CompressionMethod == zip.Deflate {
-		r := flate.NewReader(bytes.NewReader(compressedData))
-		defer r.Close()
-		_, err = io.Copy(writer, r)
+	}
+	if _, err := io.Copy(writer, &contextReader{ctx: ctx, r: deflated}); err != nil {
 		return err
 	}
+	trailer := binary.LittleEndian.AppendUint32(nil, crc)
+	trailer = binary.LittleEndian.AppendUint32(trailer, uint32(size))
+	_, err := writer.Write(trailer)
+	return err
+}
 
-	return fmt.Errorf("unsupported compression method: %d", metadata.CompressionMethod)
+// ReadDir Lists the immediate children of a directory inside the ZIP archive. The directory
+// is given as a slash-terminated prefix ("" for the archive root). Directories that only
+// exist implicitly through the names of the entries they contain are listed as well.
+func (zi *FastZipReader) ReadDir(ctx context.Context, zipPath, dir string) ([]DirEntry, error) {
+	defer zi.pin(zipPath)()
+	resident, err := zi.residentIndex(ctx, zipPath)
+	if err != nil {
+		return nil, err
+	}
+	if resident != nil {
+		return resident.readDir(dir)
+	}
+	zipID, done, err := zi.lookup(ctx, zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return zi.readDir(ctx, zipID, dir)
+}
+
+// namePrefix returns the condition selecting the entries whose name starts with prefix, and
+// its arguments. It is a range of names, which the index of entries by archive and name
+// answers, where matching the prefix would read every entry of the archive.
+func namePrefix(prefix string) (string, []any) {
+	// Names starting with the prefix sort before its successor: the prefix with its last
+	// byte below 0xff incremented, and the bytes after it dropped
+	for end := len(prefix); end > 0; end-- {
+		if prefix[end-1] < 0xff {
+			return "file_name >= ? AND file_name < ?", []any{prefix, prefix[:end-1] + string([]byte{prefix[end-1] + 1})}
+		}
+	}
+	return "file_name >= ?", []any{prefix}
+}
+
+// readDir lists the immediate children of a directory of an indexed archive.
+func (zi *FastZipReader) readDir(ctx context.Context, zipID int, dir string) ([]DirEntry, error) {
+	under, args := namePrefix(dir)
+	rows, err := zi.db.QueryContext(ctx, "SELECT file_name, uncompressed_size, modified FROM lookup_zip_contents WHERE zip_id = ? AND "+under, append([]any{zipID}, args...)...)
+	if err != nil {
+		return nil, zi.dbError(fmt.Errorf("failed to list directory %s: %w", dir, err))
+	}
+	defer rows.Close()
+
+	found := false
+	children := make(map[string]DirEntry)
+	for rows.Next() {
+		var name string
+		var size uint64
+		var modified sql.NullInt64
+		if err := rows.Scan(&name, &size, &modified); err != nil {
+			return nil, zi.dbError(fmt.Errorf("failed to read directory entry: %w", err))
+		}
+		found = true
+
+		rest := strings.TrimPrefix(name, dir)
+		if rest == "" {
+			// Explicit entry for the directory itself
+			continue
+		}
+		if i := strings.Index(rest, "/"); i >= 0 {
+			children[rest[:i]] = DirEntry{Name: rest[:i], IsDir: true}
+		} else if _, exists := children[rest]; !exists {
+			children[rest] = DirEntry{Name: rest, Size: size, Modified: modifiedTime(modified)}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, zi.dbError(fmt.Errorf("failed to list directory %s: %w", dir, err))
+	}
+	if !found && dir != "" {
+		return nil, fmt.Errorf("directory %s: %w", dir, ErrNotFound)
+	}
+
+	entries := make([]DirEntry, 0, len(children))
+	for _, entry := range children {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// walkBatchSize is the number of entries Walk reads from the index at a time.
+const walkBatchSize = 1000
+
+// Walk calls fn for every entry whose name starts with prefix, in name order, from the
+// index alone. Entries are read in batches, so a slow fn, such as one writing to a client,
+// doesn't hold the database. Walk stops at the first error returned by fn and returns it.
+// The archive gets indexed automatically.
+func (zi *FastZipReader) Walk(ctx context.Context, zipPath, prefix string, fn func(FileInfo) error) error {
+	defer zi.pin(zipPath)()
+	resident, err := zi.residentIndex(ctx, zipPath)
+	if err != nil {
+		return err
+	}
+	if resident != nil {
+		return resident.walk(prefix, fn)
+	}
+	zipID, done, err := zi.lookup(ctx, zipPath)
+	if err != nil {
+		return err
+	}
+
+	after := ""
+	for {
+		batch, err := zi.walkBatch(ctx, zipID, prefix, after)
+		done()
+		if err != nil {
+			return err
+		}
+		for _, info := range batch {
+			if err := fn(info); err != nil {
+				return err
+			}
+		}
+		if len(batch) < walkBatchSize {
+			return nil
+		}
+		after = batch[len(batch)-1].Name
+		zi.indexLock.RLock()
+		done = zi.indexLock.RUnlock
+	}
+}
+
+// walkBatch reads the entries of the archive that start with prefix and sort after the
+// given name.
+func (zi *FastZipReader) walkBatch(ctx context.Context, zipID int, prefix, after string) ([]FileInfo, error) {
+	under, args := namePrefix(prefix)
+	rows, err := zi.db.QueryContext(ctx, "SELECT file_name, compressed_size, uncompressed_size, compression_method, crc32, modified FROM lookup_zip_contents WHERE zip_id = ? AND "+under+" AND file_name > ? ORDER BY file_name LIMIT ?", append(append([]any{zipID}, args...), after, walkBatchSize)...)
+	if err != nil {
+		return nil, zi.dbError(fmt.Errorf("failed to list entries under %s: %w", prefix, err))
+	}
+	defer rows.Close()
+
+	batch := make([]FileInfo, 0, walkBatchSize)
+	for rows.Next() {
+		var info FileInfo
+		var crc, modified sql.NullInt64
+		if err := rows.Scan(&info.Name, &info.CompressedSize, &info.UncompressedSize, &info.CompressionMethod, &crc, &modified); err != nil {
+			return nil, zi.dbError(fmt.Errorf("failed to read entry: %w", err))
+		}
+		info.CRC32, info.HasCRC32 = uint32(crc.Int64), crc.Valid
+		info.Modified = modifiedTime(modified)
+		batch = append(batch, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, zi.dbError(fmt.Errorf("failed to list entries under %s: %w", prefix, err))
+	}
+	return batch, nil
+}
+
+// contextReader stops reading with the error of ctx once it is done, so copies check for
+// cancellation between buffers.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
 }
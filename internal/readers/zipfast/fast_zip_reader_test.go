@@ -2,8 +2,18 @@ package zipfast
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -47,7 +57,7 @@ func TestFastZipReader(t *testing.T) {
 	}
 	require.NoError(t, createTestZipFile(zipPath, files))
 
-	reader, err := NewFastZipReader(dbPath)
+	reader, err := NewFastZipReader(dbPath, Options{})
 	require.NoError(t, err)
 	t.Cleanup(func() { require.NoError(t, reader.Close()) })
 
@@ -57,7 +67,7 @@ func TestFastZipReader(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, 1, count)
 
-	err = reader.indexZip(zipPath)
+	err = reader.indexZip(context.Background(), zipPath)
 	require.NoError(t, err)
 
 	// Check if ZIP metadata is stored
@@ -73,7 +83,7 @@ func TestFastZipReader(t *testing.T) {
 
 	// Test streaming a file
 	var output bytes.Buffer
-	err = reader.StreamFile(zipPath, "file1.txt", &output)
+	err = reader.StreamFile(context.Background(), zipPath, "file1.txt", &output)
 	require.NoError(t, err)
 	assert.Equal(t, files["file1.txt"], output.String())
 }
@@ -88,20 +98,535 @@ func TestReindexingZip(t *testing.T) {
 	}
 	require.NoError(t, createTestZipFile(zipPath, files))
 
-	reader, err := NewFastZipReader(dbPath)
+	reader, err := NewFastZipReader(dbPath, Options{})
 	require.NoError(t, err)
 	t.Cleanup(func() { require.NoError(t, reader.Close()) })
 
-	require.NoError(t, reader.indexZip(zipPath))
+	require.NoError(t, reader.indexZip(context.Background(), zipPath))
 
 	// Modify ZIP file
 	time.Sleep(time.Second) // Ensure modification timestamp changes
 	files["file1.txt"] = "Updated content"
 	require.NoError(t, createTestZipFile(zipPath, files))
 
-	require.NoError(t, reader.indexZip(zipPath))
+	require.NoError(t, reader.indexZip(context.Background(), zipPath))
 
 	var output bytes.Buffer
-	require.NoError(t, reader.StreamFile(zipPath, "file1.txt", &output))
+	require.NoError(t, reader.StreamFile(context.Background(), zipPath, "file1.txt", &output))
 	assert.Equal(t, files["file1.txt"], output.String())
 }
+
+// withoutModTimes drops the modification times of entries, which depend on when the test
+// archive was written.
+func withoutModTimes(entries []DirEntry) []DirEntry {
+	for i := range entries {
+		entries[i].Modified = time.Time{}
+	}
+	return entries
+}
+
+func TestReadDir(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+	zipPath := filepath.Join(tempDir, "test.zip")
+
+	files := map[string]string{
+		"index.txt":            "root",
+		"images/":              "",
+		"images/a.png":         "a",
+		"images/icons/b.png":   "b",
+		"implicit/nested/c.js": "c",
+	}
+	require.NoError(t, createTestZipFile(zipPath, files))
+
+	reader, err := NewFastZipReader(dbPath, Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+
+	entries, err := reader.ReadDir(context.Background(), zipPath, "")
+	require.NoError(t, err)
+	assert.Equal(t, []DirEntry{
+		{Name: "images", IsDir: true},
+		{Name: "implicit", IsDir: true},
+		{Name: "index.txt", Size: 4},
+	}, withoutModTimes(entries))
+
+	entries, err = reader.ReadDir(context.Background(), zipPath, "images/")
+	require.NoError(t, err)
+	assert.Equal(t, []DirEntry{
+		{Name: "a.png", Size: 1},
+		{Name: "icons", IsDir: true},
+	}, withoutModTimes(entries))
+
+	// Directories without an explicit entry are still listed
+	entries, err = reader.ReadDir(context.Background(), zipPath, "implicit/")
+	require.NoError(t, err)
+	assert.Equal(t, []DirEntry{{Name: "nested", IsDir: true}}, entries)
+
+	_, err = reader.ReadDir(context.Background(), zipPath, "missing/")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	var output bytes.Buffer
+	assert.ErrorIs(t, reader.StreamFile(context.Background(), zipPath, "missing.txt", &output), ErrNotFound)
+}
+
+func TestNamePrefix(t *testing.T) {
+	for prefix, args := range map[string][]any{
+		"":           {""},
+		"images/":    {"images/", "images0"},
+		"a\xff":      {"a\xff", "b"},
+		"\xff\xff":   {"\xff\xff"},
+		"caf\u00e9/": {"caf\u00e9/", "caf\u00e90"},
+	} {
+		_, got := namePrefix(prefix)
+		assert.Equal(t, args, got, prefix)
+	}
+
+	// Listings are answered from the index rather than by reading every entry
+	reader, err := NewFastZipReader(filepath.Join(t.TempDir(), "test.db"), Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+	under, args := namePrefix("images/")
+	var plan string
+	var id, parent, unused int
+	require.NoError(t, reader.db.QueryRow("EXPLAIN QUERY PLAN SELECT file_name FROM lookup_zip_contents WHERE zip_id = ? AND "+under, append([]any{1}, args...)...).Scan(&id, &parent, &unused, &plan))
+	assert.Contains(t, plan, "file_name>? AND file_name<?")
+}
+
+func TestDirectoryAndDuplicateEntries(t *testing.T) {
+	tempDir := t.TempDir()
+	zipPath := filepath.Join(tempDir, "test.zip")
+	// Entries in archive order, as an update appended to an archive writes them
+	entries := []struct{ name, content string }{
+		{"assets/", ""},
+		{"assets/app.js", "version 1"},
+		{"empty/", ""},
+		{"index.html", "index"},
+		{"assets/app.js", "version 2"},
+	}
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		w, err := zipWriter.Create(entry.name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(entry.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zipWriter.Close())
+	require.NoError(t, os.WriteFile(zipPath, buf.Bytes(), 0o644))
+
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+	ctx := context.Background()
+
+	count, err := reader.Reindex(ctx, zipPath)
+	require.NoError(t, err)
+	assert.Equal(t, 4, count)
+	var output bytes.Buffer
+	require.NoError(t, reader.StreamFile(ctx, zipPath, "assets/app.js", &output))
+	assert.Equal(t, "version 2", output.String())
+	info, err := reader.Stat(ctx, zipPath, "assets/app.js")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(len("version 2")), info.UncompressedSize)
+
+	// Directory entries are never served as files, even empty ones listing as directories
+	for _, name := range []string{"assets/", "empty/"} {
+		_, err = reader.Stat(ctx, zipPath, name)
+		assert.ErrorIs(t, err, ErrNotFound, name)
+		assert.ErrorIs(t, reader.StreamFile(ctx, zipPath, name, io.Discard), ErrNotFound, name)
+		assert.ErrorIs(t, reader.StreamGzip(ctx, zipPath, name, io.Discard), ErrNotFound, name)
+	}
+	dirEntries, err := reader.ReadDir(ctx, zipPath, "")
+	require.NoError(t, err)
+	assert.Equal(t, []DirEntry{
+		{Name: "assets", IsDir: true},
+		{Name: "empty", IsDir: true},
+		{Name: "index.html", Size: 5},
+	}, withoutModTimes(dirEntries))
+	dirEntries, err = reader.ReadDir(ctx, zipPath, "empty/")
+	require.NoError(t, err)
+	assert.Empty(t, dirEntries)
+
+	v, err := reader.Verify(ctx, zipPath, true)
+	require.NoError(t, err)
+	assert.True(t, v.OK(), v.Problems)
+	assert.Equal(t, 4, v.Entries)
+}
+
+func TestIndexingLogs(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+	zipPath := filepath.Join(tempDir, "test.zip")
+	require.NoError(t, createTestZipFile(zipPath, map[string]string{"a.txt": "a", "b.txt": "b"}))
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	reader, err := NewFastZipReader(dbPath, Options{Logger: logger})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+
+	_, err = reader.Stat(context.Background(), zipPath, "a.txt")
+	require.NoError(t, err)
+	assert.Contains(t, logs.String(), `msg="Archive index cache miss"`)
+	assert.Contains(t, logs.String(), `msg="Indexed archive" archive=`+zipPath+` entries=2 duration=`)
+
+	logs.Reset()
+	_, err = reader.Stat(context.Background(), zipPath, "b.txt")
+	require.NoError(t, err)
+	assert.Contains(t, logs.String(), `msg="Archive index cache hit"`)
+	assert.NotContains(t, logs.String(), "Indexing archive")
+}
+
+// recordingObserver counts the events reported by a reader.
+type recordingObserver struct {
+	indexed, entries, hits, misses, dbErrors, evicted int
+}
+
+func (o *recordingObserver) ArchiveIndexed(entries int, _ time.Duration) {
+	o.indexed++
+	o.entries += entries
+}
+
+func (o *recordingObserver) IndexLookup(hit bool) {
+	if hit {
+		o.hits++
+	} else {
+		o.misses++
+	}
+}
+
+func (o *recordingObserver) DatabaseError(error) {
+	o.dbErrors++
+}
+
+func (o *recordingObserver) ArchivesEvicted(count int) {
+	o.evicted += count
+}
+
+func TestObserver(t *testing.T) {
+	tempDir := t.TempDir()
+	zipPath := filepath.Join(tempDir, "test.zip")
+	require.NoError(t, createTestZipFile(zipPath, map[string]string{"a.txt": "a", "b/c.txt": "c"}))
+
+	observer := &recordingObserver{}
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{Observer: observer})
+	require.NoError(t, err)
+
+	_, err = reader.Stat(context.Background(), zipPath, "a.txt")
+	require.NoError(t, err)
+	_, err = reader.ReadDir(context.Background(), zipPath, "b/")
+	require.NoError(t, err)
+	assert.Equal(t, &recordingObserver{indexed: 1, entries: 2, hits: 1, misses: 1}, observer)
+
+	// Failures of the index database are reported
+	require.NoError(t, reader.Close())
+	_, err = reader.Stat(context.Background(), zipPath, "a.txt")
+	assert.Error(t, err)
+	assert.Positive(t, observer.dbErrors)
+}
+
+func TestStreamGzip(t *testing.T) {
+	tempDir := t.TempDir()
+	zipPath := filepath.Join(tempDir, "test.zip")
+	content := strings.Repeat("deflated content ", 1000)
+	require.NoError(t, createTestZipFile(zipPath, map[string]string{"app.js": content, "empty.txt": ""}))
+	// createTestZipFile always deflates, so stored entries get their own archive
+	storedPath := filepath.Join(tempDir, "stored.zip")
+	stored, err := os.Create(storedPath)
+	require.NoError(t, err)
+	zipWriter := zip.NewWriter(stored)
+	w, err := zipWriter.CreateHeader(&zip.FileHeader{Name: "stored.txt", Method: zip.Store})
+	require.NoError(t, err)
+	_, _ = w.Write([]byte("stored"))
+	require.NoError(t, zipWriter.Close())
+	require.NoError(t, stored.Close())
+
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+
+	for name, want := range map[string]string{"app.js": content, "empty.txt": ""} {
+		info, err := reader.Stat(context.Background(), zipPath, name)
+		require.NoError(t, err)
+		assert.True(t, info.Gzippable(), name)
+
+		var output bytes.Buffer
+		require.NoError(t, reader.StreamGzip(context.Background(), zipPath, name, &output))
+		assert.Equal(t, info.GzipSize(), int64(output.Len()), name)
+		gz, err := gzip.NewReader(&output)
+		require.NoError(t, err)
+		data, err := io.ReadAll(gz)
+		require.NoError(t, err, "the checksum and size in the trailer must match")
+		assert.Equal(t, want, string(data), name)
+	}
+
+	info, err := reader.Stat(context.Background(), storedPath, "stored.txt")
+	require.NoError(t, err)
+	assert.False(t, info.Gzippable())
+	assert.ErrorIs(t, reader.StreamGzip(context.Background(), storedPath, "stored.txt", io.Discard), ErrNotGzippable)
+	assert.ErrorIs(t, reader.StreamGzip(context.Background(), zipPath, "missing.txt", io.Discard), ErrNotFound)
+
+	// Entries indexed before checksums were recorded
+	_, err = reader.db.Exec("UPDATE lookup_zip_contents SET crc32 = NULL")
+	require.NoError(t, err)
+	info, err = reader.Stat(context.Background(), zipPath, "app.js")
+	require.NoError(t, err)
+	assert.False(t, info.Gzippable())
+	assert.ErrorIs(t, reader.StreamGzip(context.Background(), zipPath, "app.js", io.Discard), ErrNotGzippable)
+}
+
+func TestChecksumColumnMigration(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := sql.Open("sqlite", dbPath)
+	require.NoError(t, err)
+	_, err = db.Exec(`CREATE TABLE lookup_zip_files (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		zip_path TEXT UNIQUE NOT NULL,
+		size INTEGER NOT NULL,
+		modification_time INTEGER NOT NULL,
+		indexed_at DATETIME NOT NULL
+	)`)
+	require.NoError(t, err)
+	_, err = db.Exec(`CREATE TABLE lookup_zip_contents (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		zip_id INTEGER NOT NULL,
+		file_name TEXT NOT NULL,
+		offset INTEGER NOT NULL,
+		compressed_size INTEGER NOT NULL,
+		uncompressed_size INTEGER NOT NULL,
+		compression_method INTEGER NOT NULL,
+		UNIQUE(zip_id, file_name)
+	)`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// Opening the old index twice adds the columns once
+	for range 2 {
+		reader, err := NewFastZipReader(dbPath, Options{})
+		require.NoError(t, err)
+		var columns int
+		require.NoError(t, reader.db.QueryRow("SELECT count(*) FROM pragma_table_info('lookup_zip_contents') WHERE name IN ('crc32', 'modified', 'raw_name')").Scan(&columns))
+		assert.Equal(t, 3, columns)
+		require.NoError(t, reader.db.QueryRow("SELECT count(*) FROM pragma_table_info('lookup_zip_files') WHERE name IN ('last_accessed', 'modification_time_ns', 'fingerprint')").Scan(&columns))
+		assert.Equal(t, 3, columns)
+		require.NoError(t, reader.Close())
+	}
+}
+
+// benchmarkArchive creates an archive with a compressible 1 MiB entry.
+func benchmarkArchive(b *testing.B) (*FastZipReader, string) {
+	b.Helper()
+	tempDir := b.TempDir()
+	zipPath := filepath.Join(tempDir, "bench.zip")
+	require.NoError(b, createTestZipFile(zipPath, map[string]string{"bundle.js": strings.Repeat("function f() { return 42; }\n", 1<<20/28)}))
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "bench.db"), Options{Logger: slog.New(slog.DiscardHandler)})
+	require.NoError(b, err)
+	b.Cleanup(func() { _ = reader.Close() })
+	require.NoError(b, reader.StreamFile(context.Background(), zipPath, "bundle.js", io.Discard))
+	return reader, zipPath
+}
+
+func BenchmarkStreamFile(b *testing.B) {
+	reader, zipPath := benchmarkArchive(b)
+	for b.Loop() {
+		require.NoError(b, reader.StreamFile(context.Background(), zipPath, "bundle.js", io.Discard))
+	}
+}
+
+func BenchmarkStreamGzip(b *testing.B) {
+	reader, zipPath := benchmarkArchive(b)
+	for b.Loop() {
+		require.NoError(b, reader.StreamGzip(context.Background(), zipPath, "bundle.js", io.Discard))
+	}
+}
+
+func TestIndexingBatches(t *testing.T) {
+	tempDir := t.TempDir()
+	zipPath := filepath.Join(tempDir, "test.zip")
+	files := map[string]string{
+		`quoted "name".txt`: "quoted",
+		`back\slash.txt`:    "backslash",
+		"ünïcödé/日本.txt":    "unicode",
+	}
+	// Map order scatters entries in the archive, while they are inserted by name
+	for i := range 2*indexBatchSize + 7 {
+		files[fmt.Sprintf("data/%05d.txt", i)] = fmt.Sprintf("entry %d", i)
+	}
+	require.NoError(t, createTestZipFile(zipPath, files))
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+
+	entries, err := reader.Reindex(context.Background(), zipPath)
+	require.NoError(t, err)
+	assert.Equal(t, len(files), entries)
+	for name, content := range files {
+		var output bytes.Buffer
+		require.NoError(t, reader.StreamFile(context.Background(), zipPath, name, &output), name)
+		assert.Equal(t, content, output.String(), name)
+	}
+}
+
+// BenchmarkIndexZip indexes an archive of 100k small entries, as map tile archives hold.
+func BenchmarkIndexZip(b *testing.B) {
+	tempDir := b.TempDir()
+	zipPath := filepath.Join(tempDir, "tiles.zip")
+	file, err := os.Create(zipPath)
+	require.NoError(b, err)
+	zipWriter := zip.NewWriter(file)
+	for i := range 100_000 {
+		w, err := zipWriter.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("tiles/%d/%d/%d.png", i/10000, i/100%100, i%100), Method: zip.Store})
+		require.NoError(b, err)
+		_, err = w.Write([]byte("tile"))
+		require.NoError(b, err)
+	}
+	require.NoError(b, zipWriter.Close())
+	require.NoError(b, file.Close())
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "bench.db"), Options{Logger: slog.New(slog.DiscardHandler)})
+	require.NoError(b, err)
+	b.Cleanup(func() { _ = reader.Close() })
+
+	ctx := context.Background()
+	for b.Loop() {
+		require.NoError(b, reader.indexZip(ctx, zipPath))
+		b.StopTimer()
+		_, err := reader.Invalidate(ctx, zipPath)
+		require.NoError(b, err)
+		b.StartTimer()
+	}
+}
+
+func TestWalk(t *testing.T) {
+	tempDir := t.TempDir()
+	zipPath := filepath.Join(tempDir, "test.zip")
+	files := map[string]string{"other.txt": "other"}
+	for i := range walkBatchSize + 5 {
+		files[fmt.Sprintf("data/%05d.txt", i)] = "x"
+	}
+	require.NoError(t, createTestZipFile(zipPath, files))
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+
+	// Entries span several batches and come in name order
+	var names []string
+	require.NoError(t, reader.Walk(context.Background(), zipPath, "data/", func(info FileInfo) error {
+		names = append(names, info.Name)
+		assert.Equal(t, uint64(1), info.UncompressedSize)
+		assert.True(t, info.HasCRC32)
+		return nil
+	}))
+	assert.Len(t, names, walkBatchSize+5)
+	assert.True(t, sort.StringsAreSorted(names))
+
+	count := 0
+	require.NoError(t, reader.Walk(context.Background(), zipPath, "", func(FileInfo) error { count++; return nil }))
+	assert.Equal(t, len(files), count)
+
+	stop := errors.New("stop")
+	count = 0
+	err = reader.Walk(context.Background(), zipPath, "", func(FileInfo) error {
+		count++
+		if count == 3 {
+			return stop
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, stop)
+	assert.Equal(t, 3, count)
+}
+
+// cancelingWriter cancels its context on the first write and counts the writes.
+type cancelingWriter struct {
+	cancel  context.CancelFunc
+	writes  int
+	written int
+}
+
+func (w *cancelingWriter) Write(p []byte) (int, error) {
+	w.cancel()
+	w.writes++
+	w.written += len(p)
+	return len(p), nil
+}
+
+func TestStreamFileCanceled(t *testing.T) {
+	tempDir := t.TempDir()
+	zipPath := filepath.Join(tempDir, "test.zip")
+	content := strings.Repeat("function f() { return 42; }\n", 1<<20/28)
+	require.NoError(t, createTestZipFile(zipPath, map[string]string{"bundle.js": content}))
+	observer := &recordingObserver{}
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{Observer: observer})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+
+	for name, stream := range map[string]func(context.Context, io.Writer) error{
+		"StreamFile": func(ctx context.Context, w io.Writer) error { return reader.StreamFile(ctx, zipPath, "bundle.js", w) },
+		"StreamGzip": func(ctx context.Context, w io.Writer) error { return reader.StreamGzip(ctx, zipPath, "bundle.js", w) },
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		w := &cancelingWriter{cancel: cancel}
+		// The copy stops at the buffer after the one written when the client went away
+		assert.ErrorIs(t, stream(ctx, w), context.Canceled, name)
+		assert.Equal(t, 1, w.writes, name)
+		assert.Less(t, w.written, len(content), name)
+	}
+
+	// Canceling before the lookup fails it without a database error
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, reader.StreamFile(ctx, zipPath, "bundle.js", io.Discard), context.Canceled)
+	assert.Zero(t, observer.dbErrors)
+}
+
+// countdownContext is canceled once its Err method has been called a number of times, to
+// interrupt indexing between two batches of entries.
+type countdownContext struct {
+	context.Context
+	cancel context.CancelFunc
+	calls  atomic.Int32
+	limit  int32
+}
+
+func (c *countdownContext) Err() error {
+	if c.calls.Add(1) > c.limit {
+		c.cancel()
+	}
+	return c.Context.Err()
+}
+
+func TestIndexingCanceled(t *testing.T) {
+	tempDir := t.TempDir()
+	zipPath := filepath.Join(tempDir, "test.zip")
+	files := make(map[string]string)
+	for i := range 5 * indexBatchSize {
+		files[fmt.Sprintf("file%04d.txt", i)] = fmt.Sprintf("content %d", i)
+	}
+	require.NoError(t, createTestZipFile(zipPath, files))
+	observer := &recordingObserver{}
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{Observer: observer})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+
+	parent, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Reading the offsets and looking the archive up take 11 calls, so two batches get in
+	ctx := &countdownContext{Context: parent, cancel: cancel, limit: 13}
+	_, err = reader.Stat(ctx, zipPath, "file0999.txt")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Nothing of the interrupted indexing is left behind
+	var archives, entries int
+	require.NoError(t, reader.db.QueryRow("SELECT count(*) FROM lookup_zip_files").Scan(&archives))
+	require.NoError(t, reader.db.QueryRow("SELECT count(*) FROM lookup_zip_contents").Scan(&entries))
+	assert.Zero(t, archives)
+	assert.Zero(t, entries)
+
+	var output bytes.Buffer
+	require.NoError(t, reader.StreamFile(context.Background(), zipPath, "file0999.txt", &output))
+	assert.Equal(t, "content 999", output.String())
+	assert.Equal(t, 1, observer.indexed)
+	assert.Equal(t, 5*indexBatchSize, observer.entries)
+	assert.Zero(t, observer.dbErrors)
+}
@@ -0,0 +1,227 @@
+package zipfast
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+)
+
+// errIsDir is returned when reading a directory of an archive FS as a file.
+var errIsDir = errors.New("is a directory")
+
+// FS returns an fs.FS over the entries of an archive, answering Open and ReadDir from the
+// index and decompressing file entries as they are read. Directories are derived from
+// entry names, so they needn't have entries of their own, and report no modification time.
+// Files of stored entries implement io.Seeker and io.ReaderAt; deflated ones can only be
+// read sequentially and don't implement them. The archive gets indexed automatically, and
+// again if its index was evicted meanwhile.
+func (zi *FastZipReader) FS(zipPath string) (fs.FS, error) {
+	defer zi.pin(zipPath)()
+	if _, err := zi.lookupZipID(context.Background(), zipPath); err != nil {
+		return nil, err
+	}
+	return &archiveFS{zi: zi, zipPath: zipPath}, nil
+}
+
+type archiveFS struct {
+	zi      *FastZipReader
+	zipPath string
+}
+
+// entryLocation is where the data of an entry lies in the archive.
+type entryLocation struct {
+	offset            int64
+	compressedSize    int64
+	uncompressedSize  int64
+	compressionMethod uint16
+	modified          time.Time
+}
+
+func (fsys *archiveFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return &archiveDir{fsys: fsys, name: name, prefix: ""}, nil
+	}
+
+	defer fsys.zi.pin(fsys.zipPath)()
+	zipID, done, err := fsys.zi.lookup(context.Background(), fsys.zipPath)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	defer done()
+	location, err := fsys.locate(zipID, name)
+	if err == nil {
+		return fsys.openFile(name, location)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	isDir, err := fsys.isDir(zipID, name+"/")
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if !isDir {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &archiveDir{fsys: fsys, name: name, prefix: name + "/"}, nil
+}
+
+// locate looks up the data of the file entry name.
+func (fsys *archiveFS) locate(zipID int, name string) (entryLocation, error) {
+	var location entryLocation
+	var modified sql.NullInt64
+	err := fsys.zi.db.QueryRow("SELECT offset, compressed_size, uncompressed_size, compression_method, modified FROM lookup_zip_contents WHERE zip_id = ? AND file_name = ?", zipID, name).Scan(&location.offset, &location.compressedSize, &location.uncompressedSize, &location.compressionMethod, &modified)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return entryLocation{}, fmt.Errorf("file %s: %w", name, ErrNotFound)
+		}
+		return entryLocation{}, fsys.zi.dbError(fmt.Errorf("failed to look up file %s: %w", name, err))
+	}
+	location.modified = modifiedTime(modified)
+	return location, nil
+}
+
+// isDir reports whether any entry lies under the slash-terminated prefix.
+func (fsys *archiveFS) isDir(zipID int, prefix string) (bool, error) {
+	var exists bool
+	under, args := namePrefix(prefix)
+	err := fsys.zi.db.QueryRow("SELECT EXISTS (SELECT 1 FROM lookup_zip_contents WHERE zip_id = ? AND "+under+")", append([]any{zipID}, args...)...).Scan(&exists)
+	if err != nil {
+		return false, fsys.zi.dbError(fmt.Errorf("failed to look up directory %s: %w", prefix, err))
+	}
+	return exists, nil
+}
+
+func (fsys *archiveFS) openFile(name string, location entryLocation) (fs.File, error) {
+	if location.compressionMethod != zip.Store && location.compressionMethod != zip.Deflate {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("unsupported compression method: %d", location.compressionMethod)}
+	}
+	file, err := fsys.zi.openArchive(fsys.zipPath)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("failed to open ZIP file: %w", err)}
+	}
+	info := entryInfo{
+		name:     path.Base(name),
+		size:     location.uncompressedSize,
+		mode:     0o444,
+		modified: location.modified,
+	}
+	data := io.NewSectionReader(file, location.offset, location.compressedSize)
+	if location.compressionMethod == zip.Store {
+		return &storedFile{file: file, info: info, data: data}, nil
+	}
+	inflated := flate.NewReader(data)
+	// Reads stop at the declared size, even if the data goes on
+	return &deflatedFile{file: file, info: info, data: inflated, limited: io.LimitReader(inflated, info.size)}, nil
+}
+
+// entryInfo describes a file or directory of an archive FS.
+type entryInfo struct {
+	name     string
+	size     int64
+	mode     fs.FileMode
+	modified time.Time
+}
+
+func (info entryInfo) Name() string       { return info.name }
+func (info entryInfo) Size() int64        { return info.size }
+func (info entryInfo) Mode() fs.FileMode  { return info.mode }
+func (info entryInfo) ModTime() time.Time { return info.modified }
+func (info entryInfo) IsDir() bool        { return info.mode.IsDir() }
+func (info entryInfo) Sys() any           { return nil }
+
+// storedFile reads an uncompressed entry straight from the archive.
+type storedFile struct {
+	file *archiveFile
+	info entryInfo
+	data *io.SectionReader
+}
+
+func (f *storedFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *storedFile) Read(p []byte) (int, error) { return f.data.Read(p) }
+func (f *storedFile) ReadAt(p []byte, offset int64) (int, error) {
+	return f.data.ReadAt(p, offset)
+}
+func (f *storedFile) Seek(offset int64, whence int) (int64, error) {
+	return f.data.Seek(offset, whence)
+}
+func (f *storedFile) Close() error { return f.file.Close() }
+
+// deflatedFile decompresses an entry as it is read.
+type deflatedFile struct {
+	file *archiveFile
+	info entryInfo
+	data io.ReadCloser
+	// limited reads data up to the declared size.
+	limited io.Reader
+}
+
+func (f *deflatedFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *deflatedFile) Read(p []byte) (int, error) { return f.limited.Read(p) }
+func (f *deflatedFile) Close() error {
+	_ = f.data.Close()
+	return f.file.Close()
+}
+
+// archiveDir lists a directory of an archive FS, reading its children on the first
+// ReadDir call.
+type archiveDir struct {
+	fsys    *archiveFS
+	name    string
+	prefix  string
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *archiveDir) Stat() (fs.FileInfo, error) {
+	return entryInfo{name: path.Base(d.name), mode: fs.ModeDir | 0o555}, nil
+}
+
+func (d *archiveDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errIsDir}
+}
+
+func (d *archiveDir) Close() error { return nil }
+
+func (d *archiveDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		children, err := d.fsys.zi.ReadDir(context.Background(), d.fsys.zipPath, d.prefix)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: err}
+		}
+		for _, child := range children {
+			// Names such as the empty one between the slashes of a//b can't be opened
+			if !fs.ValidPath(child.Name) || child.Name == "." {
+				continue
+			}
+			info := entryInfo{name: child.Name, size: int64(child.Size), mode: 0o444, modified: child.Modified}
+			if child.IsDir {
+				info = entryInfo{name: child.Name, mode: fs.ModeDir | 0o555}
+			}
+			d.entries = append(d.entries, fs.FileInfoToDirEntry(info))
+		}
+		d.read = true
+	}
+
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
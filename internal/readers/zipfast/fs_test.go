@@ -0,0 +1,96 @@
+package zipfast
+
+import (
+	"archive/zip"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFS(t *testing.T) {
+	tempDir := t.TempDir()
+	zipPath := filepath.Join(tempDir, "test.zip")
+	modified := time.Date(2025, 3, 14, 15, 9, 26, 0, time.UTC)
+
+	file, err := os.Create(zipPath)
+	require.NoError(t, err)
+	zipWriter := zip.NewWriter(file)
+	for _, entry := range []struct {
+		name, content string
+		method        uint16
+	}{
+		{"index.html", "<h1>home</h1>", zip.Deflate},
+		{"stored.txt", "stored as it is", zip.Store},
+		{"assets/", "", zip.Store},
+		{"assets/app.js", strings.Repeat("console.log(1);\n", 100), zip.Deflate},
+		{"assets/img/logo.svg", "<svg/>", zip.Store},
+		{"implicit/nested/data.json", "{}", zip.Deflate},
+	} {
+		w, err := zipWriter.CreateHeader(&zip.FileHeader{Name: entry.name, Method: entry.method, Modified: modified})
+		require.NoError(t, err)
+		_, err = io.WriteString(w, entry.content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, zipWriter.Close())
+	require.NoError(t, file.Close())
+
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+
+	fsys, err := reader.FS(zipPath)
+	require.NoError(t, err)
+	require.NoError(t, fstest.TestFS(fsys, "index.html", "stored.txt", "assets/app.js", "assets/img/logo.svg", "implicit/nested/data.json"))
+
+	info, err := fs.Stat(fsys, "assets/app.js")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1600), info.Size())
+	assert.True(t, modified.Equal(info.ModTime()))
+	info, err = fs.Stat(fsys, "implicit/nested")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	// Only stored entries can seek
+	stored, err := fsys.Open("stored.txt")
+	require.NoError(t, err)
+	defer stored.Close()
+	seeker, ok := stored.(io.Seeker)
+	require.True(t, ok)
+	_, err = seeker.Seek(10, io.SeekStart)
+	require.NoError(t, err)
+	rest, err := io.ReadAll(stored)
+	require.NoError(t, err)
+	assert.Equal(t, "it is", string(rest))
+	deflated, err := fsys.Open("index.html")
+	require.NoError(t, err)
+	defer deflated.Close()
+	_, ok = deflated.(io.Seeker)
+	assert.False(t, ok)
+
+	for _, name := range []string{"missing.txt", "assets/missing", "assets/app", "ass"} {
+		_, err := fsys.Open(name)
+		assert.ErrorIs(t, err, fs.ErrNotExist, name)
+	}
+	for _, name := range []string{"/index.html", "assets/", "../test.zip", "assets/../index.html"} {
+		_, err := fsys.Open(name)
+		assert.ErrorIs(t, err, fs.ErrInvalid, name)
+	}
+
+	var walked []string
+	require.NoError(t, fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		walked = append(walked, name)
+		return err
+	}))
+	assert.Equal(t, []string{".", "assets", "assets/app.js", "assets/img", "assets/img/logo.svg", "implicit", "implicit/nested", "implicit/nested/data.json", "index.html", "stored.txt"}, walked)
+
+	_, err = reader.FS(filepath.Join(tempDir, "missing.zip"))
+	assert.Error(t, err)
+}
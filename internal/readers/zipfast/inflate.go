@@ -0,0 +1,496 @@
+package zipfast
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// windowSize is the size of the deflate window, the farthest back a match reaches, and
+// so of the dictionary decompression needs to resume from a block.
+const windowSize = 1 << 15
+
+// inflateTableBits is the width of the lookup tables of Huffman codes. Longer codes,
+// which are rare, are decoded a bit at a time.
+const inflateTableBits = 10
+
+var errCorruptDeflate = errors.New("corrupt deflate data")
+
+var (
+	lengthBase  = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+	// codeLengthOrder is the order code lengths of the code length alphabet are sent in.
+	codeLengthOrder = [19]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+)
+
+// huffmanCode decodes the canonical Huffman code given by the code lengths of symbols.
+type huffmanCode struct {
+	counts  [16]uint16
+	symbols [288]uint16
+	// table maps the next inflateTableBits bits of input to symbol<<4 | code length, or
+	// to zero for the codes longer than inflateTableBits.
+	table [1 << inflateTableBits]uint16
+}
+
+func (h *huffmanCode) init(lengths []uint8) error {
+	h.counts = [16]uint16{}
+	for _, length := range lengths {
+		h.counts[length]++
+	}
+	h.counts[0] = 0
+	left := 1
+	for length := 1; length <= 15; length++ {
+		left = left<<1 - int(h.counts[length])
+		if left < 0 {
+			return errCorruptDeflate
+		}
+	}
+
+	var offsets, next [16]int
+	code := 0
+	for length := 1; length <= 15; length++ {
+		offsets[length] = offsets[length-1] + int(h.counts[length-1])
+		code = (code + int(h.counts[length-1])) << 1
+		next[length] = code
+	}
+	clear(h.table[:])
+	for symbol, length := range lengths {
+		if length == 0 {
+			continue
+		}
+		h.symbols[offsets[length]] = uint16(symbol)
+		offsets[length]++
+		code := next[length]
+		next[length]++
+		if length > inflateTableBits {
+			continue
+		}
+		// Codes are sent starting from their first bit, which ends up lowest
+		reversed := 0
+		for i := uint8(0); i < length; i++ {
+			reversed |= (code >> i & 1) << (length - 1 - i)
+		}
+		for i := reversed; i < len(h.table); i += 1 << length {
+			h.table[i] = uint16(symbol)<<4 | uint16(length)
+		}
+	}
+	return nil
+}
+
+// fixedCodes are the codes of blocks compressed with fixed Huffman codes.
+var fixedCodes = sync.OnceValues(func() (*huffmanCode, *huffmanCode) {
+	var lengths [288]uint8
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	literals, distances := &huffmanCode{}, &huffmanCode{}
+	var distanceLengths [30]uint8
+	for i := range distanceLengths {
+		distanceLengths[i] = 5
+	}
+	if literals.init(lengths[:]) != nil || distances.init(distanceLengths[:]) != nil {
+		panic("invalid fixed Huffman codes")
+	}
+	return literals, distances
+})
+
+type inflateState int
+
+const (
+	stateHeader inflateState = iota
+	stateStored
+	stateHuffman
+	stateDone
+)
+
+// inflater decompresses raw deflate data as compress/flate does, and also reports where
+// its blocks start, the only places decompression can resume from, given the last
+// windowSize bytes of output before them. It can itself start from such a place.
+type inflater struct {
+	r io.ByteReader
+	// bits holds nbits bits of input read ahead; pos is the offset in bits of the first of
+	// them in the compressed data.
+	bits  uint64
+	nbits uint
+	pos   int64
+	// readErr is what reading more input failed with.
+	readErr error
+
+	// history holds the last windowSize bytes of output, of which avail are valid; out is
+	// the offset of the next one in the decompressed data.
+	history [windowSize]byte
+	avail   int
+	out     int64
+
+	state     inflateState
+	final     bool
+	stored    int
+	literals  *huffmanCode
+	distances *huffmanCode
+	copyLen   int
+	copyDist  int
+	err       error
+
+	dynamicLiterals, dynamicDistances, codeLengths huffmanCode
+
+	// onBlock is called before the header of every block is read, with the offset in bits
+	// of the block in the compressed data and that of its output.
+	onBlock func(input, output int64)
+}
+
+// newInflater returns an inflater reading r, which holds the compressed data from the
+// byte of the block starting input bits into it, whose output starts at offset output,
+// preceded by dictionary.
+func newInflater(r io.ByteReader, input, output int64, dictionary []byte) *inflater {
+	f := &inflater{r: r, pos: input &^ 7, out: output}
+	dictionary = dictionary[max(0, len(dictionary)-windowSize):]
+	for i, b := range dictionary {
+		f.history[(output-int64(len(dictionary))+int64(i))&(windowSize-1)] = b
+	}
+	f.avail = len(dictionary)
+	if skip := uint(input & 7); skip > 0 {
+		if f.err = f.need(skip); f.err == nil {
+			f.consume(skip)
+		}
+	}
+	return f
+}
+
+func (f *inflater) Read(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	n := 0
+	for n < len(p) {
+		switch f.state {
+		case stateHeader:
+			if f.final {
+				f.state = stateDone
+				continue
+			}
+			if f.onBlock != nil {
+				f.onBlock(f.pos, f.out)
+			}
+			f.err = f.header()
+		case stateStored:
+			n += f.copyStored(p[n:])
+		case stateHuffman:
+			if f.copyLen > 0 {
+				n += f.copyMatch(p[n:])
+				continue
+			}
+			var literal bool
+			if literal, f.err = f.symbol(); literal {
+				f.write(byte(f.copyDist))
+				p[n] = byte(f.copyDist)
+				n++
+			}
+		case stateDone:
+			if n == 0 {
+				return 0, io.EOF
+			}
+			return n, nil
+		}
+		if f.err != nil {
+			return n, f.err
+		}
+	}
+	return n, nil
+}
+
+// write appends b to the history.
+func (f *inflater) write(b byte) {
+	f.history[f.out&(windowSize-1)] = b
+	f.out++
+	if f.avail < windowSize {
+		f.avail++
+	}
+}
+
+// dictionary returns the history, as newInflater and flate.NewReaderDict take it.
+func (f *inflater) dictionary() []byte {
+	dictionary := make([]byte, f.avail)
+	for i := range dictionary {
+		dictionary[i] = f.history[(f.out-int64(f.avail)+int64(i))&(windowSize-1)]
+	}
+	return dictionary
+}
+
+// fill reads input until bits holds at least 57 bits, the input ends or reading fails.
+func (f *inflater) fill() {
+	for f.nbits <= 56 && f.readErr == nil {
+		b, err := f.r.ReadByte()
+		if err != nil {
+			f.readErr = err
+			return
+		}
+		f.bits |= uint64(b) << f.nbits
+		f.nbits += 8
+	}
+}
+
+// need makes sure bits holds at least n bits.
+func (f *inflater) need(n uint) error {
+	if f.nbits < n {
+		f.fill()
+		if f.nbits < n {
+			if f.readErr == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return f.readErr
+		}
+	}
+	return nil
+}
+
+func (f *inflater) consume(n uint) {
+	f.bits >>= n
+	f.nbits -= n
+	f.pos += int64(n)
+}
+
+func (f *inflater) take(n uint) (int, error) {
+	if err := f.need(n); err != nil {
+		return 0, err
+	}
+	v := int(f.bits & (1<<n - 1))
+	f.consume(n)
+	return v, nil
+}
+
+// decode reads a symbol of h.
+func (f *inflater) decode(h *huffmanCode) (int, error) {
+	if f.nbits < 15 {
+		f.fill()
+	}
+	if entry := h.table[f.bits&(1<<inflateTableBits-1)]; entry != 0 {
+		if length := uint(entry & 15); length <= f.nbits {
+			f.consume(length)
+			return int(entry >> 4), nil
+		}
+		return 0, f.need(15)
+	}
+	code, first, index := 0, 0, 0
+	for length := uint(1); length <= 15; length++ {
+		if length > f.nbits {
+			return 0, f.need(15)
+		}
+		code |= int(f.bits>>(length-1)) & 1
+		count := int(h.counts[length])
+		if code-first < count {
+			f.consume(length)
+			return int(h.symbols[index+code-first]), nil
+		}
+		index += count
+		first = (first + count) << 1
+		code <<= 1
+	}
+	return 0, errCorruptDeflate
+}
+
+// header reads the header of a block, and the codes of dynamic ones.
+func (f *inflater) header() error {
+	v, err := f.take(3)
+	if err != nil {
+		return err
+	}
+	f.final = v&1 == 1
+	switch v >> 1 {
+	case 0:
+		if err := f.need(uint(8-f.pos&7) & 7); err != nil {
+			return err
+		}
+		f.consume(uint(8-f.pos&7) & 7)
+		v, err := f.take(32)
+		if err != nil {
+			return err
+		}
+		if v&0xffff != ^v>>16&0xffff {
+			return errCorruptDeflate
+		}
+		f.stored, f.state = v&0xffff, stateStored
+	case 1:
+		f.literals, f.distances = fixedCodes()
+		f.state = stateHuffman
+	case 2:
+		if err := f.readCodes(); err != nil {
+			return err
+		}
+		f.literals, f.distances = &f.dynamicLiterals, &f.dynamicDistances
+		f.state = stateHuffman
+	default:
+		return errCorruptDeflate
+	}
+	return nil
+}
+
+func (f *inflater) readCodes() error {
+	var counts [3]int
+	for i, width := range []uint{5, 5, 4} {
+		v, err := f.take(width)
+		if err != nil {
+			return err
+		}
+		counts[i] = v
+	}
+	literalCount, distanceCount, codeLengthCount := counts[0]+257, counts[1]+1, counts[2]+4
+	if literalCount > 286 || distanceCount > 30 {
+		return errCorruptDeflate
+	}
+
+	var codeLengths [19]uint8
+	for _, symbol := range codeLengthOrder[:codeLengthCount] {
+		v, err := f.take(3)
+		if err != nil {
+			return err
+		}
+		codeLengths[symbol] = uint8(v)
+	}
+	if err := f.codeLengths.init(codeLengths[:]); err != nil {
+		return err
+	}
+
+	var lengths [286 + 30]uint8
+	total := literalCount + distanceCount
+	for i := 0; i < total; {
+		symbol, err := f.decode(&f.codeLengths)
+		if err != nil {
+			return err
+		}
+		if symbol < 16 {
+			lengths[i] = uint8(symbol)
+			i++
+			continue
+		}
+		var repeat int
+		var value uint8
+		switch symbol {
+		case 16:
+			if i == 0 {
+				return errCorruptDeflate
+			}
+			value = lengths[i-1]
+			repeat, err = f.take(2)
+			repeat += 3
+		case 17:
+			repeat, err = f.take(3)
+			repeat += 3
+		default:
+			repeat, err = f.take(7)
+			repeat += 11
+		}
+		if err != nil {
+			return err
+		}
+		if i+repeat > total {
+			return errCorruptDeflate
+		}
+		for ; repeat > 0; repeat-- {
+			lengths[i] = value
+			i++
+		}
+	}
+	if lengths[256] == 0 {
+		return errCorruptDeflate
+	}
+	if err := f.dynamicLiterals.init(lengths[:literalCount]); err != nil {
+		return err
+	}
+	return f.dynamicDistances.init(lengths[literalCount:total])
+}
+
+// symbol decodes the next symbol of a compressed block. It reports a literal, left in
+// copyDist, or sets up the copy of a match, or ends the block.
+func (f *inflater) symbol() (bool, error) {
+	symbol, err := f.decode(f.literals)
+	switch {
+	case err != nil:
+		return false, err
+	case symbol < 256:
+		f.copyDist = symbol
+		return true, nil
+	case symbol == 256:
+		f.state = stateHeader
+		return false, nil
+	case symbol > 285:
+		return false, errCorruptDeflate
+	}
+	symbol -= 257
+	extra, err := f.take(uint(lengthExtra[symbol]))
+	if err != nil {
+		return false, err
+	}
+	length := int(lengthBase[symbol]) + extra
+
+	symbol, err = f.decode(f.distances)
+	if err != nil {
+		return false, err
+	}
+	if symbol >= 30 {
+		return false, errCorruptDeflate
+	}
+	extra, err = f.take(uint(distExtra[symbol]))
+	if err != nil {
+		return false, err
+	}
+	distance := int(distBase[symbol]) + extra
+	if distance > f.avail {
+		return false, errCorruptDeflate
+	}
+	f.copyLen, f.copyDist = length, distance
+	return false, nil
+}
+
+func (f *inflater) copyMatch(p []byte) int {
+	n := min(len(p), f.copyLen)
+	for i := range n {
+		b := f.history[(f.out-int64(f.copyDist))&(windowSize-1)]
+		f.write(b)
+		p[i] = b
+	}
+	f.copyLen -= n
+	return n
+}
+
+// copyStored copies the data of a stored block, from the bits read ahead, and then
+// straight from the input.
+func (f *inflater) copyStored(p []byte) int {
+	if f.stored == 0 {
+		f.state = stateHeader
+		return 0
+	}
+	n := 0
+	for n < len(p) && f.stored > 0 {
+		var b byte
+		if f.nbits >= 8 {
+			b = byte(f.bits)
+			f.consume(8)
+		} else {
+			var err error
+			if b, err = f.r.ReadByte(); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				f.err = err
+				return n
+			}
+			f.pos += 8
+		}
+		f.write(b)
+		p[n] = b
+		n++
+		f.stored--
+	}
+	return n
+}
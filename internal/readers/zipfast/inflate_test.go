@@ -0,0 +1,132 @@
+package zipfast
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// inflateTestData is text, with matches near and far, interleaved with random bytes, which
+// deflate stores or codes without matches.
+func inflateTestData(size int) []byte {
+	random := rand.New(rand.NewPCG(1, 2))
+	words := []string{"alpha", "beta", "gamma", "delta", "epsilon", "zeta", "eta", "theta", "\n"}
+	var data bytes.Buffer
+	for data.Len() < size {
+		if random.IntN(10) == 0 {
+			noise := make([]byte, random.IntN(40_000))
+			for i := range noise {
+				noise[i] = byte(random.Uint32())
+			}
+			data.Write(noise)
+			continue
+		}
+		for range random.IntN(5_000) {
+			data.WriteString(words[random.IntN(len(words))])
+			data.WriteByte(' ')
+			fmt.Fprint(&data, random.IntN(1_000))
+		}
+	}
+	return data.Bytes()[:size]
+}
+
+func deflate(t testing.TB, data []byte, level int) []byte {
+	t.Helper()
+	var compressed bytes.Buffer
+	w, err := flate.NewWriter(&compressed, level)
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return compressed.Bytes()
+}
+
+func TestInflater(t *testing.T) {
+	data := inflateTestData(3 << 20)
+	for _, level := range []int{flate.NoCompression, flate.HuffmanOnly, flate.BestSpeed, flate.DefaultCompression, flate.BestCompression} {
+		compressed := deflate(t, data, level)
+		f := newInflater(bufio.NewReader(bytes.NewReader(compressed)), 0, 0, nil)
+		var checkpoints []checkpoint
+		f.onBlock = func(input, output int64) {
+			checkpoints = append(checkpoints, checkpoint{output: output, input: input, dictionary: f.dictionary()})
+		}
+		output, err := io.ReadAll(f)
+		require.NoError(t, err, "level %d", level)
+		require.True(t, bytes.Equal(data, output), "level %d", level)
+		require.Greater(t, len(checkpoints), 10, "level %d", level)
+
+		// Decompression resumes from every block
+		for i, cp := range checkpoints {
+			if i%7 != 0 && i != len(checkpoints)-1 {
+				continue
+			}
+			assert.Equal(t, data[max(0, cp.output-windowSize):cp.output], cp.dictionary)
+			rest := compressed[cp.input/8:]
+			f := newInflater(bufio.NewReader(bytes.NewReader(rest)), cp.input, cp.output, cp.dictionary)
+			output, err := io.ReadAll(f)
+			require.NoError(t, err, "level %d, block %d", level, i)
+			require.True(t, bytes.Equal(data[cp.output:], output), "level %d, block %d", level, i)
+		}
+	}
+}
+
+func TestInflaterCorrupt(t *testing.T) {
+	compressed := deflate(t, inflateTestData(200_000), flate.DefaultCompression)
+	_, err := io.ReadAll(newInflater(bufio.NewReader(bytes.NewReader(compressed[:len(compressed)/2])), 0, 0, nil))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Matches can't reach before the dictionary
+	var numbers bytes.Buffer
+	for i := range 200_000 {
+		fmt.Fprint(&numbers, i%5_000, " ")
+	}
+	compressed = deflate(t, numbers.Bytes(), flate.DefaultCompression)
+	f := newInflater(bufio.NewReader(bytes.NewReader(compressed)), 0, 0, nil)
+	var checkpoints []checkpoint
+	f.onBlock = func(input, output int64) {
+		checkpoints = append(checkpoints, checkpoint{output: output, input: input, dictionary: f.dictionary()})
+	}
+	_, err = io.Copy(io.Discard, f)
+	require.NoError(t, err)
+	require.Greater(t, len(checkpoints), 2)
+	cp := checkpoints[1]
+	_, err = io.ReadAll(newInflater(bufio.NewReader(bytes.NewReader(compressed[cp.input/8:])), cp.input, cp.output, cp.dictionary[:100]))
+	assert.ErrorIs(t, err, errCorruptDeflate)
+
+	garbage := bytes.Repeat([]byte{0xff}, 100)
+	_, err = io.ReadAll(newInflater(bufio.NewReader(bytes.NewReader(garbage)), 0, 0, nil))
+	assert.ErrorIs(t, err, errCorruptDeflate)
+	stored := []byte{0x01, 0x05, 0x00, 0x00, 0x00, 'h', 'e', 'l', 'l', 'o'}
+	_, err = io.ReadAll(newInflater(bufio.NewReader(bytes.NewReader(stored)), 0, 0, nil))
+	assert.ErrorIs(t, err, errCorruptDeflate)
+	stored[3], stored[4] = 0xfa, 0xff
+	output, err := io.ReadAll(newInflater(bufio.NewReader(bytes.NewReader(stored)), 0, 0, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(output))
+}
+
+func BenchmarkInflater(b *testing.B) {
+	data := inflateTestData(8 << 20)
+	compressed := deflate(b, data, flate.DefaultCompression)
+	b.SetBytes(int64(len(data)))
+	for _, decompressor := range []string{"inflater", "flate"} {
+		b.Run(decompressor, func(b *testing.B) {
+			for b.Loop() {
+				var r io.Reader = newInflater(bufio.NewReader(bytes.NewReader(compressed)), 0, 0, nil)
+				if decompressor == "flate" {
+					r = flate.NewReader(bytes.NewReader(compressed))
+				}
+				if _, err := io.Copy(io.Discard, r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package zipfast
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/text/encoding"
+)
+
+// ErrRejected is returned for archives beyond the Limits, whose index records why so that
+// they aren't read again until they change.
+var ErrRejected = errors.New("rejected for exceeding limits")
+
+const (
+	// DefaultMaxEntries is the number of entries an archive may have by default.
+	DefaultMaxEntries = 1_000_000
+	// DefaultMaxTotalSize is the total uncompressed size the entries of an archive may
+	// declare by default.
+	DefaultMaxTotalSize = 1 << 40
+	// DefaultMaxEntrySize is the uncompressed size an entry may declare by default.
+	DefaultMaxEntrySize = 64 << 30
+	// DefaultMaxCompressionRatio is the compression ratio an entry may declare by default,
+	// just above the 1032:1 that deflate can reach, so only sizes the data can't hold are
+	// refused.
+	DefaultMaxCompressionRatio = 1100
+)
+
+// minRatioSize is the uncompressed size above which the compression ratio of entries is
+// checked, as smaller ones can't take much whatever their ratio.
+const minRatioSize = 1 << 20
+
+// Limits bound the archives a FastZipReader indexes, against archives crafted to take
+// the memory and database space of the server, as zip bombs are. They are checked
+// against the central directory, before anything is recorded: archives beyond them are
+// rejected, and lookups fail with ErrRejected without reading the archive again until it
+// changes, it is reindexed, or the limits do. Zero fields mean their default, and
+// negative ones no limit.
+type Limits struct {
+	// MaxEntries bounds the number of entries of an archive. The count its end of central
+	// directory declares is checked before the directory is read.
+	MaxEntries int
+	// MaxTotalSize bounds the total uncompressed size the entries of an archive declare,
+	// those left out by the other limits aside.
+	MaxTotalSize int64
+	// MaxEntrySize bounds the uncompressed size an entry declares. Reads of an entry stop
+	// at the size it declares, whatever its data holds.
+	MaxEntrySize int64
+	// MaxCompressionRatio bounds the ratio of the uncompressed to the compressed size an
+	// entry declares, for entries over 1 MiB uncompressed.
+	MaxCompressionRatio int
+	// RejectArchive rejects the whole archive for an entry beyond MaxEntrySize or
+	// MaxCompressionRatio, rather than leaving the entry out of the index, so it isn't
+	// found.
+	RejectArchive bool
+}
+
+// limits are Limits with their defaults applied, zero fields meaning no limit.
+type limits struct {
+	entries       uint64
+	totalSize     uint64
+	entrySize     uint64
+	ratio         uint64
+	rejectArchive bool
+}
+
+// newLimits returns the limits of l, with defaults for zero values and no limit for
+// negative ones.
+func newLimits(l Limits) limits {
+	limit := func(value, fallback int64) uint64 {
+		switch {
+		case value == 0:
+			return uint64(fallback)
+		case value < 0:
+			return 0
+		}
+		return uint64(value)
+	}
+	return limits{
+		entries:       limit(int64(l.MaxEntries), DefaultMaxEntries),
+		totalSize:     limit(l.MaxTotalSize, DefaultMaxTotalSize),
+		entrySize:     limit(l.MaxEntrySize, DefaultMaxEntrySize),
+		ratio:         limit(int64(l.MaxCompressionRatio), DefaultMaxCompressionRatio),
+		rejectArchive: l.RejectArchive,
+	}
+}
+
+// key identifies the limits, recorded with the rejections they make, so that archives
+// rejected under other limits are indexed again.
+func (l limits) key() string {
+	return fmt.Sprintf("entries=%d total=%d entry=%d ratio=%d reject=%t", l.entries, l.totalSize, l.entrySize, l.ratio, l.rejectArchive)
+}
+
+// refusal is an entry left out of the index for being beyond the limits.
+type refusal struct {
+	name   string
+	reason string
+}
+
+// archiveFiles reads the central directory of an archive of the given size and returns
+// its entries to index, as indexedFiles does, within the limits. Entries beyond the
+// per-entry limits are left out and returned as refusals, unless the limits reject the
+// whole archive; the reason it is rejected for is then returned instead, with no entries.
+// Errors are those of archive/zip reading the directory.
+func (l limits) archiveFiles(file io.ReaderAt, size int64, names *encoding.Decoder) ([]archiveEntry, []refusal, string, error) {
+	// Reading the central directory takes memory for every entry, so a count beyond the
+	// limit is refused before it is read
+	if declared, ok := declaredEntries(file, size); ok && l.entries > 0 && declared > l.entries {
+		return nil, nil, fmt.Sprintf("%d entries declared, more than %d", declared, l.entries), nil
+	}
+	zipReader, err := zip.NewReader(file, size)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	// The declared count only has to match the entries modulo 65536
+	if l.entries > 0 && uint64(len(zipReader.File)) > l.entries {
+		return nil, nil, fmt.Sprintf("%d entries, more than %d", len(zipReader.File), l.entries), nil
+	}
+
+	files := indexedFiles(zipReader.File, names)
+	var refused []refusal
+	var total uint64
+	kept := files[:0]
+	for _, f := range files {
+		if reason := l.entryRefusal(f.file); reason != "" {
+			if l.rejectArchive {
+				return nil, nil, fmt.Sprintf("entry %s: %s", f.name, reason), nil
+			}
+			refused = append(refused, refusal{name: f.name, reason: reason})
+			continue
+		}
+		if size := f.file.UncompressedSize64; l.totalSize > 0 {
+			if size > l.totalSize-total {
+				return nil, nil, fmt.Sprintf("entries declare more than %d bytes uncompressed", l.totalSize), nil
+			}
+			total += size
+		}
+		kept = append(kept, f)
+	}
+	return kept, refused, "", nil
+}
+
+// entryRefusal returns why an entry is beyond the per-entry limits, or "" if it isn't.
+func (l limits) entryRefusal(f *zip.File) string {
+	size := f.UncompressedSize64
+	switch {
+	case isDirEntry(f.Name):
+		return ""
+	case l.entrySize > 0 && size > l.entrySize:
+		return fmt.Sprintf("%d bytes uncompressed, more than %d", size, l.entrySize)
+	case l.ratio > 0 && size > minRatioSize && (f.CompressedSize64 == 0 || size/f.CompressedSize64 > l.ratio):
+		return fmt.Sprintf("%d bytes uncompressed from %d, a ratio over %d", size, f.CompressedSize64, l.ratio)
+	}
+	return ""
+}
+
+// reject records that an archive was rejected for reason under the current limits, in
+// place of its index, replacing staleID if not zero, so lookups fail without reading it
+// again. It returns the error they fail with.
+func (zi *FastZipReader) reject(ctx context.Context, zipPath string, fileInfo os.FileInfo, staleID int, sum []byte, reason string) error {
+	zi.logger.WarnContext(ctx, "Rejected archive beyond limits", "archive", zipPath, "reason", reason)
+	if err := zi.recordRejection(ctx, zipPath, fileInfo, staleID, sum, reason); err != nil {
+		zi.logger.WarnContext(ctx, "Failed to record rejected archive", "archive", zipPath, "error", err)
+	}
+	return rejectedError(zipPath, reason)
+}
+
+// recordRejection records the rejection of an archive for reject.
+func (zi *FastZipReader) recordRejection(ctx context.Context, zipPath string, fileInfo os.FileInfo, staleID int, sum []byte, reason string) error {
+	tx, err := zi.db.BeginTx(ctx, nil)
+	if err != nil {
+		return zi.txError(ctx, fmt.Errorf("failed to begin transaction: %w", err))
+	}
+	defer tx.Rollback()
+	if staleID != 0 {
+		if _, err := tx.ExecContext(ctx, deleteCheckpoints, staleID); err != nil {
+			return zi.txError(ctx, fmt.Errorf("failed to delete stale index: %w", err))
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM lookup_zip_contents WHERE zip_id = ?", staleID); err != nil {
+			return zi.txError(ctx, fmt.Errorf("failed to delete stale index: %w", err))
+		}
+	}
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `INSERT INTO lookup_zip_files (zip_path, size, modification_time, modification_time_ns, fingerprint, indexed_at, last_accessed, rejected, rejected_limits)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (zip_path) DO UPDATE SET size = excluded.size, modification_time = excluded.modification_time, modification_time_ns = excluded.modification_time_ns,
+			fingerprint = excluded.fingerprint, indexed_at = excluded.indexed_at, index_duration_ns = NULL, last_accessed = excluded.last_accessed,
+			rejected = excluded.rejected, rejected_limits = excluded.rejected_limits`,
+		zipPath, fileInfo.Size(), fileInfo.ModTime().Unix(), fileInfo.ModTime().UnixNano(), sum, now.Format(time.RFC3339), now.UnixNano(), reason, zi.limits.key(),
+	)
+	if err != nil {
+		return zi.txError(ctx, fmt.Errorf("failed to record ZIP file metadata: %w", err))
+	}
+	if err := tx.Commit(); err != nil {
+		return zi.txError(ctx, fmt.Errorf("failed to commit transaction: %w", err))
+	}
+	zi.forgetResident(zipPath)
+	return nil
+}
+
+// rejection returns the error lookups of an archive fail with if it was rejected under
+// the limits l, and whether it was rejected under other limits, to be indexed again.
+func (st archiveState) rejection(zipPath string, l limits) (retry bool, err error) {
+	switch {
+	case !st.rejected.Valid:
+		return false, nil
+	case st.rejectedLimits.String != l.key():
+		return true, nil
+	}
+	return false, rejectedError(zipPath, st.rejected.String)
+}
+
+// rejectedError returns the error lookups of an archive rejected for reason fail with.
+func rejectedError(zipPath, reason string) error {
+	return fmt.Errorf("archive %s %w: %s", zipPath, ErrRejected, reason)
+}
+
+// Signatures of end of central directory records, and of the ZIP64 ones of archives with
+// more entries than the former can count.
+var (
+	directoryEndSignature       = []byte("PK\x05\x06")
+	directory64LocatorSignature = []byte("PK\x06\x07")
+	directory64EndSignature     = []byte("PK\x06\x06")
+)
+
+const (
+	directoryEndLength          = 22
+	directory64LocatorLength    = 20
+	directory64EndRecordsOffset = 32
+	maxCommentLength            = 0xffff
+)
+
+// declaredEntries returns the number of entries the end of central directory of an
+// archive declares, reading the ZIP64 record if there is one, and whether it was found.
+// Archives it isn't found in are left for archive/zip to refuse.
+func declaredEntries(file io.ReaderAt, size int64) (uint64, bool) {
+	tail := make([]byte, min(size, int64(directoryEndLength+maxCommentLength)))
+	tailOffset := size - int64(len(tail))
+	if n, err := file.ReadAt(tail, tailOffset); err != nil && !(errors.Is(err, io.EOF) && n == len(tail)) {
+		return 0, false
+	}
+	end := bytes.LastIndex(tail[:max(len(tail)-directoryEndLength+len(directoryEndSignature), 0)], directoryEndSignature)
+	if end < 0 {
+		return 0, false
+	}
+	records := uint64(binary.LittleEndian.Uint16(tail[end+10:]))
+	if records != 0xffff || end < directory64LocatorLength {
+		return records, true
+	}
+	locator := tail[end-directory64LocatorLength : end]
+	if !bytes.HasPrefix(locator, directory64LocatorSignature) {
+		return records, true
+	}
+	record := make([]byte, directory64EndRecordsOffset+8)
+	if _, err := file.ReadAt(record, int64(binary.LittleEndian.Uint64(locator[8:]))); err != nil || !bytes.HasPrefix(record, directory64EndSignature) {
+		return records, true
+	}
+	return binary.LittleEndian.Uint64(record[directory64EndRecordsOffset:]), true
+}
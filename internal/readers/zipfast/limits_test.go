@@ -0,0 +1,228 @@
+package zipfast
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// rawEntry is an archive entry written with the uncompressed size it declares, whatever
+// its data decompresses to, and the checksum of its data as stored.
+type rawEntry struct {
+	name   string
+	method uint16
+	data   []byte
+	size   uint64
+}
+
+func createRawZipFile(t *testing.T, zipPath string, entries ...rawEntry) {
+	t.Helper()
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		w, err := zipWriter.CreateRaw(&zip.FileHeader{
+			Name:               entry.name,
+			Method:             entry.method,
+			CRC32:              crc32.ChecksumIEEE(entry.data),
+			CompressedSize64:   uint64(len(entry.data)),
+			UncompressedSize64: entry.size,
+		})
+		require.NoError(t, err)
+		_, err = w.Write(entry.data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, zipWriter.Close())
+	require.NoError(t, os.WriteFile(zipPath, buf.Bytes(), 0o644))
+}
+
+func TestEntryLimits(t *testing.T) {
+	tempDir := t.TempDir()
+	zipPath := filepath.Join(tempDir, "upload.zip")
+	zeros := make([]byte, 2<<20)
+	createRawZipFile(t, zipPath,
+		rawEntry{name: "index.html", method: zip.Store, data: []byte("home"), size: 4},
+		// Zeros deflate about as well as anything does
+		rawEntry{name: "zeros.bin", method: zip.Deflate, data: deflate(t, zeros, flate.BestCompression), size: uint64(len(zeros))},
+		rawEntry{name: "petabyte.bin", method: zip.Deflate, data: deflate(t, []byte("x"), flate.BestCompression), size: 1 << 50},
+		rawEntry{name: "stored.bin", method: zip.Store, data: []byte("short"), size: 2 << 20},
+	)
+	ctx := context.Background()
+	stat := func(reader *FastZipReader, name string) error {
+		_, err := reader.Stat(ctx, zipPath, name)
+		return err
+	}
+
+	// Entries beyond the limits are left out of the index
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "default.db"), Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+	assert.NoError(t, stat(reader, "index.html"))
+	assert.NoError(t, stat(reader, "zeros.bin"))
+	assert.ErrorIs(t, stat(reader, "petabyte.bin"), ErrNotFound)
+	assert.ErrorIs(t, stat(reader, "stored.bin"), ErrNotFound)
+	v, err := reader.Verify(ctx, zipPath, false)
+	require.NoError(t, err)
+	assert.True(t, v.OK(), v.Problems)
+	assert.Equal(t, 2, v.Entries)
+
+	strict, err := NewFastZipReader(filepath.Join(tempDir, "strict.db"), Options{Limits: Limits{MaxCompressionRatio: 100}})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, strict.Close()) })
+	assert.ErrorIs(t, stat(strict, "zeros.bin"), ErrNotFound)
+	assert.NoError(t, stat(strict, "index.html"))
+
+	// or refuse the whole archive
+	whole, err := NewFastZipReader(filepath.Join(tempDir, "whole.db"), Options{Limits: Limits{RejectArchive: true}})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, whole.Close()) })
+	err = stat(whole, "index.html")
+	assert.ErrorIs(t, err, ErrRejected)
+	assert.ErrorContains(t, err, "entry petabyte.bin: 1125899906842624 bytes uncompressed")
+
+	unlimited, err := NewFastZipReader(filepath.Join(tempDir, "unlimited.db"), Options{Limits: Limits{MaxEntries: -1, MaxTotalSize: -1, MaxEntrySize: -1, MaxCompressionRatio: -1}})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, unlimited.Close()) })
+	assert.NoError(t, stat(unlimited, "petabyte.bin"))
+}
+
+func TestArchiveLimits(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+	zipPath := filepath.Join(tempDir, "upload.zip")
+	require.NoError(t, createTestZipFile(zipPath, map[string]string{"a.txt": "aaaa", "b.txt": "bbbb", "c.txt": "cccc"}))
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		limits Limits
+		reason string
+	}{
+		{Limits{MaxEntries: 2}, "3 entries declared, more than 2"},
+		{Limits{MaxTotalSize: 10}, "entries declare more than 10 bytes uncompressed"},
+	} {
+		reader, err := NewFastZipReader(filepath.Join(t.TempDir(), "test.db"), Options{Limits: tc.limits})
+		require.NoError(t, err)
+		_, err = reader.Stat(ctx, zipPath, "a.txt")
+		assert.ErrorIs(t, err, ErrRejected)
+		assert.ErrorContains(t, err, tc.reason)
+		require.NoError(t, reader.Close())
+	}
+
+	reader, err := NewFastZipReader(dbPath, Options{Limits: Limits{MaxEntries: 2}})
+	require.NoError(t, err)
+	_, err = reader.Stat(ctx, zipPath, "a.txt")
+	require.ErrorIs(t, err, ErrRejected)
+	archives, err := reader.Archives(ctx)
+	require.NoError(t, err)
+	require.Len(t, archives, 1)
+	assert.Equal(t, "3 entries declared, more than 2", archives[0].Rejected)
+	v, err := reader.Verify(ctx, zipPath, false)
+	require.NoError(t, err)
+	assert.True(t, v.OK())
+	assert.Equal(t, archives[0].Rejected, v.Rejected)
+	require.NoError(t, reader.Close())
+
+	// The rejection is recorded, so lookups don't read the archive again, across restarts
+	// too, as an archive replaced unnoticed shows
+	replaceUnnoticed(t, zipPath, map[string]string{"a.txt": "AAAA", "b.txt": "BBBB", "c.txt": "CCCC"})
+	reader, err = NewFastZipReader(dbPath, Options{Limits: Limits{MaxEntries: 2}})
+	require.NoError(t, err)
+	queries := countQueries(t, reader, dbPath)
+	_, err = reader.Stat(ctx, zipPath, "a.txt")
+	assert.ErrorIs(t, err, ErrRejected)
+	assert.Equal(t, int64(1), queries.Load())
+	_, err = reader.OpenEntry(ctx, zipPath, "a.txt")
+	assert.ErrorIs(t, err, ErrRejected)
+	_, _, err = reader.ReindexIfChanged(ctx, zipPath)
+	assert.ErrorIs(t, err, ErrRejected)
+
+	// until it changes
+	require.NoError(t, createTestZipFile(zipPath, map[string]string{"a.txt": "a", "b.txt": "b"}))
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(zipPath, later, later))
+	_, err = reader.Stat(ctx, zipPath, "a.txt")
+	assert.NoError(t, err)
+	archives, err = reader.Archives(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "", archives[0].Rejected)
+	assert.Equal(t, 2, archives[0].Entries)
+
+	// and is reconsidered under other limits
+	require.NoError(t, createTestZipFile(zipPath, map[string]string{"a.txt": "a", "b.txt": "b", "c.txt": "c"}))
+	later = later.Add(time.Hour)
+	require.NoError(t, os.Chtimes(zipPath, later, later))
+	_, err = reader.Stat(ctx, zipPath, "a.txt")
+	require.ErrorIs(t, err, ErrRejected)
+	require.NoError(t, reader.Close())
+	reader, err = NewFastZipReader(dbPath, Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+	_, err = reader.Stat(ctx, zipPath, "c.txt")
+	assert.NoError(t, err)
+}
+
+func TestDeclaredEntries(t *testing.T) {
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	require.NoError(t, zipWriter.SetComment("comment"))
+	// Archives of this many entries count them in a ZIP64 record
+	for i := range 0xffff {
+		_, err := zipWriter.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("%d", i), Method: zip.Store})
+		require.NoError(t, err)
+	}
+	require.NoError(t, zipWriter.Close())
+	archive := bytes.NewReader(buf.Bytes())
+	entries, ok := declaredEntries(archive, archive.Size())
+	require.True(t, ok)
+	assert.Equal(t, uint64(0xffff), entries)
+	_, _, reason, err := newLimits(Limits{MaxEntries: 0xfffe}).archiveFiles(archive, archive.Size(), charmap.CodePage437.NewDecoder())
+	require.NoError(t, err)
+	assert.Equal(t, "65535 entries declared, more than 65534", reason)
+
+	_, ok = declaredEntries(bytes.NewReader([]byte("not an archive")), 14)
+	assert.False(t, ok)
+}
+
+func TestReadsStopAtDeclaredSize(t *testing.T) {
+	tempDir := t.TempDir()
+	zipPath := filepath.Join(tempDir, "lying.zip")
+	createRawZipFile(t, zipPath, rawEntry{name: "short.txt", method: zip.Deflate, data: deflate(t, []byte("hello, and a lot more"), flate.BestCompression), size: 5})
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+	ctx := context.Background()
+
+	var output bytes.Buffer
+	err = reader.StreamFile(ctx, zipPath, "short.txt", &output)
+	assert.ErrorContains(t, err, "data longer than its declared size")
+	assert.Equal(t, "hello", output.String())
+
+	entry, err := reader.OpenEntry(ctx, zipPath, "short.txt")
+	require.NoError(t, err)
+	data, err := io.ReadAll(entry)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	require.NoError(t, entry.Close())
+
+	fsys, err := reader.FS(zipPath)
+	require.NoError(t, err)
+	data, err = fs.ReadFile(fsys, "short.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	v, err := reader.Verify(ctx, zipPath, true)
+	require.NoError(t, err)
+	assert.Contains(t, v.Problems, "entry short.txt: decompresses to 6 bytes, indexed 5")
+}
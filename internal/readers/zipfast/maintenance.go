@@ -0,0 +1,139 @@
+package zipfast
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ArchiveInfo describes an indexed archive.
+type ArchiveInfo struct {
+	Path string
+	// Size and Modified are those of the archive file when it was indexed.
+	Size     int64
+	Modified time.Time
+	Entries  int
+	// IndexedAt is when the archive was last indexed, to the second.
+	IndexedAt time.Time
+	// Rejected is why the archive was rejected for exceeding the Limits, with no entries
+	// indexed, or empty if it wasn't.
+	Rejected string
+}
+
+// Archives lists the indexed archives by path.
+func (zi *FastZipReader) Archives(ctx context.Context) ([]ArchiveInfo, error) {
+	rows, err := zi.db.QueryContext(ctx, `SELECT f.zip_path, f.size, f.modification_time, f.modification_time_ns, f.indexed_at, coalesce(f.rejected, ''), count(c.id)
+		FROM lookup_zip_files f LEFT JOIN lookup_zip_contents c ON c.zip_id = f.id
+		GROUP BY f.id ORDER BY f.zip_path`)
+	if err != nil {
+		return nil, zi.dbError(fmt.Errorf("failed to list archives: %w", err))
+	}
+	defer rows.Close()
+
+	var archives []ArchiveInfo
+	for rows.Next() {
+		var info ArchiveInfo
+		var state archiveState
+		var indexedAt string
+		if err := rows.Scan(&info.Path, &info.Size, &state.modTime, &state.modTimeNs, &indexedAt, &info.Rejected, &info.Entries); err != nil {
+			return nil, zi.dbError(fmt.Errorf("failed to list archives: %w", err))
+		}
+		info.Modified = state.modified()
+		info.IndexedAt, _ = time.Parse(time.RFC3339, indexedAt)
+		archives = append(archives, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, zi.dbError(fmt.Errorf("failed to list archives: %w", err))
+	}
+	return archives, nil
+}
+
+// Reindex indexes an archive again, whether or not it looks changed, and returns its
+// number of entries.
+// The index is replaced in one transaction, so operations reading it meanwhile find either
+// the old index or the new one.
+func (zi *FastZipReader) Reindex(ctx context.Context, zipPath string) (int, error) {
+	defer zi.pin(zipPath)()
+	zi.indexing.Lock()
+	defer zi.indexing.Unlock()
+	fileInfo, err := os.Stat(zipPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	var zipID int
+	err = zi.db.QueryRowContext(ctx, "SELECT id FROM lookup_zip_files WHERE zip_path = ?", zipPath).Scan(&zipID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, zi.dbError(fmt.Errorf("failed to look up archive %s: %w", zipPath, err))
+	}
+	zi.logger.InfoContext(ctx, "Reindexing archive", "archive", zipPath)
+	entries, err := zi.indexZipFile(ctx, zipPath, fileInfo, zipID)
+	if err != nil {
+		return 0, err
+	}
+	if zipID == 0 {
+		zi.evict(ctx)
+	}
+	return entries, nil
+}
+
+// ReindexIfChanged indexes an archive again if it changed since it was indexed, checked as
+// ValidateStrict does, or indexes it if it isn't yet. It returns its number of entries and
+// whether it was indexed.
+func (zi *FastZipReader) ReindexIfChanged(ctx context.Context, zipPath string) (int, bool, error) {
+	defer zi.pin(zipPath)()
+	indexed, err := zi.indexIfChanged(ctx, zipPath, ValidateStrict)
+	if err != nil {
+		return 0, false, err
+	}
+	if indexed {
+		zi.evict(ctx)
+	}
+	var entries int
+	err = zi.db.QueryRowContext(ctx, `SELECT count(c.id) FROM lookup_zip_files f JOIN lookup_zip_contents c ON c.zip_id = f.id
+		WHERE f.zip_path = ?`, zipPath).Scan(&entries)
+	if err != nil {
+		return 0, false, zi.dbError(fmt.Errorf("failed to count entries of %s: %w", zipPath, err))
+	}
+	return entries, indexed, nil
+}
+
+// Invalidate removes the index of an archive, which gets indexed again when next
+// requested, and reports whether there was one. It waits for operations that looked up an
+// archive to finish reading its index, so they don't find it gone halfway.
+func (zi *FastZipReader) Invalidate(ctx context.Context, zipPath string) (bool, error) {
+	zi.indexLock.Lock()
+	defer zi.indexLock.Unlock()
+
+	tx, err := zi.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, zi.dbError(fmt.Errorf("failed to begin transaction: %w", err))
+	}
+	defer tx.Rollback()
+	var zipID int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM lookup_zip_files WHERE zip_path = ?", zipPath).Scan(&zipID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, zi.dbError(fmt.Errorf("failed to look up archive %s: %w", zipPath, err))
+	}
+	if _, err := tx.ExecContext(ctx, deleteCheckpoints, zipID); err != nil {
+		return false, zi.dbError(fmt.Errorf("failed to invalidate %s: %w", zipPath, err))
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM lookup_zip_contents WHERE zip_id = ?", zipID); err != nil {
+		return false, zi.dbError(fmt.Errorf("failed to invalidate %s: %w", zipPath, err))
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM lookup_zip_files WHERE id = ?", zipID); err != nil {
+		return false, zi.dbError(fmt.Errorf("failed to invalidate %s: %w", zipPath, err))
+	}
+	if err := tx.Commit(); err != nil {
+		return false, zi.dbError(fmt.Errorf("failed to commit transaction: %w", err))
+	}
+	zi.forgetResident(zipPath)
+	zi.logger.InfoContext(ctx, "Invalidated archive index", "archive", zipPath)
+	return true, nil
+}
@@ -0,0 +1,146 @@
+package zipfast
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// replaceUnnoticed rewrites an archive keeping its size and modification time, as a
+// replacement within the same second would.
+func replaceUnnoticed(t *testing.T, zipPath string, files map[string]string) {
+	t.Helper()
+	info, err := os.Stat(zipPath)
+	require.NoError(t, err)
+	require.NoError(t, createTestZipFile(zipPath, files))
+	require.NoError(t, os.Chtimes(zipPath, info.ModTime(), info.ModTime()))
+	replaced, err := os.Stat(zipPath)
+	require.NoError(t, err)
+	require.Equal(t, info.Size(), replaced.Size())
+}
+
+func TestReindexAndInvalidate(t *testing.T) {
+	tempDir := t.TempDir()
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+	ctx := context.Background()
+
+	zipPath := filepath.Join(tempDir, "site.zip")
+	require.NoError(t, createTestZipFile(zipPath, map[string]string{"index.html": "version 1", "a.txt": "a"}))
+	read := func() string {
+		var output bytes.Buffer
+		require.NoError(t, reader.StreamFile(ctx, zipPath, "index.html", &output))
+		return output.String()
+	}
+	assert.Equal(t, "version 1", read())
+	archives, err := reader.Archives(ctx)
+	require.NoError(t, err)
+	require.Len(t, archives, 1)
+	assert.Equal(t, zipPath, archives[0].Path)
+	assert.Equal(t, 2, archives[0].Entries)
+	assert.WithinDuration(t, time.Now(), archives[0].IndexedAt, time.Minute)
+	before := archives[0]
+
+	// The stale index goes unnoticed until the archive is reindexed
+	replaceUnnoticed(t, zipPath, map[string]string{"index.html": "version 2", "b.txt": "b"})
+	_, err = reader.Stat(ctx, zipPath, "b.txt")
+	assert.ErrorIs(t, err, ErrNotFound)
+	entries, err := reader.Reindex(ctx, zipPath)
+	require.NoError(t, err)
+	assert.Equal(t, 2, entries)
+	assert.Equal(t, "version 2", read())
+	_, err = reader.Stat(ctx, zipPath, "b.txt")
+	assert.NoError(t, err)
+	_, err = reader.Stat(ctx, zipPath, "a.txt")
+	assert.ErrorIs(t, err, ErrNotFound)
+	archives, err = reader.Archives(ctx)
+	require.NoError(t, err)
+	require.Len(t, archives, 1)
+	assert.Equal(t, before.Size, archives[0].Size)
+	assert.Equal(t, before.Modified, archives[0].Modified)
+
+	// Invalidated archives are indexed again when next requested
+	replaceUnnoticed(t, zipPath, map[string]string{"index.html": "version 3", "c.txt": "c"})
+	invalidated, err := reader.Invalidate(ctx, zipPath)
+	require.NoError(t, err)
+	assert.True(t, invalidated)
+	archives, err = reader.Archives(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, archives)
+	invalidated, err = reader.Invalidate(ctx, zipPath)
+	require.NoError(t, err)
+	assert.False(t, invalidated)
+	assert.Equal(t, "version 3", read())
+	_, err = reader.Stat(ctx, zipPath, "c.txt")
+	assert.NoError(t, err)
+
+	// Archives not indexed yet are indexed by Reindex, missing ones fail
+	other := filepath.Join(tempDir, "other.zip")
+	require.NoError(t, createTestZipFile(other, map[string]string{"x": "x"}))
+	entries, err = reader.Reindex(ctx, other)
+	require.NoError(t, err)
+	assert.Equal(t, 1, entries)
+	_, err = reader.Reindex(ctx, filepath.Join(tempDir, "missing.zip"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	archives, err = reader.Archives(ctx)
+	require.NoError(t, err)
+	require.Len(t, archives, 2)
+	assert.Equal(t, other, archives[0].Path)
+}
+
+func TestReindexConcurrentReads(t *testing.T) {
+	tempDir := t.TempDir()
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+	ctx := context.Background()
+
+	zipPath := filepath.Join(tempDir, "site.zip")
+	require.NoError(t, createTestZipFile(zipPath, map[string]string{"index.html": "version 1"}))
+	_, err = reader.Reindex(ctx, zipPath)
+	require.NoError(t, err)
+
+	// Readers find the archive indexed throughout, whether reindexed or invalidated
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				var output bytes.Buffer
+				if !assert.NoError(t, reader.StreamFile(ctx, zipPath, "index.html", &output)) {
+					return
+				}
+				assert.Equal(t, "version 1", output.String())
+				entries, err := reader.ReadDir(ctx, zipPath, "")
+				if assert.NoError(t, err) {
+					assert.Len(t, entries, 1)
+				}
+			}
+		}()
+	}
+	for i := range 20 {
+		if i%2 == 0 {
+			_, err = reader.Reindex(ctx, zipPath)
+		} else {
+			_, err = reader.Invalidate(ctx, zipPath)
+		}
+		require.NoError(t, err)
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,67 @@
+package zipfast
+
+import (
+	"archive/zip"
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// ParseNameEncoding parses the IANA name of the encoding of entry names lacking the UTF-8
+// flag, such as cp437, cp866 or shift_jis. The default, "", is cp437, which the ZIP format
+// specifies; utf-8 keeps names as they are stored.
+func ParseNameEncoding(name string) (encoding.Encoding, error) {
+	if name == "" {
+		return charmap.CodePage437, nil
+	}
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil || enc == nil {
+		return nil, fmt.Errorf("unsupported name encoding %q, use an IANA name such as cp437, cp866 or shift_jis", name)
+	}
+	if enc == unicode.UTF8 {
+		return encoding.Nop, nil
+	}
+	return enc, nil
+}
+
+// archiveEntry is an entry of an archive along with the UTF-8 name it is indexed under.
+type archiveEntry struct {
+	file *zip.File
+	name string
+}
+
+// indexedFiles returns the entries of an archive to index, sorted by the names they are
+// indexed under, which are decoded with names unless they have the UTF-8 flag. Archives
+// updated by appending can list a name more than once; as when extracting them, the last
+// entry with the name wins.
+func indexedFiles(entries []*zip.File, names *encoding.Decoder) []archiveEntry {
+	files := make([]archiveEntry, len(entries))
+	for i, f := range entries {
+		files[i] = archiveEntry{file: f, name: f.Name}
+		if f.NonUTF8 {
+			if name, err := names.String(f.Name); err == nil {
+				files[i].name = name
+			}
+		}
+	}
+	slices.SortStableFunc(files, func(a, b archiveEntry) int { return strings.Compare(a.name, b.name) })
+	kept := files[:0]
+	for i, f := range files {
+		if i+1 < len(files) && files[i+1].name == f.name {
+			continue
+		}
+		kept = append(kept, f)
+	}
+	return kept
+}
+
+// isDirEntry reports whether name is that of an explicit directory entry. Those are indexed,
+// so empty directories exist, but never served as files.
+func isDirEntry(name string) bool {
+	return strings.HasSuffix(name, "/")
+}
@@ -0,0 +1,126 @@
+package zipfast
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+)
+
+// createLegacyZipFile writes an archive whose entry names are stored as given, without the
+// UTF-8 flag, as older Windows tools write them.
+func createLegacyZipFile(t *testing.T, zipPath string, files map[string]string) {
+	t.Helper()
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zipWriter.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, NonUTF8: true})
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zipWriter.Close())
+	require.NoError(t, os.WriteFile(zipPath, buf.Bytes(), 0o644))
+}
+
+func TestParseNameEncoding(t *testing.T) {
+	for name, expected := range map[string]encoding.Encoding{
+		"":          charmap.CodePage437,
+		"cp437":     charmap.CodePage437,
+		"IBM866":    charmap.CodePage866,
+		"shift_jis": japanese.ShiftJIS,
+		"utf-8":     encoding.Nop,
+	} {
+		enc, err := ParseNameEncoding(name)
+		require.NoError(t, err, name)
+		assert.Equal(t, expected, enc, name)
+	}
+	_, err := ParseNameEncoding("klingon")
+	assert.Error(t, err)
+}
+
+func TestNameEncoding(t *testing.T) {
+	tempDir := t.TempDir()
+	ctx := context.Background()
+	open := func(name string, enc encoding.Encoding) *FastZipReader {
+		reader, err := NewFastZipReader(filepath.Join(tempDir, name), Options{NameEncoding: enc})
+		require.NoError(t, err)
+		t.Cleanup(func() { require.NoError(t, reader.Close()) })
+		return reader
+	}
+	read := func(reader *FastZipReader, zipPath, name string) string {
+		var output bytes.Buffer
+		require.NoError(t, reader.StreamFile(ctx, zipPath, name, &output), name)
+		return output.String()
+	}
+
+	// ü and ß in CP437, next to a name flagged as UTF-8 and a plain ASCII one
+	zipPath := filepath.Join(tempDir, "cp437.zip")
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for _, entry := range []struct {
+		header  zip.FileHeader
+		content string
+	}{
+		{zip.FileHeader{Name: "\x81berblick.html", NonUTF8: true}, "Überblick"},
+		{zip.FileHeader{Name: "stra\xe1e/plan.txt", NonUTF8: true}, "Straße"},
+		{zip.FileHeader{Name: "größe.txt"}, "UTF-8"},
+		{zip.FileHeader{Name: "index.html"}, "index"},
+	} {
+		w, err := zipWriter.CreateHeader(&entry.header)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(entry.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zipWriter.Close())
+	require.NoError(t, os.WriteFile(zipPath, buf.Bytes(), 0o644))
+
+	reader := open("cp437.db", nil)
+	assert.Equal(t, "Überblick", read(reader, zipPath, "überblick.html"))
+	assert.Equal(t, "Straße", read(reader, zipPath, "straße/plan.txt"))
+	assert.Equal(t, "UTF-8", read(reader, zipPath, "größe.txt"))
+	assert.Equal(t, "index", read(reader, zipPath, "index.html"))
+	assert.ErrorIs(t, reader.StreamFile(ctx, zipPath, "\x81berblick.html", &bytes.Buffer{}), ErrNotFound)
+	entries, err := reader.ReadDir(ctx, zipPath, "")
+	require.NoError(t, err)
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name
+	}
+	assert.Equal(t, []string{"größe.txt", "index.html", "straße", "überblick.html"}, names)
+
+	// Verification matches entries by their stored names, even under another encoding
+	v, err := reader.Verify(ctx, zipPath, true)
+	require.NoError(t, err)
+	assert.True(t, v.OK(), v.Problems)
+	var raw []byte
+	require.NoError(t, reader.db.QueryRow("SELECT raw_name FROM lookup_zip_contents WHERE file_name = ?", "überblick.html").Scan(&raw))
+	assert.Equal(t, []byte("\x81berblick.html"), raw)
+	other := open("other.db", charmap.CodePage866)
+	_, err = other.Reindex(ctx, zipPath)
+	require.NoError(t, err)
+	other.nameEncoding = charmap.CodePage437
+	v, err = other.Verify(ctx, zipPath, false)
+	require.NoError(t, err)
+	assert.True(t, v.OK(), v.Problems)
+
+	// Another encoding, chosen for archives from Japanese systems
+	name, err := japanese.ShiftJIS.NewEncoder().String("資料/日本語.txt")
+	require.NoError(t, err)
+	sjisPath := filepath.Join(tempDir, "sjis.zip")
+	createLegacyZipFile(t, sjisPath, map[string]string{name: "Shift-JIS"})
+	assert.Equal(t, "Shift-JIS", read(open("sjis.db", japanese.ShiftJIS), sjisPath, "資料/日本語.txt"))
+
+	// Kept as stored with utf-8, bytes that aren't valid UTF-8 included
+	latin1Path := filepath.Join(tempDir, "latin1.zip")
+	createLegacyZipFile(t, latin1Path, map[string]string{"latin1-\xe9t\xe9.txt": "not UTF-8"})
+	assert.Equal(t, "not UTF-8", read(open("raw.db", encoding.Nop), latin1Path, "latin1-\xe9t\xe9.txt"))
+}
@@ -0,0 +1,247 @@
+package zipfast
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+// residentEntryOverhead approximates the memory an entry of a resident archive takes
+// besides its name: its fileEntry, and its share of the map and the list of names.
+const residentEntryOverhead = int64(unsafe.Sizeof(fileEntry{})) + 64
+
+// residentArchive is the index of an archive held in memory by KeepResident, so that
+// looking up its entries doesn't query the database.
+type residentArchive struct {
+	// state is the archive as it was indexed, to validate lookups against.
+	state   archiveState
+	entries map[string]fileEntry
+	// names lists the names of the entries in order, for ReadDir, Walk and Resolve.
+	names []string
+	size  int64
+}
+
+// KeepResident keeps the index of an archive in memory, indexing it first if needed, and
+// returns its number of entries and the approximate memory it takes. Lookups of its entries
+// are then answered without querying the database, after the validation of their context,
+// and the index is loaded again once the archive is reindexed, invalidated or found
+// changed. Resident archives are never evicted.
+func (zi *FastZipReader) KeepResident(ctx context.Context, zipPath string) (entries int, size int64, err error) {
+	zi.residentMu.Lock()
+	_, registered := zi.resident[zipPath]
+	if !registered {
+		zi.resident[zipPath] = nil
+	}
+	zi.residentMu.Unlock()
+	resident, err := zi.residentIndex(ctx, zipPath)
+	if err != nil {
+		if !registered {
+			zi.residentMu.Lock()
+			delete(zi.resident, zipPath)
+			zi.residentGeneration++
+			zi.residentMu.Unlock()
+		}
+		return 0, 0, err
+	}
+	return len(resident.names), resident.size, nil
+}
+
+// isResident reports whether an archive was kept resident.
+func (zi *FastZipReader) isResident(zipPath string) bool {
+	zi.residentMu.RLock()
+	defer zi.residentMu.RUnlock()
+	_, ok := zi.resident[zipPath]
+	return ok
+}
+
+// residentIndex returns the index in memory of a resident archive, loading it if it isn't
+// yet or if the archive changed as checked by the validation of ctx, or nil for archives
+// that aren't resident.
+func (zi *FastZipReader) residentIndex(ctx context.Context, zipPath string) (*residentArchive, error) {
+	zi.residentMu.RLock()
+	resident, ok := zi.resident[zipPath]
+	zi.residentMu.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	if resident != nil {
+		changed := false
+		if v := zi.validation(ctx); v != ValidateNone {
+			fileInfo, err := os.Stat(zipPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get file info: %w", err)
+			}
+			if changed, err = resident.state.changed(zipPath, fileInfo, v); err != nil {
+				return nil, err
+			}
+		}
+		if !changed {
+			zi.hits.Add(1)
+			zi.observer.IndexLookup(true)
+			return resident, nil
+		}
+	}
+	return zi.loadResident(ctx, zipPath)
+}
+
+// loadResident reads the index of a resident archive into memory, indexing the archive if
+// needed. An index loaded while the archive is reindexed or invalidated serves the call
+// loading it, but isn't kept.
+func (zi *FastZipReader) loadResident(ctx context.Context, zipPath string) (*residentArchive, error) {
+	zipID, done, err := zi.lookup(ctx, zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	// Indexing by the lookup drops the index in memory before this load, and reindexing
+	// racing with it after
+	zi.residentMu.RLock()
+	generation := zi.residentGeneration
+	zi.residentMu.RUnlock()
+	resident := &residentArchive{entries: make(map[string]fileEntry)}
+	if err := resident.state.scan(zi.db.QueryRowContext(ctx, selectArchiveState, zipPath)); err != nil {
+		return nil, zi.dbError(fmt.Errorf("failed to look up archive %s: %w", zipPath, err))
+	}
+	rows, err := zi.db.QueryContext(ctx, "SELECT id, file_name, offset, compressed_size, uncompressed_size, compression_method, crc32, modified FROM lookup_zip_contents WHERE zip_id = ? ORDER BY file_name", zipID)
+	if err != nil {
+		return nil, zi.dbError(fmt.Errorf("failed to read index of %s: %w", zipPath, err))
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry fileEntry
+		var crc, modified sql.NullInt64
+		if err := rows.Scan(&entry.id, &entry.info.Name, &entry.offset, &entry.info.CompressedSize, &entry.info.UncompressedSize, &entry.info.CompressionMethod, &crc, &modified); err != nil {
+			return nil, zi.dbError(fmt.Errorf("failed to read index of %s: %w", zipPath, err))
+		}
+		entry.info.CRC32, entry.info.HasCRC32 = uint32(crc.Int64), crc.Valid
+		entry.info.Modified = modifiedTime(modified)
+		resident.names = append(resident.names, entry.info.Name)
+		resident.entries[entry.info.Name] = entry
+		resident.size += int64(len(entry.info.Name)) + residentEntryOverhead
+	}
+	if err := rows.Err(); err != nil {
+		return nil, zi.dbError(fmt.Errorf("failed to read index of %s: %w", zipPath, err))
+	}
+
+	zi.residentMu.Lock()
+	if _, ok := zi.resident[zipPath]; ok && zi.residentGeneration == generation {
+		zi.resident[zipPath] = resident
+	}
+	zi.residentMu.Unlock()
+	zi.logger.InfoContext(ctx, "Loaded archive index into memory", "archive", zipPath, "entries", len(resident.names), "bytes", resident.size)
+	return resident, nil
+}
+
+// forgetResident drops the index in memory of a resident archive, once its index changed,
+// so that it is loaded again when next looked up.
+func (zi *FastZipReader) forgetResident(zipPath string) {
+	zi.residentMu.Lock()
+	defer zi.residentMu.Unlock()
+	if _, ok := zi.resident[zipPath]; ok {
+		zi.resident[zipPath] = nil
+		zi.residentGeneration++
+	}
+}
+
+// under returns the names starting with prefix, which sort together.
+func (ra *residentArchive) under(prefix string) []string {
+	from := sort.SearchStrings(ra.names, prefix)
+	to := from
+	for to < len(ra.names) && strings.HasPrefix(ra.names[to], prefix) {
+		to++
+	}
+	return ra.names[from:to]
+}
+
+// readDir lists the immediate children of a directory, as readDir does from the index.
+func (ra *residentArchive) readDir(dir string) ([]DirEntry, error) {
+	names := ra.under(dir)
+	if len(names) == 0 && dir != "" {
+		return nil, fmt.Errorf("directory %s: %w", dir, ErrNotFound)
+	}
+	children := make(map[string]DirEntry)
+	for _, name := range names {
+		rest := strings.TrimPrefix(name, dir)
+		if rest == "" {
+			continue
+		}
+		if i := strings.Index(rest, "/"); i >= 0 {
+			children[rest[:i]] = DirEntry{Name: rest[:i], IsDir: true}
+		} else if _, exists := children[rest]; !exists {
+			info := ra.entries[name].info
+			children[rest] = DirEntry{Name: rest, Size: info.UncompressedSize, Modified: info.Modified}
+		}
+	}
+	entries := make([]DirEntry, 0, len(children))
+	for _, entry := range children {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// walk calls fn for the entries starting with prefix, in name order.
+func (ra *residentArchive) walk(prefix string, fn func(FileInfo) error) error {
+	for _, name := range ra.under(prefix) {
+		if err := fn(ra.entries[name].info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve resolves a name as Resolve does from the index, comparing ASCII letters
+// case-insensitively as SQLite's NOCASE collation does.
+func (ra *residentArchive) resolve(name string) (string, error) {
+	isDir := strings.HasSuffix(name, "/")
+	if _, ok := ra.entries[name]; (ok && !isDir) || (isDir && len(ra.under(name)) > 0) {
+		return name, nil
+	}
+	var matches []string
+	for _, candidate := range ra.names {
+		if isDir {
+			if len(candidate) < len(name) || !asciiEqualFold(candidate[:len(name)], name) {
+				continue
+			}
+			candidate = candidate[:len(name)]
+		} else if !asciiEqualFold(candidate, name) {
+			continue
+		}
+		if !slices.Contains(matches, candidate) {
+			matches = append(matches, candidate)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("%s: %w", name, ErrNotFound)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("%s: %w", name, ErrAmbiguous)
+	}
+}
+
+// asciiEqualFold reports whether a and b are equal once ASCII letters are folded.
+func asciiEqualFold(a, b string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range len(a) {
+		ca, cb := a[i], b[i]
+		if 'A' <= ca && ca <= 'Z' {
+			ca += 'a' - 'A'
+		}
+		if 'A' <= cb && cb <= 'Z' {
+			cb += 'a' - 'A'
+		}
+		if ca != cb {
+			return false
+		}
+	}
+	return true
+}
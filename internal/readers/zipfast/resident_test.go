@@ -0,0 +1,208 @@
+package zipfast
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingConnector opens connections of a driver that count the statements prepared on
+// them. The wrapped connections only offer Prepare, which database/sql falls back to for
+// every query and exec.
+type countingConnector struct {
+	driver  driver.Driver
+	dsn     string
+	queries *atomic.Int64
+}
+
+func (c countingConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{Conn: conn, queries: c.queries}, nil
+}
+
+func (c countingConnector) Driver() driver.Driver { return c.driver }
+
+type countingConn struct {
+	driver.Conn
+	queries *atomic.Int64
+}
+
+func (c countingConn) Prepare(query string) (driver.Stmt, error) {
+	c.queries.Add(1)
+	return c.Conn.Prepare(query)
+}
+
+// countQueries makes reader count the statements it runs against its database.
+func countQueries(t *testing.T, reader *FastZipReader, dbPath string) *atomic.Int64 {
+	t.Helper()
+	queries := new(atomic.Int64)
+	counting := sql.OpenDB(countingConnector{driver: reader.db.Driver(), dsn: dbPath, queries: queries})
+	require.NoError(t, reader.db.Close())
+	reader.db = counting
+	return queries
+}
+
+func TestKeepResident(t *testing.T) {
+	tempDir := t.TempDir()
+	dbPath := filepath.Join(tempDir, "test.db")
+	zipPath := filepath.Join(tempDir, "bundle.zip")
+	files := map[string]string{
+		"index.html":      "home",
+		"README.md":       "readme",
+		"docs/guide.txt":  "guide",
+		"docs/":           "",
+		"docs.txt":        "a file named like a directory",
+		"Assets/app.js":   "app",
+		"Assets/app.css":  "style",
+		"deep/a/b/c.txt":  "deep",
+		"deep/a/b2/c.txt": "deep too",
+	}
+	require.NoError(t, createTestZipFile(zipPath, files))
+	ctx := context.Background()
+
+	// What a reader answers from the index, for comparison
+	plain, err := NewFastZipReader(filepath.Join(tempDir, "plain.db"), Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, plain.Close()) })
+
+	reader, err := NewFastZipReader(dbPath, Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+	queries := countQueries(t, reader, dbPath)
+
+	entries, size, err := reader.KeepResident(ctx, zipPath)
+	require.NoError(t, err)
+	assert.Equal(t, len(files), entries)
+	assert.Greater(t, size, int64(len(files))*residentEntryOverhead)
+
+	// Once loaded, lookups don't query the database
+	queries.Store(0)
+	for name, content := range files {
+		if isDirEntry(name) {
+			continue
+		}
+		info, err := reader.Stat(ctx, zipPath, name)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(len(content)), info.UncompressedSize, name)
+		var output bytes.Buffer
+		require.NoError(t, reader.StreamFile(ctx, zipPath, name, &output))
+		assert.Equal(t, content, output.String(), name)
+		er, err := reader.OpenEntry(ctx, zipPath, name)
+		require.NoError(t, err)
+		data, err := io.ReadAll(er)
+		require.NoError(t, err)
+		require.NoError(t, er.Close())
+		assert.Equal(t, content, string(data), name)
+	}
+	for _, dir := range []string{"", "docs/", "deep/", "deep/a/", "Assets/"} {
+		want, err := plain.ReadDir(ctx, zipPath, dir)
+		require.NoError(t, err)
+		got, err := reader.ReadDir(ctx, zipPath, dir)
+		require.NoError(t, err)
+		assert.Equal(t, want, got, dir)
+	}
+	for _, name := range []string{"readme.MD", "assets/", "DOCS/", "docs/GUIDE.txt", "missing.txt", "missing/", "deep/a/B/"} {
+		want, wantErr := plain.Resolve(ctx, zipPath, name)
+		got, err := reader.Resolve(ctx, zipPath, name)
+		assert.Equal(t, want, got, name)
+		assert.Equal(t, wantErr, err, name)
+	}
+	for _, prefix := range []string{"", "deep/", "docs"} {
+		var want, got []FileInfo
+		require.NoError(t, plain.Walk(ctx, zipPath, prefix, func(info FileInfo) error { want = append(want, info); return nil }))
+		require.NoError(t, reader.Walk(ctx, zipPath, prefix, func(info FileInfo) error { got = append(got, info); return nil }))
+		assert.Equal(t, want, got, prefix)
+	}
+	_, err = reader.Stat(ctx, zipPath, "missing.txt")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = reader.ReadDir(ctx, zipPath, "missing/")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Zero(t, queries.Load())
+
+	// A changed archive is reindexed and loaded again, once
+	require.NoError(t, createTestZipFile(zipPath, map[string]string{"index.html": "new home", "added.txt": "added"}))
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(zipPath, later, later))
+	var output bytes.Buffer
+	require.NoError(t, reader.StreamFile(ctx, zipPath, "added.txt", &output))
+	assert.Equal(t, "added", output.String())
+	assert.NotZero(t, queries.Load())
+	queries.Store(0)
+	_, err = reader.Stat(ctx, zipPath, "docs/guide.txt")
+	assert.ErrorIs(t, err, ErrNotFound)
+	listing, err := reader.ReadDir(ctx, zipPath, "")
+	require.NoError(t, err)
+	assert.Len(t, listing, 2)
+	assert.Zero(t, queries.Load())
+
+	// Invalidating and reindexing drop the loaded index as well
+	_, err = reader.Invalidate(ctx, zipPath)
+	require.NoError(t, err)
+	info, err := reader.Stat(ctx, zipPath, "index.html")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(len("new home")), info.UncompressedSize)
+	replaceUnnoticed(t, zipPath, map[string]string{"index.html": "new page", "added.txt": "other"})
+	_, err = reader.Reindex(ctx, zipPath)
+	require.NoError(t, err)
+	output.Reset()
+	require.NoError(t, reader.StreamFile(ctx, zipPath, "added.txt", &output))
+	assert.Equal(t, "other", output.String())
+}
+
+func TestKeepResidentMissingArchive(t *testing.T) {
+	tempDir := t.TempDir()
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+
+	_, _, err = reader.KeepResident(context.Background(), filepath.Join(tempDir, "missing.zip"))
+	assert.Error(t, err)
+	assert.False(t, reader.isResident(filepath.Join(tempDir, "missing.zip")))
+}
+
+// BenchmarkStatResident looks up entries of an archive of 10,000 entries from the index and
+// from memory.
+func BenchmarkStatResident(b *testing.B) {
+	tempDir := b.TempDir()
+	zipPath := filepath.Join(tempDir, "bundle.zip")
+	files := make(map[string]string)
+	for i := range 10000 {
+		files[fmt.Sprintf("assets/chunk-%05d.js", i)] = "chunk"
+	}
+	require.NoError(b, createTestZipFile(zipPath, files))
+	for _, resident := range []bool{false, true} {
+		b.Run(map[bool]string{false: "index", true: "resident"}[resident], func(b *testing.B) {
+			reader, err := NewFastZipReader(filepath.Join(b.TempDir(), "bench.db"), Options{Logger: slog.New(slog.DiscardHandler)})
+			require.NoError(b, err)
+			b.Cleanup(func() { _ = reader.Close() })
+			ctx := context.Background()
+			if resident {
+				_, _, err = reader.KeepResident(ctx, zipPath)
+			} else {
+				_, err = reader.Stat(ctx, zipPath, "assets/chunk-00000.js")
+			}
+			require.NoError(b, err)
+			i := 0
+			for b.Loop() {
+				_, err := reader.Stat(ctx, zipPath, fmt.Sprintf("assets/chunk-%05d.js", i%10000))
+				require.NoError(b, err)
+				i++
+			}
+		})
+	}
+}
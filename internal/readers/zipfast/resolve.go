@@ -0,0 +1,87 @@
+package zipfast
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Resolve returns the name of the entry matching name exactly or, failing that, of the
+// single entry matching it with ASCII letters compared case-insensitively. Slash-terminated
+// names are resolved as directories, which needn't have entries of their own. It fails
+// with ErrNotFound when nothing matches and ErrAmbiguous when several entries match once
+// case is ignored, such as README.md and readme.md. Lookups use an index of the names, so
+// they don't scan the archive. The archive gets indexed automatically.
+func (zi *FastZipReader) Resolve(ctx context.Context, zipPath, name string) (string, error) {
+	defer zi.pin(zipPath)()
+	resident, err := zi.residentIndex(ctx, zipPath)
+	if err != nil {
+		return "", err
+	}
+	if resident != nil {
+		return resident.resolve(name)
+	}
+	zipID, done, err := zi.lookup(ctx, zipPath)
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	if strings.HasSuffix(name, "/") {
+		return zi.resolveDir(ctx, zipID, name)
+	}
+
+	var exact bool
+	err = zi.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM lookup_zip_contents WHERE zip_id = ? AND file_name = ?)", zipID, name).Scan(&exact)
+	if err != nil {
+		return "", zi.dbError(fmt.Errorf("failed to resolve %s: %w", name, err))
+	}
+	if exact {
+		return name, nil
+	}
+	return zi.resolveFolded(ctx, name, "SELECT file_name FROM lookup_zip_contents WHERE zip_id = ? AND file_name = ? COLLATE NOCASE LIMIT 2", zipID, name)
+}
+
+// resolveDir resolves a slash-terminated directory name. Entries below a directory sort
+// between its name and the name with the slash replaced by the next character, 0.
+func (zi *FastZipReader) resolveDir(ctx context.Context, zipID int, dir string) (string, error) {
+	upper := strings.TrimSuffix(dir, "/") + "0"
+	var exact bool
+	err := zi.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM lookup_zip_contents WHERE zip_id = ? AND file_name >= ? AND file_name < ?)", zipID, dir, upper).Scan(&exact)
+	if err != nil {
+		return "", zi.dbError(fmt.Errorf("failed to resolve %s: %w", dir, err))
+	}
+	if exact {
+		return dir, nil
+	}
+
+	return zi.resolveFolded(ctx, dir, "SELECT DISTINCT substr(file_name, 1, ?) FROM lookup_zip_contents WHERE zip_id = ? AND file_name >= ? COLLATE NOCASE AND file_name < ? COLLATE NOCASE LIMIT 2", utf8.RuneCountInString(dir), zipID, dir, upper)
+}
+
+// resolveFolded runs a query returning up to two names matching name once case is ignored.
+func (zi *FastZipReader) resolveFolded(ctx context.Context, name, query string, args ...any) (string, error) {
+	rows, err := zi.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return "", zi.dbError(fmt.Errorf("failed to resolve %s: %w", name, err))
+	}
+	defer rows.Close()
+	var matches []string
+	for rows.Next() {
+		var match string
+		if err := rows.Scan(&match); err != nil {
+			return "", zi.dbError(fmt.Errorf("failed to resolve %s: %w", name, err))
+		}
+		matches = append(matches, match)
+	}
+	if err := rows.Err(); err != nil {
+		return "", zi.dbError(fmt.Errorf("failed to resolve %s: %w", name, err))
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("%s: %w", name, ErrNotFound)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("%s: %w", name, ErrAmbiguous)
+	}
+}
@@ -0,0 +1,66 @@
+package zipfast
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolve(t *testing.T) {
+	tempDir := t.TempDir()
+	zipPath := filepath.Join(tempDir, "test.zip")
+	require.NoError(t, createTestZipFile(zipPath, map[string]string{
+		"Index.html":          "home",
+		"README.md":           "upper",
+		"readme.md":           "lower",
+		"Docs/Guide.txt":      "guide",
+		"Assets/app.js":       "app",
+		"assets/style.css":    "style",
+		"Percent%_/file.txt":  "wildcards",
+		"Docs.old/backup.txt": "backup",
+	}))
+
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+
+	for name, want := range map[string]string{
+		"Index.html":         "Index.html",
+		"index.HTML":         "Index.html",
+		"README.md":          "README.md",
+		"readme.md":          "readme.md",
+		"docs/guide.TXT":     "Docs/Guide.txt",
+		"docs/":              "Docs/",
+		"DOCS/":              "Docs/",
+		"Docs/":              "Docs/",
+		"assets/":            "assets/",
+		"Assets/":            "Assets/",
+		"percent%_/":         "Percent%_/",
+		"docs.OLD/":          "Docs.old/",
+		"assets/STYLE.css":   "assets/style.css",
+		"Assets/App.js":      "Assets/app.js",
+		"percent%_/FILE.txt": "Percent%_/file.txt",
+	} {
+		resolved, err := reader.Resolve(context.Background(), zipPath, name)
+		require.NoError(t, err, name)
+		assert.Equal(t, want, resolved, name)
+	}
+
+	// Exact matches win, but several matches once case is ignored resolve to none
+	for _, name := range []string{"Readme.md", "ASSETS/"} {
+		_, err := reader.Resolve(context.Background(), zipPath, name)
+		assert.ErrorIs(t, err, ErrAmbiguous, name)
+	}
+	for _, name := range []string{"missing.txt", "docs/guide", "Doc/", "docs/guide.txt/"} {
+		_, err := reader.Resolve(context.Background(), zipPath, name)
+		assert.ErrorIs(t, err, ErrNotFound, name)
+	}
+
+	var plan string
+	var id, parent, unused int
+	require.NoError(t, reader.db.QueryRow("EXPLAIN QUERY PLAN SELECT file_name FROM lookup_zip_contents WHERE zip_id = ? AND file_name = ? COLLATE NOCASE LIMIT 2", 1, "readme.md").Scan(&id, &parent, &unused, &plan))
+	assert.Contains(t, plan, "lookup_zip_contents_nocase")
+}
@@ -0,0 +1,108 @@
+package zipfast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// recentArchives is the number of archives Stats lists among the most recently indexed.
+const recentArchives = 10
+
+// Stats summarizes the index, and the lookups and open archives of a FastZipReader since
+// it was created.
+type Stats struct {
+	Archives int
+	Entries  int
+	// DatabaseSize is the size of the database file, its write-ahead log included.
+	DatabaseSize int64
+	// Hits and Misses count the archive lookups finding an index, and those indexing the
+	// archive first.
+	Hits   int64
+	Misses int64
+	// OpenArchives counts the archive files open to index or read them.
+	OpenArchives int64
+	// Recent lists the most recently indexed archives, latest first.
+	Recent []IndexedArchive
+}
+
+// IndexedArchive describes the last indexing of an archive.
+type IndexedArchive struct {
+	Path      string
+	Entries   int
+	IndexedAt time.Time
+	// Duration is how long indexing took, or zero for archives indexed before durations
+	// were recorded.
+	Duration time.Duration
+}
+
+// Stats counts the indexed archives and entries, with a few aggregate queries.
+func (zi *FastZipReader) Stats(ctx context.Context) (Stats, error) {
+	stats := Stats{Hits: zi.hits.Load(), Misses: zi.misses.Load(), OpenArchives: zi.open.Load()}
+	err := zi.db.QueryRowContext(ctx, "SELECT (SELECT count(*) FROM lookup_zip_files), (SELECT count(*) FROM lookup_zip_contents)").Scan(&stats.Archives, &stats.Entries)
+	if err != nil {
+		return Stats{}, zi.dbError(fmt.Errorf("failed to count archives: %w", err))
+	}
+
+	rows, err := zi.db.QueryContext(ctx, `SELECT f.zip_path, f.indexed_at, f.index_duration_ns, (SELECT count(*) FROM lookup_zip_contents c WHERE c.zip_id = f.id)
+		FROM lookup_zip_files f ORDER BY f.indexed_at DESC, f.id DESC LIMIT ?`, recentArchives)
+	if err != nil {
+		return Stats{}, zi.dbError(fmt.Errorf("failed to list recent archives: %w", err))
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var archive IndexedArchive
+		var indexedAt string
+		var duration *int64
+		if err := rows.Scan(&archive.Path, &indexedAt, &duration, &archive.Entries); err != nil {
+			return Stats{}, zi.dbError(fmt.Errorf("failed to list recent archives: %w", err))
+		}
+		archive.IndexedAt, _ = time.Parse(time.RFC3339, indexedAt)
+		if duration != nil {
+			archive.Duration = time.Duration(*duration)
+		}
+		stats.Recent = append(stats.Recent, archive)
+	}
+	if err := rows.Err(); err != nil {
+		return Stats{}, zi.dbError(fmt.Errorf("failed to list recent archives: %w", err))
+	}
+
+	var file string
+	if err := zi.db.QueryRowContext(ctx, "SELECT file FROM pragma_database_list WHERE name = 'main'").Scan(&file); err != nil {
+		return Stats{}, zi.dbError(fmt.Errorf("failed to locate database: %w", err))
+	}
+	for _, name := range []string{file, file + "-wal"} {
+		if info, err := os.Stat(name); err == nil {
+			stats.DatabaseSize += info.Size()
+		}
+	}
+	return stats, nil
+}
+
+// archiveFile is an archive file opened by a FastZipReader, counted in Stats until it is
+// closed.
+type archiveFile struct {
+	*os.File
+	open *atomic.Int64
+}
+
+// openArchive opens an archive file for reading.
+func (zi *FastZipReader) openArchive(zipPath string) (*archiveFile, error) {
+	file, err := os.Open(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	zi.open.Add(1)
+	return &archiveFile{File: file, open: &zi.open}, nil
+}
+
+func (f *archiveFile) Close() error {
+	err := f.File.Close()
+	if !errors.Is(err, os.ErrClosed) {
+		f.open.Add(-1)
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package zipfast
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	tempDir := t.TempDir()
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+	ctx := context.Background()
+
+	stats, err := reader.Stats(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, stats.Archives)
+	assert.Empty(t, stats.Recent)
+	assert.Positive(t, stats.DatabaseSize)
+
+	for i := range recentArchives + 2 {
+		zipPath := filepath.Join(tempDir, fmt.Sprintf("%02d.zip", i))
+		require.NoError(t, createTestZipFile(zipPath, map[string]string{"a.txt": "a", "b.txt": "b"}))
+		_, err := reader.Stat(ctx, zipPath, "a.txt")
+		require.NoError(t, err)
+		_, err = reader.Stat(ctx, zipPath, "b.txt")
+		require.NoError(t, err)
+	}
+	entry, err := reader.OpenEntry(ctx, filepath.Join(tempDir, "00.zip"), "a.txt")
+	require.NoError(t, err)
+
+	stats, err = reader.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, recentArchives+2, stats.Archives)
+	assert.Equal(t, 2*(recentArchives+2), stats.Entries)
+	assert.Equal(t, int64(recentArchives+3), stats.Hits)
+	assert.Equal(t, int64(recentArchives+2), stats.Misses)
+	assert.Equal(t, int64(1), stats.OpenArchives)
+	require.Len(t, stats.Recent, recentArchives)
+	// Indexed within the same second, the latest come first by ID
+	assert.Equal(t, filepath.Join(tempDir, "11.zip"), stats.Recent[0].Path)
+	assert.Equal(t, 2, stats.Recent[0].Entries)
+	assert.Positive(t, stats.Recent[0].Duration)
+	assert.WithinDuration(t, time.Now(), stats.Recent[0].IndexedAt, time.Minute)
+
+	_, err = io.ReadAll(entry)
+	require.NoError(t, err)
+	require.NoError(t, entry.Close())
+	assert.Error(t, entry.file.Close())
+	stats, err = reader.Stats(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, stats.OpenArchives)
+}
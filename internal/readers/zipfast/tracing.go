@@ -0,0 +1,61 @@
+package zipfast
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Span attributes of archive operations.
+const (
+	AttrArchive         = attribute.Key("cmpserve.archive.path")
+	AttrArchiveSize     = attribute.Key("cmpserve.archive.size")
+	AttrArchiveEntries  = attribute.Key("cmpserve.archive.entries")
+	AttrIndexHit        = attribute.Key("cmpserve.archive.index_hit")
+	AttrEntry           = attribute.Key("cmpserve.entry.name")
+	AttrEntrySize       = attribute.Key("cmpserve.entry.size")
+	AttrEntryCompressed = attribute.Key("cmpserve.entry.compressed_size")
+	AttrEntryMethod     = attribute.Key("cmpserve.entry.compression_method")
+)
+
+// startSpan starts a span of an archive operation, or returns a no-op one when tracing is
+// off. Attributes are only worth building for spans that are recording.
+func (zi *FastZipReader) startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	if zi.tracer == nil {
+		return ctx, noop.Span{}
+	}
+	return zi.tracer.Start(ctx, name)
+}
+
+// endSpan ends a span, marking it failed with err if any.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// endEntryLookup ends the span of looking up the metadata of an entry, describing the
+// entry. Entries that are missing aren't errors, as clients probe for them.
+func endEntryLookup(span trace.Span, zipPath string, info FileInfo, err error) {
+	if span.IsRecording() {
+		span.SetAttributes(AttrArchive.String(zipPath), AttrEntry.String(info.Name))
+		if err == nil {
+			span.SetAttributes(
+				AttrEntrySize.Int64(int64(info.UncompressedSize)),
+				AttrEntryCompressed.Int64(int64(info.CompressedSize)),
+				AttrEntryMethod.Int(int(info.CompressionMethod)),
+			)
+		}
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	endSpan(span, err)
+}
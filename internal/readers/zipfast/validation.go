@@ -0,0 +1,142 @@
+package zipfast
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Validation decides how lookups check that the index of an archive still describes the
+// file on disk, reindexing the archives found changed. Validations compare as their
+// strictness.
+type Validation int
+
+const (
+	// ValidateNone trusts the index of archives until Reindex or Invalidate.
+	ValidateNone Validation = iota - 1
+	// ValidateStat compares the size and modification time of archives, to the
+	// nanosecond, on every lookup. It is the default.
+	ValidateStat
+	// ValidateStrict also compares a fingerprint of the end of archives, which holds their
+	// central directory, catching archives replaced with one of the same size and
+	// modification time, as copies preserving timestamps make. It reads 64 KiB of the
+	// archive on every lookup.
+	ValidateStrict
+)
+
+// ParseValidation parses a validation name: none, stat or strict.
+func ParseValidation(name string) (Validation, error) {
+	switch name {
+	case "none":
+		return ValidateNone, nil
+	case "stat":
+		return ValidateStat, nil
+	case "strict":
+		return ValidateStrict, nil
+	}
+	return 0, fmt.Errorf("unknown cache validation %q, expected none, stat or strict", name)
+}
+
+type validationKey struct{}
+
+// WithValidation returns a context under which lookups check archives at least as
+// strictly as v, e.g. ValidateStrict for a request that must not be answered from a
+// stale index.
+func WithValidation(ctx context.Context, v Validation) context.Context {
+	return context.WithValue(ctx, validationKey{}, v)
+}
+
+// validation returns the validation of lookups made with ctx.
+func (zi *FastZipReader) validation(ctx context.Context) Validation {
+	if v, ok := ctx.Value(validationKey{}).(Validation); ok && v > zi.validate {
+		return v
+	}
+	return zi.validate
+}
+
+// fingerprintSize is the length of the end of archives hashed into their fingerprint. It
+// holds the end of central directory record, and the central directory of archives of
+// up to several hundred entries; of larger ones, the records of the last entries.
+const fingerprintSize = 64 << 10
+
+// fingerprint hashes the last fingerprintSize bytes of an archive of the given size.
+func fingerprint(file io.ReaderAt, size int64) ([]byte, error) {
+	tail := make([]byte, min(size, fingerprintSize))
+	if n, err := file.ReadAt(tail, size-int64(len(tail))); err != nil && !(errors.Is(err, io.EOF) && n == len(tail)) {
+		return nil, fmt.Errorf("failed to read archive fingerprint: %w", err)
+	}
+	sum := sha256.Sum256(tail)
+	return sum[:], nil
+}
+
+// selectArchiveState reads the archiveState of an archive by path.
+const selectArchiveState = "SELECT id, size, modification_time, modification_time_ns, fingerprint, rejected, rejected_limits FROM lookup_zip_files WHERE zip_path = ?"
+
+// archiveState is what the index recorded of an archive file, to tell whether it changed.
+type archiveState struct {
+	id      int
+	size    int64
+	modTime int64
+	// modTimeNs and fingerprint are missing from archives indexed before they were
+	// recorded.
+	modTimeNs   sql.NullInt64
+	fingerprint []byte
+	// rejected is why the archive was rejected, if it was, under the limits identified by
+	// rejectedLimits.
+	rejected       sql.NullString
+	rejectedLimits sql.NullString
+}
+
+// scan reads the row of selectArchiveState into st.
+func (st *archiveState) scan(row *sql.Row) error {
+	return row.Scan(&st.id, &st.size, &st.modTime, &st.modTimeNs, &st.fingerprint, &st.rejected, &st.rejectedLimits)
+}
+
+// modified returns the modification time the archive was indexed with.
+func (st archiveState) modified() time.Time {
+	if st.modTimeNs.Valid {
+		return time.Unix(0, st.modTimeNs.Int64)
+	}
+	return time.Unix(st.modTime, 0)
+}
+
+// changed reports whether the archive at zipPath, described by fileInfo, no longer
+// matches its recorded state as checked by v. Modification times recorded to the second
+// are compared to the second, and strict checks report archives indexed without a
+// fingerprint as changed, so they get one.
+func (st archiveState) changed(zipPath string, fileInfo os.FileInfo, v Validation) (bool, error) {
+	switch {
+	case v == ValidateNone:
+		return false, nil
+	case st.size != fileInfo.Size(), !st.modified().Equal(fileInfo.ModTime().Truncate(st.precision())):
+		return true, nil
+	case v < ValidateStrict:
+		return false, nil
+	case st.fingerprint == nil:
+		return true, nil
+	}
+	file, err := os.Open(zipPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to open ZIP file: %w", err)
+	}
+	defer file.Close()
+	sum, err := fingerprint(file, fileInfo.Size())
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(sum, st.fingerprint), nil
+}
+
+// precision returns the precision of the recorded modification time.
+func (st archiveState) precision() time.Duration {
+	if st.modTimeNs.Valid {
+		return time.Nanosecond
+	}
+	return time.Second
+}
@@ -0,0 +1,129 @@
+package zipfast
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// replaceAt rewrites an archive with one of the same size, modified at modTime.
+func replaceAt(t *testing.T, zipPath string, files map[string]string, modTime time.Time) {
+	t.Helper()
+	info, err := os.Stat(zipPath)
+	require.NoError(t, err)
+	require.NoError(t, createTestZipFile(zipPath, files))
+	require.NoError(t, os.Chtimes(zipPath, modTime, modTime))
+	replaced, err := os.Stat(zipPath)
+	require.NoError(t, err)
+	require.Equal(t, info.Size(), replaced.Size())
+}
+
+func TestValidation(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "site.zip")
+	indexed := time.Date(2026, time.March, 4, 5, 6, 7, 100_000_000, time.UTC)
+	sameSecond := indexed.Add(500 * time.Millisecond)
+	// Versions differ by the name of their one entry, as the offsets of a stale index would
+	// find the data of the replacement
+	version := func(n string) map[string]string { return map[string]string{"version" + n + ".txt": "content"} }
+	read := func(ctx context.Context, reader *FastZipReader) string {
+		t.Helper()
+		entries, err := reader.ReadDir(ctx, zipPath, "")
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		return strings.TrimSuffix(entries[0].Name, ".txt")
+	}
+	newReader := func(v Validation) *FastZipReader {
+		t.Helper()
+		require.NoError(t, createTestZipFile(zipPath, version("1")))
+		require.NoError(t, os.Chtimes(zipPath, indexed, indexed))
+		reader, err := NewFastZipReader(filepath.Join(t.TempDir(), "test.db"), Options{Validation: v})
+		require.NoError(t, err)
+		t.Cleanup(func() { require.NoError(t, reader.Close()) })
+		require.Equal(t, "version1", read(context.Background(), reader))
+		return reader
+	}
+	ctx := context.Background()
+	strict := WithValidation(ctx, ValidateStrict)
+
+	// Replacements of the same size within the same second are noticed, to the nanosecond
+	reader := newReader(ValidateStat)
+	replaceAt(t, zipPath, version("2"), sameSecond)
+	assert.Equal(t, "version2", read(ctx, reader))
+
+	// and those keeping the modification time as well by strict validation
+	replaceAt(t, zipPath, version("3"), sameSecond)
+	assert.Equal(t, "version2", read(ctx, reader))
+	assert.Equal(t, "version3", read(strict, reader))
+	reader = newReader(ValidateStrict)
+	replaceAt(t, zipPath, version("2"), indexed)
+	assert.Equal(t, "version2", read(ctx, reader))
+
+	// Archives indexed before nanoseconds and fingerprints were recorded are compared to the
+	// second, and reindexed by strict validation to record them
+	reader = newReader(ValidateStat)
+	_, err := reader.db.Exec("UPDATE lookup_zip_files SET modification_time_ns = NULL, fingerprint = NULL")
+	require.NoError(t, err)
+	replaceAt(t, zipPath, version("2"), sameSecond)
+	assert.Equal(t, "version1", read(ctx, reader))
+	assert.Equal(t, "version2", read(strict, reader))
+	replaceAt(t, zipPath, version("3"), sameSecond)
+	assert.Equal(t, "version3", read(strict, reader))
+
+	// Without validation, the index is trusted until the archive is reindexed
+	reader = newReader(ValidateNone)
+	replaceAt(t, zipPath, version("2"), indexed.Add(time.Hour))
+	assert.Equal(t, "version1", read(ctx, reader))
+	archives, err := reader.Archives(ctx)
+	require.NoError(t, err)
+	require.Len(t, archives, 1)
+	assert.True(t, indexed.Equal(archives[0].Modified), archives[0].Modified)
+	assert.Equal(t, "version2", read(strict, reader))
+
+	for name, want := range map[string]Validation{"none": ValidateNone, "stat": ValidateStat, "strict": ValidateStrict} {
+		v, err := ParseValidation(name)
+		require.NoError(t, err)
+		assert.Equal(t, want, v)
+	}
+	_, err = ParseValidation("mtime")
+	assert.Error(t, err)
+}
+
+func TestReindexIfChanged(t *testing.T) {
+	tempDir := t.TempDir()
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+	ctx := context.Background()
+
+	// Archives not indexed yet are indexed
+	zipPath := filepath.Join(tempDir, "site.zip")
+	require.NoError(t, createTestZipFile(zipPath, map[string]string{"index.html": "version1", "a.txt": "a"}))
+	entries, indexed, err := reader.ReindexIfChanged(ctx, zipPath)
+	require.NoError(t, err)
+	assert.Equal(t, 2, entries)
+	assert.True(t, indexed)
+
+	entries, indexed, err = reader.ReindexIfChanged(ctx, zipPath)
+	require.NoError(t, err)
+	assert.Equal(t, 2, entries)
+	assert.False(t, indexed)
+
+	replaceUnnoticed(t, zipPath, map[string]string{"index.html": "version2", "b.txt": "b"})
+	_, err = reader.Stat(ctx, zipPath, "b.txt")
+	assert.ErrorIs(t, err, ErrNotFound)
+	entries, indexed, err = reader.ReindexIfChanged(ctx, zipPath)
+	require.NoError(t, err)
+	assert.Equal(t, 2, entries)
+	assert.True(t, indexed)
+	_, err = reader.Stat(ctx, zipPath, "b.txt")
+	assert.NoError(t, err)
+
+	_, _, err = reader.ReindexIfChanged(ctx, filepath.Join(tempDir, "missing.zip"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,231 @@
+package zipfast
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// ErrNotIndexed is returned by Verify for archives that aren't in the index.
+var ErrNotIndexed = errors.New("archive not indexed")
+
+// maxReportedEntries bounds the mismatched entries a Verification describes one by one,
+// as an archive indexed from a different version mismatches on most of them.
+const maxReportedEntries = 10
+
+// Verification is the outcome of checking the index of an archive against the archive.
+type Verification struct {
+	Path string
+	// Entries is the number of entries in the archive, those sharing a name counted once.
+	Entries int
+	// Missing is set if the archive no longer exists, so its index can only be dropped.
+	Missing bool
+	// Problems describe the mismatches found, none if the index matches the archive.
+	Problems []string
+	// Rejected is why the archive was rejected for exceeding the limits when it was
+	// indexed, in which case its entries aren't checked.
+	Rejected string
+}
+
+// OK reports whether the index matches the archive.
+func (v Verification) OK() bool {
+	return len(v.Problems) == 0
+}
+
+// indexedEntry is an entry of an archive as recorded in the index.
+type indexedEntry struct {
+	name              string
+	offset            int64
+	compressedSize    uint64
+	uncompressedSize  uint64
+	compressionMethod uint16
+	crc32             sql.NullInt64
+}
+
+// Verify checks the index of an archive against the archive on disk: that it still has
+// the recorded size and modification time, and that its central directory lists the
+// indexed entries at the recorded offsets, sizes and checksums. With deep, every entry is
+// also decompressed from its recorded offset and its checksum validated, which reads the
+// whole archive. Entries beyond the limits aren't expected in the index, and the entries
+// of archives rejected for them aren't checked. Mismatches are reported in the Verification; errors are only returned
+// for archives that aren't indexed, with ErrNotIndexed, and failures of the index itself.
+func (zi *FastZipReader) Verify(ctx context.Context, zipPath string, deep bool) (Verification, error) {
+	defer zi.pin(zipPath)()
+	v := Verification{Path: zipPath}
+	state, indexed, err := zi.indexedEntries(ctx, zipPath)
+	if err != nil {
+		return v, err
+	}
+
+	fileInfo, err := os.Stat(zipPath)
+	if errors.Is(err, os.ErrNotExist) {
+		v.Missing = true
+		v.Problems = append(v.Problems, "archive no longer exists")
+		return v, nil
+	}
+	if err != nil {
+		v.Problems = append(v.Problems, fmt.Sprintf("failed to get file info: %v", err))
+		return v, nil
+	}
+	if fileInfo.Size() != state.size {
+		v.Problems = append(v.Problems, fmt.Sprintf("size is %d, indexed %d", fileInfo.Size(), state.size))
+	}
+	if modified := fileInfo.ModTime().Truncate(state.precision()); !modified.Equal(state.modified()) {
+		v.Problems = append(v.Problems, fmt.Sprintf("modification time is %s, indexed %s", modified.UTC().Format(time.RFC3339Nano), state.modified().UTC().Format(time.RFC3339Nano)))
+	}
+
+	if state.rejected.Valid {
+		v.Rejected = state.rejected.String
+		return v, nil
+	}
+
+	file, err := zi.openArchive(zipPath)
+	if err != nil {
+		v.Problems = append(v.Problems, fmt.Sprintf("failed to open ZIP file: %v", err))
+		return v, nil
+	}
+	defer file.Close()
+	// Entries beyond the limits are left out, as indexing does
+	files, _, reason, err := zi.limits.archiveFiles(file, fileInfo.Size(), zi.nameEncoding.NewDecoder())
+	if err != nil {
+		v.Problems = append(v.Problems, fmt.Sprintf("failed to read central directory: %v", err))
+		return v, nil
+	}
+	if reason != "" {
+		v.Problems = append(v.Problems, "archive is beyond limits: "+reason)
+		return v, nil
+	}
+	v.Entries = len(files)
+	if v.Entries != len(indexed) {
+		v.Problems = append(v.Problems, fmt.Sprintf("archive has %d entries, indexed %d", v.Entries, len(indexed)))
+	}
+
+	var mismatched []string
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return v, fmt.Errorf("verification interrupted: %w", err)
+		}
+		// Entries are matched by their names as stored, whichever encoding decoded them
+		entry, ok := indexed[f.file.Name]
+		if !ok {
+			mismatched = append(mismatched, fmt.Sprintf("entry %s isn't indexed", f.name))
+			continue
+		}
+		delete(indexed, f.file.Name)
+		if problem := compareEntry(f.file, entry); problem != "" {
+			mismatched = append(mismatched, fmt.Sprintf("entry %s: %s", f.name, problem))
+			continue
+		}
+		if deep {
+			if problem := checkEntryData(ctx, file, entry, f.file.CRC32); problem != "" {
+				if err := ctx.Err(); err != nil {
+					return v, fmt.Errorf("verification interrupted: %w", err)
+				}
+				mismatched = append(mismatched, fmt.Sprintf("entry %s: %s", f.name, problem))
+			}
+		}
+	}
+	stale := make([]string, 0, len(indexed))
+	for _, entry := range indexed {
+		stale = append(stale, entry.name)
+	}
+	sort.Strings(stale)
+	for _, name := range stale {
+		mismatched = append(mismatched, fmt.Sprintf("entry %s is indexed but not in the archive", name))
+	}
+
+	if len(mismatched) > maxReportedEntries {
+		more := len(mismatched) - maxReportedEntries
+		mismatched = append(mismatched[:maxReportedEntries], fmt.Sprintf("%d more mismatched entries", more))
+	}
+	v.Problems = append(v.Problems, mismatched...)
+	return v, nil
+}
+
+// indexedEntries reads the recorded state of an archive and its
+// entries by name as stored in the archive, in one read transaction so a concurrent
+// reindex can't mix them up.
+func (zi *FastZipReader) indexedEntries(ctx context.Context, zipPath string) (archiveState, map[string]indexedEntry, error) {
+	tx, err := zi.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return archiveState{}, nil, zi.dbError(fmt.Errorf("failed to begin transaction: %w", err))
+	}
+	defer tx.Rollback()
+
+	var state archiveState
+	err = state.scan(tx.QueryRowContext(ctx, selectArchiveState, zipPath))
+	if errors.Is(err, sql.ErrNoRows) {
+		return archiveState{}, nil, fmt.Errorf("%s: %w", zipPath, ErrNotIndexed)
+	}
+	if err != nil {
+		return archiveState{}, nil, zi.dbError(fmt.Errorf("failed to look up archive %s: %w", zipPath, err))
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT file_name, coalesce(raw_name, file_name), offset, compressed_size, uncompressed_size, compression_method, crc32 FROM lookup_zip_contents WHERE zip_id = ?", state.id)
+	if err != nil {
+		return archiveState{}, nil, zi.dbError(fmt.Errorf("failed to read index of %s: %w", zipPath, err))
+	}
+	defer rows.Close()
+	entries := make(map[string]indexedEntry)
+	for rows.Next() {
+		var rawName string
+		var entry indexedEntry
+		if err := rows.Scan(&entry.name, &rawName, &entry.offset, &entry.compressedSize, &entry.uncompressedSize, &entry.compressionMethod, &entry.crc32); err != nil {
+			return archiveState{}, nil, zi.dbError(fmt.Errorf("failed to read index of %s: %w", zipPath, err))
+		}
+		entries[rawName] = entry
+	}
+	if err := rows.Err(); err != nil {
+		return archiveState{}, nil, zi.dbError(fmt.Errorf("failed to read index of %s: %w", zipPath, err))
+	}
+	return state, entries, nil
+}
+
+// compareEntry describes how an indexed entry differs from the central directory, if it does.
+func compareEntry(f *zip.File, entry indexedEntry) string {
+	offset, err := f.DataOffset()
+	switch {
+	case err != nil:
+		return fmt.Sprintf("failed to get data offset: %v", err)
+	case offset != entry.offset:
+		return fmt.Sprintf("offset is %d, indexed %d", offset, entry.offset)
+	case f.CompressedSize64 != entry.compressedSize:
+		return fmt.Sprintf("compressed size is %d, indexed %d", f.CompressedSize64, entry.compressedSize)
+	case f.UncompressedSize64 != entry.uncompressedSize:
+		return fmt.Sprintf("size is %d, indexed %d", f.UncompressedSize64, entry.uncompressedSize)
+	case f.Method != entry.compressionMethod:
+		return fmt.Sprintf("compression method is %d, indexed %d", f.Method, entry.compressionMethod)
+	case entry.crc32.Valid && f.CRC32 != uint32(entry.crc32.Int64):
+		return fmt.Sprintf("checksum is %08x, indexed %08x", f.CRC32, uint32(entry.crc32.Int64))
+	}
+	return ""
+}
+
+// checkEntryData decompresses an entry from its indexed offset, as it is served, and
+// describes how its data doesn't match the indexed size and the checksum crc, if it doesn't.
+func checkEntryData(ctx context.Context, file io.ReaderAt, entry indexedEntry, crc uint32) string {
+	r, err := entryReader(file, entry.offset, entry.compressedSize, entry.compressionMethod)
+	if err != nil {
+		return err.Error()
+	}
+	defer r.Close()
+	hash := crc32.NewIEEE()
+	// Data longer than indexed is only read up to a byte past it
+	n, err := io.Copy(hash, &contextReader{ctx: ctx, r: io.LimitReader(r, int64(entry.uncompressedSize)+1)})
+	switch {
+	case err != nil:
+		return fmt.Sprintf("failed to decompress: %v", err)
+	case uint64(n) != entry.uncompressedSize:
+		return fmt.Sprintf("decompresses to %d bytes, indexed %d", n, entry.uncompressedSize)
+	case hash.Sum32() != crc:
+		return fmt.Sprintf("data checksum is %08x, expected %08x", hash.Sum32(), crc)
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+package zipfast
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	tempDir := t.TempDir()
+	reader, err := NewFastZipReader(filepath.Join(tempDir, "test.db"), Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, reader.Close()) })
+	ctx := context.Background()
+
+	index := func(name string, files map[string]string) string {
+		zipPath := filepath.Join(tempDir, name)
+		require.NoError(t, createTestZipFile(zipPath, files))
+		_, err := reader.Reindex(ctx, zipPath)
+		require.NoError(t, err)
+		return zipPath
+	}
+	verify := func(zipPath string, deep bool) Verification {
+		v, err := reader.Verify(ctx, zipPath, deep)
+		require.NoError(t, err)
+		return v
+	}
+
+	intact := index("intact.zip", map[string]string{"index.html": "<h1>Hi</h1>", "app.js": "console.log(1)"})
+	v := verify(intact, true)
+	assert.True(t, v.OK(), v.Problems)
+	assert.Equal(t, 2, v.Entries)
+
+	// Replaced by another archive of the same size and modification time
+	replaced := index("replaced.zip", map[string]string{"index.html": "version 1", "a.txt": "a"})
+	replaceUnnoticed(t, replaced, map[string]string{"index.html": "version 2", "b.txt": "b"})
+	v = verify(replaced, false)
+	// Entries are written in map order, so index.html may have moved as well as changed
+	require.Len(t, v.Problems, 3)
+	problems := slices.Sorted(slices.Values(v.Problems[:2]))
+	assert.Equal(t, "entry b.txt isn't indexed", problems[0])
+	assert.Regexp(t, `^entry index\.html: (checksum|offset) is`, problems[1])
+	assert.Equal(t, "entry a.txt is indexed but not in the archive", v.Problems[2])
+
+	// Data corrupted in place goes unnoticed until entries are decompressed
+	corrupted := filepath.Join(tempDir, "corrupted.zip")
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	w, err := zipWriter.CreateHeader(&zip.FileHeader{Name: "stored.txt", Method: zip.Store})
+	require.NoError(t, err)
+	_, err = w.Write([]byte("stored as it is"))
+	require.NoError(t, err)
+	require.NoError(t, zipWriter.Close())
+	require.NoError(t, os.WriteFile(corrupted, buf.Bytes(), 0o644))
+	_, err = reader.Reindex(ctx, corrupted)
+	require.NoError(t, err)
+	info, err := os.Stat(corrupted)
+	require.NoError(t, err)
+	data := bytes.Replace(buf.Bytes(), []byte("stored as it is"), []byte("STORED AS IT IS"), 1)
+	require.NoError(t, os.WriteFile(corrupted, data, 0o644))
+	require.NoError(t, os.Chtimes(corrupted, info.ModTime(), info.ModTime()))
+	assert.True(t, verify(corrupted, false).OK())
+	v = verify(corrupted, true)
+	require.Len(t, v.Problems, 1)
+	assert.Contains(t, v.Problems[0], "entry stored.txt: data checksum is")
+
+	// Truncated, as by a partial sync
+	truncated := index("truncated.zip", map[string]string{"index.html": "truncated"})
+	require.NoError(t, os.Truncate(truncated, 20))
+	v = verify(truncated, false)
+	require.GreaterOrEqual(t, len(v.Problems), 2)
+	assert.Contains(t, v.Problems[0], "size is 20, indexed")
+	assert.Contains(t, v.Problems[len(v.Problems)-1], "failed to read central directory")
+
+	// Mismatched entries beyond the first ones are counted
+	files := make(map[string]string)
+	for i := range maxReportedEntries + 5 {
+		files[fmt.Sprintf("file%02d.txt", i)] = "x"
+	}
+	many := index("many.zip", files)
+	renamed := make(map[string]string)
+	for name, content := range files {
+		renamed["F"+name[1:]] = content
+	}
+	replaceUnnoticed(t, many, renamed)
+	v = verify(many, false)
+	require.Len(t, v.Problems, maxReportedEntries+1)
+	assert.Equal(t, fmt.Sprintf("%d more mismatched entries", 2*len(files)-maxReportedEntries), v.Problems[maxReportedEntries])
+
+	missing := index("missing.zip", map[string]string{"index.html": "gone"})
+	require.NoError(t, os.Remove(missing))
+	v = verify(missing, false)
+	assert.True(t, v.Missing)
+	assert.Equal(t, []string{"archive no longer exists"}, v.Problems)
+
+	_, err = reader.Verify(ctx, filepath.Join(tempDir, "unknown.zip"), false)
+	assert.ErrorIs(t, err, ErrNotIndexed)
+}
@@ -0,0 +1,229 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"cmpserve/internal/auth"
+)
+
+// accessFile protects the directory holding it, and those below it up to the next one.
+const accessFile = ".cmpserve-access"
+
+// accessCheckInterval is how long access files, and their absence, are trusted before
+// their directory is checked again.
+const accessCheckInterval = 2 * time.Second
+
+// realmEscaper escapes a realm for the quoted string of WWW-Authenticate.
+var realmEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// accessRule is what an access file requires of requests.
+type accessRule struct {
+	// public lifts the protection of a parent directory.
+	public bool
+	// users are the credentials accepted, of the file itself and of the htpasswd files it
+	// names. Rules without any refuse every request.
+	users []*auth.Htpasswd
+}
+
+// authenticate reports whether password is valid for user.
+func (rule *accessRule) authenticate(user, password string) bool {
+	for _, users := range rule.users {
+		if users.Authenticate(user, password) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAccessFile parses the access file at path. Its lines are require-auth, public,
+// htpasswd followed by the path of an htpasswd file, relative to the directory, and user
+// lines in htpasswd format; blank lines and # comments are skipped.
+func parseAccessFile(path string, data []byte, logger *slog.Logger) (*accessRule, error) {
+	rule := &accessRule{}
+	var requireAuth bool
+	// Other lines are blanked out of the user lines, so warnings name the right ones
+	var users bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		directive, argument, _ := strings.Cut(line, " ")
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case line == "require-auth":
+			requireAuth = true
+		case line == "public":
+			rule.public = true
+		case directive == "htpasswd":
+			htpasswdPath := strings.TrimSpace(argument)
+			if !filepath.IsAbs(htpasswdPath) {
+				htpasswdPath = filepath.Join(filepath.Dir(path), htpasswdPath)
+			}
+			htpasswd, err := auth.NewHtpasswd(htpasswdPath, logger)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			rule.users = append(rule.users, htpasswd)
+			requireAuth = true
+		case strings.Contains(line, ":"):
+			users.WriteString(line)
+			requireAuth = true
+		default:
+			return nil, fmt.Errorf("line %d: unknown directive %q", lineNumber, directive)
+		}
+		users.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read access file: %w", err)
+	}
+	if rule.public && requireAuth {
+		return nil, errors.New("public can't be combined with require-auth or users")
+	}
+	if bytes.ContainsRune(users.Bytes(), ':') {
+		inline, err := auth.ParseHtpasswd(users.Bytes(), path, logger)
+		if err != nil {
+			return nil, err
+		}
+		rule.users = append(rule.users, inline)
+	}
+	return rule, nil
+}
+
+// accessState is what was found of the access file of a directory.
+type accessState struct {
+	checked time.Time
+	// rule is nil for directories without an access file.
+	rule    *accessRule
+	modTime time.Time
+	size    int64
+}
+
+// accessCache holds the access files of directories, read again once changed.
+type accessCache struct {
+	interval time.Duration
+	logger   *slog.Logger
+
+	mu   sync.Mutex
+	dirs map[string]accessState
+}
+
+func newAccessCache(logger *slog.Logger) *accessCache {
+	return &accessCache{interval: accessCheckInterval, logger: logger, dirs: make(map[string]accessState)}
+}
+
+// rule returns the rule of the access file of dir, or nil if it has none. Access files
+// that can't be read or parsed refuse every request.
+func (c *accessCache) rule(ctx context.Context, dir string) *accessRule {
+	now := time.Now()
+	c.mu.Lock()
+	state, ok := c.dirs[dir]
+	c.mu.Unlock()
+	if ok && now.Sub(state.checked) < c.interval {
+		return state.rule
+	}
+
+	path := filepath.Join(dir, accessFile)
+	info, err := os.Stat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		state = accessState{}
+	case err != nil:
+		c.logger.ErrorContext(ctx, "Failed to check access file, refusing requests", "path", path, "error", err)
+		state = accessState{rule: &accessRule{}}
+	case ok && state.rule != nil && info.ModTime().Equal(state.modTime) && info.Size() == state.size:
+	default:
+		state = accessState{rule: c.load(ctx, path), modTime: info.ModTime(), size: info.Size()}
+	}
+	state.checked = now
+	c.mu.Lock()
+	c.dirs[dir] = state
+	c.mu.Unlock()
+	return state.rule
+}
+
+func (c *accessCache) load(ctx context.Context, path string) *accessRule {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var rule *accessRule
+		if rule, err = parseAccessFile(path, data, c.logger); err == nil {
+			c.logger.DebugContext(ctx, "Loaded access file", "path", path)
+			return rule
+		}
+	}
+	c.logger.ErrorContext(ctx, "Invalid access file, refusing requests", "path", path, "error", err)
+	return &accessRule{}
+}
+
+// accessRule returns the rule of the access file closest to dir, a directory of the
+// service, and the directory holding it, or nil if none protects dir.
+func (s *Service) accessRule(ctx context.Context, dir string) (*accessRule, string) {
+	// An archive served as the tree has no directories to protect
+	if s.rootArchive != "" {
+		return nil, ""
+	}
+	for {
+		if rule := s.access.rule(ctx, dir); rule != nil {
+			return rule, dir
+		}
+		if dir == s.rootServiceDir || filepath.Dir(dir) == dir {
+			return nil, ""
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// authorize enforces the access file closest to dir. Unless the request carries
+// credentials it accepts, it answers with 401, in the realm of the URL path of the
+// protected directory, and returns false.
+func (s *Service) authorize(w http.ResponseWriter, r *http.Request, dir string) bool {
+	rule, ruleDir := s.accessRule(r.Context(), dir)
+	if rule == nil || rule.public {
+		return true
+	}
+	user, password, ok := r.BasicAuth()
+	if ok && rule.authenticate(user, password) {
+		return true
+	}
+	if ok {
+		s.logger.WarnContext(r.Context(), "Authentication failed", "user", user, "remote", r.RemoteAddr, "path", r.URL.Path, "access_file", filepath.Join(ruleDir, accessFile))
+	}
+	realm := s.basePath + "/"
+	if rel, err := filepath.Rel(s.rootServiceDir, ruleDir); err == nil && rel != "." {
+		realm += filepath.ToSlash(rel) + "/"
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+realmEscaper.Replace(realm)+`", charset="UTF-8"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// refuse answers a path that can't be served, found in dir, with 404, unless dir is
+// protected and the request lacks credentials, which would tell its names apart.
+func (s *Service) refuse(w http.ResponseWriter, r *http.Request, dir, archivePath string) {
+	if s.authorize(w, r, dir) {
+		s.notFound(w, r, dir, archivePath)
+	}
+}
+
+// dir returns the directory whose access file protects the target.
+func (t target) dir() string {
+	switch {
+	case t.archivePath != "":
+		return filepath.Dir(t.archivePath)
+	case t.path == "":
+		return t.lastDir
+	case t.isDir:
+		return t.path
+	}
+	return filepath.Dir(t.path)
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func userLine(t *testing.T, user, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+	return user + ":" + string(hash)
+}
+
+func getAs(s http.Handler, target, user, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.SetBasicAuth(user, password)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+func accessFixture(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"public.txt":                   "public",
+		"internal/" + accessFile:       "# staff only\nrequire-auth\n" + userLine(t, "alice", "wonderland") + "\n",
+		"internal/report.txt":          "report",
+		"internal/404.html":            "internal not found",
+		"internal/team/" + accessFile:  "require-auth\nhtpasswd ../../.htpasswd\n",
+		"internal/team/notes.txt":      "notes",
+		"internal/team/handbook/a.txt": "handbook",
+		"internal/open/" + accessFile:  "public\n",
+		"internal/open/readme.txt":     "readme",
+		".htpasswd":                    userLine(t, "bob", "builder") + "\n",
+	})
+	require.NoError(t, createTestZipFile(filepath.Join(root, "internal", "bundle.zip"), map[string]string{"a.txt": "archived"}))
+	return root
+}
+
+func TestAccessFile(t *testing.T) {
+	s := newTestService(t, accessFixture(t), Options{CreateIndexes: true})
+
+	assert.Equal(t, "public", get(s, "/public.txt").Body.String())
+	for _, target := range []string{"/internal/report.txt", "/internal/", "/internal/bundle/a.txt", "/internal/bundle.zip", "/internal/missing.txt", "/internal/.hidden", "/internal/bundle/missing.txt"} {
+		rec := get(s, target)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, target)
+		assert.Equal(t, `Basic realm="/internal/", charset="UTF-8"`, rec.Header().Get("WWW-Authenticate"), target)
+		assert.NotContains(t, rec.Body.String(), "internal not found", target)
+	}
+	assert.Equal(t, http.StatusUnauthorized, getAs(s, "/internal/report.txt", "alice", "Wonderland").Code)
+	assert.Equal(t, http.StatusUnauthorized, getAs(s, "/internal/report.txt", "bob", "builder").Code)
+
+	assert.Equal(t, "report", getAs(s, "/internal/report.txt", "alice", "wonderland").Body.String())
+	assert.Equal(t, "archived", getAs(s, "/internal/bundle/a.txt", "alice", "wonderland").Body.String())
+	rec := getAs(s, "/internal/missing.txt", "alice", "wonderland")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "internal not found", rec.Body.String())
+	rec = getAs(s, "/internal/", "alice", "wonderland")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "report.txt")
+	assert.NotContains(t, rec.Body.String(), accessFile)
+
+	// The closest access file alone applies
+	rec = getAs(s, "/internal/team/handbook/a.txt", "alice", "wonderland")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, `Basic realm="/internal/team/", charset="UTF-8"`, rec.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, "handbook", getAs(s, "/internal/team/handbook/a.txt", "bob", "builder").Body.String())
+	assert.Equal(t, "notes", getAs(s, "/internal/team/notes.txt", "bob", "builder").Body.String())
+	assert.Equal(t, "readme", get(s, "/internal/open/readme.txt").Body.String())
+}
+
+func TestAccessFileUnreachable(t *testing.T) {
+	root := accessFixture(t)
+	for _, options := range []Options{{}, {ExposeHiddenFiles: true, CreateIndexes: true}, {ExposeHiddenFiles: true, CaseInsensitive: true}} {
+		s := newTestService(t, root, options)
+		assert.Equal(t, http.StatusNotFound, getAs(s, "/internal/"+accessFile, "alice", "wonderland").Code)
+		assert.Equal(t, http.StatusNotFound, get(s, "/internal/open/"+accessFile).Code)
+		assert.Equal(t, http.StatusNotFound, get(s, "/internal/open/"+strings.ToUpper(accessFile)).Code)
+	}
+	s := newTestService(t, root, Options{ExposeHiddenFiles: true, CreateIndexes: true})
+	rec := get(s, "/internal/open/")
+	assert.Contains(t, rec.Body.String(), "readme.txt")
+	assert.NotContains(t, rec.Body.String(), accessFile)
+}
+
+func TestAccessFileBasePath(t *testing.T) {
+	s := newTestService(t, accessFixture(t), Options{BasePath: "/files"})
+	rec := get(s, "/files/internal/team/notes.txt")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, `Basic realm="/files/internal/team/", charset="UTF-8"`, rec.Header().Get("WWW-Authenticate"))
+
+	// The root itself can be protected
+	root := accessFixture(t)
+	writeTestFiles(t, root, map[string]string{accessFile: userLine(t, "carol", "secret")})
+	s = newTestService(t, root, Options{BasePath: "/files"})
+	rec = get(s, "/files/public.txt")
+	assert.Equal(t, `Basic realm="/files/", charset="UTF-8"`, rec.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, "public", getAs(s, "/files/public.txt", "carol", "secret").Body.String())
+	assert.Equal(t, "readme", get(s, "/files/internal/open/readme.txt").Body.String())
+}
+
+func TestAccessFileChanges(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"docs/guide.txt": "guide"})
+	s := newTestService(t, root, Options{})
+	s.access.interval = 0
+	accessPath := filepath.Join(root, "docs", accessFile)
+	assert.Equal(t, http.StatusOK, get(s, "/docs/guide.txt").Code)
+
+	require.NoError(t, os.WriteFile(accessPath, []byte(userLine(t, "alice", "wonderland")+"\n"), 0o644))
+	assert.Equal(t, http.StatusUnauthorized, get(s, "/docs/guide.txt").Code)
+	assert.Equal(t, "guide", getAs(s, "/docs/guide.txt", "alice", "wonderland").Body.String())
+
+	require.NoError(t, os.WriteFile(accessPath, []byte(userLine(t, "bob", "builder")+"\n"+userLine(t, "alice", "looking-glass")+"\n"), 0o644))
+	assert.Equal(t, http.StatusUnauthorized, getAs(s, "/docs/guide.txt", "alice", "wonderland").Code)
+	assert.Equal(t, http.StatusOK, getAs(s, "/docs/guide.txt", "alice", "looking-glass").Code)
+
+	// Broken files refuse everyone rather than open the directory
+	for _, contents := range []string{"require-everything\n", "htpasswd missing\n", "public\nrequire-auth\n", "require-auth\n"} {
+		require.NoError(t, os.WriteFile(accessPath, []byte(contents), 0o644))
+		assert.Equal(t, http.StatusUnauthorized, getAs(s, "/docs/guide.txt", "bob", "builder").Code, contents)
+	}
+
+	require.NoError(t, os.Remove(accessPath))
+	assert.Equal(t, http.StatusOK, get(s, "/docs/guide.txt").Code)
+}
+
+func TestAccessFileCached(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"docs/guide.txt": "guide"})
+	s := newTestService(t, root, Options{})
+	assert.Equal(t, http.StatusOK, get(s, "/docs/guide.txt").Code)
+
+	// Until the directory is checked again
+	writeTestFiles(t, root, map[string]string{"docs/" + accessFile: "require-auth\n"})
+	assert.Equal(t, http.StatusOK, get(s, "/docs/guide.txt").Code)
+	s.access.interval = 0
+	assert.Equal(t, http.StatusUnauthorized, get(s, "/docs/guide.txt").Code)
+}
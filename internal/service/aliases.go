@@ -0,0 +1,288 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// aliasFile maps URL paths of the service directory to the archives served under them.
+const aliasFile = ".cmpserve-aliases.json"
+
+// aliasCheckInterval is how long the alias file, and the archives its globs picked, are
+// trusted before they are checked again.
+const aliasCheckInterval = 2 * time.Second
+
+// How an alias picks one of the archives its glob matches.
+const (
+	// pickGreatest picks the archive whose path sorts last.
+	pickGreatest = "greatest"
+	// pickNewest picks the archive modified last.
+	pickNewest = "newest"
+)
+
+// aliasSpec is the target of an alias: an archive, or one of the archives matching a glob,
+// both slash-separated and relative to the service directory. In the alias file, a string
+// stands for an archive.
+type aliasSpec struct {
+	Archive string `json:"archive"`
+	Glob    string `json:"glob"`
+	Pick    string `json:"pick"`
+}
+
+func (spec *aliasSpec) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &spec.Archive)
+	}
+	type plain aliasSpec
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode((*plain)(spec))
+}
+
+// alias serves the archive of spec under the URL path made of the prefix segments.
+type alias struct {
+	prefix []string
+	spec   aliasSpec
+	// archive is the archive on disk the alias currently points at, empty when its glob
+	// matches nothing or its target isn't allowed, and name its slash-separated path in the
+	// service directory.
+	archive, name string
+}
+
+// parseAliasFile parses an alias file: a JSON object from URL paths, such as docs/latest,
+// to aliasSpecs. Picks default to pickGreatest. Aliases are returned longest first, so an
+// alias wins over those of the paths above it.
+func parseAliasFile(data []byte) ([]alias, error) {
+	var specs map[string]aliasSpec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, err
+	}
+	aliases := make([]alias, 0, len(specs))
+	for name, spec := range specs {
+		prefix := strings.Trim(name, "/")
+		if prefix == "." || !fs.ValidPath(prefix) {
+			return nil, fmt.Errorf("invalid alias path %q", name)
+		}
+		switch {
+		case (spec.Archive == "") == (spec.Glob == ""):
+			return nil, fmt.Errorf("alias %s: needs either an archive or a glob", prefix)
+		case spec.Archive != "":
+			if spec.Pick != "" {
+				return nil, fmt.Errorf("alias %s: pick only applies to globs", prefix)
+			}
+			// Targets must stay inside the service directory
+			if !fs.ValidPath(spec.Archive) || !isArchiveName(spec.Archive) {
+				return nil, fmt.Errorf("alias %s: invalid archive %q", prefix, spec.Archive)
+			}
+		default:
+			if spec.Pick == "" {
+				spec.Pick = pickGreatest
+			}
+			if spec.Pick != pickGreatest && spec.Pick != pickNewest {
+				return nil, fmt.Errorf("alias %s: unknown pick %q, expected %s or %s", prefix, spec.Pick, pickGreatest, pickNewest)
+			}
+			if _, err := path.Match(spec.Glob, ""); err != nil || !fs.ValidPath(spec.Glob) {
+				return nil, fmt.Errorf("alias %s: invalid glob %q", prefix, spec.Glob)
+			}
+		}
+		aliases = append(aliases, alias{prefix: strings.Split(prefix, "/"), spec: spec})
+	}
+	sort.Slice(aliases, func(i, j int) bool {
+		if len(aliases[i].prefix) != len(aliases[j].prefix) {
+			return len(aliases[i].prefix) > len(aliases[j].prefix)
+		}
+		return strings.Join(aliases[i].prefix, "/") < strings.Join(aliases[j].prefix, "/")
+	})
+	return aliases, nil
+}
+
+// aliasState is what was found of the alias file of a service directory.
+type aliasState struct {
+	checked time.Time
+	// aliases is empty for directories without an alias file.
+	aliases []alias
+	modTime time.Time
+	size    int64
+}
+
+// aliasCache holds the alias files of service directories, read again once changed, with
+// the archives their aliases point at.
+type aliasCache struct {
+	interval time.Duration
+	logger   *slog.Logger
+
+	mu    sync.Mutex
+	roots map[string]aliasState
+}
+
+func newAliasCache(logger *slog.Logger) *aliasCache {
+	return &aliasCache{interval: aliasCheckInterval, logger: logger, roots: make(map[string]aliasState)}
+}
+
+// aliases returns the aliases of the service directory. An alias file that can't be read
+// or parsed leaves the aliases it last had in place, none at first. Globs are matched again
+// on every check, so archives added since are picked.
+func (s *Service) aliases(ctx context.Context) []alias {
+	c := s.aliasCache
+	now := time.Now()
+	c.mu.Lock()
+	state, ok := c.roots[s.rootServiceDir]
+	c.mu.Unlock()
+	if ok && now.Sub(state.checked) < c.interval {
+		return state.aliases
+	}
+
+	path := filepath.Join(s.rootServiceDir, aliasFile)
+	info, err := os.Stat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		state = aliasState{}
+	case err != nil:
+		c.logger.ErrorContext(ctx, "Failed to check alias file, keeping the previous aliases", "path", path, "error", err)
+	case ok && info.ModTime().Equal(state.modTime) && info.Size() == state.size:
+	default:
+		state.modTime, state.size = info.ModTime(), info.Size()
+		data, err := os.ReadFile(path)
+		var aliases []alias
+		if err == nil {
+			aliases, err = parseAliasFile(data)
+		}
+		if err != nil {
+			c.logger.ErrorContext(ctx, "Invalid alias file, keeping the previous aliases", "path", path, "error", err)
+			break
+		}
+		c.logger.DebugContext(ctx, "Loaded alias file", "path", path, "aliases", len(aliases))
+		state.aliases = aliases
+	}
+	state.aliases = s.pickArchives(ctx, state.aliases)
+	state.checked = now
+	c.mu.Lock()
+	c.roots[s.rootServiceDir] = state
+	c.mu.Unlock()
+	return state.aliases
+}
+
+// pickArchives returns aliases with the archives they currently point at.
+func (s *Service) pickArchives(ctx context.Context, aliases []alias) []alias {
+	if len(aliases) == 0 {
+		return nil
+	}
+	picked := make([]alias, len(aliases))
+	for i, a := range aliases {
+		picked[i] = a
+		name := a.spec.Archive
+		if a.spec.Glob != "" {
+			name = s.pickArchive(a.spec)
+		}
+		picked[i].archive, picked[i].name = "", ""
+		if zipPath, err := s.archivePath("alias", name); name != "" && err == nil && s.aliasTargetAllowed(name) {
+			picked[i].archive, picked[i].name = zipPath, name
+		}
+		if a.spec.Glob != "" && picked[i].archive != a.archive {
+			s.logger.InfoContext(ctx, "Archive alias switched", "alias", "/"+strings.Join(a.prefix, "/"), "glob", a.spec.Glob, "from", a.archive, "to", picked[i].archive)
+		}
+	}
+	return picked
+}
+
+// pickArchive returns the slash-separated path of the archive a glob picks, or "" if it
+// matches none. Names sorting last win ties of modification times.
+func (s *Service) pickArchive(spec aliasSpec) string {
+	matches, _ := filepath.Glob(filepath.Join(s.rootServiceDir, filepath.FromSlash(spec.Glob)))
+	best, bestTime := "", time.Time{}
+	for _, match := range matches {
+		rel, err := filepath.Rel(s.rootServiceDir, match)
+		if err != nil || !filepath.IsLocal(rel) || !isArchiveName(rel) || !s.aliasTargetAllowed(filepath.ToSlash(rel)) {
+			continue
+		}
+		info, err := os.Stat(match)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		name := filepath.ToSlash(rel)
+		better := name > best
+		if spec.Pick == pickNewest {
+			better = info.ModTime().After(bestTime) || (info.ModTime().Equal(bestTime) && better)
+		}
+		if better {
+			best, bestTime = name, info.ModTime()
+		}
+	}
+	return best
+}
+
+// aliasTargetAllowed reports whether the archive at the slash-separated path name may be
+// served under an alias, as it would be by its own path: unless it is hidden, without
+// ExposeHiddenFiles, or ignored, by its file name or as the directory of its contents.
+func (s *Service) aliasTargetAllowed(name string) bool {
+	if !s.exposeHiddenFiles && hiddenEntry(name) {
+		return false
+	}
+	return !s.ignore.Match(name) && !s.ignore.Match(strings.TrimSuffix(name, path.Ext(name))+"/")
+}
+
+// matchAlias returns the alias whose URL path the request path segments parts start with,
+// compared regardless of case for CaseInsensitive.
+func (s *Service) matchAlias(ctx context.Context, parts []string) (alias, bool) {
+	for _, a := range s.aliases(ctx) {
+		if len(parts) < len(a.prefix) {
+			continue
+		}
+		matched := true
+		for i, segment := range a.prefix {
+			if parts[i] != segment && !(s.caseInsensitive && strings.EqualFold(parts[i], segment)) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return a, true
+		}
+	}
+	return alias{}, false
+}
+
+// resolveAlias resolves the rest of a request path under an alias into its archive, as a
+// request for the archive by its own path would be. Aliases pointing at no archive, or at
+// one that doesn't exist, resolve to nothing.
+func (s *Service) resolveAlias(w http.ResponseWriter, r *http.Request, t target, a alias, rest []string) (target, bool) {
+	t.lastDir = s.rootServiceDir
+	if a.archive == "" {
+		return t, true
+	}
+	if _, err := os.Stat(a.archive); err != nil {
+		t.uncertain = !errors.Is(err, fs.ErrNotExist)
+		return t, true
+	}
+	s.logger.DebugContext(r.Context(), "Resolved archive alias", "path", t.urlPath, "archive", a.archive)
+	t.archivePath = a.archive
+	if len(rest) == 0 {
+		return t, true
+	}
+	for _, entryPart := range rest {
+		if strings.Contains(entryPart, "/") || (!s.exposeHiddenFiles && strings.HasPrefix(entryPart, ".")) {
+			s.refuse(w, r, filepath.Dir(t.archivePath), t.archivePath)
+			return t, false
+		}
+	}
+	t.entry, t.slash = strings.Join(rest, "/"), true
+	// Entries are ignored by their path under the archive's own, too
+	if s.ignore.Match(strings.TrimSuffix(a.name, path.Ext(a.name)) + "/" + t.entry) {
+		s.refuse(w, r, filepath.Dir(t.archivePath), t.archivePath)
+		return t, false
+	}
+	return t, true
+}
@@ -0,0 +1,157 @@
+package service
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// releaseArchive writes a documentation bundle of version, modified at modTime.
+func releaseArchive(t *testing.T, root, version string, modTime time.Time) {
+	t.Helper()
+	zipPath := filepath.Join(root, "releases", "docs-"+version+".zip")
+	require.NoError(t, os.MkdirAll(filepath.Dir(zipPath), 0o755))
+	require.NoError(t, createTestZipFile(zipPath, map[string]string{"index.html": version, "guide/intro.txt": version + " intro", "404.html": version + " not found"}))
+	require.NoError(t, os.Chtimes(zipPath, modTime, modTime))
+}
+
+func TestArchiveAliases(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now().Truncate(time.Second)
+	releaseArchive(t, root, "v1.4.2", now.Add(-2*time.Hour))
+	releaseArchive(t, root, "v1.10.0", now.Add(-3*time.Hour))
+	writeTestFiles(t, root, map[string]string{
+		"docs/other.txt": "not aliased",
+		aliasFile: `{
+			"docs/v1.4.2": "releases/docs-v1.4.2.zip",
+			"/docs/latest/": {"glob": "releases/docs-v*.zip", "pick": "newest"},
+			"docs/greatest": {"glob": "releases/docs-v*.zip"},
+			"docs/gone": "releases/docs-v0.1.0.zip",
+			"docs/none": {"glob": "drafts/*.zip"}
+		}`,
+	})
+	s := newTestService(t, root, Options{CreateIndexes: true, ExposeHiddenFiles: true})
+	s.aliasCache.interval = 0
+
+	// Explicit mappings resolve like the archive itself
+	assert.Equal(t, "v1.4.2", get(s, "/docs/v1.4.2/").Body.String())
+	assert.Equal(t, "v1.4.2 intro", get(s, "/docs/v1.4.2/guide/intro.txt").Body.String())
+	rec := get(s, "/docs/v1.4.2?lang=en")
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+	assert.Equal(t, "/docs/v1.4.2/?lang=en", rec.Header().Get("Location"))
+	rec = get(s, "/docs/v1.4.2/missing.txt")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "v1.4.2 not found", rec.Body.String())
+	assert.Contains(t, get(s, "/docs/v1.4.2/guide/").Body.String(), "intro.txt")
+	assert.Equal(t, "not aliased", get(s, "/docs/other.txt").Body.String())
+	assert.Equal(t, "v1.4.2", get(s, "/releases/docs-v1.4.2/").Body.String())
+
+	// Globs pick the newest archive, or the one sorting last
+	assert.Equal(t, "v1.4.2", get(s, "/docs/latest/").Body.String())
+	assert.Equal(t, "v1.4.2", get(s, "/docs/greatest/").Body.String())
+	releaseArchive(t, root, "v1.5.0", now.Add(-time.Hour))
+	assert.Equal(t, "v1.5.0", get(s, "/docs/latest/").Body.String())
+	assert.Equal(t, "v1.5.0 intro", get(s, "/docs/latest/guide/intro.txt").Body.String())
+	assert.Equal(t, "v1.5.0", get(s, "/docs/greatest/").Body.String())
+	require.NoError(t, os.Remove(filepath.Join(root, "releases", "docs-v1.5.0.zip")))
+	assert.Equal(t, "v1.4.2", get(s, "/docs/latest/").Body.String())
+
+	// Dangling aliases are missing paths
+	for _, target := range []string{"/docs/gone/", "/docs/gone/index.html", "/docs/none/", "/docs/none"} {
+		assert.Equal(t, http.StatusNotFound, get(s, target).Code, target)
+	}
+
+	// The alias file is reloaded once changed, and never served
+	writeTestFiles(t, root, map[string]string{aliasFile: `{"docs/stable": "releases/docs-v1.10.0.zip"}`})
+	assert.Equal(t, "v1.10.0", get(s, "/docs/stable/").Body.String())
+	assert.Equal(t, http.StatusNotFound, get(s, "/docs/v1.4.2/").Code)
+	assert.Equal(t, http.StatusNotFound, get(s, "/"+aliasFile).Code)
+
+	// An invalid one leaves the previous aliases in place
+	writeTestFiles(t, root, map[string]string{aliasFile: `{"docs/stable": "../outside.zip"}`})
+	assert.Equal(t, "v1.10.0", get(s, "/docs/stable/").Body.String())
+}
+
+func TestArchiveAliasesTrusted(t *testing.T) {
+	root := t.TempDir()
+	releaseArchive(t, root, "v1", time.Now().Add(-time.Hour))
+	writeTestFiles(t, root, map[string]string{aliasFile: `{"latest": {"glob": "releases/*.zip", "pick": "newest"}}`})
+	s := newTestService(t, root, Options{})
+
+	assert.Equal(t, "v1", get(s, "/latest/").Body.String())
+	// Globs are matched again once the check interval passed
+	releaseArchive(t, root, "v2", time.Now())
+	assert.Equal(t, "v1", get(s, "/latest/").Body.String())
+	s.aliasCache.mu.Lock()
+	state := s.aliasCache.roots[s.rootServiceDir]
+	state.checked = time.Time{}
+	s.aliasCache.roots[s.rootServiceDir] = state
+	s.aliasCache.mu.Unlock()
+	assert.Equal(t, "v2", get(s, "/latest/").Body.String())
+}
+
+func TestArchiveAliasesHiddenAndIgnored(t *testing.T) {
+	root := t.TempDir()
+	// The archives that aren't served are the newest
+	for i, name := range []string{"public/c.zip", "private/b.zip", ".secret/a.zip"} {
+		zipPath := filepath.Join(root, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(zipPath), 0o755))
+		require.NoError(t, createTestZipFile(zipPath, map[string]string{"index.html": name, ".env": "SECRET", "drafts/x.txt": "draft"}))
+		modTime := time.Now().Add(time.Duration(i-3) * time.Hour)
+		require.NoError(t, os.Chtimes(zipPath, modTime, modTime))
+	}
+	writeTestFiles(t, root, map[string]string{aliasFile: `{
+		"hidden": ".secret/a.zip",
+		"ignored": "private/b.zip",
+		"globbed": {"glob": ".secret/*.zip"},
+		"mixed": {"glob": "*/?.zip", "pick": "newest"},
+		"public": "public/c.zip"
+	}`})
+	s := newTestService(t, root, Options{Ignore: []string{"/private/**", "/public/c/drafts/"}})
+
+	// Aliases reach no further than the archives' own paths do
+	for _, target := range []string{"/hidden/", "/ignored/", "/globbed/", "/.secret/a/", "/private/b/", "/public/.env", "/public/drafts/x.txt"} {
+		assert.Equal(t, http.StatusNotFound, get(s, target).Code, target)
+	}
+	assert.Equal(t, "public/c.zip", get(s, "/public/").Body.String())
+	// Globs pass over the archives that aren't served
+	assert.Equal(t, "public/c.zip", get(s, "/mixed/").Body.String())
+
+	s = newTestService(t, root, Options{ExposeHiddenFiles: true})
+	assert.Equal(t, ".secret/a.zip", get(s, "/hidden/").Body.String())
+	assert.Equal(t, ".secret/a.zip", get(s, "/globbed/").Body.String())
+	assert.Equal(t, "SECRET", get(s, "/hidden/.env").Body.String())
+}
+
+func TestParseAliasFile(t *testing.T) {
+	aliases, err := parseAliasFile([]byte(`{"a": "a.zip", "a/b": {"archive": "x/b.zip"}, "c": {"glob": "c-*.zip", "pick": "newest"}}`))
+	require.NoError(t, err)
+	require.Len(t, aliases, 3)
+	assert.Equal(t, []string{"a", "b"}, aliases[0].prefix)
+	assert.Equal(t, "x/b.zip", aliases[0].spec.Archive)
+	assert.Equal(t, aliasSpec{Glob: "c-*.zip", Pick: pickNewest}, aliases[2].spec)
+
+	for _, data := range []string{
+		`[]`,
+		`{"": "a.zip"}`,
+		`{"a/../b": "a.zip"}`,
+		`{"a": "../outside.zip"}`,
+		`{"a": "/etc/a.zip"}`,
+		`{"a": "notes.txt"}`,
+		`{"a": {}}`,
+		`{"a": {"archive": "a.zip", "glob": "*.zip"}}`,
+		`{"a": {"archive": "a.zip", "pick": "newest"}}`,
+		`{"a": {"glob": "*.zip", "pick": "oldest"}}`,
+		`{"a": {"glob": "../*.zip"}}`,
+		`{"a": {"glob": "[.zip"}}`,
+		`{"a": {"target": "a.zip"}}`,
+	} {
+		_, err := parseAliasFile([]byte(data))
+		assert.Error(t, err, data)
+	}
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"cmpserve/internal/readers/zipfast"
+)
+
+// archiveListEntry is an element of the ?list=json listing of an archive.
+type archiveListEntry struct {
+	Name           string `json:"name"`
+	Size           uint64 `json:"size"`
+	CompressedSize uint64 `json:"compressed_size"`
+	Method         uint16 `json:"method"`
+	CRC32          string `json:"crc32,omitempty"`
+}
+
+// listArchiveContents answers ?list=json on a directory of an archive with a JSON array of
+// every file below it, optionally limited to names starting with ?prefix=. Names are
+// relative to the directory, and everything comes from the archive index, so the archive
+// itself is only read to index it. The array is streamed as it is read. urlPath is the
+// request path of the directory, against which ignore patterns match.
+func (s *Service) listArchiveContents(w http.ResponseWriter, r *http.Request, archivePath, dir, urlPath string) {
+	var out *bufio.Writer
+	err := s.zipReader.Walk(r.Context(), archivePath, dir+r.URL.Query().Get("prefix"), func(info zipfast.FileInfo) error {
+		name := strings.TrimPrefix(info.Name, dir)
+		if strings.HasSuffix(name, "/") || (!s.exposeHiddenFiles && hiddenEntry(name)) || s.ignore.Match(urlPath+name) {
+			return nil
+		}
+		entry := archiveListEntry{
+			Name:           name,
+			Size:           info.UncompressedSize,
+			CompressedSize: info.CompressedSize,
+			Method:         info.CompressionMethod,
+		}
+		if info.HasCRC32 {
+			entry.CRC32 = fmt.Sprintf("%08x", info.CRC32)
+		}
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		separator := byte(',')
+		if out == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			out = newChunkedWriter(w)
+			separator = '['
+		}
+		if err := out.WriteByte(separator); err != nil {
+			return err
+		}
+		_, err = out.Write(encoded)
+		return err
+	})
+	if err != nil && s.canceled(r, archivePath, dir) {
+		return
+	}
+
+	if out != nil {
+		if err == nil {
+			_, _ = out.WriteString("]\n")
+		} else {
+			// The truncated array tells the client the listing failed
+			s.logger.WarnContext(r.Context(), "Failed to list archive contents", "archive", archivePath, "dir", dir, "error", err)
+		}
+		_ = out.Flush()
+		return
+	}
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "Failed to list archive contents", "archive", archivePath, "dir", dir, "error", err)
+		http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+		return
+	}
+	if dir != "" {
+		if _, err := s.zipReader.ReadDir(r.Context(), archivePath, dir); errors.Is(err, zipfast.ErrNotFound) {
+			s.notFound(w, r, filepath.Dir(archivePath), archivePath)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte("[]\n"))
+}
+
+// hiddenEntry reports whether any segment of an entry name is dot-prefixed.
+func hiddenEntry(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
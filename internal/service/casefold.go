@@ -0,0 +1,92 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"cmpserve/internal/readers/zipfast"
+)
+
+// errAmbiguousName is returned when a name matches several names of a directory once case
+// is ignored, such as README.md and readme.md.
+var errAmbiguousName = errors.New("name matches several names")
+
+// foldSegment finds the name a path segment stands for when case is ignored, given that
+// neither the segment nor its archive candidate exist in dir as requested. It returns the
+// matching file or directory name, or else the matching archive name, or neither. Exact
+// names were tried first, so they always win over folded ones.
+func foldSegment(dir, part string) (entry, archive string, err error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	var entries, archives []string
+	for {
+		names, err := file.Readdirnames(listingBatchSize)
+		for _, name := range names {
+			switch {
+			case strings.EqualFold(name, part):
+				entries = append(entries, name)
+			case strings.EqualFold(name, part+".zip"):
+				archives = append(archives, name)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", "", err
+		}
+	}
+	switch {
+	case len(entries) > 1:
+		return "", "", fmt.Errorf("%w: %s", errAmbiguousName, strings.Join(entries, ", "))
+	case len(entries) == 1:
+		return entries[0], "", nil
+	case len(archives) > 1:
+		return "", "", fmt.Errorf("%w: %s", errAmbiguousName, strings.Join(archives, ", "))
+	case len(archives) == 1:
+		return "", archives[0], nil
+	}
+	return "", "", nil
+}
+
+// exists reports whether something, even a dangling symbolic link, is at target.
+func exists(target string) bool {
+	_, err := os.Lstat(target)
+	return err == nil
+}
+
+// foldArchivePath resolves the path of an entry or slash-terminated directory inside an
+// archive when case is ignored. Entries that are missing as files may be directories,
+// which are then returned without the slash so the request gets redirected. The path is
+// returned unchanged when nothing matches.
+func (s *Service) foldArchivePath(ctx context.Context, archivePath, remainingPath string) (string, error) {
+	if remainingPath == "" {
+		return "", nil
+	}
+	resolved, err := s.zipReader.Resolve(ctx, archivePath, remainingPath)
+	if errors.Is(err, zipfast.ErrNotFound) && !strings.HasSuffix(remainingPath, "/") {
+		resolved, err = s.zipReader.Resolve(ctx, archivePath, remainingPath+"/")
+		resolved = strings.TrimSuffix(resolved, "/")
+	}
+	if err != nil {
+		if errors.Is(err, zipfast.ErrNotFound) {
+			return remainingPath, nil
+		}
+		return remainingPath, err
+	}
+	return resolved, nil
+}
+
+// logAmbiguous warns about a request path that can't be resolved because it matches
+// several names once case is ignored.
+func (s *Service) logAmbiguous(ctx context.Context, urlPath string, err error) {
+	s.logger.WarnContext(ctx, "Ambiguous case-insensitive path", "path", urlPath, "error", err)
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strings"
+
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+// sniffLen is how many first bytes of an entry http.DetectContentType looks at.
+const sniffLen = 512
+
+// byteOrderMarks are the byte order marks announcing the charset of text entries.
+var byteOrderMarks = []struct {
+	bom     []byte
+	charset string
+}{
+	{[]byte{0xEF, 0xBB, 0xBF}, "utf-8"},
+	{[]byte{0xFF, 0xFE}, "utf-16le"},
+	{[]byte{0xFE, 0xFF}, "utf-16be"},
+}
+
+// bomLength is the length of the longest byte order mark.
+const bomLength = 3
+
+// charsetRule gives the archive entries matching a glob a charset, for legacy text content
+// that doesn't declare one.
+type charsetRule struct {
+	glob    string
+	charset string
+}
+
+// parseCharsetRules parses rules of the form glob=charset, such as *.csv=iso-8859-1. Globs
+// with a slash match the path of entries in their archive, others their base name.
+func parseCharsetRules(specs []string) ([]charsetRule, error) {
+	rules := make([]charsetRule, 0, len(specs))
+	for _, spec := range specs {
+		glob, charset, ok := strings.Cut(spec, "=")
+		glob, charset = strings.TrimPrefix(strings.TrimSpace(glob), "/"), strings.ToLower(strings.TrimSpace(charset))
+		if !ok || glob == "" || charset == "" {
+			return nil, fmt.Errorf("invalid charset rule %q, expected glob=charset such as *.csv=iso-8859-1", spec)
+		}
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid charset rule %q: %w", spec, err)
+		}
+		if enc, err := ianaindex.IANA.Encoding(charset); err != nil || enc == nil {
+			return nil, fmt.Errorf("invalid charset rule %q: unknown charset %q", spec, charset)
+		}
+		rules = append(rules, charsetRule{glob: glob, charset: charset})
+	}
+	return rules, nil
+}
+
+// ruleCharset returns the charset of the first rule matching entry, or "".
+func (s *Service) ruleCharset(entry string) string {
+	for _, rule := range s.charsets {
+		name := path.Base(entry)
+		if strings.Contains(rule.glob, "/") {
+			name = entry
+		}
+		if matched, _ := path.Match(rule.glob, name); matched {
+			return rule.charset
+		}
+	}
+	return ""
+}
+
+// detectBOM returns the charset of the byte order mark head starts with and its length, or
+// "" and 0 without one.
+func detectBOM(head []byte) (string, int) {
+	for _, mark := range byteOrderMarks {
+		if bytes.HasPrefix(head, mark.bom) {
+			return mark.charset, len(mark.bom)
+		}
+	}
+	return "", 0
+}
+
+// isText reports whether a media type is text, which a charset applies to.
+func isText(mediaType string) bool {
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "application/x-yaml", "application/yaml":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// isJSON reports whether a media type is JSON, whose byte order mark StripJSONBOM drops.
+func isJSON(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// withCharset returns the Content-Type ctype of an archive entry with its charset: that of
+// the byte order mark head, the first bytes of the entry when they were read, starts with,
+// else that of the first charset rule matching the entry, else the one ctype declares, and
+// utf-8 for text types declaring none.
+func (s *Service) withCharset(ctype, entry string, head []byte) string {
+	mediaType, params, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return ctype
+	}
+	var charset string
+	if isText(mediaType) {
+		charset, _ = detectBOM(head)
+	}
+	if charset == "" {
+		charset = s.ruleCharset(entry)
+	}
+	if charset == "" && isText(mediaType) && params["charset"] == "" {
+		charset = "utf-8"
+	}
+	if charset == "" {
+		return ctype
+	}
+	params["charset"] = charset
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// readHead reads up to n first bytes of r.
+func readHead(r io.Reader, n int) []byte {
+	head := make([]byte, n)
+	n, _ = io.ReadFull(r, head)
+	return head[:n]
+}
+
+// entryBody serves the data of an entry whose first bytes, head, were read to find its
+// type, from head rather than reading them again, and without the skip bytes of a stripped
+// byte order mark, which head then leaves out too.
+type entryBody struct {
+	head []byte
+	r    io.ReadSeeker
+	skip int64
+	size int64
+	pos  int64
+}
+
+func (b *entryBody) Read(p []byte) (int, error) {
+	if b.pos >= b.size {
+		return 0, io.EOF
+	}
+	if b.pos < int64(len(b.head)) {
+		n := copy(p, b.head[b.pos:])
+		b.pos += int64(n)
+		return n, nil
+	}
+	if _, err := b.r.Seek(b.skip+b.pos, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := b.r.Read(p)
+	b.pos += int64(n)
+	return n, err
+}
+
+func (b *entryBody) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.pos
+	case io.SeekEnd:
+		offset += b.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the entry")
+	}
+	b.pos = offset
+	return offset, nil
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	utf8BOM    = "\xef\xbb\xbf"
+	utf16LEBOM = "\xff\xfe"
+)
+
+// charsetFixture writes an archive of text entries in various charsets.
+func charsetFixture(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	require.NoError(t, createTestZipFile(filepath.Join(root, "texts.zip"), map[string]string{
+		"plain.txt":          "plain",
+		"bom.txt":            utf8BOM + "with bom",
+		"data.json":          utf8BOM + `{"a":1}`,
+		"utf16.txt":          utf16LEBOM + "h\x00i\x00",
+		"UTF16":              utf16LEBOM + "h\x00i\x00",
+		"report.csv":         "caf\xe9",
+		"legacy/index.html":  "<p>caf\xe9</p>",
+		"legacy/new.csv":     utf8BOM + "caf\xc3\xa9",
+		"image.png":          "\x89PNG\r\n\x1a\n",
+		"modern/index.html":  utf8BOM + "<p>ok</p>",
+		"modern/config.yaml": "a: 1",
+	}))
+	return root
+}
+
+func TestArchiveCharsets(t *testing.T) {
+	s := newTestService(t, charsetFixture(t), Options{Charsets: []string{"*.csv=ISO-8859-1", "legacy/*.html=windows-1252"}})
+
+	for _, tc := range []struct {
+		target, ctype, body string
+	}{
+		{"/texts/plain.txt", "text/plain; charset=utf-8", "plain"},
+		{"/texts/bom.txt", "text/plain; charset=utf-8", utf8BOM + "with bom"},
+		{"/texts/data.json", "application/json; charset=utf-8", utf8BOM + `{"a":1}`},
+		{"/texts/utf16.txt", "text/plain; charset=utf-16le", utf16LEBOM + "h\x00i\x00"},
+		{"/texts/UTF16", "text/plain; charset=utf-16le", utf16LEBOM + "h\x00i\x00"},
+		{"/texts/report.csv", "text/csv; charset=iso-8859-1", "caf\xe9"},
+		{"/texts/legacy/", "text/html; charset=windows-1252", "<p>caf\xe9</p>"},
+		// Byte order marks win over rules
+		{"/texts/legacy/new.csv", "text/csv; charset=utf-8", utf8BOM + "caf\xc3\xa9"},
+		{"/texts/modern/", "text/html; charset=utf-8", utf8BOM + "<p>ok</p>"},
+		{"/texts/modern/config.yaml", "application/x-yaml; charset=utf-8", "a: 1"},
+		{"/texts/image.png", "image/png", "\x89PNG\r\n\x1a\n"},
+	} {
+		rec := get(s, tc.target)
+		require.Equal(t, http.StatusOK, rec.Code, tc.target)
+		assert.Equal(t, tc.ctype, rec.Header().Get("Content-Type"), tc.target)
+		assert.Equal(t, tc.body, rec.Body.String(), tc.target)
+	}
+
+	// Ranges still count the bytes read to find the type
+	req := httptest.NewRequest(http.MethodGet, "/texts/utf16.txt", nil)
+	req.Header.Set("Range", "bytes=1-3")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "\xfeh\x00", rec.Body.String())
+
+	// Entries handed to gzip clients compressed get the charset of rules and extensions
+	req = httptest.NewRequest(http.MethodGet, "/texts/report.csv", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "text/csv; charset=iso-8859-1", rec.Header().Get("Content-Type"))
+}
+
+func TestStripJSONBOM(t *testing.T) {
+	s := newTestService(t, charsetFixture(t), Options{StripJSONBOM: true})
+
+	rec := get(s, "/texts/data.json")
+	assert.Equal(t, "application/json; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Equal(t, `{"a":1}`, rec.Body.String())
+	assert.Equal(t, "7", rec.Header().Get("Content-Length"))
+	assert.Contains(t, rec.Header().Get("ETag"), "-nobom")
+
+	req := httptest.NewRequest(http.MethodGet, "/texts/data.json", nil)
+	req.Header.Set("Range", "bytes=2-")
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, `a":1}`, rec.Body.String())
+
+	// JSON isn't handed to gzip clients compressed, which would keep the mark
+	req = httptest.NewRequest(http.MethodGet, "/texts/data.json", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, `{"a":1}`, rec.Body.String())
+
+	// Other text keeps its mark
+	assert.Equal(t, utf8BOM+"with bom", get(s, "/texts/bom.txt").Body.String())
+}
+
+func TestParseCharsetRules(t *testing.T) {
+	rules, err := parseCharsetRules([]string{"*.csv=ISO-8859-1", " /legacy/*.txt = windows-1252 "})
+	require.NoError(t, err)
+	assert.Equal(t, []charsetRule{{"*.csv", "iso-8859-1"}, {"legacy/*.txt", "windows-1252"}}, rules)
+
+	for _, spec := range []string{"*.csv", "=utf-8", "*.csv=", "[.csv=utf-8", "*.csv=klingon"} {
+		_, err := parseCharsetRules([]string{spec})
+		assert.Error(t, err, spec)
+	}
+}
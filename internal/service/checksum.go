@@ -0,0 +1,95 @@
+package service
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cmpserve/internal/readers/zipfast"
+)
+
+// checksumSuffix appended to the path of a file or archive entry names its digest.
+const checksumSuffix = ".sha256"
+
+// serveChecksum answers requests for the SHA-256 digest of a file or archive entry, asked
+// for with ?checksum=sha256 or by the path of the file with .sha256 appended, as long as
+// nothing exists at that path. The digest is sent as a line of sha256sum output. It returns
+// false, having served nothing, for other requests.
+func (s *Service) serveChecksum(w http.ResponseWriter, r *http.Request, t target) bool {
+	switch {
+	case r.URL.Query().Has("checksum"):
+		if algorithm := r.URL.Query().Get("checksum"); algorithm != "sha256" {
+			http.Error(w, "unsupported checksum "+algorithm+", expected sha256", http.StatusBadRequest)
+			return true
+		}
+	case strings.HasSuffix(t.urlPath, checksumSuffix) && !s.targetExists(r, t):
+		u := *r.URL
+		u.Path = strings.TrimSuffix(u.Path, checksumSuffix)
+		u.RawPath = strings.TrimSuffix(u.RawPath, checksumSuffix)
+		stripped := r.Clone(r.Context())
+		stripped.URL = &u
+		var ok bool
+		if t, ok = s.resolve(w, stripped); !ok || !s.authorize(w, r, t.dir()) {
+			return true
+		}
+	default:
+		return false
+	}
+
+	var digest []byte
+	var name string
+	var err error
+	switch {
+	case t.archivePath != "" && t.entry != "" && !strings.HasSuffix(t.entry, "/"):
+		entry := t.entry
+		if s.caseInsensitive {
+			if entry, err = s.foldArchivePath(r.Context(), t.archivePath, entry); err != nil {
+				s.notFound(w, r, filepath.Dir(t.archivePath), t.archivePath)
+				return true
+			}
+		}
+		// Computing the digest decompresses the entry
+		if !s.acquireExtraction(w, r, t.archivePath) {
+			return true
+		}
+		digest, err = s.zipReader.EntrySHA256(r.Context(), t.archivePath, entry)
+		s.releaseExtraction()
+		name = path.Base(entry)
+	case t.path != "" && !t.isDir:
+		digest, err = s.zipReader.FileSHA256(r.Context(), t.path)
+		name = filepath.Base(t.path)
+	default:
+		s.notFound(w, r, t.dir(), t.archivePath)
+		return true
+	}
+	if err != nil {
+		if s.canceled(r, t.archivePath, t.entry) {
+			return true
+		}
+		if !errors.Is(err, zipfast.ErrNotFound) && !errors.Is(err, zipfast.ErrRejected) && !errors.Is(err, fs.ErrNotExist) {
+			s.logger.WarnContext(r.Context(), "Failed to compute checksum", "path", t.urlPath, "error", err)
+		}
+		s.notFound(w, r, t.dir(), t.archivePath)
+		return true
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeContent(w, r, "", time.Time{}, strings.NewReader(hex.EncodeToString(digest)+"  "+name+"\n"))
+	return true
+}
+
+// targetExists reports whether something exists at a resolved request path, or may.
+func (s *Service) targetExists(r *http.Request, t target) bool {
+	switch {
+	case t.path != "", t.archivePath != "" && t.entry == "":
+		return true
+	case t.archivePath != "":
+		_, err := s.zipReader.Stat(r.Context(), t.archivePath, t.entry)
+		return !errors.Is(err, zipfast.ErrNotFound)
+	}
+	return t.uncertain
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// checksumLine returns the line of sha256sum output for content.
+func checksumLine(content, name string) string {
+	digest := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(digest[:]) + "  " + name + "\n"
+}
+
+func TestChecksums(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"releases/app.tar":        "app",
+		"releases/app.tar.sha256": "published  app.tar\n",
+		"releases/other.tar":      "other",
+		".hidden":                 "hidden",
+	})
+	require.NoError(t, createTestZipFile(filepath.Join(root, "bundle.zip"), map[string]string{"assets/app.js": "js", "docs/": ""}))
+	cacheDir := t.TempDir()
+	s, err := NewService(root, cacheDir, Options{Checksums: true})
+	require.NoError(t, err)
+
+	for _, tc := range []struct{ target, body string }{
+		{"/releases/other.tar.sha256", checksumLine("other", "other.tar")},
+		{"/releases/other.tar?checksum=sha256", checksumLine("other", "other.tar")},
+		{"/bundle/assets/app.js.sha256", checksumLine("js", "app.js")},
+		{"/bundle/assets/app.js?checksum=sha256", checksumLine("js", "app.js")},
+		{"/bundle.zip.sha256", checksumLine(readFile(t, filepath.Join(root, "bundle.zip")), "bundle.zip")},
+		// Files named like a checksum are served as they are
+		{"/releases/app.tar.sha256", "published  app.tar\n"},
+		{"/releases/app.tar.sha256?checksum=sha256", checksumLine("published  app.tar\n", "app.tar.sha256")},
+	} {
+		rec := get(s, tc.target)
+		require.Equal(t, http.StatusOK, rec.Code, tc.target)
+		assert.Equal(t, tc.body, rec.Body.String(), tc.target)
+	}
+	assert.Equal(t, "text/plain; charset=utf-8", get(s, "/releases/other.tar.sha256").Header().Get("Content-Type"))
+
+	for _, target := range []string{"/releases/missing.tar.sha256", "/releases.sha256", "/releases/?checksum=sha256", "/bundle.sha256", "/bundle/docs.sha256", "/bundle/missing.js.sha256", "/.hidden.sha256"} {
+		assert.Equal(t, http.StatusNotFound, get(s, target).Code, target)
+	}
+	assert.Equal(t, http.StatusBadRequest, get(s, "/releases/other.tar?checksum=md5").Code)
+
+	// The digests recorded in the index are dropped once the archive is reindexed, across
+	// restarts too
+	require.NoError(t, s.Close())
+	require.NoError(t, createTestZipFile(filepath.Join(root, "bundle.zip"), map[string]string{"assets/app.js": "new js"}))
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(root, "bundle.zip"), later, later))
+	s, err = NewService(root, cacheDir, Options{Checksums: true})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, s.Close()) })
+	assert.Equal(t, checksumLine("new js", "app.js"), get(s, "/bundle/assets/app.js.sha256").Body.String())
+
+	// Without the option, nothing is synthesized
+	off := newTestService(t, root, Options{})
+	assert.Equal(t, http.StatusNotFound, get(off, "/releases/other.tar.sha256").Code)
+	assert.Equal(t, "other", get(off, "/releases/other.tar?checksum=sha256").Body.String())
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(data)
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// setDownloadDisposition asks the client to save the response rather than display it
+// when the request has a download query parameter. The file is named after its value if
+// it is a usable file name, and after name, the last segment of the requested path,
+// otherwise.
+func setDownloadDisposition(w http.ResponseWriter, r *http.Request, name string) {
+	query := r.URL.Query()
+	if !query.Has("download") {
+		return
+	}
+	if override := sanitizeFilename(query.Get("download")); override != "" {
+		name = override
+	}
+	w.Header().Set("Content-Disposition", contentDisposition(name))
+}
+
+// sanitizeFilename reduces a client-chosen file name to its last path segment without
+// control characters, or returns "" if nothing usable is left.
+func sanitizeFilename(name string) string {
+	name = strings.ReplaceAll(name, `\`, "/")
+	name = name[strings.LastIndex(name, "/")+1:]
+	name = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return -1
+		}
+		return r
+	}, name))
+	if name == "." || name == ".." {
+		return ""
+	}
+	return name
+}
+
+var quotedStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// contentDisposition formats an attachment header for name. Names beyond ASCII get an
+// RFC 5987 filename* parameter, with an ASCII approximation in filename for old clients.
+func contentDisposition(name string) string {
+	ascii := true
+	fallback := strings.Map(func(r rune) rune {
+		if r >= 0x80 {
+			ascii = false
+			return '_'
+		}
+		return r
+	}, name)
+	header := `attachment; filename="` + quotedStringEscaper.Replace(fallback) + `"`
+	if !ascii {
+		header += "; filename*=UTF-8''" + encodeExtValue(name)
+	}
+	return header
+}
+
+// encodeExtValue percent-encodes every byte of s except the attr-char set of RFC 5987.
+func encodeExtValue(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0xf])
+	}
+	return b.String()
+}
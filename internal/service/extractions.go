@@ -0,0 +1,76 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// ExtractionObserver is notified of the state of the archive extraction limiter, e.g. to
+// export metrics.
+type ExtractionObserver interface {
+	// ExtractionsChanged reports the extractions running and those waiting for a slot.
+	ExtractionsChanged(inFlight, queued int)
+	// ExtractionRejected is called when a request gave up waiting for a slot.
+	ExtractionRejected()
+}
+
+type noopExtractionObserver struct{}
+
+func (noopExtractionObserver) ExtractionsChanged(int, int) {}
+func (noopExtractionObserver) ExtractionRejected()         {}
+
+// extractionLimiter bounds the number of archive requests decompressing at once. Requests
+// beyond the limit wait in line for up to timeout.
+type extractionLimiter struct {
+	slots    *semaphore.Weighted
+	timeout  time.Duration
+	observer ExtractionObserver
+
+	mu       sync.Mutex
+	inFlight int
+	queued   int
+}
+
+func newExtractionLimiter(limit int, timeout time.Duration, observer ExtractionObserver) *extractionLimiter {
+	if observer == nil {
+		observer = noopExtractionObserver{}
+	}
+	return &extractionLimiter{slots: semaphore.NewWeighted(int64(limit)), timeout: timeout, observer: observer}
+}
+
+// acquire waits for a slot, returning false if none freed up in time or ctx was canceled.
+// Every successful acquire must be followed by a release.
+func (l *extractionLimiter) acquire(ctx context.Context) bool {
+	if l.slots.TryAcquire(1) {
+		l.update(1, 0)
+		return true
+	}
+	l.update(0, 1)
+	waitCtx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+	if err := l.slots.Acquire(waitCtx, 1); err != nil {
+		l.update(0, -1)
+		if ctx.Err() == nil {
+			l.observer.ExtractionRejected()
+		}
+		return false
+	}
+	l.update(1, -1)
+	return true
+}
+
+func (l *extractionLimiter) release() {
+	l.slots.Release(1)
+	l.update(-1, 0)
+}
+
+func (l *extractionLimiter) update(inFlight, queued int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight += inFlight
+	l.queued += queued
+	l.observer.ExtractionsChanged(l.inFlight, l.queued)
+}
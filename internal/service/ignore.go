@@ -0,0 +1,61 @@
+package service
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"cmpserve/internal/ignore"
+)
+
+// ignoreFile lists patterns to ignore, one per line, in the service directory.
+const ignoreFile = ".cmpserveignore"
+
+// loadIgnore compiles the ignore patterns of a service directory: the given ones, those of
+// its ignore file, if any, and the ignore, alias and access files themselves, optionally
+// matching regardless of case. An empty rootServiceDir has no ignore file.
+func loadIgnore(rootServiceDir string, patterns []string, foldCase bool) (*ignore.Matcher, error) {
+	matcher := &ignore.Matcher{FoldCase: foldCase}
+	for _, pattern := range []string{"/" + ignoreFile, "/" + aliasFile, accessFile} {
+		if err := matcher.Add(pattern); err != nil {
+			return nil, err
+		}
+	}
+	for _, pattern := range patterns {
+		if err := matcher.Add(pattern); err != nil {
+			return nil, err
+		}
+	}
+	if rootServiceDir == "" {
+		return matcher, nil
+	}
+	if err := matcher.AddFile(filepath.Join(rootServiceDir, ignoreFile)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return matcher, nil
+}
+
+// ignoreDir returns the directory whose ignore file applies to a service, none for an
+// archive served as the tree.
+func ignoreDir(rootServiceDir, rootArchive string) string {
+	if rootArchive != "" {
+		return ""
+	}
+	return rootServiceDir
+}
+
+// ignored reports whether a listing entry of the directory at the slash-terminated URL
+// path dir is ignored. Archives are ignored both by their file name and as the directory
+// their contents are served under.
+func (s *Service) ignored(dir string, entry indexEntry) bool {
+	name := dir + entry.name
+	switch {
+	case entry.isDir:
+		return s.ignore.Match(name + "/")
+	case entry.isArchive:
+		return s.ignore.Match(name) || s.ignore.Match(strings.TrimSuffix(name, ".zip")+"/")
+	default:
+		return s.ignore.Match(name)
+	}
+}
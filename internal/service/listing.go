@@ -0,0 +1,541 @@
+package service
+
+import (
+	"bufio"
+	"cmpserve/internal/negotiate"
+	"cmpserve/internal/readers/zipfast"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// listingBatchSize is the number of directory entries read at once.
+	listingBatchSize = 1024
+	// listingChunkSize is the amount of rendered listing buffered before flushing it to the client.
+	listingChunkSize = 64 << 10
+)
+
+// indexEntry is a single row of a generated directory index.
+type indexEntry struct {
+	name      string
+	isDir     bool
+	isArchive bool
+	isSymlink bool
+	size      int64
+	modTime   time.Time
+}
+
+// serveDirectory serves the first existing index document of a directory, falling back to
+// a listing when indexes are enabled.
+func (s *Service) serveDirectory(w http.ResponseWriter, r *http.Request, dirPath, urlPath string) {
+	if indexPath := s.findIndexFile(dirPath); indexPath != "" {
+		if !s.servePrecompressed(w, r, indexPath) {
+			http.ServeFile(w, r, indexPath)
+		}
+		return
+	}
+	if s.createIndexes {
+		s.listDirectory(w, r, dirPath, urlPath)
+		return
+	}
+	s.notFound(w, r, dirPath, "")
+}
+
+// findIndexFile returns the path of the first existing index document of a directory, or
+// an empty string when there is none. Documents that couldn't be requested themselves,
+// being hidden or ignored, are skipped.
+func (s *Service) findIndexFile(dirPath string) string {
+	for _, indexFile := range s.indexFiles {
+		if !s.exposeHiddenFiles && strings.HasPrefix(indexFile, ".") {
+			continue
+		}
+		indexPath := filepath.Join(dirPath, indexFile)
+		if rel, err := filepath.Rel(s.rootServiceDir, indexPath); err == nil && s.ignore.Match(filepath.ToSlash(rel)) {
+			continue
+		}
+		if stat, err := os.Stat(indexPath); err == nil && !stat.IsDir() && s.symlinkAllowed(indexPath) {
+			return indexPath
+		}
+	}
+	return ""
+}
+
+func (s *Service) listDirectory(w http.ResponseWriter, r *http.Request, dirPath, urlPath string) {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		switch {
+		case errors.Is(err, fs.ErrPermission):
+			s.forbidden(w, r, dirPath, err)
+		case errors.Is(err, fs.ErrNotExist):
+			s.notFound(w, r, filepath.Dir(dirPath), "")
+		default:
+			s.logger.ErrorContext(r.Context(), "Failed to read directory", "path", dirPath, "error", err)
+			http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+		}
+		return
+	}
+	defer dir.Close()
+
+	// Huge directories are read in batches so entries are never held twice
+	var entries []indexEntry
+	for {
+		dirEntries, err := dir.ReadDir(listingBatchSize)
+		entries = append(entries, s.filesystemIndexEntries(dirPath, dirEntries)...)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if errors.Is(err, fs.ErrPermission) {
+				s.forbidden(w, r, dirPath, err)
+				return
+			}
+			s.logger.ErrorContext(r.Context(), "Failed to read directory", "path", dirPath, "error", err)
+			http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+			return
+		}
+	}
+	s.writeIndex(w, r, urlPath, entries)
+}
+
+// filesystemIndexEntries converts the entries of a directory to index rows. Entries removed
+// between reading the directory and fetching their metadata are skipped, like symbolic
+// links that are dangling or not followed. The others are described by their target.
+func (s *Service) filesystemIndexEntries(dirPath string, dirEntries []fs.DirEntry) []indexEntry {
+	entries := make([]indexEntry, 0, len(dirEntries))
+	for _, entry := range dirEntries {
+		name := entry.Name()
+		symlink := entry.Type()&fs.ModeSymlink != 0
+		var info fs.FileInfo
+		var err error
+		if symlink {
+			target := filepath.Join(dirPath, name)
+			if !s.symlinkAllowed(target) {
+				continue
+			}
+			info, err = os.Stat(target)
+		} else {
+			info, err = entry.Info()
+		}
+		if err != nil {
+			continue
+		}
+		entries = append(entries, indexEntry{
+			name:      name,
+			isDir:     info.IsDir(),
+			isArchive: !info.IsDir() && strings.HasSuffix(name, ".zip"),
+			isSymlink: symlink,
+			size:      info.Size(),
+			modTime:   info.ModTime(),
+		})
+	}
+	return entries
+}
+
+// listArchiveDirectory renders an index for a directory inside an archive. dir is the
+// slash-terminated entry prefix, or empty for the archive root.
+func (s *Service) listArchiveDirectory(w http.ResponseWriter, r *http.Request, archivePath, dir, urlPath string) {
+	dirEntries, err := s.zipReader.ReadDir(r.Context(), archivePath, dir)
+	if err != nil {
+		if errors.Is(err, zipfast.ErrNotFound) {
+			s.notFound(w, r, filepath.Dir(archivePath), archivePath)
+			return
+		}
+		if s.canceled(r, archivePath, dir) {
+			return
+		}
+		s.logger.ErrorContext(r.Context(), "Failed to read archive directory", "archive", archivePath, "dir", dir, "error", err)
+		http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+		return
+	}
+
+	entries := make([]indexEntry, 0, len(dirEntries))
+	for _, entry := range dirEntries {
+		entries = append(entries, indexEntry{name: entry.Name, isDir: entry.IsDir, size: int64(entry.Size), modTime: entry.Modified})
+	}
+	s.writeIndex(w, r, urlPath, entries)
+}
+
+// visibleEntries drops the hidden and ignored entries of the directory at urlPath, reusing
+// the backing array of entries.
+func (s *Service) visibleEntries(urlPath string, entries []indexEntry) []indexEntry {
+	dir := strings.TrimSuffix(urlPath, "/") + "/"
+	visible := entries[:0]
+	for _, entry := range entries {
+		if (s.exposeHiddenFiles || !strings.HasPrefix(entry.name, ".")) && !s.ignored(dir, entry) {
+			visible = append(visible, entry)
+		}
+	}
+	return visible
+}
+
+// hrefEscape percent-encodes a name for use as a relative link. A leading "./" keeps names
+// containing a colon from being read as a URL scheme.
+func hrefEscape(name string) string {
+	escaped := url.PathEscape(name)
+	if strings.Contains(escaped, ":") {
+		escaped = "./" + escaped
+	}
+	return escaped
+}
+
+// sortIndexEntries orders directories before files, then by the given key. Names compare
+// case-insensitively and break ties for the other keys.
+func sortIndexEntries(entries []indexEntry, key string, descending bool) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.isDir != b.isDir {
+			return a.isDir
+		}
+		var cmp int
+		switch key {
+		case "size":
+			cmp = compareInt64(a.size, b.size)
+		case "time":
+			cmp = a.modTime.Compare(b.modTime)
+		}
+		if cmp == 0 {
+			cmp = strings.Compare(strings.ToLower(a.name), strings.ToLower(b.name))
+		}
+		if cmp == 0 {
+			cmp = strings.Compare(a.name, b.name)
+		}
+		if descending {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// formatSize renders a byte count with a binary unit suffix.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func formatModTime(modTime time.Time) string {
+	if modTime.IsZero() {
+		return "-"
+	}
+	return modTime.UTC().Format("2006-01-02 15:04:05")
+}
+
+//go:embed templates/index.html
+var defaultIndexTemplate string
+
+// indexTemplateFuncs are available to the default and to custom index templates.
+var indexTemplateFuncs = template.FuncMap{
+	"formatSize":    formatSize,
+	"formatModTime": formatModTime,
+}
+
+// parseIndexTemplate parses a custom index template, or the embedded default when
+// templatePath is empty. Names and links are escaped by html/template.
+func parseIndexTemplate(templatePath string) (*template.Template, error) {
+	if templatePath == "" {
+		return template.New("index").Funcs(indexTemplateFuncs).Parse(defaultIndexTemplate)
+	}
+	content, err := os.ReadFile(templatePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index template: %w", err)
+	}
+	tmpl, err := template.New(filepath.Base(templatePath)).Funcs(indexTemplateFuncs).Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse index template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// indexPage is the data passed to the index template.
+type indexPage struct {
+	Path        string
+	Breadcrumbs []indexBreadcrumb
+	Parent      string
+	Entries     []indexLink
+	Sort        string
+	Order       string
+
+	// Offset and Limit select the page of entries; Total counts all of them.
+	Offset    int
+	Limit     int
+	Total     int
+	Truncated bool
+	PrevHref  string
+	NextHref  string
+}
+
+// indexBreadcrumb links to the listing of an ancestor of the listed directory.
+type indexBreadcrumb struct {
+	Name string `json:"name"`
+	Href string `json:"href"`
+}
+
+// SortHref links to the listing sorted by key, toggling the order for the current key.
+func (p indexPage) SortHref(key string) string {
+	order := "asc"
+	if key == p.Sort && p.Order == "asc" {
+		order = "desc"
+	}
+	href := "?sort=" + key + "&order=" + order
+	if p.Limit > 0 {
+		href += "&limit=" + strconv.Itoa(p.Limit)
+	}
+	return href
+}
+
+// pageHref links to the page of the listing starting at offset, keeping the sort order.
+func (p indexPage) pageHref(offset int) string {
+	return "?sort=" + p.Sort + "&order=" + p.Order + "&offset=" + strconv.Itoa(offset) + "&limit=" + strconv.Itoa(p.Limit)
+}
+
+type indexLink struct {
+	Name         string
+	Href         string
+	DownloadHref string
+	IsDir        bool
+	IsArchive    bool
+	IsSymlink    bool
+	Size         int64
+	ModTime      time.Time
+}
+
+func (s *Service) writeIndex(w http.ResponseWriter, r *http.Request, urlPath string, entries []indexEntry) {
+	// Links are relative to the listed directory. Without a trailing slash in the request
+	// URL they would resolve against the parent, so they get the directory name prepended.
+	var base string
+	if urlPath != "" && !strings.HasSuffix(urlPath, "/") {
+		base = hrefEscape(path.Base(urlPath)) + "/"
+	}
+
+	query := r.URL.Query()
+	page := indexPage{Path: urlPath, Breadcrumbs: breadcrumbs(s.basePath, urlPath), Sort: "name", Order: "asc"}
+	if urlPath != "" {
+		page.Parent = base + "../"
+	}
+	if key := query.Get("sort"); key == "size" || key == "time" {
+		page.Sort = key
+	}
+	if query.Get("order") == "desc" {
+		page.Order = "desc"
+	}
+	if offset, err := strconv.Atoi(query.Get("offset")); err == nil && offset > 0 {
+		page.Offset = offset
+	}
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit > 0 {
+		page.Limit = limit
+	}
+
+	entries = s.visibleEntries(urlPath, entries)
+	sortIndexEntries(entries, page.Sort, page.Order == "desc")
+
+	page.Total = len(entries)
+	page.Offset = min(page.Offset, len(entries))
+	entries = entries[page.Offset:]
+	if page.Limit > 0 && len(entries) > page.Limit {
+		entries = entries[:page.Limit]
+	}
+	page.Truncated = page.Offset > 0 || page.Offset+len(entries) < page.Total
+	if page.Limit > 0 && page.Offset > 0 {
+		page.PrevHref = page.pageHref(max(page.Offset-page.Limit, 0))
+	}
+	if page.Offset+len(entries) < page.Total {
+		page.NextHref = page.pageHref(page.Offset + len(entries))
+	}
+
+	page.Entries = make([]indexLink, 0, len(entries))
+	for _, entry := range entries {
+		link := indexLink{
+			Name:      entry.name,
+			IsDir:     entry.isDir,
+			IsArchive: entry.isArchive,
+			IsSymlink: entry.isSymlink,
+			Size:      entry.size,
+			ModTime:   entry.modTime,
+		}
+		if entry.isDir {
+			link.Name += "/"
+			link.Href = base + hrefEscape(entry.name) + "/"
+		} else if entry.isArchive {
+			link.Href = base + hrefEscape(strings.TrimSuffix(entry.name, ".zip")) + "/"
+			if !s.noArchiveDownload {
+				link.DownloadHref = base + hrefEscape(entry.name)
+			}
+		} else {
+			link.Href = base + hrefEscape(entry.name)
+			if !s.noArchiveDownload || !isArchiveName(entry.name) {
+				link.DownloadHref = link.Href + "?download"
+			}
+		}
+		page.Entries = append(page.Entries, link)
+	}
+
+	if wantsJSON(r) {
+		writeJSONIndex(w, page)
+		return
+	}
+
+	tmpl := s.indexTemplate
+	if s.indexTemplateReload {
+		var err error
+		if tmpl, err = parseIndexTemplate(s.indexTemplatePath); err != nil {
+			s.logger.ErrorContext(r.Context(), "Failed to reload index template", "error", err)
+			http.Error(w, "Failed to render directory", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	out := newChunkedWriter(w)
+	if err := tmpl.Execute(out, page); err != nil {
+		s.logger.WarnContext(r.Context(), "Failed to render index", "path", urlPath, "error", err)
+	}
+	_ = out.Flush()
+}
+
+// flushingWriter flushes every write through to the client.
+type flushingWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (f flushingWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err == nil && f.flusher != nil {
+		f.flusher.Flush()
+	}
+	return n, err
+}
+
+// newChunkedWriter buffers the many small writes of a rendered listing and sends them to
+// the client in flushed chunks, so large listings are streamed instead of piling up.
+func newChunkedWriter(w http.ResponseWriter) *bufio.Writer {
+	flusher, _ := w.(http.Flusher)
+	return bufio.NewWriterSize(flushingWriter{w: w, flusher: flusher}, listingChunkSize)
+}
+
+// breadcrumbs derives the ancestors of a listing from its request path, from the root down
+// to the listed directory itself. Links are prefixed with the escaped basePath.
+func breadcrumbs(basePath, urlPath string) []indexBreadcrumb {
+	href := basePath + "/"
+	crumbs := []indexBreadcrumb{{Name: "/", Href: href}}
+	for _, segment := range strings.Split(strings.TrimSuffix(urlPath, "/"), "/") {
+		if segment == "" {
+			continue
+		}
+		href += url.PathEscape(segment) + "/"
+		crumbs = append(crumbs, indexBreadcrumb{Name: segment, Href: href})
+	}
+	return crumbs
+}
+
+// wantsJSON reports whether the client asked for a machine-readable listing, either with
+// ?format=json or through the Accept header.
+func wantsJSON(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+	return negotiate.Accepts(r.Header.Get("Accept"), "application/json")
+}
+
+// jsonIndex is the machine-readable form of a listing.
+type jsonIndex struct {
+	Path        string            `json:"path"`
+	Parent      string            `json:"parent,omitempty"`
+	Breadcrumbs []indexBreadcrumb `json:"breadcrumbs"`
+	Offset      int               `json:"offset"`
+	Total       int               `json:"total"`
+	Truncated   bool              `json:"truncated"`
+	// Entries must stay last, writeJSONIndex streams them after the other fields.
+	Entries []jsonIndexEntry `json:"entries"`
+}
+
+type jsonIndexEntry struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Size    int64  `json:"size"`
+	ModTime string `json:"mtime,omitempty"`
+	Symlink bool   `json:"symlink,omitempty"`
+}
+
+func writeJSONIndex(w http.ResponseWriter, page indexPage) {
+	index := jsonIndex{
+		Path:        "/" + page.Path,
+		Breadcrumbs: page.Breadcrumbs,
+		Offset:      page.Offset,
+		Total:       page.Total,
+		Truncated:   page.Truncated,
+		Entries:     []jsonIndexEntry{},
+	}
+	if len(page.Breadcrumbs) > 1 {
+		index.Parent = page.Breadcrumbs[len(page.Breadcrumbs)-2].Href
+	}
+	head, err := json.Marshal(index)
+	if err != nil {
+		http.Error(w, "Failed to render directory", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	out := newChunkedWriter(w)
+	defer out.Flush()
+
+	// Reopen the trailing empty entries array and stream the entries into it
+	if _, err := out.Write(head[:len(head)-2]); err != nil {
+		return
+	}
+	for i, link := range page.Entries {
+		entry := jsonIndexEntry{Name: strings.TrimSuffix(link.Name, "/"), Type: "file", Size: link.Size, Symlink: link.IsSymlink}
+		if link.IsDir {
+			entry.Type = "dir"
+		} else if link.IsArchive {
+			entry.Type = "archive"
+		}
+		if !link.ModTime.IsZero() {
+			entry.ModTime = link.ModTime.UTC().Format(time.RFC3339)
+		}
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+		if i > 0 {
+			_ = out.WriteByte(',')
+		}
+		if _, err := out.Write(encoded); err != nil {
+			return
+		}
+	}
+	_, _ = out.WriteString("]}\n")
+}
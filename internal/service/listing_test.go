@@ -0,0 +1,556 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var pageMarkup = regexp.MustCompile(`</?(html|head|title|body|h1|nav|table|thead|tbody|tr|th|td)>|<meta charset="utf-8">|<a href="[^"<>]*">|</a>`)
+
+func TestListingEscapesHostileNames(t *testing.T) {
+	root := t.TempDir()
+	hostile := []string{
+		`<img src=x onerror=alert(1)>.txt`,
+		`"quoted" 'name'.txt`,
+		`javascript:alert(1)`,
+	}
+	files := map[string]string{"<script>alert(1)</script>/file.txt": "x"}
+	for _, name := range hostile {
+		files["dir/"+name] = "x"
+	}
+	writeTestFiles(t, root, files)
+	require.NoError(t, createTestZipFile(filepath.Join(root, "dir", "<b onclick=x>.zip"), map[string]string{"a": "a"}))
+
+	s := newTestService(t, root, Options{CreateIndexes: true})
+
+	for _, target := range []string{"/dir/", "/%3Cscript%3Ealert(1)%3C/script%3E/", "/"} {
+		rec := get(s, target)
+		require.Equal(t, http.StatusOK, rec.Code, target)
+		body := rec.Body.String()
+
+		// Only the markup of the page itself may contain angle brackets
+		markup := pageMarkup.ReplaceAllString(body, "")
+		assert.NotContains(t, markup, "<", target)
+		assert.NotContains(t, markup, ">", target)
+	}
+
+	body := get(s, "/dir/").Body.String()
+	assert.Contains(t, body, "&lt;img src=x onerror=alert(1)&gt;.txt")
+	assert.Contains(t, body, `href="%3Cimg%20src=x%20onerror=alert%281%29%3E.txt"`)
+	assert.Contains(t, body, `href="./javascript:alert%281%29"`)
+	assert.Contains(t, body, `(<a href="%3Cb%20onclick=x%3E.zip">download</a>)`)
+}
+
+var hrefPattern = regexp.MustCompile(`href="([^"]*)"`)
+
+// listingLinks fetches a listing from a running server and returns its links resolved
+// against the page URL.
+func listingLinks(t *testing.T, client *http.Client, pageURL string) []string {
+	t.Helper()
+	resp, err := client.Get(pageURL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode, pageURL)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	// Resolve against the final URL, after any trailing-slash redirect
+	base := resp.Request.URL
+	var links []string
+	for _, match := range hrefPattern.FindAllStringSubmatch(string(body), -1) {
+		ref, err := url.Parse(html.UnescapeString(match[1]))
+		require.NoError(t, err)
+		links = append(links, base.ResolveReference(ref).String())
+	}
+	return links
+}
+
+func TestListingLinksResolve(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"a/b/file.txt":         "file",
+		"a/b/with space.txt":   "space",
+		"a/b/sub/nested.txt":   "nested",
+		"a/b/sub dir/more.txt": "more",
+	})
+	require.NoError(t, createTestZipFile(filepath.Join(root, "a", "b", "bundle.zip"), map[string]string{
+		"index.html":    "index",
+		"nested/x.html": "x",
+	}))
+	require.NoError(t, createTestZipFile(filepath.Join(root, "a", "b", "plain.zip"), map[string]string{
+		"docs/y.html": "y",
+	}))
+
+	s := newTestService(t, root, Options{CreateIndexes: true})
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	client := server.Client()
+
+	for _, page := range []string{"/a/b/", "/a/b", "/a/b/plain/", "/a/b/plain/docs/"} {
+		links := listingLinks(t, client, server.URL+page)
+		require.NotEmpty(t, links, page)
+		for _, link := range links {
+			resp, err := client.Get(link)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode, "%s from %s", link, page)
+		}
+	}
+
+	assert.Contains(t, listingLinks(t, client, server.URL+"/a/b"), server.URL+"/a/b/file.txt")
+	assert.Contains(t, listingLinks(t, client, server.URL+"/a/b/"), server.URL+"/a/b/bundle.zip")
+}
+
+// vanishedEntry is a directory entry whose file disappeared before Info was called.
+type vanishedEntry struct{ name string }
+
+func (e vanishedEntry) Name() string               { return e.name }
+func (e vanishedEntry) IsDir() bool                { return false }
+func (e vanishedEntry) Type() fs.FileMode          { return 0 }
+func (e vanishedEntry) Info() (fs.FileInfo, error) { return nil, fs.ErrNotExist }
+
+func TestListingSkipsVanishedEntries(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"kept.txt": "kept"})
+	dirEntries, err := os.ReadDir(root)
+	require.NoError(t, err)
+
+	s := newTestService(t, root, Options{})
+	entries := s.filesystemIndexEntries(root, append(dirEntries, vanishedEntry{name: "gone.txt"}))
+	require.Len(t, entries, 1)
+	assert.Equal(t, "kept.txt", entries[0].name)
+	assert.Equal(t, int64(4), entries[0].size)
+}
+
+func TestListingSortOrder(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"b.txt":       "12345",
+		"A.txt":       "123",
+		"c.txt":       "1",
+		"Zdir/x.txt":  "x",
+		"adir/y.txt":  "y",
+		"medium.data": "1234",
+	})
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, name := range []string{"adir", "Zdir", "c.txt", "medium.data", "A.txt", "b.txt"} {
+		modTime := base.Add(time.Duration(i) * time.Hour)
+		require.NoError(t, os.Chtimes(filepath.Join(root, name), modTime, modTime))
+	}
+
+	s := newTestService(t, root, Options{CreateIndexes: true})
+
+	order := func(target string) []string {
+		var names []string
+		for _, match := range hrefPattern.FindAllStringSubmatch(get(s, target).Body.String(), -1) {
+			// Skip the sort links, breadcrumbs and download links
+			if !strings.HasPrefix(match[1], "?") && !strings.HasPrefix(match[1], "/") && !strings.HasSuffix(match[1], "?download") {
+				names = append(names, match[1])
+			}
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"adir/", "Zdir/", "A.txt", "b.txt", "c.txt", "medium.data"}, order("/"))
+	assert.Equal(t, []string{"Zdir/", "adir/", "medium.data", "c.txt", "b.txt", "A.txt"}, order("/?sort=name&order=desc"))
+	assert.Equal(t, []string{"adir/", "Zdir/", "c.txt", "A.txt", "medium.data", "b.txt"}, order("/?sort=size"))
+	assert.Equal(t, []string{"Zdir/", "adir/", "b.txt", "medium.data", "A.txt", "c.txt"}, order("/?sort=size&order=desc"))
+	assert.Equal(t, []string{"adir/", "Zdir/", "c.txt", "medium.data", "A.txt", "b.txt"}, order("/?sort=time"))
+
+	body := get(s, "/?sort=size&order=asc").Body.String()
+	assert.Contains(t, body, `href="?sort=size&amp;order=desc"`)
+	assert.Contains(t, body, `href="?sort=name&amp;order=asc"`)
+	assert.Contains(t, body, "<td>5 B</td>")
+	assert.Contains(t, body, "2024-01-01 05:00:00")
+}
+
+func TestFormatSize(t *testing.T) {
+	assert.Equal(t, "0 B", formatSize(0))
+	assert.Equal(t, "1023 B", formatSize(1023))
+	assert.Equal(t, "1.0 KiB", formatSize(1024))
+	assert.Equal(t, "1.5 MiB", formatSize(3<<19))
+	assert.Equal(t, "2.0 GiB", formatSize(2<<30))
+}
+
+func TestJSONListing(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"docs/readme.txt": "hello",
+		"docs/.secret":    "hidden",
+		"docs/sub/x.txt":  "x",
+	})
+	require.NoError(t, createTestZipFile(filepath.Join(root, "docs", "bundle.zip"), map[string]string{
+		"index.txt":  "i",
+		"img/a.png":  "aa",
+		".dotfile":   "d",
+		"img/.h.png": "h",
+	}))
+	modTime := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	require.NoError(t, os.Chtimes(filepath.Join(root, "docs", "readme.txt"), modTime, modTime))
+
+	s := newTestService(t, root, Options{CreateIndexes: true})
+
+	decode := func(rec *httptest.ResponseRecorder) jsonIndex {
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		var index jsonIndex
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &index))
+		return index
+	}
+
+	index := decode(get(s, "/docs/?format=json"))
+	assert.Equal(t, "/docs/", index.Path)
+	require.Len(t, index.Entries, 3)
+	assert.Equal(t, jsonIndexEntry{Name: "sub", Type: "dir", Size: index.Entries[0].Size, ModTime: index.Entries[0].ModTime}, index.Entries[0])
+	assert.Equal(t, "bundle.zip", index.Entries[1].Name)
+	assert.Equal(t, "archive", index.Entries[1].Type)
+	assert.Equal(t, jsonIndexEntry{Name: "readme.txt", Type: "file", Size: 5, ModTime: "2024-05-06T07:08:09Z"}, index.Entries[2])
+
+	// Content negotiation through the Accept header, also for the root and inside archives
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "application/json;q=0.9, text/html;q=0.8")
+	s.ServeHTTP(rec, req)
+	index = decode(rec)
+	assert.Equal(t, "/", index.Path)
+	require.Len(t, index.Entries, 1)
+	assert.Equal(t, "docs", index.Entries[0].Name)
+
+	// Entries written without a modification time carry the zero date of their format
+	dosEpoch := "1979-11-30T00:00:00Z"
+	index = decode(get(s, "/docs/bundle/?format=json"))
+	assert.Equal(t, []jsonIndexEntry{{Name: "img", Type: "dir"}, {Name: "index.txt", Type: "file", Size: 1, ModTime: dosEpoch}}, index.Entries)
+	index = decode(get(s, "/docs/bundle/img/?format=json"))
+	assert.Equal(t, []jsonIndexEntry{{Name: "a.png", Type: "file", Size: 2, ModTime: dosEpoch}}, index.Entries)
+
+	// and the others the one recorded in the archive
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	_, err := zipWriter.CreateHeader(&zip.FileHeader{Name: "dated.txt", Modified: modTime})
+	require.NoError(t, err)
+	require.NoError(t, zipWriter.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(root, "docs", "dated.zip"), buf.Bytes(), 0o644))
+	index = decode(get(s, "/docs/dated/?format=json"))
+	assert.Equal(t, []jsonIndexEntry{{Name: "dated.txt", Type: "file", ModTime: "2024-05-06T07:08:09Z"}}, index.Entries)
+
+	// HTML stays the default
+	assert.Equal(t, "text/html; charset=utf-8", get(s, "/docs/").Header().Get("Content-Type"))
+
+	// No listing at all without indexes
+	s = newTestService(t, root, Options{})
+	assert.Equal(t, http.StatusNotFound, get(s, "/docs/?format=json").Code)
+}
+
+func TestCustomIndexTemplate(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"a/b/file.txt": "12345",
+		"a/b/sub/x":    "x",
+	})
+	require.NoError(t, createTestZipFile(filepath.Join(root, "a", "b", "pack.zip"), map[string]string{"x": "x"}))
+
+	templatePath := filepath.Join(t.TempDir(), "index.html")
+	require.NoError(t, os.WriteFile(templatePath, []byte(
+		`<title>{{.Path}}</title>{{range .Breadcrumbs}}[{{.Name}}|{{.Href}}]{{end}}`+
+			`{{range .Entries}}({{.Name}} href={{.Href}} dir={{.IsDir}} archive={{.IsArchive}} size={{formatSize .Size}}){{end}}`,
+	), 0o644))
+
+	s := newTestService(t, root, Options{CreateIndexes: true, IndexTemplate: templatePath})
+	rec := get(s, "/a/b/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+	body := rec.Body.String()
+	assert.Contains(t, body, "<title>a/b/</title>")
+	assert.Contains(t, body, "[/|/][a|/a/][b|/a/b/]")
+	assert.Contains(t, body, "(sub/ href=sub/ dir=true archive=false")
+	assert.Contains(t, body, "(file.txt href=file.txt dir=false archive=false size=5 B)")
+	assert.Contains(t, body, "(pack.zip href=pack/ dir=false archive=true")
+
+	// Edits are only picked up in reload mode
+	require.NoError(t, os.WriteFile(templatePath, []byte(`changed {{.Path}}`), 0o644))
+	assert.Contains(t, get(s, "/a/b/").Body.String(), "<title>")
+	s = newTestService(t, root, Options{CreateIndexes: true, IndexTemplate: templatePath, IndexTemplateReload: true})
+	assert.Equal(t, "changed a/b/", get(s, "/a/b/").Body.String())
+	require.NoError(t, os.WriteFile(templatePath, []byte(`again {{.Path}}`), 0o644))
+	assert.Equal(t, "again a/b/", get(s, "/a/b/").Body.String())
+
+	require.NoError(t, os.WriteFile(templatePath, []byte(`{{.Path`), 0o644))
+	assert.Equal(t, http.StatusInternalServerError, get(s, "/a/b/").Code)
+}
+
+func TestInvalidIndexTemplateFailsStartup(t *testing.T) {
+	templatePath := filepath.Join(t.TempDir(), "index.html")
+	require.NoError(t, os.WriteFile(templatePath, []byte(`{{range .Entries}}`), 0o644))
+
+	_, err := NewService(t.TempDir(), t.TempDir(), Options{IndexTemplate: templatePath})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to parse index template")
+	assert.Contains(t, err.Error(), "index.html")
+
+	_, err = NewService(t.TempDir(), t.TempDir(), Options{IndexTemplate: templatePath + ".missing"})
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestBreadcrumbs(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"one/two words/three/leaf.txt": "leaf"})
+	require.NoError(t, createTestZipFile(filepath.Join(root, "one", "pack.zip"), map[string]string{"in/side/x.txt": "x"}))
+
+	s := newTestService(t, root, Options{CreateIndexes: true})
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	client := server.Client()
+
+	for _, page := range []string{"/one/two%20words/three/", "/one/two%20words/three", "/one/pack/in/side/"} {
+		links := listingLinks(t, client, server.URL+page)
+		for _, link := range links {
+			resp, err := client.Get(link)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode, "%s from %s", link, page)
+		}
+		assert.Contains(t, links, server.URL+"/")
+		assert.Contains(t, links, server.URL+"/one/")
+	}
+
+	links := listingLinks(t, client, server.URL+"/one/two%20words/three/")
+	assert.Contains(t, links, server.URL+"/one/two%20words/")
+	assert.Contains(t, links, server.URL+"/one/two%20words/three/")
+
+	body := get(s, "/one/two%20words/three/").Body.String()
+	assert.Contains(t, body, `<a href="/one/two%20words/">two words</a>`)
+	assert.Contains(t, body, `<a href="../">../</a>`)
+	assert.NotContains(t, get(s, "/").Body.String(), `../`)
+
+	// Inside archives the crumbs follow the request path
+	links = listingLinks(t, client, server.URL+"/one/pack/in/side/")
+	assert.Contains(t, links, server.URL+"/one/pack/")
+	assert.Contains(t, links, server.URL+"/one/pack/in/")
+
+	var index jsonIndex
+	require.NoError(t, json.Unmarshal(get(s, "/one/pack/in/?format=json").Body.Bytes(), &index))
+	assert.Equal(t, "/one/pack/", index.Parent)
+	assert.Equal(t, []indexBreadcrumb{
+		{Name: "/", Href: "/"},
+		{Name: "one", Href: "/one/"},
+		{Name: "pack", Href: "/one/pack/"},
+		{Name: "in", Href: "/one/pack/in/"},
+	}, index.Breadcrumbs)
+}
+
+func TestListingPagination(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{}
+	for i := 0; i < 25; i++ {
+		files[fmt.Sprintf("file%02d.txt", i)] = "x"
+	}
+	writeTestFiles(t, root, files)
+
+	s := newTestService(t, root, Options{CreateIndexes: true})
+
+	var index jsonIndex
+	require.NoError(t, json.Unmarshal(get(s, "/?format=json&limit=10&offset=20").Body.Bytes(), &index))
+	assert.True(t, index.Truncated)
+	assert.Equal(t, 25, index.Total)
+	assert.Equal(t, 20, index.Offset)
+	require.Len(t, index.Entries, 5)
+	assert.Equal(t, "file20.txt", index.Entries[0].Name)
+
+	require.NoError(t, json.Unmarshal(get(s, "/?format=json").Body.Bytes(), &index))
+	assert.False(t, index.Truncated)
+	assert.Len(t, index.Entries, 25)
+
+	body := get(s, "/?limit=10&offset=10").Body.String()
+	assert.Contains(t, body, `<a href="?sort=name&amp;order=asc&amp;offset=0&amp;limit=10">previous</a>`)
+	assert.Contains(t, body, `<a href="?sort=name&amp;order=asc&amp;offset=20&amp;limit=10">next</a>`)
+	assert.Contains(t, body, `href="file10.txt"`)
+	assert.NotContains(t, body, `href="file09.txt"`)
+	assert.NotContains(t, body, `href="file20.txt"`)
+
+	body = get(s, "/?limit=10").Body.String()
+	assert.NotContains(t, body, "previous")
+	assert.Contains(t, body, "next")
+	assert.NotContains(t, get(s, "/").Body.String(), "next")
+}
+
+var reportPattern = regexp.MustCompile(`report-\d{5}\.txt`)
+
+func TestLargeListing(t *testing.T) {
+	if testing.Short() {
+		t.Skip("creates tens of thousands of files")
+	}
+	root := t.TempDir()
+	const count = 20000
+	for i := 0; i < count; i++ {
+		require.NoError(t, os.WriteFile(filepath.Join(root, fmt.Sprintf("report-%05d.txt", i)), nil, 0o644))
+	}
+
+	s := newTestService(t, root, Options{CreateIndexes: true})
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+
+	for _, target := range []string{"/", "/?format=json", "/?sort=time&order=desc"} {
+		start := time.Now()
+		resp, err := server.Client().Get(server.URL + target)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Less(t, time.Since(start), 10*time.Second, target)
+		names := map[string]bool{}
+		for _, name := range reportPattern.FindAllString(string(body), -1) {
+			names[name] = true
+		}
+		assert.Len(t, names, count, target)
+	}
+}
+
+func TestArchiveContentsListing(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"index.html":          "<html>bundle</html>",
+		"images/logo.png":     "png",
+		"images/icons/a.svg":  "<svg/>",
+		"images/.cache/x":     "hidden",
+		"scripts/app.js":      strings.Repeat("x", 1000),
+		".build-info":         "secret",
+		"scripts/images/b.js": "b",
+	}
+	require.NoError(t, createTestZipFile(filepath.Join(root, "bundle.zip"), files))
+	s := newTestService(t, root, Options{CreateIndexes: true})
+
+	list := func(target string) []archiveListEntry {
+		t.Helper()
+		rec := get(s, target)
+		require.Equal(t, http.StatusOK, rec.Code, target)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		var entries []archiveListEntry
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &entries), rec.Body.String())
+		return entries
+	}
+	names := func(entries []archiveListEntry) []string {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		return names
+	}
+
+	// The archive gets indexed by the first listing
+	entries := list("/bundle/?list=json")
+	assert.Equal(t, []string{"images/icons/a.svg", "images/logo.png", "index.html", "scripts/app.js", "scripts/images/b.js"}, names(entries))
+	app := entries[3]
+	assert.Equal(t, uint64(1000), app.Size)
+	assert.Less(t, app.CompressedSize, app.Size)
+	assert.Equal(t, uint16(8), app.Method)
+	assert.Regexp(t, `^[0-9a-f]{8}$`, app.CRC32)
+
+	assert.Equal(t, []string{"images/icons/a.svg", "images/logo.png"}, names(list("/bundle/?list=json&prefix=images/")))
+	assert.Equal(t, []string{"icons/a.svg", "logo.png"}, names(list("/bundle/images/?list=json")))
+	assert.Equal(t, []string{"logo.png"}, names(list("/bundle/images/?list=json&prefix=l")))
+	assert.Empty(t, list("/bundle/images/?list=json&prefix=none"))
+	assert.Equal(t, http.StatusNotFound, get(s, "/bundle/missing/?list=json").Code)
+
+	// Hidden entries are only listed when exposed
+	exposed := newTestService(t, root, Options{CreateIndexes: true, ExposeHiddenFiles: true})
+	rec := get(exposed, "/bundle/?list=json")
+	assert.Contains(t, rec.Body.String(), `"name":".build-info"`)
+	assert.Contains(t, rec.Body.String(), `"name":"images/.cache/x"`)
+
+	// Without indexes the parameter is ignored
+	disabled := newTestService(t, root, Options{})
+	assert.Equal(t, "<html>bundle</html>", get(disabled, "/bundle/?list=json").Body.String())
+}
+
+func TestBasePath(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"builds/one/log.txt": "log", "artifacts/trap.txt": "trap"})
+	require.NoError(t, createTestZipFile(filepath.Join(root, "builds", "site.zip"), map[string]string{"docs/page.html": "page"}))
+
+	s := newTestService(t, root, Options{CreateIndexes: true, BasePath: "/artifacts/"})
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	client := server.Client()
+	noRedirects := *client
+	noRedirects.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	for target, location := range map[string]string{
+		"/":                           "/artifacts/",
+		"/artifacts":                  "/artifacts/",
+		"/artifacts?sort=size":        "/artifacts/?sort=size",
+		"/artifacts/builds":           "/artifacts/builds/",
+		"/artifacts/builds/site":      "/artifacts/builds/site/",
+		"/artifacts/builds/site/docs": "/artifacts/builds/site/docs/",
+	} {
+		resp, err := noRedirects.Get(server.URL + target)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMovedPermanently, resp.StatusCode, target)
+		assert.Equal(t, location, resp.Header.Get("Location"), target)
+	}
+	for _, target := range []string{"/builds/one/log.txt", "/artifactsfoo", "/artifactsfoo/builds/", "/artifacts%2Fbuilds/", "/other/artifacts/"} {
+		resp, err := client.Get(server.URL + target)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, target)
+	}
+	// The prefix is stripped once, not looked up as a directory
+	resp, err := client.Get(server.URL + "/artifacts/trap.txt")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Every link of every listing stays under the prefix and resolves
+	pages := []string{"/artifacts/"}
+	visited := map[string]bool{}
+	for len(pages) > 0 {
+		page := pages[0]
+		pages = pages[1:]
+		if visited[page] {
+			continue
+		}
+		visited[page] = true
+		for _, link := range listingLinks(t, client, server.URL+page) {
+			target := strings.TrimPrefix(link, server.URL)
+			assert.True(t, strings.HasPrefix(target, "/artifacts/"), "%s from %s", link, page)
+			resp, err := client.Get(link)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode, "%s from %s", link, page)
+			if parsed, err := url.Parse(target); err == nil && strings.HasSuffix(parsed.Path, "/") && parsed.RawQuery == "" {
+				pages = append(pages, parsed.Path)
+			}
+		}
+	}
+	assert.True(t, visited["/artifacts/builds/site/docs/"], "listings reach inside archives")
+
+	var index jsonIndex
+	require.NoError(t, json.Unmarshal(get(s, "/artifacts/builds/site/?format=json").Body.Bytes(), &index))
+	assert.Equal(t, "/artifacts/builds/", index.Parent)
+	assert.Equal(t, "/artifacts/", index.Breadcrumbs[0].Href)
+	// The crumbs read as the listed path, the root crumb standing for the prefix
+	body := get(s, "/artifacts/builds/one/").Body.String()
+	assert.Contains(t, body, `<nav><a href="/artifacts/">/</a><a href="/artifacts/builds/">builds</a>/<a href="/artifacts/builds/one/">one</a>/</nav>`)
+
+	for _, basePath := range []string{"artifacts", "/a/../b", "/a//b", "/./a"} {
+		_, err := NewService(root, t.TempDir(), Options{BasePath: basePath})
+		assert.Error(t, err, basePath)
+	}
+}
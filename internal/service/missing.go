@@ -0,0 +1,110 @@
+package service
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+// missingCacheSize bounds the number of paths a missingCache remembers.
+const missingCacheSize = 4096
+
+// missingCache remembers the request paths that resolved to nothing, so that repeated
+// requests for them are answered without walking the filesystem again. Entries expire
+// after a TTL, and the least recently used ones are dropped beyond missingCacheSize.
+type missingCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[missingKey]*list.Element
+	// order holds the *missingEntry values, most recently used first.
+	order *list.List
+}
+
+// missingKey identifies a request path, relative to the service directory it was
+// resolved in, as services for several directories share the cache.
+type missingKey struct {
+	root    string
+	urlPath string
+}
+
+type missingEntry struct {
+	key     missingKey
+	target  target
+	expires time.Time
+}
+
+// newMissingCache returns a cache remembering paths for ttl, or nil if ttl isn't positive.
+func newMissingCache(ttl time.Duration) *missingCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &missingCache{ttl: ttl, entries: make(map[missingKey]*list.Element), order: list.New()}
+}
+
+// get returns the target a request path resolved to, if it is still remembered.
+func (c *missingCache) get(key missingKey) (target, bool) {
+	if c == nil {
+		return target{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return target{}, false
+	}
+	entry := element.Value.(*missingEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(element)
+		return target{}, false
+	}
+	c.order.MoveToFront(element)
+	return entry.target, true
+}
+
+// put remembers the target of a request path that resolved to nothing.
+func (c *missingCache) put(key missingKey, t target) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := time.Now().Add(c.ttl)
+	if element, ok := c.entries[key]; ok {
+		element.Value = &missingEntry{key: key, target: t, expires: expires}
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&missingEntry{key: key, target: t, expires: expires})
+	if c.order.Len() > missingCacheSize {
+		c.remove(c.order.Back())
+	}
+}
+
+// forget drops the paths of a service directory equal to or below the slash-separated
+// prefix, or all of them for an empty prefix.
+func (c *missingCache) forget(root, prefix string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, element := range c.entries {
+		if key.root == root && (prefix == "" || key.urlPath == prefix || strings.HasPrefix(key.urlPath, prefix+"/")) {
+			c.remove(element)
+		}
+	}
+}
+
+func (c *missingCache) remove(element *list.Element) {
+	delete(c.entries, element.Value.(*missingEntry).key)
+	c.order.Remove(element)
+}
+
+// forgetArchive drops the remembered paths of the archive at the slash-separated path
+// name, and of its entries, once its index changed.
+func (s *Service) forgetArchive(name string) {
+	s.missing.forget(s.rootServiceDir, name)
+	s.missing.forget(s.rootServiceDir, name[:len(name)-len(".zip")])
+}
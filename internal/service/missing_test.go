@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotFoundCache(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"docs/guide.txt": "guide", "docs/404.html": "docs not found"})
+	s := newTestService(t, root, Options{NotFoundCacheTTL: 200 * time.Millisecond})
+
+	rec := get(s, "/docs/new.txt")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "docs not found", rec.Body.String())
+	writeTestFiles(t, root, map[string]string{"docs/new.txt": "new"})
+	rec = get(s, "/docs/new.txt")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "docs not found", rec.Body.String())
+	assert.Equal(t, "guide", get(s, "/docs/guide.txt").Body.String())
+
+	assert.Eventually(t, func() bool { return get(s, "/docs/new.txt").Code == http.StatusOK }, 2*time.Second, 20*time.Millisecond)
+	assert.Equal(t, "new", get(s, "/docs/new.txt").Body.String())
+
+	// Without a TTL, new files are found right away
+	s = newTestService(t, root, Options{})
+	assert.Equal(t, http.StatusNotFound, get(s, "/docs/other.txt").Code)
+	writeTestFiles(t, root, map[string]string{"docs/other.txt": "other"})
+	assert.Equal(t, "other", get(s, "/docs/other.txt").Body.String())
+}
+
+func TestNotFoundCacheArchives(t *testing.T) {
+	root := t.TempDir()
+	s := newTestService(t, root, Options{NotFoundCacheTTL: time.Hour})
+	assert.Equal(t, http.StatusNotFound, get(s, "/docs/bundle/a.txt").Code)
+	assert.Equal(t, http.StatusNotFound, get(s, "/docs/bundle.zip").Code)
+	assert.Equal(t, http.StatusNotFound, get(s, "/docs/bundle-old/a.txt").Code)
+
+	writeTestFiles(t, root, map[string]string{"docs/.keep": ""})
+	require.NoError(t, createTestZipFile(filepath.Join(root, "docs", "bundle.zip"), map[string]string{"a.txt": "archived"}))
+	assert.Equal(t, http.StatusNotFound, get(s, "/docs/bundle/a.txt").Code)
+
+	// Paths into an archive are forgotten once it is indexed
+	_, err := s.ReindexArchive(context.Background(), "docs/bundle.zip")
+	require.NoError(t, err)
+	assert.Equal(t, "archived", get(s, "/docs/bundle/a.txt").Body.String())
+	assert.Equal(t, http.StatusOK, get(s, "/docs/bundle.zip").Code)
+	_, ok := s.missing.get(missingKey{root: s.rootServiceDir, urlPath: "docs/bundle-old/a.txt"})
+	assert.True(t, ok)
+
+	// Services for other directories have paths of their own
+	other, err := s.WithRoot(t.TempDir())
+	require.NoError(t, err)
+	_, ok = other.missing.get(missingKey{root: other.rootServiceDir, urlPath: "docs/bundle-old/a.txt"})
+	assert.False(t, ok)
+}
+
+func TestNotFoundCacheUncertain(t *testing.T) {
+	root := t.TempDir()
+	s := newTestService(t, root, Options{NotFoundCacheTTL: time.Hour})
+
+	// Failing with ENAMETOOLONG says nothing about the path existing
+	assert.Equal(t, http.StatusNotFound, get(s, "/"+strings.Repeat("a", 300)).Code)
+	assert.Empty(t, s.missing.entries)
+	assert.Equal(t, http.StatusNotFound, get(s, "/missing").Code)
+	assert.Len(t, s.missing.entries, 1)
+}
+
+func TestMissingCacheEviction(t *testing.T) {
+	c := newMissingCache(time.Hour)
+	for i := range missingCacheSize {
+		c.put(missingKey{urlPath: fmt.Sprint(i)}, target{})
+	}
+	_, ok := c.get(missingKey{urlPath: "0"})
+	require.True(t, ok)
+	c.put(missingKey{urlPath: "new"}, target{})
+
+	assert.Len(t, c.entries, missingCacheSize)
+	_, ok = c.get(missingKey{urlPath: "0"})
+	assert.True(t, ok)
+	_, ok = c.get(missingKey{urlPath: "1"})
+	assert.False(t, ok)
+
+	c.forget("", "")
+	assert.Empty(t, c.entries)
+	assert.Zero(t, c.order.Len())
+	assert.Nil(t, newMissingCache(0))
+}
+
+// BenchmarkNotFound requests a missing path eight directories deep, which costs two stats
+// per segment unless the cache remembers it.
+func BenchmarkNotFound(b *testing.B) {
+	root := b.TempDir()
+	deep := "a/b/c/d/e/f/g"
+	writeTestFiles(b, root, map[string]string{deep + "/present.txt": ""})
+	for _, ttl := range []time.Duration{0, time.Minute} {
+		b.Run(fmt.Sprintf("ttl=%s", ttl), func(b *testing.B) {
+			s, err := NewService(root, b.TempDir(), Options{NotFoundCacheTTL: ttl})
+			require.NoError(b, err)
+			defer s.Close()
+			for b.Loop() {
+				if rec := get(s, "/"+deep+"/missing/file.txt"); rec.Code != http.StatusNotFound {
+					b.Fatal(rec.Code)
+				}
+			}
+		})
+	}
+}
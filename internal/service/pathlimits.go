@@ -0,0 +1,67 @@
+package service
+
+import (
+	"net/http"
+)
+
+const (
+	// DefaultMaxPathSegments is the number of segments a request path may have by default.
+	DefaultMaxPathSegments = 64
+	// DefaultMaxSegmentLength is the length in bytes a path segment may have by default,
+	// the longest file name most filesystems allow.
+	DefaultMaxSegmentLength = 255
+	// DefaultMaxPathLength is the length in bytes a decoded request path may have by default.
+	DefaultMaxPathLength = 4096
+)
+
+// pathLimits bounds the request paths walked through the filesystem and looked up in
+// archives, which costs a few system calls or queries per segment. Zero fields mean no limit.
+type pathLimits struct {
+	segments      int
+	segmentLength int
+	length        int
+}
+
+// newPathLimits returns the limits of options, with defaults for zero values and no
+// limit for negative ones.
+func newPathLimits(options Options) pathLimits {
+	limit := func(value, fallback int) int {
+		switch {
+		case value == 0:
+			return fallback
+		case value < 0:
+			return 0
+		}
+		return value
+	}
+	return pathLimits{
+		segments:      limit(options.MaxPathSegments, DefaultMaxPathSegments),
+		segmentLength: limit(options.MaxSegmentLength, DefaultMaxSegmentLength),
+		length:        limit(options.MaxPathLength, DefaultMaxPathLength),
+	}
+}
+
+// check returns the status answering a request path made of the decoded segments parts,
+// or zero if it is within the limits. Paths with too many segments or too long get 414, and
+// those with a segment no file or entry could be named after get 404. The trailing empty
+// segment of a directory request doesn't count.
+func (l pathLimits) check(parts []string) int {
+	segments, length := len(parts), len(parts)
+	if segments > 0 && parts[segments-1] == "" {
+		segments--
+	}
+	tooLong := false
+	for _, part := range parts {
+		length += len(part)
+		if l.segmentLength > 0 && len(part) > l.segmentLength {
+			tooLong = true
+		}
+	}
+	switch {
+	case l.segments > 0 && segments > l.segments, l.length > 0 && length > l.length:
+		return http.StatusRequestURITooLong
+	case tooLong:
+		return http.StatusNotFound
+	}
+	return 0
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deepPath returns a path of n segments named name.
+func deepPath(name string, n int) string {
+	return strings.TrimSuffix(strings.Repeat(name+"/", n), "/")
+}
+
+func TestPathLimits(t *testing.T) {
+	root := t.TempDir()
+	deep := deepPath("d", DefaultMaxPathSegments-1)
+	long := strings.Repeat("n", DefaultMaxSegmentLength)
+	writeTestFiles(t, root, map[string]string{
+		deep + "/file.txt": "deep",
+		long:               "long name",
+	})
+	require.NoError(t, createTestZipFile(filepath.Join(root, "bundle.zip"), map[string]string{
+		deepPath("e", DefaultMaxPathSegments-2) + "/entry.txt": "deep entry",
+	}))
+	s := newTestService(t, root, Options{CreateIndexes: true})
+
+	// Deep but reasonable paths are served
+	assert.Equal(t, "deep", get(s, "/"+deep+"/file.txt").Body.String())
+	assert.Equal(t, http.StatusOK, get(s, "/"+deep+"/").Code)
+	assert.Equal(t, "deep entry", get(s, "/bundle/"+deepPath("e", DefaultMaxPathSegments-2)+"/entry.txt").Body.String())
+	assert.Equal(t, "long name", get(s, "/"+long).Body.String())
+
+	for _, tc := range []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"too many segments", "/" + deepPath("d", DefaultMaxPathSegments+1), http.StatusRequestURITooLong},
+		{"too many segments into an archive", "/bundle/" + deepPath("e", DefaultMaxPathSegments), http.StatusRequestURITooLong},
+		{"too long segment", "/" + strings.Repeat("n", DefaultMaxSegmentLength+1), http.StatusNotFound},
+		{"too long path", "/" + deepPath(long, DefaultMaxPathLength/DefaultMaxSegmentLength+1), http.StatusRequestURITooLong},
+		{"encoded segments count decoded", "/" + strings.Repeat("%6E", DefaultMaxSegmentLength+1), http.StatusNotFound},
+	} {
+		assert.Equal(t, tc.status, get(s, tc.path).Code, tc.name)
+	}
+
+	limited := newTestService(t, root, Options{CreateIndexes: true, MaxPathSegments: 2, MaxSegmentLength: 8, MaxPathLength: 12})
+	assert.Equal(t, http.StatusRequestURITooLong, get(limited, "/d/d/d").Code)
+	// A trailing slash doesn't add a segment
+	assert.Equal(t, http.StatusOK, get(limited, "/d/d/").Code)
+	assert.Equal(t, http.StatusNotFound, get(limited, "/123456789").Code)
+	assert.Equal(t, http.StatusRequestURITooLong, get(limited, "/12345678/1234").Code)
+
+	unlimited := newTestService(t, root, Options{MaxPathSegments: -1, MaxSegmentLength: -1, MaxPathLength: -1})
+	assert.Equal(t, http.StatusNotFound, get(unlimited, "/"+deepPath("d", 10*DefaultMaxPathSegments)).Code)
+	assert.Equal(t, http.StatusNotFound, get(unlimited, "/"+strings.Repeat("n", 1000)).Code)
+}
+
+// BenchmarkHostilePath requests a path of thousands of missing segments, which each cost a
+// few stats when walked, as the limits refuse before walking any.
+func BenchmarkHostilePath(b *testing.B) {
+	root := b.TempDir()
+	writeTestFiles(b, root, map[string]string{"a/file.txt": "a"})
+	target := "/" + deepPath("a", 2000)
+	for _, bc := range []struct {
+		name    string
+		options Options
+	}{
+		{"limited", Options{}},
+		{"unlimited", Options{MaxPathSegments: -1, MaxPathLength: -1}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			s, err := NewService(root, b.TempDir(), bc.options)
+			require.NoError(b, err)
+			b.Cleanup(func() { require.NoError(b, s.Close()) })
+			for b.Loop() {
+				get(s, target)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"cmpserve/internal/negotiate"
+)
+
+// precompressedVariants are the sibling files tried for a file, in order of preference.
+var precompressedVariants = []struct{ encoding, suffix string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// servePrecompressed serves the .br or .gz sibling of filePath when the client accepts its
+// encoding, with the Content-Type of filePath. Ranges and conditional requests apply to
+// the compressed bytes, whose length and modification time are the ones reported. It
+// returns false, having served nothing, when the original file should be served instead.
+func (s *Service) servePrecompressed(w http.ResponseWriter, r *http.Request, filePath string) bool {
+	// http.ServeFile redirects these to the directory URL
+	if !s.precompressed || strings.HasSuffix(r.URL.Path, "/index.html") {
+		return false
+	}
+
+	var chosen, encoding string
+	var best float64
+	varies := false
+	for _, variant := range precompressedVariants {
+		if stat, err := os.Stat(filePath + variant.suffix); err != nil || stat.IsDir() || !s.symlinkAllowed(filePath+variant.suffix) {
+			continue
+		}
+		varies = true
+		if q := negotiate.EncodingQuality(r.Header.Get("Accept-Encoding"), variant.encoding); q > best {
+			chosen, encoding, best = filePath+variant.suffix, variant.encoding, q
+		}
+	}
+	if varies {
+		varyOnEncoding(w.Header())
+	}
+	if chosen == "" {
+		return false
+	}
+
+	file, err := os.Open(chosen)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", contentType(filePath))
+	}
+	w.Header().Set("Content-Encoding", encoding)
+	http.ServeContent(encodedLengthWriter{w, stat.Size()}, r, stat.Name(), stat.ModTime(), file)
+	return true
+}
+
+// servePrecompressedEntry serves the .br or .gz sibling entry of an archive entry when the
+// client accepts its encoding, as servePrecompressed does for files, with the Content-Type
+// of the entry. Ranges and conditional requests apply to the compressed bytes, whose
+// length, ETag and modification time are the ones reported. It returns false, having served nothing,
+// when the entry should be served instead, or is missing.
+func (s *Service) servePrecompressedEntry(w http.ResponseWriter, r *http.Request, archivePath, entry string) bool {
+	if !s.precompressed {
+		return false
+	}
+	if _, err := s.zipReader.Stat(r.Context(), archivePath, entry); err != nil {
+		return false
+	}
+
+	var chosen, encoding string
+	var best float64
+	varies := false
+	for _, variant := range precompressedVariants {
+		if _, err := s.zipReader.Stat(r.Context(), archivePath, entry+variant.suffix); err != nil {
+			continue
+		}
+		varies = true
+		if q := negotiate.EncodingQuality(r.Header.Get("Accept-Encoding"), variant.encoding); q > best {
+			chosen, encoding, best = entry+variant.suffix, variant.encoding, q
+		}
+	}
+	if varies {
+		varyOnEncoding(w.Header())
+	}
+	if chosen == "" {
+		return false
+	}
+
+	reader, err := s.zipReader.OpenEntry(r.Context(), archivePath, chosen)
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", s.entryContentType(r.Context(), archivePath, entry))
+	}
+	if reader.Info.HasCRC32 {
+		w.Header().Set("ETag", fmt.Sprintf(`"%08x-%x"`, reader.Info.CRC32, reader.Info.UncompressedSize))
+	}
+	w.Header().Set("Content-Encoding", encoding)
+	http.ServeContent(encodedLengthWriter{w, int64(reader.Info.UncompressedSize)}, r, path.Base(chosen), reader.Info.Modified, reader)
+	if err := reader.Err(); err != nil {
+		s.logger.WarnContext(r.Context(), "Failed to stream archive entry", "archive", archivePath, "entry", chosen, "error", err)
+	}
+	return true
+}
+
+// encodedLengthWriter sets the Content-Length of whole responses, which http.ServeContent
+// leaves out once Content-Encoding is set, to the length of the encoded bytes it serves.
+type encodedLengthWriter struct {
+	http.ResponseWriter
+	length int64
+}
+
+func (w encodedLengthWriter) WriteHeader(code int) {
+	if code == http.StatusOK {
+		w.Header().Set("Content-Length", strconv.FormatInt(w.length, 10))
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w encodedLengthWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// varyOnEncoding adds Accept-Encoding to the Vary header, unless it is there already.
+func varyOnEncoding(header http.Header) {
+	if !slices.Contains(header.Values("Vary"), "Accept-Encoding") {
+		header.Add("Vary", "Accept-Encoding")
+	}
+}
+
+// notModified reports whether a GET or HEAD request for a representation of the given
+// ETag and modification time is answered with 304: when If-None-Match lists the ETag, or
+// when it is absent and the representation is no newer than If-Modified-Since.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.IsZero() && !modified.Truncate(time.Second).After(since)
+}
+
+// entryContentType returns the media type of an archive entry, with its charset, from its
+// extension or, like http.ServeContent, from its first bytes, whose byte order mark is then
+// honored.
+func (s *Service) entryContentType(ctx context.Context, archivePath, entry string) string {
+	if ctype := mime.TypeByExtension(path.Ext(entry)); ctype != "" {
+		return s.withCharset(ctype, entry, nil)
+	}
+	reader, err := s.zipReader.OpenEntry(ctx, archivePath, entry)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer reader.Close()
+	head := readHead(reader, sniffLen)
+	return s.withCharset(http.DetectContentType(head), entry, head)
+}
+
+// contentType returns the media type of the file at filePath, from its extension or, like
+// http.ServeContent, from its first bytes.
+func contentType(filePath string) string {
+	if ctype := mime.TypeByExtension(filepath.Ext(filePath)); ctype != "" {
+		return ctype
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer file.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	return http.DetectContentType(head[:n])
+}
+
+// serveArchiveGzip sends a deflated archive entry to clients accepting gzip by wrapping
+// the compressed bytes in a gzip header and trailer, without inflating them. The response
+// carries the entry's modification time and an ETag of its own, suffixed -gz, which
+// If-None-Match and If-Modified-Since are checked against. It returns false, having served
+// nothing, when the entry should be streamed decompressed: for Range requests and other
+// preconditions, which http.ServeContent evaluates, entries indexed without a checksum,
+// types that would need sniffing and JSON for StripJSONBOM. Since the compressed bytes
+// can't be looked at, the charset is the one of rules or the extension, and browsers honor
+// a byte order mark themselves.
+func (s *Service) serveArchiveGzip(w http.ResponseWriter, r *http.Request, archivePath, entry string) bool {
+	info, err := s.zipReader.Stat(r.Context(), archivePath, entry)
+	if err != nil || !info.Gzippable() {
+		return false
+	}
+	ctype := mime.TypeByExtension(path.Ext(entry))
+	if ctype == "" {
+		return false
+	}
+	if mediaType, _, _ := mime.ParseMediaType(ctype); s.stripJSONBOM && isJSON(mediaType) {
+		return false
+	}
+	ctype = s.withCharset(ctype, entry, nil)
+	varyOnEncoding(w.Header())
+	if r.Header.Get("Range") != "" || r.Header.Get("If-Match") != "" || r.Header.Get("If-Unmodified-Since") != "" ||
+		negotiate.EncodingQuality(r.Header.Get("Accept-Encoding"), "gzip") <= 0 {
+		return false
+	}
+
+	etag := fmt.Sprintf(`"%08x-%x-gz"`, info.CRC32, info.UncompressedSize)
+	w.Header().Set("ETag", etag)
+	if !info.Modified.IsZero() {
+		w.Header().Set("Last-Modified", info.Modified.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, etag, info.Modified) {
+		// As http.ServeContent answers, the ETag standing for the date
+		w.Header().Del("Last-Modified")
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.GzipSize(), 10))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return true
+	}
+	if err := s.zipReader.StreamGzip(r.Context(), archivePath, entry, w); err != nil && !s.canceled(r, archivePath, entry) {
+		s.logger.WarnContext(r.Context(), "Failed to stream archive entry", "archive", archivePath, "entry", entry, "error", err)
+	}
+	return true
+}
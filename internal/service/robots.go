@@ -0,0 +1,21 @@
+package service
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// robotsTag keeps crawlers from indexing responses and following their links.
+	robotsTag = "noindex, nofollow"
+	// disallowAll is the robots.txt served by NoRobots in place of a missing one.
+	disallowAll = "User-agent: *\nDisallow: /\n"
+)
+
+// serveRobots answers a request for a robots.txt missing from the root with one
+// disallowing everything.
+func serveRobots(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeContent(w, r, "robots.txt", time.Time{}, strings.NewReader(disallowAll))
+}
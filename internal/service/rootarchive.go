@@ -0,0 +1,44 @@
+package service
+
+import (
+	"archive/zip"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// splitRootArchive returns the directory of a service target and, when the target is an
+// archive file rather than a directory, the archive, once checked to open as one. Targets
+// that don't exist are left for resolveRoot to report.
+func splitRootArchive(root string) (dir, archive string, err error) {
+	stat, err := os.Stat(root)
+	if err != nil || stat.IsDir() {
+		return root, "", nil
+	}
+	reader, err := zip.OpenReader(root)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %s is neither a directory nor a ZIP archive: %w", ErrInvalidRoot, root, err)
+	}
+	reader.Close()
+	if archive, err = filepath.Abs(root); err != nil {
+		return "", "", fmt.Errorf("%w: %s: %w", ErrInvalidRoot, root, err)
+	}
+	return filepath.Dir(archive), archive, nil
+}
+
+// resolveRootArchive resolves a request path into the archive served as the whole tree,
+// as the contents of an archive under a directory are, with hidden entries refused like
+// hidden files unless ExposeHiddenFiles.
+func (s *Service) resolveRootArchive(w http.ResponseWriter, r *http.Request, t target, parts []string) (target, bool) {
+	t.lastDir, t.archivePath = s.rootServiceDir, s.rootArchive
+	for _, part := range parts {
+		if (!s.exposeHiddenFiles && strings.HasPrefix(part, ".")) || strings.Contains(part, "/") {
+			s.refuse(w, r, t.lastDir, t.archivePath)
+			return t, false
+		}
+	}
+	t.entry, t.slash = strings.Join(parts, "/"), true
+	return t, true
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRootArchive(t *testing.T) {
+	dir := t.TempDir()
+	zipPath := filepath.Join(dir, "site-bundle.zip")
+	require.NoError(t, createTestZipFile(zipPath, map[string]string{
+		"index.html":          "home",
+		"docs/guide.txt":      "guide",
+		"docs/api/index.html": "api",
+		"assets/app.js":       "app",
+		"assets/app.js.map":   "map",
+		".env":                "secret",
+	}))
+	// Files next to the archive aren't part of the tree
+	writeTestFiles(t, dir, map[string]string{"other.txt": "other", "404.html": "outside", ignoreFile: "*.txt"})
+	s := newTestService(t, zipPath, Options{CreateIndexes: true, Ignore: []string{"*.map"}})
+
+	assert.Equal(t, "home", get(s, "/").Body.String())
+	assert.Equal(t, "guide", get(s, "/docs/guide.txt").Body.String())
+	assert.Equal(t, "api", get(s, "/docs/api/").Body.String())
+	rec := get(s, "/docs")
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+	assert.Equal(t, "/docs/", rec.Header().Get("Location"))
+	body := get(s, "/assets/").Body.String()
+	assert.Contains(t, body, "app.js")
+	assert.NotContains(t, body, "app.js.map")
+
+	for _, target := range []string{"/missing.txt", "/docs/missing/", "/other.txt", "/site-bundle.zip", "/site-bundle/", "/.env", "/assets/app.js.map"} {
+		rec := get(s, target)
+		assert.Equal(t, http.StatusNotFound, rec.Code, target)
+		assert.NotContains(t, rec.Body.String(), "outside", target)
+	}
+
+	// Admin operations only reach the archive itself
+	_, _, err := s.PinArchive(context.Background(), "site-bundle.zip")
+	require.NoError(t, err)
+	writeTestFiles(t, dir, map[string]string{"neighbour.zip": ""})
+	_, _, err = s.PinArchive(context.Background(), "neighbour.zip")
+	assert.ErrorIs(t, err, fs.ErrInvalid)
+
+	// Replacing the archive while serving reindexes it
+	replacement := filepath.Join(dir, "next.zip")
+	require.NoError(t, createTestZipFile(replacement, map[string]string{"index.html": "new home", ".env": "secret"}))
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(replacement, later, later))
+	require.NoError(t, os.Rename(replacement, zipPath))
+	assert.Equal(t, "new home", get(s, "/").Body.String())
+	assert.Equal(t, http.StatusNotFound, get(s, "/docs/guide.txt").Code)
+
+	// Hidden entries are served on request
+	hidden := newTestService(t, zipPath, Options{ExposeHiddenFiles: true})
+	assert.Equal(t, "secret", get(hidden, "/.env").Body.String())
+}
+
+func TestRootArchiveInvalid(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{"notes.txt": "not an archive", "broken.zip": "PK"})
+	for _, name := range []string{"notes.txt", "broken.zip"} {
+		_, err := NewService(filepath.Join(dir, name), t.TempDir(), Options{})
+		assert.ErrorIs(t, err, ErrInvalidRoot, name)
+	}
+
+	zipPath := filepath.Join(dir, "site.zip")
+	require.NoError(t, createTestZipFile(zipPath, map[string]string{"index.html": "home"}))
+	_, err := NewService(zipPath, t.TempDir(), Options{FollowRootSymlink: true})
+	assert.ErrorIs(t, err, ErrInvalidRoot)
+
+	// Virtual hosts can serve archives too
+	s := newTestService(t, dir, Options{})
+	site, err := s.WithRoot(zipPath)
+	require.NoError(t, err)
+	assert.Equal(t, "home", get(site, "/").Body.String())
+}
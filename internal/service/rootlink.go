@@ -0,0 +1,99 @@
+package service
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rootRecheckInterval is how long a followed service directory link is trusted to point
+// at the same directory before it is resolved again.
+const rootRecheckInterval = time.Second
+
+// rootLink follows a service directory that is a symbolic link, such as /srv/current for
+// blue/green publishes, to the directory it points at. Each request is served by a copy of
+// the service rooted at the resolved directory, so everything it opens comes from one
+// target, and archives are indexed by their path in that target. Requests in flight when
+// the link flips finish with the target they started with.
+type rootLink struct {
+	// base is the service for the link itself, whose copies serve its targets.
+	base     *Service
+	interval time.Duration
+
+	mu      sync.Mutex
+	current atomic.Pointer[rootTarget]
+}
+
+// rootTarget is the directory a rootLink last resolved to, and the service for it.
+type rootTarget struct {
+	dir     string
+	service *Service
+	checked time.Time
+}
+
+// newRootLink follows the service directory of base, which resolved to dir.
+func newRootLink(base *Service, dir string) (*rootLink, error) {
+	service, err := base.atTarget(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := &rootLink{base: base, interval: rootRecheckInterval}
+	l.current.Store(&rootTarget{dir: dir, service: service, checked: time.Now()})
+	return l, nil
+}
+
+// service returns the service for the directory the link points at, resolving it again
+// once the interval passed. A link that fails to resolve, as it may while it is replaced
+// without a rename, leaves the previous target in place.
+func (l *rootLink) service() *Service {
+	current := l.current.Load()
+	if time.Since(current.checked) < l.interval {
+		return current.service
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	current = l.current.Load()
+	if time.Since(current.checked) < l.interval {
+		return current.service
+	}
+	next := &rootTarget{dir: current.dir, service: current.service, checked: time.Now()}
+	dir, err := resolveRoot(l.base.rootServiceDir)
+	if err != nil {
+		l.base.logger.Warn("Failed to resolve service directory, keeping the previous target", "dir", l.base.rootServiceDir, "target", current.dir, "error", err)
+	} else if dir != current.dir {
+		if service, err := l.base.atTarget(dir); err != nil {
+			l.base.logger.Warn("Failed to switch service directory, keeping the previous target", "dir", l.base.rootServiceDir, "target", dir, "error", err)
+		} else {
+			l.base.logger.Info("Service directory switched", "dir", l.base.rootServiceDir, "from", current.dir, "to", dir)
+			next.dir, next.service = dir, service
+		}
+	}
+	l.current.Store(next)
+	return next.service
+}
+
+// atTarget returns a copy of s serving dir, the resolved service directory, with the
+// ignore file found there.
+func (s *Service) atTarget(dir string) (*Service, error) {
+	dir = filepath.Clean(dir)
+	ignoreMatcher, err := loadIgnore(dir, s.ignorePatterns, s.caseInsensitive)
+	if err != nil {
+		return nil, err
+	}
+	clone := *s
+	clone.rootServiceDir = dir
+	clone.resolvedRoot = dir
+	clone.ignore = ignoreMatcher
+	clone.link = nil
+	return &clone, nil
+}
+
+// current returns the service to handle a request or an operation with: s itself, or the
+// service for the target of its followed link.
+func (s *Service) current() *Service {
+	if s.link == nil {
+		return s
+	}
+	return s.link.service()
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cmpserve/internal/readers/zipfast"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// releaseFixture writes a release tree whose files all name the version, with contents of
+// a different length for each version so the archive offsets differ.
+func releaseFixture(t *testing.T, dir, version string) {
+	t.Helper()
+	writeTestFiles(t, dir, map[string]string{
+		"index.html": version,
+		"a.txt":      strings.Repeat(version, 3),
+		"404.html":   version + " not found",
+	})
+	require.NoError(t, createTestZipFile(filepath.Join(dir, "docs.zip"), map[string]string{"page.txt": version + " page", "index.html": version + " docs"}))
+}
+
+// flipLink points link at target with a rename, as blue/green publishes do.
+func flipLink(t *testing.T, target, link string) {
+	t.Helper()
+	next := link + ".next"
+	require.NoError(t, os.Symlink(target, next))
+	require.NoError(t, os.Rename(next, link))
+}
+
+func TestFollowRootSymlink(t *testing.T) {
+	base := t.TempDir()
+	v1, v2 := filepath.Join(base, "releases", "v1"), filepath.Join(base, "releases", "version-two")
+	releaseFixture(t, v1, "v1")
+	releaseFixture(t, v2, "version-two")
+	link := filepath.Join(base, "current")
+	require.NoError(t, os.Symlink(v1, link))
+	// Without validation, only the path of the archive tells the two versions apart
+	s := newTestService(t, link, Options{FollowRootSymlink: true, CacheValidation: zipfast.ValidateNone})
+	s.link.interval = 0
+
+	paths := map[string]func(version string) string{
+		"/":              func(version string) string { return version },
+		"/a.txt":         func(version string) string { return strings.Repeat(version, 3) },
+		"/docs/":         func(version string) string { return version + " docs" },
+		"/docs/page.txt": func(version string) string { return version + " page" },
+		"/missing":       func(version string) string { return version + " not found" },
+	}
+	for path, want := range paths {
+		assert.Equal(t, want("v1"), get(s, path).Body.String(), path)
+	}
+
+	// Each response comes from one release while the link flips back and forth
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for path, want := range paths {
+					body := get(s, path).Body.String()
+					if body != want("v1") && body != want("version-two") {
+						assert.Fail(t, "response mixes releases", "%s: %q", path, body)
+						return
+					}
+				}
+			}
+		}()
+	}
+	for i := range 50 {
+		flipLink(t, []string{v2, v1}[i%2], link)
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+
+	flipLink(t, v2, link)
+	for path, want := range paths {
+		assert.Equal(t, want("version-two"), get(s, path).Body.String(), path)
+	}
+	archives, err := s.IndexedArchives(context.Background())
+	require.NoError(t, err)
+	require.Len(t, archives, 1)
+	assert.Equal(t, "docs.zip", archives[0].Path)
+
+	// A link that doesn't resolve leaves the previous target in place
+	require.NoError(t, os.Remove(link))
+	assert.Equal(t, "version-two", get(s, "/").Body.String())
+}
+
+func TestFollowRootSymlinkInFlight(t *testing.T) {
+	base := t.TempDir()
+	v1, v2 := filepath.Join(base, "v1"), filepath.Join(base, "v2")
+	large := strings.Repeat("v1 content\n", 100000)
+	writeTestFiles(t, v1, map[string]string{"large.txt": large})
+	writeTestFiles(t, v2, map[string]string{"large.txt": "v2"})
+	link := filepath.Join(base, "current")
+	require.NoError(t, os.Symlink(v1, link))
+	s := newTestService(t, link, Options{FollowRootSymlink: true})
+	s.link.interval = 0
+
+	slow, done := serveSlowly(t, s, "/large.txt")
+	flipLink(t, v2, link)
+	require.NoError(t, os.RemoveAll(v1))
+	assert.Equal(t, "v2", get(s, "/large.txt").Body.String())
+	close(slow.release)
+	<-done
+	assert.Equal(t, http.StatusOK, slow.Code)
+	assert.Equal(t, large, slow.Body.String())
+}
+
+func TestFollowRootSymlinkRecheck(t *testing.T) {
+	base := t.TempDir()
+	for _, version := range []string{"v1", "v2"} {
+		writeTestFiles(t, filepath.Join(base, version), map[string]string{"a.txt": version, ".cmpserveignore": fmt.Sprintf("/%s-only.txt\n", version)})
+		writeTestFiles(t, filepath.Join(base, version), map[string]string{"v1-only.txt": "v1 only"})
+	}
+	link := filepath.Join(base, "current")
+	require.NoError(t, os.Symlink(filepath.Join(base, "v1"), link))
+	s := newTestService(t, link, Options{FollowRootSymlink: true})
+	withRoot, err := s.WithRoot(link)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusNotFound, get(s, "/v1-only.txt").Code)
+	flipLink(t, filepath.Join(base, "v2"), link)
+	// The link is trusted for a while
+	assert.Equal(t, "v1", get(s, "/a.txt").Body.String())
+	s.link.current.Load().checked = time.Time{}
+	withRoot.link.current.Load().checked = time.Time{}
+	assert.Equal(t, "v2", get(s, "/a.txt").Body.String())
+	assert.Equal(t, "v2", get(withRoot, "/a.txt").Body.String())
+	// The ignore file of the new target applies
+	assert.Equal(t, "v1 only", get(s, "/v1-only.txt").Body.String())
+}
@@ -1,141 +1,1096 @@
 package service
 
 import (
+	"cmpserve/internal/ignore"
+	"cmpserve/internal/metrics"
 	"cmpserve/internal/readers/zipfast"
+	"context"
 	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// spaSentinel is the archive entry that opts an archive into SPA fallback.
+	spaSentinel = ".spa"
+	// notFoundPage is the custom error page looked up in archives and directories.
+	notFoundPage = "404.html"
+	// allowedMethods is advertised in the Allow header.
+	allowedMethods = "GET, HEAD, OPTIONS"
+)
+
+var (
+	// ErrInvalidRoot is returned for a service directory that is neither an existing
+	// directory nor a ZIP archive.
+	ErrInvalidRoot = errors.New("invalid service directory")
+	// ErrInvalidCacheDir is returned for a cache directory that isn't an existing, writable
+	// directory.
+	ErrInvalidCacheDir = errors.New("invalid cache directory")
+	// ErrArchiveIndex is returned when the archive index database can't be opened.
+	ErrArchiveIndex = errors.New("failed to open archive index")
 )
 
 type Service struct {
 	rootServiceDir    string
 	cacheServiceDir   string
-	zipReader         zipfast.FastZipReader
+	zipReader         *zipfast.FastZipReader
 	createIndexes     bool
 	exposeHiddenFiles bool
+	indexFiles        []string
+	spa               bool
+	spaFilesystem     bool
+	precompressed     bool
+	noArchiveDownload bool
+	basePath          string
+	baseSegments      []string
+	symlinks          SymlinkPolicy
+	ignorePatterns    []string
+	ignore            *ignore.Matcher
+	caseInsensitive   bool
+	webdav            bool
+	noRobots          bool
+	pathLimits        pathLimits
+	charsets          []charsetRule
+	stripJSONBOM      bool
+	checksums         bool
+	// rootArchive is the archive served as the whole tree when the service target is an
+	// archive file, whose directory rootServiceDir then is.
+	rootArchive string
+	// resolvedRoot is rootServiceDir with symbolic links resolved, for SymlinksInternal.
+	resolvedRoot string
+	// link hands requests to the service for the current target of rootServiceDir, for
+	// FollowRootSymlink.
+	link *rootLink
+
+	indexTemplate       *template.Template
+	indexTemplatePath   string
+	indexTemplateReload bool
+
+	extractions *extractionLimiter
+	access      *accessCache
+	aliasCache  *aliasCache
+	missing     *missingCache
+
+	logger *slog.Logger
+}
+
+// Options holds the optional behavior of a Service.
+type Options struct {
+	// CreateIndexes enables listings for directories without an index document.
+	CreateIndexes bool
+	// ExposeHiddenFiles allows serving and listing dot-prefixed names.
+	ExposeHiddenFiles bool
+	// IndexFiles are the index document names tried in order for directory requests.
+	// Defaults to index.html when empty.
+	IndexFiles []string
+	// SPA serves an archive's index document for missing extensionless entries. Archives
+	// can also opt in individually with a .spa entry.
+	SPA bool
+	// SPAFilesystem applies the same fallback to plain filesystem paths.
+	SPAFilesystem bool
+	// Precompressed serves the .br or .gz sibling of a filesystem file or archive entry to
+	// clients accepting that encoding.
+	Precompressed bool
+	// NoArchiveDownload answers requests for archive files themselves with 404, leaving
+	// their entries reachable.
+	NoArchiveDownload bool
+	// BasePath is a URL path prefix, such as /artifacts, under which the directory is
+	// served. Requests outside it get 404, and the links and redirects the service
+	// generates include it.
+	BasePath string
+	// Symlinks decides which symbolic links under the service directory are followed, for
+	// every segment of a path. Defaults to SymlinksAll.
+	Symlinks SymlinkPolicy
+	// Ignore are gitignore-style patterns, such as *.map or /private/**, matched against
+	// request paths relative to the service directory, archive entries included. Ignored
+	// paths get 404 and are left out of listings. The patterns of a .cmpserveignore file in
+	// the service directory are added to them, and the file itself is never served.
+	Ignore []string
+	// CaseInsensitive resolves path segments that don't exist as requested to the one name
+	// of their directory, or entry of their archive, that matches once case is ignored.
+	// Names matching several ones are answered with 404. Ignore patterns then match
+	// regardless of case as well.
+	CaseInsensitive bool
+	// IndexTemplate is the path of an html/template rendering directory listings in place
+	// of the embedded default. It receives .Path, .Breadcrumbs (Name, Href), .Parent (empty
+	// for the root), .Entries (Name, Href, DownloadHref, IsDir, IsArchive, IsSymlink, Size, ModTime) and
+	// the pagination fields .Offset, .Limit, .Total, .Truncated, .PrevHref and .NextHref. It
+	// can call the formatSize and formatModTime functions and .SortHref "name"|"size"|"time".
+	IndexTemplate string
+	// IndexTemplateReload re-parses IndexTemplate on every listing, for development.
+	IndexTemplateReload bool
+	// WebDAV answers PROPFIND, so WebDAV clients can mount the tree read-only, with archives
+	// as collections, and refuses the methods that would modify it with 403.
+	WebDAV bool
+	// NoRobots adds X-Robots-Tag: noindex, nofollow to every response and answers
+	// /robots.txt, unless the root has one, with one disallowing everything.
+	NoRobots bool
+	// MaxPathSegments bounds the number of segments of request paths, the base path and
+	// the path inside archives included, answering longer ones with 414 before touching the
+	// filesystem. Zero means DefaultMaxPathSegments, and a negative value no limit.
+	MaxPathSegments int
+	// MaxSegmentLength bounds the length in bytes of each decoded path segment, answering
+	// longer ones with 404. Zero means DefaultMaxSegmentLength, and a negative value no limit.
+	MaxSegmentLength int
+	// MaxPathLength bounds the length in bytes of decoded request paths, answering longer
+	// ones with 414. Zero means DefaultMaxPathLength, and a negative value no limit.
+	MaxPathLength int
+	// Charsets are rules of the form glob=charset, such as *.csv=iso-8859-1, giving the
+	// archive entries matching the glob that charset in their Content-Type, for legacy text
+	// content. Globs with a slash match entry paths, others base names. The byte order
+	// mark of a text entry wins over them, and text entries matching none get utf-8.
+	Charsets []string
+	// StripJSONBOM leaves the byte order mark of JSON archive entries out of the body, for
+	// clients whose parsers reject it.
+	StripJSONBOM bool
+	// Checksums answers ?checksum=sha256, and paths of files or archive entries with .sha256
+	// appended that don't exist themselves, with the SHA-256 digest of the file in sha256sum
+	// format. Digests are recorded in the archive index, those of files by path, size and
+	// modification time, and those of entries until their archive is reindexed.
+	Checksums bool
+	// Logger receives request handling events. Defaults to slog.Default().
+	Logger *slog.Logger
+	// Observer is notified of archive indexing and index database events.
+	Observer zipfast.Observer
+	// MaxExtractions bounds the number of archive requests served at once, since entries
+	// are decompressed on the fly. Zero means no limit.
+	MaxExtractions int
+	// ExtractionQueueTimeout is how long archive requests wait for one of MaxExtractions
+	// to finish before they are answered with 503.
+	ExtractionQueueTimeout time.Duration
+	// ExtractionObserver is notified of running and waiting archive requests.
+	ExtractionObserver ExtractionObserver
+	// NotFoundCacheTTL is how long request paths resolving to nothing are remembered, and
+	// answered without touching the filesystem. Reindexing or invalidating an archive
+	// forgets the paths into it. Zero turns the cache off.
+	NotFoundCacheTTL time.Duration
+	// CacheMaxArchives bounds the number of archives in the index, evicting the least
+	// recently used ones. Zero means no limit.
+	CacheMaxArchives int
+	// CacheCheckpointInterval is how much decompressed data separates the checkpoints
+	// recorded in the index for ranges of deflated entries to resume from. Zero records none.
+	CacheCheckpointInterval int64
+	// ArchiveNameEncoding is the IANA name of the encoding of entry names lacking the UTF-8
+	// flag, decoded when archives are indexed. Defaults to cp437; utf-8 keeps them as stored.
+	ArchiveNameEncoding string
+	// CacheValidation decides how archive lookups check that archives haven't changed
+	// since they were indexed. Defaults to zipfast.ValidateStat.
+	CacheValidation zipfast.Validation
+	// ArchiveLimits bound the entries of the archives indexed, leaving out entries beyond
+	// them or rejecting the whole archive, whose requests then get 404. Zero fields mean
+	// their defaults.
+	ArchiveLimits zipfast.Limits
+	// Tracer traces archive indexing, lookups and reads, as children of the spans in
+	// request contexts. Nil turns tracing off.
+	Tracer trace.Tracer
+	// FollowRootSymlink resolves a service directory that is a symbolic link again every
+	// second, rather than once, and serves each request wholly from the directory it then
+	// points at, so flipping the link publishes another tree at once. Archives are indexed
+	// by their path in that directory, and requests in flight keep reading the files they
+	// opened.
+	FollowRootSymlink bool
 }
 
-func NewService(rootServiceDir, cacheServiceDir string, createIndexes bool, exposeHiddenFiles bool) (*Service, error) {
-	rootServiceDir = filepath.Clean(rootServiceDir)
+// NewService returns a service for rootServiceDir, a directory or a ZIP archive served as
+// the whole tree, keeping the archive index in cacheServiceDir.
+func NewService(rootServiceDir, cacheServiceDir string, options Options) (*Service, error) {
+	rootServiceDir, rootArchive, err := splitRootArchive(filepath.Clean(rootServiceDir))
+	if err != nil {
+		return nil, err
+	}
+	if rootArchive != "" && options.FollowRootSymlink {
+		return nil, fmt.Errorf("%w: %s: following a root link needs a directory", ErrInvalidRoot, rootArchive)
+	}
 	cacheServiceDir = filepath.Clean(cacheServiceDir)
-	if stat, err := os.Stat(rootServiceDir); err != nil || !stat.IsDir() {
-		return nil, errors.New("invalid service directory")
+	resolvedRoot, err := resolveRoot(rootServiceDir)
+	if err != nil {
+		return nil, err
+	}
+	ignoreMatcher, err := loadIgnore(ignoreDir(rootServiceDir, rootArchive), options.Ignore, options.CaseInsensitive)
+	if err != nil {
+		return nil, err
 	}
 	if stat, err := os.Stat(cacheServiceDir); err != nil || !stat.IsDir() {
-		return nil, errors.New("invalid cache directory")
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCacheDir, cacheServiceDir)
+	}
+	// An index that exists opens in a read-only directory, and then fails every write
+	if err := checkWritable(cacheServiceDir); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalidCacheDir, cacheServiceDir, err)
+	}
+	indexTemplate, err := parseIndexTemplate(options.IndexTemplate)
+	if err != nil {
+		return nil, err
+	}
+	basePath, baseSegments, err := parseBasePath(options.BasePath)
+	if err != nil {
+		return nil, err
+	}
+	nameEncoding, err := zipfast.ParseNameEncoding(options.ArchiveNameEncoding)
+	if err != nil {
+		return nil, err
+	}
+	charsets, err := parseCharsetRules(options.Charsets)
+	if err != nil {
+		return nil, err
+	}
+	logger := options.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	zipReader, err := zipfast.NewFastZipReader(filepath.Join(cacheServiceDir, zipfast.DatabaseName), zipfast.Options{Logger: logger, Observer: options.Observer, MaxArchives: options.CacheMaxArchives, CheckpointInterval: options.CacheCheckpointInterval, NameEncoding: nameEncoding, Validation: options.CacheValidation, Limits: options.ArchiveLimits, Tracer: options.Tracer})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrArchiveIndex, err)
+	}
+	indexFiles := options.IndexFiles
+	if len(indexFiles) == 0 {
+		indexFiles = []string{"index.html"}
 	}
-	zipReader, err := zipfast.NewFastZipReader(cacheServiceDir + "/.zip_reader_cache.db")
+	var extractions *extractionLimiter
+	if options.MaxExtractions > 0 {
+		extractions = newExtractionLimiter(options.MaxExtractions, options.ExtractionQueueTimeout, options.ExtractionObserver)
+	}
+	s := &Service{
+		rootServiceDir:    rootServiceDir,
+		rootArchive:       rootArchive,
+		cacheServiceDir:   cacheServiceDir,
+		zipReader:         zipReader,
+		createIndexes:     options.CreateIndexes,
+		exposeHiddenFiles: options.ExposeHiddenFiles,
+		indexFiles:        indexFiles,
+		spa:               options.SPA,
+		spaFilesystem:     options.SPAFilesystem,
+		precompressed:     options.Precompressed,
+		noArchiveDownload: options.NoArchiveDownload,
+		basePath:          basePath,
+		baseSegments:      baseSegments,
+		symlinks:          options.Symlinks,
+		resolvedRoot:      resolvedRoot,
+		ignorePatterns:    options.Ignore,
+		ignore:            ignoreMatcher,
+		caseInsensitive:   options.CaseInsensitive,
+		webdav:            options.WebDAV,
+		noRobots:          options.NoRobots,
+		pathLimits:        newPathLimits(options),
+		charsets:          charsets,
+		stripJSONBOM:      options.StripJSONBOM,
+		checksums:         options.Checksums,
+
+		indexTemplate:       indexTemplate,
+		indexTemplatePath:   options.IndexTemplate,
+		indexTemplateReload: options.IndexTemplateReload,
+
+		extractions: extractions,
+		access:      newAccessCache(logger),
+		aliasCache:  newAliasCache(logger),
+		missing:     newMissingCache(options.NotFoundCacheTTL),
+
+		logger: logger,
+	}
+	if options.FollowRootSymlink {
+		if s.link, err = newRootLink(s, resolvedRoot); err != nil {
+			zipReader.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// WithRoot returns a service for another directory or archive, with the same options and
+// sharing the archive index, extraction limit and templates of s. It needs no closing of
+// its own.
+func (s *Service) WithRoot(rootServiceDir string) (*Service, error) {
+	rootServiceDir, rootArchive, err := splitRootArchive(filepath.Clean(rootServiceDir))
 	if err != nil {
 		return nil, err
 	}
-	return &Service{rootServiceDir: rootServiceDir, cacheServiceDir: cacheServiceDir, zipReader: *zipReader, createIndexes: createIndexes, exposeHiddenFiles: exposeHiddenFiles}, nil
+	if rootArchive != "" && s.link != nil {
+		return nil, fmt.Errorf("%w: %s: following a root link needs a directory", ErrInvalidRoot, rootArchive)
+	}
+	resolvedRoot, err := resolveRoot(rootServiceDir)
+	if err != nil {
+		return nil, err
+	}
+	ignoreMatcher, err := loadIgnore(ignoreDir(rootServiceDir, rootArchive), s.ignorePatterns, s.caseInsensitive)
+	if err != nil {
+		return nil, err
+	}
+	clone := *s
+	clone.rootServiceDir = rootServiceDir
+	clone.rootArchive = rootArchive
+	clone.resolvedRoot = resolvedRoot
+	clone.ignore = ignoreMatcher
+	if s.link != nil {
+		if clone.link, err = newRootLink(&clone, resolvedRoot); err != nil {
+			return nil, err
+		}
+	}
+	return &clone, nil
+}
+
+// resolveRoot checks that a service directory exists and returns it with symbolic links
+// resolved.
+func resolveRoot(rootServiceDir string) (string, error) {
+	if stat, err := os.Stat(rootServiceDir); err != nil || !stat.IsDir() {
+		return "", fmt.Errorf("%w: %s", ErrInvalidRoot, rootServiceDir)
+	}
+	resolved, err := filepath.EvalSymlinks(rootServiceDir)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %w", ErrInvalidRoot, rootServiceDir, err)
+	}
+	return resolved, nil
+}
+
+// ArchiveFS returns the ZIP archive at the slash-separated path name, relative to the
+// service directory, as an fs.FS holding all of its entries, hidden ones included.
+func (s *Service) ArchiveFS(name string) (fs.FS, error) {
+	s = s.current()
+	zipPath, err := s.archivePath("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return s.zipReader.FS(zipPath)
+}
+
+// ReindexArchive indexes the ZIP archive at the slash-separated path name again, even if
+// it looks unchanged, and returns its number of entries.
+func (s *Service) ReindexArchive(ctx context.Context, name string) (int, error) {
+	s = s.current()
+	zipPath, err := s.archivePath("reindex", name)
+	if err != nil {
+		return 0, err
+	}
+	defer s.forgetArchive(name)
+	return s.zipReader.Reindex(ctx, zipPath)
+}
+
+// ReindexArchiveIfChanged indexes the ZIP archive at the slash-separated path name again
+// if it changed, as strict validation checks, and returns its number of entries and
+// whether it was indexed.
+func (s *Service) ReindexArchiveIfChanged(ctx context.Context, name string) (int, bool, error) {
+	s = s.current()
+	zipPath, err := s.archivePath("reindex", name)
+	if err != nil {
+		return 0, false, err
+	}
+	defer s.forgetArchive(name)
+	return s.zipReader.ReindexIfChanged(ctx, zipPath)
+}
+
+// InvalidateArchive drops the index of the ZIP archive at the slash-separated path name,
+// which gets indexed again when next requested, and reports whether there was one.
+func (s *Service) InvalidateArchive(ctx context.Context, name string) (bool, error) {
+	s = s.current()
+	zipPath, err := s.archivePath("invalidate", name)
+	if err != nil {
+		return false, err
+	}
+	defer s.forgetArchive(name)
+	return s.zipReader.Invalidate(ctx, zipPath)
+}
+
+// PinArchive keeps the index of the ZIP archive at the slash-separated path name in
+// memory, indexing it first if needed, so that its entries are looked up without querying
+// the index. It returns the number of entries and the approximate memory they take.
+func (s *Service) PinArchive(ctx context.Context, name string) (int, int64, error) {
+	s = s.current()
+	zipPath, err := s.archivePath("pin", name)
+	if err != nil {
+		return 0, 0, err
+	}
+	return s.zipReader.KeepResident(ctx, zipPath)
+}
+
+// IndexedArchives lists the indexed archives under the service directory, with paths
+// relative to it.
+func (s *Service) IndexedArchives(ctx context.Context) ([]zipfast.ArchiveInfo, error) {
+	s = s.current()
+	archives, err := s.zipReader.Archives(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// The index may be shared with services for other directories
+	var within []zipfast.ArchiveInfo
+	for _, archive := range archives {
+		rel, err := filepath.Rel(s.rootServiceDir, archive.Path)
+		if err != nil || !filepath.IsLocal(rel) {
+			continue
+		}
+		archive.Path = filepath.ToSlash(rel)
+		within = append(within, archive)
+	}
+	return within, nil
+}
+
+// IndexStats summarizes the archive index, which may be shared with services for other
+// directories. The paths of recently indexed archives under the service directory are
+// relative to it.
+func (s *Service) IndexStats(ctx context.Context) (zipfast.Stats, error) {
+	s = s.current()
+	stats, err := s.zipReader.Stats(ctx)
+	if err != nil {
+		return zipfast.Stats{}, err
+	}
+	for i, archive := range stats.Recent {
+		if rel, err := filepath.Rel(s.rootServiceDir, archive.Path); err == nil && filepath.IsLocal(rel) {
+			stats.Recent[i].Path = filepath.ToSlash(rel)
+		}
+	}
+	return stats, nil
+}
+
+// checkWritable creates and removes a file in dir, as SQLite does with its journal.
+func checkWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".cmpserve-write-check-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// archivePath checks the slash-separated path name of an archive, relative to the service
+// directory, and returns its path on disk.
+func (s *Service) archivePath(op, name string) (string, error) {
+	if !fs.ValidPath(name) || !isArchiveName(name) || !s.pathAllowed(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	zipPath := filepath.Join(s.rootServiceDir, filepath.FromSlash(name))
+	// The directory of an archive served as the tree isn't served
+	if s.rootArchive != "" && zipPath != s.rootArchive {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return zipPath, nil
+}
+
+// Close releases the archive index. It must only be called once the HTTP server has
+// stopped handing requests to the service.
+func (s *Service) Close() error {
+	return s.zipReader.Close()
 }
 
 func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	urlPath := strings.TrimPrefix(r.URL.Path, "/")
-	parts := strings.Split(urlPath, "/")
+	s = s.current()
+	if s.noRobots {
+		w.Header().Set("X-Robots-Tag", robotsTag)
+	}
+	// Methods are checked before touching the filesystem, so probes can't trigger indexing
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+	case r.Method == http.MethodOptions:
+		w.Header().Set("Allow", s.allow())
+		if s.webdav {
+			w.Header().Set("DAV", "1")
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case s.webdav && r.Method == methodPropfind:
+	case s.webdav && davWriteMethods[r.Method]:
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
+	default:
+		w.Header().Set("Allow", s.allow())
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	currentPath := s.rootServiceDir
-	var archivePath, remainingPath string
+	t, ok := s.resolve(w, r)
+	if !ok || !s.authorize(w, r, t.dir()) {
+		return
+	}
+	if r.Method == methodPropfind {
+		s.propfind(w, r, t)
+		return
+	}
+	if s.checksums && s.serveChecksum(w, r, t) {
+		return
+	}
+	switch {
+	case t.archivePath != "":
+		if !t.slash {
+			redirectToDirectory(w, r)
+			return
+		}
+		s.serveArchive(w, r, t.archivePath, t.entry, t.urlPath)
+	case t.path == "":
+		if s.noRobots && t.urlPath == "robots.txt" {
+			serveRobots(w, r)
+			return
+		}
+		if s.spaFilesystem && s.serveFilesystemFallback(w, r, t.lastDir, t.urlPath) {
+			return
+		}
+		s.notFound(w, r, t.lastDir, "")
+	case t.isDir:
+		// Relative links only work from the slash-terminated URL
+		if !t.slash && (s.createIndexes || s.findIndexFile(t.path) != "") {
+			redirectToDirectory(w, r)
+			return
+		}
+		s.serveDirectory(w, r, t.path, t.urlPath)
+	default:
+		setDownloadDisposition(w, r, filepath.Base(t.path))
+		if !s.servePrecompressed(w, r, t.path) {
+			http.ServeFile(w, r, t.path)
+		}
+	}
+}
+
+// target is what a request path resolves to: a file or directory, the contents of an
+// archive, or nothing.
+type target struct {
+	// urlPath is the request path relative to the base path, without its leading slash.
+	urlPath string
+	// path is the file or directory, empty when the path leads into an archive or to nothing.
+	path  string
+	isDir bool
+	// archivePath is the archive the path leads into, and entry the path inside it, empty
+	// for the archive root.
+	archivePath string
+	entry       string
+	// slash tells whether directories and archive roots were requested with a trailing
+	// slash; the root of the service always is.
+	slash bool
+	// lastDir is the deepest directory on the way, whose 404 page answers for missing paths.
+	lastDir string
+	// uncertain tells that the path may exist after all, as checking it failed for another
+	// reason than its absence, such as running out of file descriptors.
+	uncertain bool
+}
+
+// resolve walks a request path through the service directory up to the file, directory or
+// archive it names. Paths that are invalid, hidden, ignored or not allowed by the symlink
+// policy are answered right away, and ok is false; those under a protected directory
+// only once the request is authorized.
+func (s *Service) resolve(w http.ResponseWriter, r *http.Request) (t target, ok bool) {
+	parts, err := splitRequestPath(r.URL)
+	if err != nil || !validPathSegments(parts) {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return t, false
+	}
+	switch status := s.pathLimits.check(parts); status {
+	case 0:
+	case http.StatusNotFound:
+		http.NotFound(w, r)
+		return t, false
+	default:
+		http.Error(w, "414 Request URI Too Long", status)
+		return t, false
+	}
+	if s.basePath != "" {
+		n := len(s.baseSegments)
+		switch {
+		case len(parts) == n && slices.Equal(parts, s.baseSegments), r.URL.Path == "/":
+			redirectTo(w, r, s.basePath+"/")
+			return t, false
+		case len(parts) < n || !slices.Equal(parts[:n], s.baseSegments):
+			http.NotFound(w, r)
+			return t, false
+		}
+		parts = parts[n:]
+	}
+	t.urlPath = strings.Join(parts, "/")
+	if s.ignore.Match(t.urlPath) {
+		s.refuse(w, r, s.rootServiceDir, "")
+		return t, false
+	}
+	if s.rootArchive != "" {
+		return s.resolveRootArchive(w, r, t, parts)
+	}
+	// Aliases come first, so they are found as soon as the alias file names them
+	if a, ok := s.matchAlias(r.Context(), parts); ok {
+		return s.resolveAlias(w, r, t, a, parts[len(a.prefix):])
+	}
+	key := missingKey{root: s.rootServiceDir, urlPath: t.urlPath}
+	if missing, ok := s.missing.get(key); ok {
+		return missing, true
+	}
 
+	currentPath := s.rootServiceDir
+	t.lastDir = s.rootServiceDir
 	for i, part := range parts {
 		currentPath = filepath.Join(currentPath, part)
+		if !s.withinRoot(currentPath) {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return t, false
+		}
 
 		if !s.exposeHiddenFiles && strings.HasPrefix(part, ".") {
-			http.NotFound(w, r)
-			return
+			s.refuse(w, r, t.lastDir, "")
+			return t, false
 		}
 
-		if stat, err := os.Stat(currentPath); err == nil {
+		// An encoded slash can't name a file or an entry, and must not act as a separator
+		if strings.Contains(part, "/") {
+			s.refuse(w, r, t.lastDir, "")
+			return t, false
+		}
+
+		archiveCandidate := currentPath + ".zip"
+		if s.caseInsensitive && !exists(currentPath) && !exists(archiveCandidate) {
+			entry, archive, err := foldSegment(t.lastDir, part)
+			if errors.Is(err, errAmbiguousName) {
+				s.logAmbiguous(r.Context(), t.urlPath, err)
+				s.refuse(w, r, t.lastDir, "")
+				return t, false
+			}
+			if err != nil {
+				t.uncertain = true
+			}
+			if entry != "" {
+				currentPath = filepath.Join(t.lastDir, entry)
+				archiveCandidate = currentPath + ".zip"
+			} else if archive != "" {
+				archiveCandidate = filepath.Join(t.lastDir, archive)
+			}
+		}
+
+		if !s.symlinkAllowed(currentPath) {
+			s.refuse(w, r, t.lastDir, "")
+			return t, false
+		}
+
+		stat, err := os.Stat(currentPath)
+		if err != nil && errors.Is(err, fs.ErrPermission) {
+			s.forbidden(w, r, currentPath, err)
+			return t, false
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			t.uncertain = true
+		}
+		if err == nil {
 			if stat.IsDir() {
-				// If it's a directory and createIndexes is enabled, list the directory contents
-				if i == len(parts)-1 && s.createIndexes {
-					s.listDirectory(w, currentPath, urlPath)
-					return
+				if i == len(parts)-1 {
+					if part != "" && s.ignore.Match(t.urlPath+"/") {
+						s.refuse(w, r, t.lastDir, "")
+						return t, false
+					}
+					t.path, t.isDir, t.slash = currentPath, true, part == ""
+					return t, true
 				}
+				t.lastDir = currentPath
 				continue
 			} else {
-				http.ServeFile(w, r, currentPath)
-				return
+				// A file can't have children, not even an empty one from a trailing slash
+				if i != len(parts)-1 {
+					s.refuse(w, r, t.lastDir, "")
+					return t, false
+				}
+				if s.noArchiveDownload && isArchiveName(filepath.Base(currentPath)) {
+					s.refuse(w, r, t.lastDir, "")
+					return t, false
+				}
+				t.path = currentPath
+				return t, true
 			}
 		}
 
-		archiveCandidate := currentPath + ".zip"
-		if _, err := os.Stat(archiveCandidate); err == nil {
-			archivePath = archiveCandidate
+		_, err = os.Stat(archiveCandidate)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			t.uncertain = true
+		}
+		if err == nil && s.symlinkAllowed(archiveCandidate) {
+			if s.ignore.Match(strings.Join(parts[:i+1], "/")+".zip") || (i == len(parts)-1 && s.ignore.Match(t.urlPath+"/")) {
+				s.refuse(w, r, t.lastDir, "")
+				return t, false
+			}
+			s.logger.DebugContext(r.Context(), "Resolved archive", "path", t.urlPath, "archive", archiveCandidate)
+			t.archivePath = archiveCandidate
 			if i == len(parts)-1 {
-				http.Redirect(w, r, "/"+urlPath+"/", http.StatusMovedPermanently)
-				return
+				return t, true
 			}
-			remainingPath = strings.Join(parts[i+1:], "/")
-			break
+			// Entries follow the rules of files, as they do in an archive served as the tree
+			for _, entryPart := range parts[i+1:] {
+				if strings.Contains(entryPart, "/") || (!s.exposeHiddenFiles && strings.HasPrefix(entryPart, ".")) {
+					s.refuse(w, r, filepath.Dir(t.archivePath), t.archivePath)
+					return t, false
+				}
+			}
+			t.entry, t.slash = strings.Join(parts[i+1:], "/"), true
+			return t, true
+		}
+		s.logger.DebugContext(r.Context(), "No archive candidate", "path", t.urlPath, "candidate", archiveCandidate)
+	}
+	if !t.uncertain {
+		s.missing.put(key, t)
+	}
+	return t, true
+}
+
+// isArchiveName reports whether name has the archive extension, in any case, as it may
+// still name an archive on a case-insensitive filesystem.
+func isArchiveName(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".zip")
+}
+
+// redirectToDirectory redirects to the slash-terminated form of the request URL, keeping
+// the query string.
+func redirectToDirectory(w http.ResponseWriter, r *http.Request) {
+	redirectTo(w, r, r.URL.EscapedPath()+"/")
+}
+
+// redirectTo redirects to the escaped path target, keeping the query string.
+func redirectTo(w http.ResponseWriter, r *http.Request, target string) {
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
+
+// parseBasePath returns the escaped form of a URL path prefix, without a trailing slash,
+// and its segments. An empty or "/" prefix yields nothing.
+func parseBasePath(basePath string) (string, []string, error) {
+	if basePath == "" || basePath == "/" {
+		return "", nil, nil
+	}
+	segments := strings.Split(strings.Trim(basePath, "/"), "/")
+	if !strings.HasPrefix(basePath, "/") || !validPathSegments(segments) || slices.Contains(segments, "") || slices.Contains(segments, ".") {
+		return "", nil, fmt.Errorf("invalid base path %q", basePath)
+	}
+	var escaped strings.Builder
+	for _, segment := range segments {
+		escaped.WriteString("/" + url.PathEscape(segment))
+	}
+	return escaped.String(), segments, nil
+}
+
+// splitRequestPath splits the escaped request path into decoded segments, so an encoded
+// slash stays part of its segment instead of becoming a separator. A plus sign is kept as is.
+func splitRequestPath(u *url.URL) ([]string, error) {
+	parts := strings.Split(strings.TrimPrefix(u.EscapedPath(), "/"), "/")
+	for i, part := range parts {
+		decoded, err := url.PathUnescape(part)
+		if err != nil {
+			return nil, err
 		}
+		parts[i] = decoded
 	}
+	return parts, nil
+}
 
-	if archivePath == "" {
+// validPathSegments rejects parent directory references, NUL bytes and backslashes (a path
+// separator on Windows), including those hidden behind an encoded slash. The same segments
+// make up the path inside an archive, so entry lookups are covered as well.
+func validPathSegments(parts []string) bool {
+	for _, part := range parts {
+		if strings.ContainsRune(part, 0) || strings.ContainsRune(part, '\\') {
+			return false
+		}
+		for _, sub := range strings.Split(part, "/") {
+			if sub == ".." {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// withinRoot reports whether a path resolved from a request stays inside the service directory.
+func (s *Service) withinRoot(target string) bool {
+	return withinDir(s.rootServiceDir, target)
+}
+
+// withinDir reports whether target is dir or lies under it.
+func withinDir(dir, target string) bool {
+	rel, err := filepath.Rel(dir, target)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// serveArchive serves an entry, an index document or a listing from inside an archive.
+func (s *Service) serveArchive(w http.ResponseWriter, r *http.Request, archivePath, remainingPath, urlPath string) {
+	metrics.SetSource(r, metrics.SourceArchive)
+	if s.caseInsensitive {
+		resolved, err := s.foldArchivePath(r.Context(), archivePath, remainingPath)
+		if err != nil {
+			if s.canceled(r, archivePath, remainingPath) {
+				return
+			}
+			if errors.Is(err, zipfast.ErrAmbiguous) {
+				s.logAmbiguous(r.Context(), urlPath, err)
+			} else {
+				s.logArchiveError(r.Context(), "Failed to resolve archive entry", archivePath, remainingPath, err)
+			}
+			s.notFound(w, r, filepath.Dir(archivePath), archivePath)
+			return
+		}
+		remainingPath = resolved
+	}
+	isDir := remainingPath == "" || strings.HasSuffix(remainingPath, "/")
+	if isDir && s.createIndexes && r.URL.Query().Get("list") == "json" {
+		// Listings only read the index, so they don't wait for an extraction slot
+		s.listArchiveContents(w, r, archivePath, remainingPath, urlPath)
+		return
+	}
+	if !s.acquireExtraction(w, r, archivePath) {
+		return
+	}
+	defer s.releaseExtraction()
+	if isDir {
+		for _, indexFile := range s.indexFiles {
+			if s.servePrecompressedEntry(w, r, archivePath, remainingPath+indexFile) {
+				return
+			}
+			err := s.serveArchiveEntry(w, r, archivePath, remainingPath+indexFile)
+			if err == nil {
+				return
+			}
+			if s.canceled(r, archivePath, remainingPath+indexFile) {
+				return
+			}
+			if !errors.Is(err, zipfast.ErrNotFound) {
+				s.logArchiveError(r.Context(), "Failed to stream archive entry", archivePath, remainingPath+indexFile, err)
+				s.notFound(w, r, filepath.Dir(archivePath), archivePath)
+				return
+			}
+		}
 		if s.createIndexes {
-			s.listDirectory(w, currentPath, urlPath)
+			if _, err := s.zipReader.ReadDir(r.Context(), archivePath, remainingPath); err == nil {
+				s.listArchiveDirectory(w, r, archivePath, remainingPath, urlPath)
+				return
+			}
+		}
+		if s.serveArchiveFallback(w, r, archivePath, remainingPath) {
 			return
 		}
-		http.NotFound(w, r)
+		s.notFound(w, r, filepath.Dir(archivePath), archivePath)
 		return
 	}
 
-	if remainingPath == "" {
-		remainingPath = "index.html"
+	setDownloadDisposition(w, r, path.Base(remainingPath))
+	if s.servePrecompressedEntry(w, r, archivePath, remainingPath) || s.serveArchiveGzip(w, r, archivePath, remainingPath) {
+		return
 	}
-
-	err := s.zipReader.StreamFile(archivePath, remainingPath, w)
+	err := s.serveArchiveEntry(w, r, archivePath, remainingPath)
 	if err != nil {
-		http.NotFound(w, r)
+		if s.canceled(r, archivePath, remainingPath) {
+			return
+		}
+		w.Header().Del("Content-Disposition")
+		if errors.Is(err, zipfast.ErrNotFound) {
+			// The path may name a directory inside the archive
+			if _, dirErr := s.zipReader.ReadDir(r.Context(), archivePath, remainingPath+"/"); dirErr == nil {
+				redirectToDirectory(w, r)
+				return
+			}
+			if s.serveArchiveFallback(w, r, archivePath, remainingPath) {
+				return
+			}
+		} else {
+			s.logArchiveError(r.Context(), "Failed to stream archive entry", archivePath, remainingPath, err)
+		}
+		s.notFound(w, r, filepath.Dir(archivePath), archivePath)
 		return
 	}
 }
 
-func (s *Service) listDirectory(w http.ResponseWriter, dirPath, urlPath string) {
-	entries, err := os.ReadDir(dirPath)
-	if err != nil {
-		http.Error(w, "Failed to read directory", http.StatusInternalServerError)
-		return
+// logArchiveError logs a failure to serve from an archive, at debug level for archives
+// rejected for exceeding the limits, which logged why when they were indexed.
+func (s *Service) logArchiveError(ctx context.Context, msg, archivePath, entry string, err error) {
+	level := slog.LevelWarn
+	if errors.Is(err, zipfast.ErrRejected) {
+		level = slog.LevelDebug
 	}
+	s.logger.Log(ctx, level, msg, "archive", archivePath, "entry", entry, "error", err)
+}
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write([]byte("<html><body><h1>Index of " + urlPath + "</h1><ul>"))
+// acquireExtraction waits for one of MaxExtractions to serve an archive request, answering
+// with 503 once the queue timeout passed. It returns false, having answered, when the
+// request is given up on; callers call releaseExtraction otherwise.
+func (s *Service) acquireExtraction(w http.ResponseWriter, r *http.Request, archivePath string) bool {
+	if s.extractions == nil || s.extractions.acquire(r.Context()) {
+		return true
+	}
+	if r.Context().Err() == nil {
+		s.logger.DebugContext(r.Context(), "Too many archive requests, gave up waiting", "archive", archivePath, "timeout", s.extractions.timeout)
+		w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(s.extractions.timeout.Seconds())), 1)))
+		http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+	}
+	return false
+}
+
+// releaseExtraction hands back the slot taken by acquireExtraction.
+func (s *Service) releaseExtraction() {
+	if s.extractions != nil {
+		s.extractions.release()
+	}
+}
+
+// serveArchiveEntry serves a file entry of an archive with http.ServeContent, which answers
+// ranges and conditional requests, If-Range included, against the entry's modification time
+// and an ETag derived from its checksum and size. Its first bytes are read once, to sniff
+// types unknown by extension and find the byte order mark of text, and a JSON one is left
+// out for StripJSONBOM. It returns the error opening the entry, having served nothing;
+// errors reading it once the response started are logged.
+func (s *Service) serveArchiveEntry(w http.ResponseWriter, r *http.Request, archivePath, entry string) error {
+	reader, err := s.zipReader.OpenEntry(r.Context(), archivePath, entry)
 	if err != nil {
-		return
+		return err
 	}
+	defer reader.Close()
+	body := &entryBody{r: reader, size: int64(reader.Info.UncompressedSize)}
+	ctype := mime.TypeByExtension(path.Ext(entry))
+	if ctype == "" {
+		body.head = readHead(reader, sniffLen)
+		ctype = http.DetectContentType(body.head)
+	}
+	mediaType, _, _ := mime.ParseMediaType(ctype)
+	if isText(mediaType) && body.head == nil {
+		body.head = readHead(reader, bomLength)
+	}
+	w.Header().Set("Content-Type", s.withCharset(ctype, entry, body.head))
+	etag := fmt.Sprintf(`"%08x-%x"`, reader.Info.CRC32, reader.Info.UncompressedSize)
+	if _, n := detectBOM(body.head); n > 0 && s.stripJSONBOM && isJSON(mediaType) {
+		body.head, body.skip, body.size = body.head[n:], int64(n), body.size-int64(n)
+		etag = fmt.Sprintf(`"%08x-%x-nobom"`, reader.Info.CRC32, reader.Info.UncompressedSize)
+	}
+	if reader.Info.HasCRC32 {
+		w.Header().Set("ETag", etag)
+	}
+	http.ServeContent(w, r, path.Base(entry), reader.Info.Modified, body)
+	if err := reader.Err(); err != nil {
+		s.logger.WarnContext(r.Context(), "Failed to stream archive entry", "archive", archivePath, "entry", entry, "error", err)
+	}
+	return nil
+}
+
+// canceled reports whether the request was canceled, e.g. by the client disconnecting,
+// so reading the archive stopped and there is no one left to answer.
+func (s *Service) canceled(r *http.Request, archivePath, entry string) bool {
+	if r.Context().Err() == nil {
+		return false
+	}
+	s.logger.DebugContext(r.Context(), "Request canceled, stopped reading archive", "archive", archivePath, "entry", entry, "error", r.Context().Err())
+	return true
+}
 
-	for _, entry := range entries {
-		name := entry.Name()
-		if !s.exposeHiddenFiles && strings.HasPrefix(name, ".") {
+// serveArchiveFallback serves the archive's root index document in place of a missing
+// extensionless entry when SPA mode is enabled globally or by a .spa entry in the archive.
+func (s *Service) serveArchiveFallback(w http.ResponseWriter, r *http.Request, archivePath, remainingPath string) bool {
+	if path.Ext(strings.TrimSuffix(remainingPath, "/")) != "" {
+		return false
+	}
+	if !s.spa {
+		if _, err := s.zipReader.Stat(r.Context(), archivePath, spaSentinel); err != nil {
+			return false
+		}
+	}
+	for _, indexFile := range s.indexFiles {
+		if _, err := s.zipReader.Stat(r.Context(), archivePath, indexFile); err != nil {
+			continue
+		}
+		w.Header().Set("Content-Type", s.withCharset("text/html", indexFile, nil))
+		if err := s.zipReader.StreamFile(r.Context(), archivePath, indexFile, w); err != nil {
+			w.Header().Del("Content-Type")
 			continue
 		}
+		return true
+	}
+	return false
+}
+
+// serveFilesystemFallback serves the index document of the deepest existing directory, or
+// of its closest ancestor providing one, in place of a missing extensionless path.
+func (s *Service) serveFilesystemFallback(w http.ResponseWriter, r *http.Request, dirPath, urlPath string) bool {
+	if path.Ext(strings.TrimSuffix(urlPath, "/")) != "" {
+		return false
+	}
+	for {
+		if indexPath := s.findIndexFile(dirPath); indexPath != "" {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if !s.servePrecompressed(w, r, indexPath) {
+				serveFileContent(w, r, indexPath)
+			}
+			return true
+		}
+		if dirPath == s.rootServiceDir || filepath.Dir(dirPath) == dirPath {
+			return false
+		}
+		dirPath = filepath.Dir(dirPath)
+	}
+}
 
-		var linkName string
-		var extraLink string
+// forbidden answers with a 403 status for paths the server isn't allowed to read. The
+// cause is only logged.
+func (s *Service) forbidden(w http.ResponseWriter, r *http.Request, target string, err error) {
+	s.logger.WarnContext(r.Context(), "Permission denied", "path", target, "error", err)
+	http.Error(w, "403 Forbidden", http.StatusForbidden)
+}
 
-		if entry.IsDir() {
-			name += "/"
-			linkName = name
-		} else if strings.HasSuffix(name, ".zip") {
-			nameWithoutExt := strings.TrimSuffix(name, ".zip") + "/"
-			linkName = nameWithoutExt
-			extraLink = " (<a href=\"" + name + "\">download</a>)"
-		} else {
-			linkName = name
+// notFound answers with a 404 status, using the 404.html page of the archive or of the
+// nearest directory under the service root that has one, and the plain Go page otherwise.
+// archivePath is empty for filesystem misses.
+func (s *Service) notFound(w http.ResponseWriter, r *http.Request, dirPath, archivePath string) {
+	if archivePath != "" {
+		if _, err := s.zipReader.Stat(r.Context(), archivePath, notFoundPage); err == nil {
+			w.Header().Set("Content-Type", s.withCharset("text/html", notFoundPage, nil))
+			w.WriteHeader(http.StatusNotFound)
+			_ = s.zipReader.StreamFile(r.Context(), archivePath, notFoundPage, w)
+			return
 		}
+	}
+	if s.rootArchive != "" {
+		http.NotFound(w, r)
+		return
+	}
 
-		_, err = w.Write([]byte("<li><a href=\"" + linkName + "\">" + name + "</a>" + extraLink + "</li>"))
-		if err != nil {
+	for {
+		if pagePath := filepath.Join(dirPath, notFoundPage); s.symlinkAllowed(pagePath) && serveNotFoundPage(w, pagePath) {
 			return
 		}
+		if dirPath == s.rootServiceDir || filepath.Dir(dirPath) == dirPath {
+			break
+		}
+		dirPath = filepath.Dir(dirPath)
+	}
+	http.NotFound(w, r)
+}
+
+func serveNotFoundPage(w http.ResponseWriter, pagePath string) bool {
+	file, err := os.Open(pagePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	if stat, err := file.Stat(); err != nil || stat.IsDir() {
+		return false
 	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	_, _ = io.Copy(w, file)
+	return true
+}
 
-	_, err = w.Write([]byte("</ul></body></html>"))
+// serveFileContent serves a file without the index.html redirect of http.ServeFile, so it
+// can stand in for a different request path.
+func serveFileContent(w http.ResponseWriter, r *http.Request, filePath string) {
+	file, err := os.Open(filePath)
 	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		http.NotFound(w, r)
 		return
 	}
+	http.ServeContent(w, r, stat.Name(), stat.ModTime(), file)
 }
@@ -0,0 +1,1474 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cmpserve/internal/metrics"
+	"cmpserve/internal/middleware"
+	"cmpserve/internal/readers/zipfast"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createTestZipFile(zipPath string, files map[string]string) error {
+	file, err := os.Create(zipPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	zipWriter := zip.NewWriter(file)
+	defer zipWriter.Close()
+
+	for name, content := range files {
+		w, err := zipWriter.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write([]byte(content))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeTestFiles(t testing.TB, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+}
+
+func newTestService(t *testing.T, root string, options Options) *Service {
+	t.Helper()
+	s, err := NewService(root, t.TempDir(), options)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, s.zipReader.Close()) })
+	return s
+}
+
+func get(s http.Handler, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+func TestIndexFilesInArchive(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, createTestZipFile(filepath.Join(root, "site.zip"), map[string]string{
+		"index.htm":     "htm index",
+		"sub/page.html": "page",
+	}))
+
+	s := newTestService(t, root, Options{IndexFiles: []string{"index.html", "index.htm"}})
+
+	rec := get(s, "/site/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "htm index", rec.Body.String())
+
+	// Default candidates do not include index.htm
+	s = newTestService(t, root, Options{})
+	assert.Equal(t, http.StatusNotFound, get(s, "/site/").Code)
+}
+
+func TestIndexFilesInDirectory(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"docs/default.html": "default",
+		"docs/index.html":   "index",
+	})
+
+	s := newTestService(t, root, Options{IndexFiles: []string{"default.html", "index.html"}})
+	rec := get(s, "/docs/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "default", rec.Body.String())
+
+	s = newTestService(t, root, Options{IndexFiles: []string{"index.html", "default.html"}})
+	rec = get(s, "/docs/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "index", rec.Body.String())
+}
+
+func TestDirectoryIndexDocument(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"site/index.html":          "<html>site</html>",
+		"site/docs/index.html":     `<link rel="stylesheet" href="style.css">`,
+		"site/docs/style.css":      "body {}",
+		"plain/readme.txt":         "readme",
+		"private/index.html":       "private",
+		"private/other.txt":        "other",
+		"hidden/.index.html":       "hidden",
+		"hidden/visible/index.htm": "visible",
+	})
+
+	// Index documents win over listings, and are served with conditional requests
+	for _, options := range []Options{{}, {CreateIndexes: true}} {
+		s := newTestService(t, root, options)
+		rec := get(s, "/site/")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "<html>site</html>", rec.Body.String())
+		assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+
+		req := httptest.NewRequest(http.MethodGet, "/site/", nil)
+		req.Header.Set("If-Modified-Since", rec.Header().Get("Last-Modified"))
+		conditional := httptest.NewRecorder()
+		s.ServeHTTP(conditional, req)
+		assert.Equal(t, http.StatusNotModified, conditional.Code)
+	}
+
+	// Nested directories are redirected to their slash-terminated URL, against which the
+	// relative links of their index document resolve
+	s := newTestService(t, root, Options{})
+	rec := get(s, "/site/docs")
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+	assert.Equal(t, "/site/docs/", rec.Header().Get("Location"))
+	rec = get(s, "/site/docs/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	href := regexp.MustCompile(`href="([^"]+)"`).FindStringSubmatch(rec.Body.String())
+	require.NotNil(t, href)
+	base, err := url.Parse("/site/docs/")
+	require.NoError(t, err)
+	asset, err := base.Parse(href[1])
+	require.NoError(t, err)
+	assert.Equal(t, "body {}", get(s, asset.String()).Body.String())
+
+	// Without an index document, directories are listed or not found
+	assert.Equal(t, http.StatusNotFound, get(s, "/plain/").Code)
+	s = newTestService(t, root, Options{CreateIndexes: true})
+	rec = get(s, "/plain/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "readme.txt")
+
+	// Index documents that couldn't be requested themselves aren't served for their directory
+	s = newTestService(t, root, Options{CreateIndexes: true, Ignore: []string{"/private/index.html"}, IndexFiles: []string{".index.html", "index.html", "index.htm"}})
+	rec = get(s, "/private/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "other.txt")
+	rec = get(s, "/hidden/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "visible/")
+	assert.Equal(t, "visible", get(s, "/hidden/visible/").Body.String())
+}
+
+func TestArchiveDirectoryListing(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, createTestZipFile(filepath.Join(root, "bundle.zip"), map[string]string{
+		"index.html":          "root",
+		"images/a.png":        "a",
+		"images/icons/b.png":  "b",
+		"images/.hidden.png":  "h",
+		"images/<tag>&x.png":  "x",
+		"pages/index.html":    "pages",
+		"pages/other/x.html":  "x",
+		"implicit/only/y.txt": "y",
+	}))
+
+	s := newTestService(t, root, Options{CreateIndexes: true})
+
+	rec := get(s, "/bundle/images/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	assert.Contains(t, body, `href="a.png"`)
+	assert.Contains(t, body, `href="icons/"`)
+	assert.Contains(t, body, "&lt;tag&gt;&amp;x.png")
+	assert.NotContains(t, body, ".hidden.png")
+
+	// An index document takes precedence over the listing
+	rec = get(s, "/bundle/pages/")
+	assert.Equal(t, "pages", rec.Body.String())
+
+	// Implicit directories are listed and redirected to the slash-terminated URL
+	assert.Equal(t, http.StatusOK, get(s, "/bundle/implicit/").Code)
+	rec = get(s, "/bundle/implicit")
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+	assert.Equal(t, "/bundle/implicit/", rec.Header().Get("Location"))
+
+	assert.Equal(t, http.StatusNotFound, get(s, "/bundle/missing/").Code)
+
+	// Listings are only generated when indexes are enabled
+	s = newTestService(t, root, Options{})
+	assert.Equal(t, http.StatusNotFound, get(s, "/bundle/images/").Code)
+}
+
+func TestSPAFallback(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, createTestZipFile(filepath.Join(root, "app.zip"), map[string]string{
+		"index.html": "<p>app</p>",
+		"main.js":    "js",
+	}))
+	require.NoError(t, createTestZipFile(filepath.Join(root, "optin.zip"), map[string]string{
+		".spa":       "",
+		"index.html": "<p>optin</p>",
+	}))
+	writeTestFiles(t, root, map[string]string{"site/index.html": "<p>site</p>"})
+
+	s := newTestService(t, root, Options{SPA: true})
+
+	rec := get(s, "/app/settings/profile")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "<p>app</p>", rec.Body.String())
+	assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+
+	assert.Equal(t, http.StatusOK, get(s, "/app/settings/").Code)
+	assert.Equal(t, "js", get(s, "/app/main.js").Body.String())
+	assert.Equal(t, http.StatusNotFound, get(s, "/app/missing.js").Code)
+	assert.Equal(t, http.StatusNotFound, get(s, "/app/styles/site.css").Code)
+
+	// Filesystem paths need their own opt-in
+	assert.Equal(t, http.StatusNotFound, get(s, "/site/deep/link").Code)
+
+	s = newTestService(t, root, Options{})
+	assert.Equal(t, http.StatusNotFound, get(s, "/app/settings/profile").Code)
+	rec = get(s, "/optin/settings/profile")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "<p>optin</p>", rec.Body.String())
+
+	s = newTestService(t, root, Options{SPAFilesystem: true})
+	rec = get(s, "/site/deep/link")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "<p>site</p>", rec.Body.String())
+	assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Equal(t, http.StatusNotFound, get(s, "/site/missing.png").Code)
+}
+
+func TestCustomNotFoundPage(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"404.html":          "root missing",
+		"docs/404.html":     "docs missing",
+		"docs/guide/a.html": "a",
+		"plain/b.html":      "b",
+	})
+	require.NoError(t, createTestZipFile(filepath.Join(root, "branded.zip"), map[string]string{
+		"index.html": "index",
+		"404.html":   "archive missing",
+	}))
+	require.NoError(t, createTestZipFile(filepath.Join(root, "docs", "bare.zip"), map[string]string{
+		"index.html": "index",
+	}))
+
+	s := newTestService(t, root, Options{})
+
+	cases := map[string]string{
+		"/branded/nope.html":    "archive missing",
+		"/docs/bare/nope.html":  "docs missing",
+		"/docs/guide/nope.html": "docs missing",
+		"/docs/nope/deeper":     "docs missing",
+		"/plain/nope.html":      "root missing",
+		"/nope":                 "root missing",
+	}
+	for target, body := range cases {
+		rec := get(s, target)
+		assert.Equal(t, http.StatusNotFound, rec.Code, target)
+		assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"), target)
+		assert.Equal(t, body, rec.Body.String(), target)
+	}
+
+	// Without any custom page the default response is kept
+	bare := t.TempDir()
+	s = newTestService(t, bare, Options{})
+	rec := get(s, "/nope")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "404 page not found\n", rec.Body.String())
+}
+
+func TestPathTraversal(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	writeTestFiles(t, base, map[string]string{
+		"secret.txt":     "secret",
+		"root/a/ok.txt":  "ok",
+		"root/.hidden/x": "x",
+	})
+	require.NoError(t, createTestZipFile(filepath.Join(root, "bundle.zip"), map[string]string{
+		"index.html": "index",
+	}))
+
+	// Hidden files are exposed so dot-prefixed segments are not rejected by that rule
+	s := newTestService(t, root, Options{ExposeHiddenFiles: true, CreateIndexes: true})
+
+	payloads := []string{
+		"/../secret.txt",
+		"/../../../../etc/passwd",
+		"/a/../../secret.txt",
+		"/%2e%2e/secret.txt",
+		"/%2e%2e%2fsecret.txt",
+		"/a/..%2f..%2fsecret.txt",
+		"/a/%2E%2E/%2e./secret.txt",
+		"/bundle/../../secret.txt",
+		"/bundle/%2e%2e%2f%2e%2e%2fsecret.txt",
+		"/a/ok.txt%00",
+		"/..%5csecret.txt",
+	}
+	for _, payload := range payloads {
+		rec := get(s, payload)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, payload)
+		assert.NotContains(t, rec.Body.String(), "secret", payload)
+	}
+
+	assert.Equal(t, "ok", get(s, "/a/ok.txt").Body.String())
+	assert.Equal(t, "x", get(s, "/.hidden/x").Body.String())
+}
+
+func TestEncodedPaths(t *testing.T) {
+	root := t.TempDir()
+	names := map[string]string{
+		"docs/release notes.pdf": "notes",
+		"docs/überblick.html":    "unicode",
+		"docs/100%.txt":          "percent",
+		"docs/a+b.txt":           "plus",
+		"docs/a&b #1.txt":        "amp",
+	}
+	writeTestFiles(t, root, names)
+	require.NoError(t, createTestZipFile(filepath.Join(root, "bundle.zip"), names))
+
+	s := newTestService(t, root, Options{})
+
+	for _, prefix := range []string{"/", "/bundle/"} {
+		for target, body := range map[string]string{
+			"docs/release%20notes.pdf":   "notes",
+			"docs/%C3%BCberblick.html":   "unicode",
+			"docs/100%25.txt":            "percent",
+			"docs/a+b.txt":               "plus",
+			"docs/a&b%20%231.txt":        "amp",
+			"docs%2Frelease%20notes.pdf": "",
+		} {
+			rec := get(s, prefix+target)
+			if body == "" {
+				// An encoded slash stays inside its segment
+				assert.Equal(t, http.StatusNotFound, rec.Code, prefix+target)
+				continue
+			}
+			assert.Equal(t, http.StatusOK, rec.Code, prefix+target)
+			assert.Equal(t, body, rec.Body.String(), prefix+target)
+		}
+		assert.Equal(t, http.StatusNotFound, get(s, prefix+"docs/a%20b.txt").Code)
+	}
+
+	s = newTestService(t, root, Options{CreateIndexes: true})
+	body := get(s, "/docs/").Body.String()
+	assert.Contains(t, body, `href="a&amp;b%20%231.txt"`)
+	assert.Contains(t, body, `href="release%20notes.pdf"`)
+	assert.Contains(t, body, `href="100%25.txt"`)
+}
+
+func TestDirectoryTrailingSlash(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"docs/index.html":     "index",
+		"my docs/a.txt":       "a",
+		"listing/b.txt":       "b",
+		"plain.txt":           "plain",
+		"nested/dir/file.txt": "file",
+	})
+
+	s := newTestService(t, root, Options{CreateIndexes: true})
+
+	rec := get(s, "/docs?x=1&y=2")
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+	assert.Equal(t, "/docs/?x=1&y=2", rec.Header().Get("Location"))
+
+	rec = get(s, "/my%20docs")
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+	assert.Equal(t, "/my%20docs/", rec.Header().Get("Location"))
+
+	rec = get(s, "/nested/dir")
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+	assert.Equal(t, "/nested/dir/", rec.Header().Get("Location"))
+
+	assert.Equal(t, "index", get(s, "/docs/").Body.String())
+	assert.Equal(t, http.StatusOK, get(s, "/listing/").Code)
+	assert.Equal(t, http.StatusOK, get(s, "/").Code)
+
+	// Files never match a path with a trailing slash or children
+	assert.Equal(t, http.StatusNotFound, get(s, "/plain.txt/").Code)
+	assert.Equal(t, http.StatusNotFound, get(s, "/plain.txt/child").Code)
+	assert.Equal(t, "plain", get(s, "/plain.txt").Body.String())
+
+	// Without indexes only directories with an index document are redirected
+	s = newTestService(t, root, Options{})
+	assert.Equal(t, http.StatusMovedPermanently, get(s, "/docs").Code)
+	assert.Equal(t, http.StatusNotFound, get(s, "/listing").Code)
+	assert.Equal(t, http.StatusNotFound, get(s, "/listing/").Code)
+}
+
+func TestArchiveDirectoryAndDuplicateEntries(t *testing.T) {
+	root := t.TempDir()
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for _, entry := range []struct{ name, content string }{
+		{"assets/", ""},
+		{"assets/app.js", "version 1"},
+		{"assets/app.js", "version 2"},
+	} {
+		w, err := zipWriter.Create(entry.name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(entry.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zipWriter.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(root, "bundle.zip"), buf.Bytes(), 0o644))
+
+	s := newTestService(t, root, Options{CreateIndexes: true})
+	// The last entry with a name is served
+	rec := get(s, "/bundle/assets/app.js")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "version 2", rec.Body.String())
+
+	// The directory entry isn't an empty file
+	rec = get(s, "/bundle/assets")
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+	assert.Equal(t, "/bundle/assets/", rec.Header().Get("Location"))
+	rec = get(s, "/bundle/assets/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "app.js")
+}
+
+func TestLegacyArchiveNames(t *testing.T) {
+	root := t.TempDir()
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	// Überblick and Обзор, in CP437 and CP866 without the UTF-8 flag
+	for name, content := range map[string]string{"\x9aberblick.html": "Überblick", "\x8e\xa1\xa7\xae\xe0.txt": "Обзор"} {
+		w, err := zipWriter.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, NonUTF8: true})
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zipWriter.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(root, "legacy.zip"), buf.Bytes(), 0o644))
+
+	s := newTestService(t, root, Options{CreateIndexes: true})
+	rec := get(s, "/legacy/%C3%9Cberblick.html")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "Überblick", rec.Body.String())
+	assert.Contains(t, get(s, "/legacy/").Body.String(), "Überblick.html")
+
+	s = newTestService(t, root, Options{ArchiveNameEncoding: "cp866"})
+	rec = get(s, "/legacy/%D0%9E%D0%B1%D0%B7%D0%BE%D1%80.txt")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "Обзор", rec.Body.String())
+
+	_, err := NewService(root, t.TempDir(), Options{ArchiveNameEncoding: "klingon"})
+	assert.Error(t, err)
+}
+
+func TestUnresolvedPaths(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"valid/a.txt":     "a",
+		"locked/b.txt":    "b",
+		"locked/sub/c.md": "c",
+	})
+
+	s := newTestService(t, root, Options{CreateIndexes: true})
+
+	// Missing paths are not listed, whether indexes are enabled or not
+	for _, target := range []string{"/missing", "/missing/", "/valid/missing/", "/valid/missing/deeper"} {
+		rec := get(s, target)
+		assert.Equal(t, http.StatusNotFound, rec.Code, target)
+		assert.NotContains(t, rec.Body.String(), "Failed to read directory", target)
+	}
+
+	rec := get(s, "/valid/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `href="a.txt"`)
+
+	if os.Geteuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+	require.NoError(t, os.Chmod(filepath.Join(root, "locked"), 0o000))
+	t.Cleanup(func() { _ = os.Chmod(filepath.Join(root, "locked"), 0o755) })
+
+	for _, target := range []string{"/locked/", "/locked/b.txt", "/locked/sub/c.md"} {
+		rec := get(s, target)
+		assert.Equal(t, http.StatusForbidden, rec.Code, target)
+		assert.NotContains(t, rec.Body.String(), root, target)
+	}
+}
+
+func TestRequestMethods(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"plain.txt": "plain"})
+	require.NoError(t, createTestZipFile(filepath.Join(root, "bundle.zip"), map[string]string{
+		"index.html": "<html>index</html>",
+	}))
+
+	cacheDir := t.TempDir()
+	s, err := NewService(root, cacheDir, Options{CreateIndexes: true})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, s.zipReader.Close()) })
+
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch, "PROPFIND", "TRACE"} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(method, "/bundle/index.html", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, rec.Code, method)
+		assert.Equal(t, "GET, HEAD, OPTIONS", rec.Header().Get("Allow"), method)
+		assert.NotContains(t, rec.Body.String(), "index", method)
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodOptions, "/bundle/index.html", nil))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "GET, HEAD, OPTIONS", rec.Header().Get("Allow"))
+
+	// Rejected methods must not have indexed the archive
+	var count int
+	require.NoError(t, sqlCount(filepath.Join(cacheDir, ".zip_reader_cache.db"), &count))
+	assert.Equal(t, 0, count)
+
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	for _, target := range []string{"/plain.txt", "/bundle/", "/"} {
+		getResp, err := server.Client().Get(server.URL + target)
+		require.NoError(t, err)
+		getResp.Body.Close()
+		headResp, err := server.Client().Head(server.URL + target)
+		require.NoError(t, err)
+		headResp.Body.Close()
+
+		assert.Equal(t, getResp.StatusCode, headResp.StatusCode, target)
+		getResp.Header.Del("Date")
+		headResp.Header.Del("Date")
+		assert.Equal(t, getResp.Header, headResp.Header, target)
+	}
+}
+
+func TestStreamFailuresAreLogged(t *testing.T) {
+	root := t.TempDir()
+	file, err := os.Create(filepath.Join(root, "bundle.zip"))
+	require.NoError(t, err)
+	zipWriter := zip.NewWriter(file)
+	w, err := zipWriter.CreateRaw(&zip.FileHeader{Name: "data.bin", Method: 99, CompressedSize64: 4, UncompressedSize64: 4})
+	require.NoError(t, err)
+	_, err = w.Write([]byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, zipWriter.Close())
+	require.NoError(t, file.Close())
+
+	var logs bytes.Buffer
+	logger := slog.New(middleware.LogRequestIDs(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	s := newTestService(t, root, Options{Logger: logger})
+
+	rec := get(middleware.RequestID(nil)(s), "/bundle/data.bin")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// Every line about the request, those of indexing the archive included, carries its ID
+	id := rec.Header().Get(middleware.RequestIDHeader)
+	require.NotEmpty(t, id)
+	var warning map[string]any
+	messages := map[any]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var record map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		assert.Equal(t, id, record["request_id"], line)
+		messages[record["msg"]] = true
+		if record["level"] == "WARN" {
+			warning = record
+		}
+	}
+	require.NotNil(t, warning, logs.String())
+	assert.Equal(t, filepath.Join(root, "bundle.zip"), warning["archive"])
+	assert.Equal(t, "data.bin", warning["entry"])
+	assert.Contains(t, warning["error"], "unsupported compression method")
+	assert.True(t, messages["Resolved archive"], logs.String())
+	assert.True(t, messages["Indexed archive"], logs.String())
+}
+
+func TestMetrics(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"plain.txt": "plain"})
+	require.NoError(t, createTestZipFile(filepath.Join(root, "bundle.zip"), map[string]string{
+		"index.html": "<html>index</html>",
+		"a.txt":      "a",
+	}))
+
+	m := metrics.New()
+	s := newTestService(t, root, Options{Observer: m})
+	server := httptest.NewServer(middleware.Metrics(m)(s))
+	t.Cleanup(server.Close)
+
+	for _, target := range []string{"/plain.txt", "/bundle/", "/bundle/a.txt", "/bundle/missing.txt"} {
+		resp, err := server.Client().Get(server.URL + target)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	rec := get(m.Handler(), "/metrics")
+	require.Equal(t, http.StatusOK, rec.Code)
+	out := rec.Body.String()
+	assert.Contains(t, out, `cmpserve_http_requests_total{code="2xx",source="filesystem"} 1`)
+	assert.Contains(t, out, `cmpserve_http_requests_total{code="2xx",source="archive"} 2`)
+	assert.Contains(t, out, `cmpserve_http_requests_total{code="4xx",source="archive"} 1`)
+	assert.Contains(t, out, `cmpserve_http_response_bytes_total{source="filesystem"} 5`)
+	assert.Contains(t, out, "cmpserve_archive_index_duration_seconds_count 1")
+	assert.Contains(t, out, "cmpserve_archive_index_entries_sum 2")
+	assert.Contains(t, out, `cmpserve_archive_index_lookups_total{result="miss"} 1`)
+	assert.Regexp(t, `cmpserve_archive_index_lookups_total\{result="hit"\} [1-9]`, out)
+	assert.Contains(t, out, "cmpserve_sqlite_errors_total 0")
+}
+
+func sqlCount(dbPath string, count *int) error {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.QueryRow("SELECT count(*) FROM lookup_zip_files").Scan(count)
+}
+
+// slowWriter stands in for a slow client: its first write signals started, then it blocks
+// until release is closed.
+type slowWriter struct {
+	*httptest.ResponseRecorder
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func newSlowWriter() *slowWriter {
+	return &slowWriter{ResponseRecorder: httptest.NewRecorder(), started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.started) })
+	<-w.release
+	return w.ResponseRecorder.Write(p)
+}
+
+// serveSlowly starts serving target to a slow client, returning once the response is being written.
+func serveSlowly(t *testing.T, s http.Handler, target string) (*slowWriter, <-chan struct{}) {
+	t.Helper()
+	slow, done := newSlowWriter(), make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ServeHTTP(slow, httptest.NewRequest(http.MethodGet, target, nil))
+	}()
+	select {
+	case <-slow.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the slow request never started writing")
+	}
+	t.Cleanup(func() { <-done })
+	return slow, done
+}
+
+func TestExtractionLimit(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"plain.txt": "plain"})
+	require.NoError(t, createTestZipFile(filepath.Join(root, "bundle.zip"), map[string]string{"a.txt": "a", "b.txt": "b"}))
+	m := metrics.New()
+	s := newTestService(t, root, Options{MaxExtractions: 1, ExtractionQueueTimeout: 5 * time.Second, ExtractionObserver: m})
+
+	slow, slowDone := serveSlowly(t, s, "/bundle/a.txt")
+
+	// Filesystem requests don't wait for extraction slots
+	assert.Equal(t, "plain", get(s, "/plain.txt").Body.String())
+
+	queued := make(chan *httptest.ResponseRecorder)
+	go func() { queued <- get(s, "/bundle/b.txt") }()
+	assert.Eventually(t, func() bool {
+		return strings.Contains(get(m.Handler(), "/metrics").Body.String(), "cmpserve_archive_extractions_queued 1")
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, get(m.Handler(), "/metrics").Body.String(), "cmpserve_archive_extractions_in_flight 1")
+	select {
+	case <-queued:
+		t.Fatal("the second extraction didn't wait for a free slot")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(slow.release)
+	<-slowDone
+	rec := <-queued
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "b", rec.Body.String())
+	assert.Equal(t, "a", slow.Body.String())
+
+	out := get(m.Handler(), "/metrics").Body.String()
+	assert.Contains(t, out, "cmpserve_archive_extractions_in_flight 0")
+	assert.Contains(t, out, "cmpserve_archive_extractions_queued 0")
+}
+
+func TestExtractionQueueTimeout(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, createTestZipFile(filepath.Join(root, "bundle.zip"), map[string]string{"a.txt": "a"}))
+	m := metrics.New()
+	s := newTestService(t, root, Options{MaxExtractions: 1, ExtractionQueueTimeout: 50 * time.Millisecond, ExtractionObserver: m})
+
+	slow, _ := serveSlowly(t, s, "/bundle/a.txt")
+	defer close(slow.release)
+
+	start := time.Now()
+	rec := get(s, "/bundle/a.txt")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Contains(t, get(m.Handler(), "/metrics").Body.String(), "cmpserve_archive_extractions_rejected_total 1")
+}
+
+func TestPrecompressed(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"app.js":             "console.log(1)",
+		"app.js.gz":          "gzip bytes",
+		"app.js.br":          "brotli bytes",
+		"style.css":          "body{}",
+		"style.css.gz":       "gzip css",
+		"docs/index.html":    "<html>docs</html>",
+		"docs/index.html.gz": "gzip docs",
+		"plain.txt":          "plain",
+	})
+	siblingTime := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(filepath.Join(root, "app.js.gz"), siblingTime, siblingTime))
+	s := newTestService(t, root, Options{Precompressed: true})
+
+	serve := func(target, acceptEncoding string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, tc := range []struct {
+		target, acceptEncoding, body, encoding string
+	}{
+		{"/app.js", "gzip, deflate, br", "brotli bytes", "br"},
+		{"/app.js", "gzip", "gzip bytes", "gzip"},
+		{"/app.js", "br;q=0, gzip", "gzip bytes", "gzip"},
+		{"/app.js", "br;q=0.5, gzip;q=0.8", "gzip bytes", "gzip"},
+		{"/app.js", "*", "brotli bytes", "br"},
+		{"/app.js", "", "console.log(1)", ""},
+		{"/app.js", "identity", "console.log(1)", ""},
+		{"/style.css", "br", "body{}", ""},
+		{"/style.css", "br, gzip", "gzip css", "gzip"},
+		{"/docs/", "gzip", "gzip docs", "gzip"},
+	} {
+		rec := serve(tc.target, tc.acceptEncoding)
+		name := tc.target + " " + tc.acceptEncoding
+		assert.Equal(t, http.StatusOK, rec.Code, name)
+		assert.Equal(t, tc.body, rec.Body.String(), name)
+		assert.Equal(t, tc.encoding, rec.Header().Get("Content-Encoding"), name)
+		assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"), name)
+	}
+	assert.Equal(t, "text/javascript; charset=utf-8", serve("/app.js", "gzip").Header().Get("Content-Type"))
+	assert.Equal(t, "text/html; charset=utf-8", serve("/docs/", "gzip").Header().Get("Content-Type"))
+	assert.Equal(t, siblingTime.Format(http.TimeFormat), serve("/app.js", "gzip").Header().Get("Last-Modified"))
+	assert.Equal(t, "12", serve("/app.js", "br").Header().Get("Content-Length"))
+
+	// Files without variants don't vary, and variants can be fetched as they are
+	assert.Empty(t, serve("/plain.txt", "gzip").Header().Get("Vary"))
+	rec := serve("/app.js.gz", "gzip")
+	assert.Equal(t, "gzip bytes", rec.Body.String())
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+
+	// Ranges and conditional requests apply to the compressed bytes
+	rec = serve("/app.js", "gzip", "Range", "bytes=0-3")
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "gzip", rec.Body.String())
+	assert.Equal(t, "bytes 0-3/10", rec.Header().Get("Content-Range"))
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	rec = serve("/app.js", "gzip", "If-Modified-Since", siblingTime.Format(http.TimeFormat))
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	disabled := newTestService(t, root, Options{})
+	req := httptest.NewRequest(http.MethodGet, "/app.js", nil)
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	rec = httptest.NewRecorder()
+	disabled.ServeHTTP(rec, req)
+	assert.Equal(t, "console.log(1)", rec.Body.String())
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+}
+
+func TestPrecompressedArchive(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, createTestZipFile(filepath.Join(root, "bundle.zip"), map[string]string{
+		"app.wasm":        "\x00asm wasm module",
+		"app.wasm.br":     "brotli wasm",
+		"app.wasm.gz":     "gzip wasm",
+		"index.html":      "<html>bundle</html>",
+		"index.html.gz":   "gzip bundle",
+		"README":          "plain text readme",
+		"README.br":       "brotli readme",
+		"orphan.js.br":    "brotli orphan",
+		"plain/style.css": "body{}",
+	}))
+	s := newTestService(t, root, Options{Precompressed: true})
+
+	serve := func(s http.Handler, target, acceptEncoding string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, tc := range []struct {
+		target, acceptEncoding, body, encoding, contentType string
+	}{
+		{"/bundle/app.wasm", "gzip, br", "brotli wasm", "br", "application/wasm"},
+		{"/bundle/app.wasm", "br;q=0.5, gzip", "gzip wasm", "gzip", "application/wasm"},
+		{"/bundle/app.wasm", "identity", "\x00asm wasm module", "", "application/wasm"},
+		{"/bundle/", "gzip", "gzip bundle", "gzip", "text/html; charset=utf-8"},
+		{"/bundle/README", "br", "brotli readme", "br", "text/plain; charset=utf-8"},
+	} {
+		rec := serve(s, tc.target, tc.acceptEncoding)
+		name := tc.target + " " + tc.acceptEncoding
+		assert.Equal(t, http.StatusOK, rec.Code, name)
+		assert.Equal(t, tc.body, rec.Body.String(), name)
+		assert.Equal(t, tc.encoding, rec.Header().Get("Content-Encoding"), name)
+		assert.Equal(t, tc.contentType, rec.Header().Get("Content-Type"), name)
+		assert.Equal(t, []string{"Accept-Encoding"}, rec.Header().Values("Vary"), name)
+		assert.Equal(t, strconv.Itoa(len(tc.body)), rec.Header().Get("Content-Length"), name)
+	}
+
+	// The variants have ETags of their own, and ranges apply to their bytes
+	plain, compressed := serve(s, "/bundle/app.wasm", ""), serve(s, "/bundle/app.wasm", "br")
+	assert.NotEmpty(t, compressed.Header().Get("ETag"))
+	assert.NotEqual(t, plain.Header().Get("ETag"), compressed.Header().Get("ETag"))
+	rec := serve(s, "/bundle/app.wasm", "br", "Range", "bytes=0-5")
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "brotli", rec.Body.String())
+	assert.Equal(t, "br", rec.Header().Get("Content-Encoding"))
+	rec = serve(s, "/bundle/app.wasm", "br", "If-None-Match", compressed.Header().Get("ETag"))
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	// Variants can be fetched as they are, but don't stand in for missing entries
+	rec = serve(s, "/bundle/app.wasm.br", "br")
+	assert.Equal(t, "brotli wasm", rec.Body.String())
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, http.StatusNotFound, serve(s, "/bundle/orphan.js", "br").Code)
+	rec = serve(s, "/bundle/plain/style.css", "br")
+	assert.Equal(t, "body{}", rec.Body.String())
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+
+	disabled := newTestService(t, root, Options{})
+	rec = serve(disabled, "/bundle/app.wasm", "br")
+	assert.Equal(t, "\x00asm wasm module", rec.Body.String())
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+}
+
+func TestArchiveGzip(t *testing.T) {
+	root := t.TempDir()
+	script := strings.Repeat("console.log(1);\n", 200)
+	require.NoError(t, createTestZipFile(filepath.Join(root, "site.zip"), map[string]string{
+		"app.js": script,
+		"README": "no extension",
+	}))
+	s := newTestService(t, root, Options{})
+
+	serve := func(method, target string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(http.MethodGet, "/site/app.js", "Accept-Encoding", "gzip, br")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+	assert.Equal(t, "text/javascript; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Equal(t, strconv.Itoa(rec.Body.Len()), rec.Header().Get("Content-Length"))
+	assert.Less(t, rec.Body.Len(), len(script))
+	gz, err := gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+	data, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, script, string(data))
+
+	head := serve(http.MethodHead, "/site/app.js", "Accept-Encoding", "gzip")
+	assert.Equal(t, "gzip", head.Header().Get("Content-Encoding"))
+	assert.Equal(t, rec.Header().Get("Content-Length"), head.Header().Get("Content-Length"))
+	assert.Empty(t, head.Body.String())
+
+	// Everything else gets the decompressed bytes
+	for _, header := range [][]string{
+		nil,
+		{"Accept-Encoding", "gzip;q=0, br"},
+	} {
+		rec := serve(http.MethodGet, "/site/app.js", header...)
+		assert.Equal(t, script, rec.Body.String(), header)
+		assert.Empty(t, rec.Header().Get("Content-Encoding"), header)
+		assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"), header)
+	}
+	// The gzip stream has validators of its own, which browsers revalidate with
+	etag, lastModified := rec.Header().Get("ETag"), rec.Header().Get("Last-Modified")
+	assert.Regexp(t, `^"[0-9a-f]{8}-[0-9a-f]+-gz"$`, etag)
+	assert.NotEqual(t, serve(http.MethodGet, "/site/app.js").Header().Get("ETag"), etag)
+	require.NotEmpty(t, lastModified)
+	for _, header := range [][]string{
+		{"If-None-Match", etag},
+		{"If-None-Match", `"other", W/` + etag},
+		{"If-Modified-Since", lastModified},
+	} {
+		rec := serve(http.MethodGet, "/site/app.js", append([]string{"Accept-Encoding", "gzip"}, header...)...)
+		assert.Equal(t, http.StatusNotModified, rec.Code, header)
+		assert.Equal(t, etag, rec.Header().Get("ETag"), header)
+		assert.Empty(t, rec.Body.String(), header)
+	}
+	rec = serve(http.MethodGet, "/site/app.js", "Accept-Encoding", "gzip", "If-None-Match", `"other"`, "If-Modified-Since", lastModified)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	// Other preconditions are evaluated for the decompressed entry
+	rec = serve(http.MethodGet, "/site/app.js", "Accept-Encoding", "gzip", "If-Match", `"other"`)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+
+	// Ranges apply to the decompressed entry
+	rec = serve(http.MethodGet, "/site/app.js", "Accept-Encoding", "gzip", "Range", "bytes=0-3")
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "cons", rec.Body.String())
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+
+	rec = serve(http.MethodGet, "/site/README", "Accept-Encoding", "gzip")
+	assert.Equal(t, "no extension", rec.Body.String())
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+}
+
+func TestHiddenArchiveEntries(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, createTestZipFile(filepath.Join(root, "bundle.zip"), map[string]string{
+		".env":            "SECRET",
+		"dir/.git/config": "config",
+		"dir/page.html":   "page",
+	}))
+
+	// Hidden entries are refused like hidden files, as in an archive served as the tree
+	s := newTestService(t, root, Options{})
+	for _, target := range []string{"/bundle/.env", "/bundle/dir/.git/config", "/bundle/dir/.git/"} {
+		assert.Equal(t, http.StatusNotFound, get(s, target).Code, target)
+	}
+	assert.Equal(t, "page", get(s, "/bundle/dir/page.html").Body.String())
+
+	s = newTestService(t, root, Options{ExposeHiddenFiles: true})
+	assert.Equal(t, "SECRET", get(s, "/bundle/.env").Body.String())
+	assert.Equal(t, "config", get(s, "/bundle/dir/.git/config").Body.String())
+}
+
+func TestArchiveIfRange(t *testing.T) {
+	root := t.TempDir()
+	zipPath := filepath.Join(root, "dist.zip")
+	writeArchive := func(content string, modified time.Time) {
+		var buf bytes.Buffer
+		zipWriter := zip.NewWriter(&buf)
+		w, err := zipWriter.CreateHeader(&zip.FileHeader{Name: "release.bin", Method: zip.Deflate, Modified: modified})
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+		require.NoError(t, zipWriter.Close())
+		require.NoError(t, os.WriteFile(zipPath, buf.Bytes(), 0o644))
+	}
+	built := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	writeArchive("release one, first build", built)
+	s := newTestService(t, root, Options{})
+	request := func(target string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+	resume := func(ifRange string) *httptest.ResponseRecorder {
+		return request("/dist/release.bin", "Range", "bytes=8-", "If-Range", ifRange)
+	}
+
+	rec := get(s, "/dist/release.bin")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "bytes", rec.Header().Get("Accept-Ranges"))
+	etag, lastModified := rec.Header().Get("ETag"), rec.Header().Get("Last-Modified")
+	require.NotEmpty(t, etag)
+	assert.Equal(t, built.Format(http.TimeFormat), lastModified)
+
+	// Unchanged, the download resumes with either validator
+	for _, validator := range []string{etag, lastModified} {
+		rec = resume(validator)
+		assert.Equal(t, http.StatusPartialContent, rec.Code, validator)
+		assert.Equal(t, "one, first build", rec.Body.String(), validator)
+	}
+	assert.Equal(t, http.StatusNotModified, request("/dist/release.bin", "If-None-Match", etag).Code)
+
+	// Replaced and reindexed, the range would splice two builds, so the whole entry is sent
+	writeArchive("release one, second build", built.Add(time.Hour))
+	_, err := s.zipReader.Reindex(context.Background(), zipPath)
+	require.NoError(t, err)
+	for _, validator := range []string{etag, lastModified, "W/" + etag} {
+		rec = resume(validator)
+		assert.Equal(t, http.StatusOK, rec.Code, validator)
+		assert.Equal(t, "release one, second build", rec.Body.String(), validator)
+	}
+	assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+	rec = resume(rec.Header().Get("ETag"))
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "one, second build", rec.Body.String())
+
+	// http.ServeContent does the same for files on disk
+	writeTestFiles(t, root, map[string]string{"plain.bin": "plain file content"})
+	rec = request("/plain.bin", "Range", "bytes=6-", "If-Range", get(s, "/plain.bin").Header().Get("Last-Modified"))
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "file content", rec.Body.String())
+	rec = request("/plain.bin", "Range", "bytes=6-", "If-Range", time.Now().Add(-24*time.Hour).Format(http.TimeFormat))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "plain file content", rec.Body.String())
+}
+
+func TestDownload(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"reports/summary.html": "<html>summary</html>"})
+	require.NoError(t, createTestZipFile(filepath.Join(root, "reports", "2026.zip"), map[string]string{
+		"q3/résumé 2026.pdf": "pdf",
+		"q3/report.html":     "<html>q3</html>",
+	}))
+	s := newTestService(t, root, Options{CreateIndexes: true})
+
+	for _, tc := range []struct{ target, disposition string }{
+		{"/reports/summary.html?download", `attachment; filename="summary.html"`},
+		{"/reports/summary.html?download=", `attachment; filename="summary.html"`},
+		{"/reports/summary.html?download=Q3%20summary.html", `attachment; filename="Q3 summary.html"`},
+		{"/reports/2026/q3/report.html?download", `attachment; filename="report.html"`},
+		{"/reports/2026/q3/r%C3%A9sum%C3%A9%202026.pdf?download", `attachment; filename="r_sum_ 2026.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9%202026.pdf`},
+		{"/reports/2026.zip?download", `attachment; filename="2026.zip"`},
+		// Overrides can't name another directory or smuggle header syntax
+		{"/reports/summary.html?download=../../etc/passwd", `attachment; filename="passwd"`},
+		{"/reports/summary.html?download=..%5C..%5Cboot.ini", `attachment; filename="boot.ini"`},
+		{"/reports/summary.html?download=..", `attachment; filename="summary.html"`},
+		{"/reports/summary.html?download=a%22%3B%0D%0AX-Injected:%201.html", `attachment; filename="a\";X-Injected: 1.html"`},
+		{"/reports/summary.html?download=%E2%82%AC.html", `attachment; filename="_.html"; filename*=UTF-8''%E2%82%AC.html`},
+	} {
+		rec := get(s, tc.target)
+		assert.Equal(t, http.StatusOK, rec.Code, tc.target)
+		assert.Equal(t, tc.disposition, rec.Header().Get("Content-Disposition"), tc.target)
+	}
+
+	// Plain requests are displayed, and errors aren't attachments
+	assert.Empty(t, get(s, "/reports/summary.html").Header().Get("Content-Disposition"))
+	rec := get(s, "/reports/2026/q3/missing.html?download")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Empty(t, rec.Header().Get("Content-Disposition"))
+
+	// Listings link to the download of every file
+	body := get(s, "/reports/2026/q3/").Body.String()
+	assert.Contains(t, body, `(<a href="report.html?download">download</a>)`)
+	assert.Contains(t, body, `(<a href="r%C3%A9sum%C3%A9%202026.pdf?download">download</a>)`)
+}
+
+func TestNoArchiveDownload(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, createTestZipFile(filepath.Join(root, "docs.zip"), map[string]string{"index.html": "<html>docs</html>"}))
+	require.NoError(t, createTestZipFile(filepath.Join(root, "BUILD.ZIP"), map[string]string{"meta.txt": "secret"}))
+	writeTestFiles(t, root, map[string]string{"notes.txt": "notes"})
+	archive, err := os.ReadFile(filepath.Join(root, "docs.zip"))
+	require.NoError(t, err)
+
+	s := newTestService(t, root, Options{CreateIndexes: true, NoArchiveDownload: true})
+	for _, target := range []string{"/docs.zip", "/docs.zip?download", "/BUILD.ZIP", "/BUILD.ZIP?download", "/docs.zip/"} {
+		rec := get(s, target)
+		assert.Equal(t, http.StatusNotFound, rec.Code, target)
+		assert.NotContains(t, rec.Body.String(), "PK", target)
+	}
+	rec := get(s, "/docs/index.html")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "<html>docs</html>", rec.Body.String())
+	assert.Equal(t, "<html>docs</html>", get(s, "/docs/").Body.String())
+
+	body := get(s, "/").Body.String()
+	assert.Contains(t, body, `<a href="docs/">docs.zip</a>`)
+	assert.NotContains(t, body, `href="docs.zip"`)
+	assert.NotContains(t, body, `BUILD.ZIP?download`)
+	assert.Contains(t, body, `(<a href="notes.txt?download">download</a>)`)
+
+	// Archives are served as they are by default
+	s = newTestService(t, root, Options{CreateIndexes: true})
+	assert.Equal(t, archive, get(s, "/docs.zip").Body.Bytes())
+	assert.Contains(t, get(s, "/").Body.String(), `(<a href="docs.zip">download</a>)`)
+}
+
+func TestWithRoot(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"a/hello.txt": "hello a", "b/hello.txt": "hello b", "b/.hidden": "hidden"})
+	require.NoError(t, createTestZipFile(filepath.Join(root, "b", "site.zip"), map[string]string{"index.html": "site b"}))
+	s := newTestService(t, filepath.Join(root, "a"), Options{})
+
+	other, err := s.WithRoot(filepath.Join(root, "b"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello b", get(other, "/hello.txt").Body.String())
+	assert.Equal(t, "site b", get(other, "/site/").Body.String())
+	assert.Equal(t, http.StatusNotFound, get(other, "/.hidden").Code)
+	assert.Equal(t, "hello a", get(s, "/hello.txt").Body.String())
+
+	_, err = s.WithRoot(filepath.Join(root, "missing"))
+	assert.Error(t, err)
+	_, err = s.WithRoot(filepath.Join(root, "a", "hello.txt"))
+	assert.Error(t, err)
+}
+
+// symlinkFixture lays out a service directory with symbolic links pointing inside it, out
+// of it and nowhere, next to the directory they escape to.
+func symlinkFixture(t *testing.T) string {
+	t.Helper()
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	writeTestFiles(t, root, map[string]string{"docs/page.txt": "page", "idx/.keep": ""})
+	writeTestFiles(t, filepath.Join(base, "outside"), map[string]string{"secret.txt": "secret"})
+	require.NoError(t, createTestZipFile(filepath.Join(root, "site.zip"), map[string]string{"index.html": "site"}))
+	require.NoError(t, createTestZipFile(filepath.Join(base, "outside", "archive.zip"), map[string]string{"index.html": "outside site"}))
+	for link, target := range map[string]string{
+		"inner":          "docs",
+		"page-link.txt":  "docs/page.txt",
+		"site-link.zip":  "site.zip",
+		"shared":         "../outside",
+		"secret.txt":     "../outside/secret.txt",
+		"ext.zip":        "../outside/archive.zip",
+		"via":            "shared",
+		"dangling":       "missing",
+		"idx/index.html": "../../outside/secret.txt",
+	} {
+		require.NoError(t, os.Symlink(target, filepath.Join(root, link)))
+	}
+	return root
+}
+
+func TestSymlinkPolicy(t *testing.T) {
+	root := symlinkFixture(t)
+	for _, tc := range []struct {
+		target              string
+		all, internal, deny int
+		body                string
+	}{
+		{target: "/docs/page.txt", all: 200, internal: 200, deny: 200, body: "page"},
+		{target: "/inner/page.txt", all: 200, internal: 200, deny: 404, body: "page"},
+		{target: "/page-link.txt", all: 200, internal: 200, deny: 404, body: "page"},
+		{target: "/site-link/", all: 200, internal: 200, deny: 404, body: "site"},
+		{target: "/shared/secret.txt", all: 200, internal: 404, deny: 404, body: "secret"},
+		{target: "/secret.txt", all: 200, internal: 404, deny: 404, body: "secret"},
+		{target: "/ext/", all: 200, internal: 404, deny: 404, body: "outside site"},
+		// An in-root link to a link leaving the root is resolved all the way
+		{target: "/via/secret.txt", all: 200, internal: 404, deny: 404, body: "secret"},
+		{target: "/idx/", all: 200, internal: 404, deny: 404, body: "secret"},
+		{target: "/dangling", all: 404, internal: 404, deny: 404},
+	} {
+		for policy, want := range map[SymlinkPolicy]int{SymlinksAll: tc.all, SymlinksInternal: tc.internal, SymlinksDeny: tc.deny} {
+			rec := get(newTestService(t, root, Options{Symlinks: policy}), tc.target)
+			assert.Equal(t, want, rec.Code, "%s with %s", tc.target, policy)
+			if want == http.StatusOK {
+				assert.Equal(t, tc.body, rec.Body.String(), "%s with %s", tc.target, policy)
+			}
+		}
+	}
+
+	// The service directory may itself be reached through a link
+	linkedRoot := filepath.Join(t.TempDir(), "current")
+	require.NoError(t, os.Symlink(root, linkedRoot))
+	s := newTestService(t, linkedRoot, Options{Symlinks: SymlinksInternal})
+	assert.Equal(t, "page", get(s, "/inner/page.txt").Body.String())
+	assert.Equal(t, http.StatusNotFound, get(s, "/secret.txt").Code)
+	s = newTestService(t, linkedRoot, Options{Symlinks: SymlinksDeny})
+	assert.Equal(t, "page", get(s, "/docs/page.txt").Body.String())
+
+	_, err := newTestService(t, root, Options{Symlinks: SymlinksInternal}).ArchiveFS("ext.zip")
+	assert.ErrorIs(t, err, fs.ErrInvalid)
+	_, err = newTestService(t, root, Options{Symlinks: SymlinksInternal}).ArchiveFS("site-link.zip")
+	assert.NoError(t, err)
+}
+
+func TestSymlinkListing(t *testing.T) {
+	root := symlinkFixture(t)
+	listing := func(policy SymlinkPolicy) map[string]string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		newTestService(t, root, Options{CreateIndexes: true, Symlinks: policy}).ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var index struct {
+			Entries []struct {
+				Name    string
+				Type    string
+				Symlink bool
+			}
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &index))
+		entries := make(map[string]string)
+		for _, entry := range index.Entries {
+			entries[entry.Name] = entry.Type
+			if entry.Symlink {
+				entries[entry.Name] += " symlink"
+			}
+		}
+		return entries
+	}
+
+	// Links are listed as what they point to, and dangling ones not at all
+	assert.Equal(t, map[string]string{
+		"docs": "dir", "idx": "dir", "site.zip": "archive",
+		"inner": "dir symlink", "page-link.txt": "file symlink", "site-link.zip": "archive symlink",
+		"shared": "dir symlink", "secret.txt": "file symlink", "ext.zip": "archive symlink", "via": "dir symlink",
+	}, listing(SymlinksAll))
+	assert.Equal(t, map[string]string{
+		"docs": "dir", "idx": "dir", "site.zip": "archive",
+		"inner": "dir symlink", "page-link.txt": "file symlink", "site-link.zip": "archive symlink",
+	}, listing(SymlinksInternal))
+	assert.Equal(t, map[string]string{"docs": "dir", "idx": "dir", "site.zip": "archive"}, listing(SymlinksDeny))
+
+	rec := get(newTestService(t, root, Options{CreateIndexes: true}), "/")
+	assert.Contains(t, rec.Body.String(), `<a href="inner/">inner/</a> (symlink)`)
+}
+
+func TestParseSymlinkPolicy(t *testing.T) {
+	for _, policy := range []SymlinkPolicy{SymlinksAll, SymlinksInternal, SymlinksDeny} {
+		parsed, err := ParseSymlinkPolicy(policy.String())
+		require.NoError(t, err)
+		assert.Equal(t, policy, parsed)
+	}
+	_, err := ParseSymlinkPolicy("some")
+	assert.Error(t, err)
+}
+
+func TestIgnore(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		".cmpserveignore":               "# generated\n/private/**\n",
+		"app.js":                        "app",
+		"app.js.map":                    "map",
+		"private/keys.txt":              "keys",
+		"docs/private/page.txt":         "public page",
+		"web/node_modules/lib/index.js": "lib",
+		"web/index.js":                  "web",
+		"build/out.txt":                 "out",
+		"notes/build":                   "a file named build",
+	})
+	require.NoError(t, createTestZipFile(filepath.Join(root, "site.zip"), map[string]string{
+		"index.html":                "site",
+		"static/app.js":             "site app",
+		"static/app.js.map":         "site map",
+		"node_modules/pkg/index.js": "pkg",
+		"private/in-archive.txt":    "archived page",
+	}))
+	require.NoError(t, createTestZipFile(filepath.Join(root, "secret.zip"), map[string]string{"index.html": "secret"}))
+	s := newTestService(t, root, Options{CreateIndexes: true, ExposeHiddenFiles: true, Ignore: []string{"*.map", "**/node_modules/**", "build/", "/secret.zip"}})
+
+	for target, body := range map[string]string{
+		"/app.js":                      "app",
+		"/docs/private/page.txt":       "public page",
+		"/web/index.js":                "web",
+		"/notes/build":                 "a file named build",
+		"/site/static/app.js":          "site app",
+		"/site/private/in-archive.txt": "archived page",
+	} {
+		rec := get(s, target)
+		assert.Equal(t, http.StatusOK, rec.Code, target)
+		assert.Equal(t, body, rec.Body.String(), target)
+	}
+	for _, target := range []string{
+		"/.cmpserveignore",
+		"/app.js.map",
+		"/private/keys.txt",
+		"/private/",
+		"/private",
+		"/web/node_modules/lib/index.js",
+		"/web/node_modules/",
+		"/build/out.txt",
+		"/build",
+		"/secret/",
+		"/secret",
+		"/secret.zip",
+		"/site/static/app.js.map",
+		"/site/node_modules/pkg/index.js",
+		"/site/node_modules/",
+	} {
+		assert.Equal(t, http.StatusNotFound, get(s, target).Code, target)
+	}
+
+	listing := func(target string) []string {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code, target)
+		var index struct{ Entries []struct{ Name string } }
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &index))
+		var names []string
+		for _, entry := range index.Entries {
+			names = append(names, entry.Name)
+		}
+		return names
+	}
+	assert.Equal(t, []string{"docs", "notes", "web", "app.js", "site.zip"}, listing("/"))
+	assert.Equal(t, []string{"index.js"}, listing("/web/"))
+	assert.Equal(t, []string{"app.js"}, listing("/site/static/"))
+
+	rec := get(s, "/site/?list=json")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var contents []struct{ Name string }
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &contents))
+	var names []string
+	for _, entry := range contents {
+		names = append(names, entry.Name)
+	}
+	assert.ElementsMatch(t, []string{"index.html", "static/app.js", "private/in-archive.txt"}, names)
+
+	// Each root of a service has its own ignore file
+	other := t.TempDir()
+	writeTestFiles(t, other, map[string]string{".cmpserveignore": "*.txt\n", "a.txt": "a", "private/keys.txt": "keys", "app.js.map": "map", "b.html": "b"})
+	otherService, err := s.WithRoot(other)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, get(otherService, "/a.txt").Code)
+	assert.Equal(t, http.StatusNotFound, get(otherService, "/app.js.map").Code)
+	assert.Equal(t, http.StatusOK, get(otherService, "/b.html").Code)
+	assert.Equal(t, http.StatusOK, get(s, "/app.js").Code)
+
+	_, err = NewService(root, t.TempDir(), Options{Ignore: []string{"[x"}})
+	assert.Error(t, err)
+	writeTestFiles(t, other, map[string]string{".cmpserveignore": "!keep.txt\n"})
+	_, err = NewService(other, t.TempDir(), Options{})
+	assert.ErrorContains(t, err, ".cmpserveignore:1:")
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"docs/README.md":   "upper",
+		"docs/readme.md":   "lower",
+		"docs/Guide.txt":   "guide",
+		"Photos/cat.JPG":   "cat",
+		"Private/keys.txt": "keys",
+		"app.js":           "exact app",
+		"App.js":           "folded app",
+	})
+	require.NoError(t, createTestZipFile(filepath.Join(root, "Site.ZIP"), map[string]string{
+		"Index.html":     "site",
+		"Docs/Guide.txt": "archived guide",
+		"NOTES.md":       "upper notes",
+		"notes.md":       "lower notes",
+	}))
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	s := newTestService(t, root, Options{CaseInsensitive: true, Ignore: []string{"/private/**"}, Logger: logger})
+
+	for target, body := range map[string]string{
+		"/docs/README.md":      "upper",
+		"/docs/readme.md":      "lower",
+		"/DOCS/guide.TXT":      "guide",
+		"/photos/CAT.jpg":      "cat",
+		"/app.js":              "exact app",
+		"/App.js":              "folded app",
+		"/site/index.html":     "site",
+		"/SITE/docs/GUIDE.txt": "archived guide",
+		"/site/notes.md":       "lower notes",
+		"/site/NOTES.md":       "upper notes",
+		"/Site/Docs/Guide.txt": "archived guide",
+	} {
+		rec := get(s, target)
+		assert.Equal(t, http.StatusOK, rec.Code, target)
+		assert.Equal(t, body, rec.Body.String(), target)
+	}
+	// Redirects keep the requested case
+	assert.Equal(t, "/SITE/", get(s, "/SITE").Header().Get("Location"))
+	assert.Equal(t, "/site/docs/", get(s, "/site/docs").Header().Get("Location"))
+
+	// Several names matching once case is ignored resolve to none
+	for _, target := range []string{"/docs/Readme.md", "/site/Notes.md", "/private/keys.txt", "/PRIVATE/keys.txt", "/docs/missing.md"} {
+		assert.Equal(t, http.StatusNotFound, get(s, target).Code, target)
+	}
+	assert.Contains(t, logs.String(), `"msg":"Ambiguous case-insensitive path","path":"docs/Readme.md"`)
+	assert.Contains(t, logs.String(), `"msg":"Ambiguous case-insensitive path","path":"site/Notes.md"`)
+
+	// Without the option, paths only resolve as requested
+	s = newTestService(t, root, Options{})
+	assert.Equal(t, http.StatusNotFound, get(s, "/DOCS/guide.txt").Code)
+	assert.Equal(t, http.StatusNotFound, get(s, "/site/index.html").Code)
+}
+
+func TestNoRobots(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"plain.txt":       "plain",
+		"docs/robots.txt": "not at the root",
+		"own/robots.txt":  "User-agent: *\nAllow: /\n",
+	})
+	require.NoError(t, createTestZipFile(filepath.Join(root, "site.zip"), map[string]string{"assets/js/deep/app.js": "js"}))
+
+	s := newTestService(t, root, Options{NoRobots: true, CreateIndexes: true, BasePath: "/files"})
+	rec := get(s, "/files/robots.txt")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "User-agent: *\nDisallow: /\n", rec.Body.String())
+	assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+
+	// Every response carries the header, archive entries, listings and errors included
+	for target, status := range map[string]int{
+		"/files/site/assets/js/deep/app.js": http.StatusOK,
+		"/files/":                           http.StatusOK,
+		"/files/site/assets/":               http.StatusOK,
+		"/files/plain.txt":                  http.StatusOK,
+		"/files/missing.txt":                http.StatusNotFound,
+		"/files/docs/robots.txt":            http.StatusOK,
+	} {
+		rec := get(s, target)
+		assert.Equal(t, status, rec.Code, target)
+		assert.Equal(t, "noindex, nofollow", rec.Header().Get("X-Robots-Tag"), target)
+	}
+	assert.Equal(t, "not at the root", get(s, "/files/docs/robots.txt").Body.String())
+
+	// A robots.txt of the root is served instead, in each root
+	own, err := s.WithRoot(filepath.Join(root, "own"))
+	require.NoError(t, err)
+	rec = get(own, "/files/robots.txt")
+	assert.Equal(t, "User-agent: *\nAllow: /\n", rec.Body.String())
+	assert.Equal(t, "noindex, nofollow", rec.Header().Get("X-Robots-Tag"))
+
+	s = newTestService(t, root, Options{})
+	assert.Equal(t, http.StatusNotFound, get(s, "/robots.txt").Code)
+	assert.Empty(t, get(s, "/plain.txt").Header().Get("X-Robots-Tag"))
+}
+
+func TestArchiveLimits(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, createTestZipFile(filepath.Join(root, "site.zip"), map[string]string{"index.html": "home", "big.bin": "too big to serve"}))
+	require.NoError(t, createTestZipFile(filepath.Join(root, "many.zip"), map[string]string{"a.txt": "a", "b.txt": "b", "c.txt": "c", "d.txt": "d"}))
+	s := newTestService(t, root, Options{ArchiveLimits: zipfast.Limits{MaxEntries: 3, MaxEntrySize: 8}})
+
+	// Entries beyond the limits are left out, and archives beyond them rejected
+	assert.Equal(t, "home", get(s, "/site/").Body.String())
+	assert.Equal(t, http.StatusNotFound, get(s, "/site/big.bin").Code)
+	for range 2 {
+		assert.Equal(t, http.StatusNotFound, get(s, "/many/a.txt").Code)
+	}
+	_, err := s.ReindexArchive(context.Background(), "many.zip")
+	assert.ErrorIs(t, err, zipfast.ErrRejected)
+}
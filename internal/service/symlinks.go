@@ -0,0 +1,87 @@
+package service
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SymlinkPolicy decides which symbolic links under the service directory are followed.
+type SymlinkPolicy int
+
+const (
+	// SymlinksAll follows every symbolic link, wherever it points.
+	SymlinksAll SymlinkPolicy = iota
+	// SymlinksInternal follows symbolic links whose fully resolved target stays under the
+	// service directory.
+	SymlinksInternal
+	// SymlinksDeny follows no symbolic links at all.
+	SymlinksDeny
+)
+
+// ParseSymlinkPolicy parses a policy name: all, internal or deny.
+func ParseSymlinkPolicy(name string) (SymlinkPolicy, error) {
+	switch name {
+	case "all":
+		return SymlinksAll, nil
+	case "internal":
+		return SymlinksInternal, nil
+	case "deny":
+		return SymlinksDeny, nil
+	default:
+		return 0, fmt.Errorf("invalid symlink policy %q, use all, internal or deny", name)
+	}
+}
+
+func (p SymlinkPolicy) String() string {
+	switch p {
+	case SymlinksAll:
+		return "all"
+	case SymlinksInternal:
+		return "internal"
+	case SymlinksDeny:
+		return "deny"
+	default:
+		return fmt.Sprintf("SymlinkPolicy(%d)", int(p))
+	}
+}
+
+// symlinkAllowed reports whether the policy lets target be opened, given that its parent
+// directory was already checked. Paths that aren't symbolic links, including missing ones,
+// are always allowed; opening them reports whether they exist. Dangling links aren't
+// allowed under the internal policy, and resolve to nothing under the others.
+func (s *Service) symlinkAllowed(target string) bool {
+	if s.symlinks == SymlinksAll {
+		return true
+	}
+	info, err := os.Lstat(target)
+	if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		return true
+	}
+	if s.symlinks == SymlinksInternal {
+		resolved, err := filepath.EvalSymlinks(target)
+		if err == nil && withinDir(s.resolvedRoot, resolved) {
+			return true
+		}
+	}
+	s.logger.Debug("Symbolic link not followed", "path", target, "policy", s.symlinks)
+	return false
+}
+
+// pathAllowed checks the symlink policy for every segment of the slash-separated path
+// name, relative to the service directory.
+func (s *Service) pathAllowed(name string) bool {
+	if s.symlinks == SymlinksAll {
+		return true
+	}
+	current := s.rootServiceDir
+	for _, part := range strings.Split(name, "/") {
+		current = filepath.Join(current, part)
+		if !s.symlinkAllowed(current) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,338 @@
+package service
+
+import (
+	"cmpserve/internal/metrics"
+	"cmpserve/internal/readers/zipfast"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	methodPropfind = "PROPFIND"
+	// maxPropfindBody bounds the PROPFIND request bodies read.
+	maxPropfindBody = 64 << 10
+)
+
+// davWriteMethods are the WebDAV and HTTP methods modifying resources, refused with 403
+// as the tree is read-only.
+var davWriteMethods = map[string]bool{
+	http.MethodPut: true, http.MethodDelete: true, "MKCOL": true, "COPY": true, "MOVE": true,
+	"PROPPATCH": true, "LOCK": true, "UNLOCK": true,
+}
+
+// davProperties are the live properties of resources, in the order they are reported.
+var davProperties = []string{"resourcetype", "getcontentlength", "getlastmodified", "getcontenttype"}
+
+// allow returns the methods advertised in the Allow header.
+func (s *Service) allow() string {
+	if s.webdav {
+		return allowedMethods + ", PROPFIND"
+	}
+	return allowedMethods
+}
+
+// davResource is a file or collection reported by PROPFIND.
+type davResource struct {
+	// href is the escaped absolute path of the resource, slash-terminated for collections.
+	href        string
+	collection  bool
+	size        int64
+	modTime     time.Time
+	contentType string
+}
+
+// property returns the XML value of a live property, and whether the resource has it.
+func (res davResource) property(name string) (string, bool) {
+	switch name {
+	case "resourcetype":
+		if res.collection {
+			return "<D:collection/>", true
+		}
+		return "", true
+	case "getcontentlength":
+		return strconv.FormatInt(res.size, 10), !res.collection
+	case "getlastmodified":
+		return res.modTime.UTC().Format(http.TimeFormat), !res.modTime.IsZero()
+	case "getcontenttype":
+		return xmlEscape(res.contentType), !res.collection
+	}
+	return "", false
+}
+
+// davFile describes a file named name for PROPFIND.
+func davFile(href, name string, size int64, modTime time.Time) davResource {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return davResource{href: href, size: size, modTime: modTime, contentType: contentType}
+}
+
+// propfindRequest is the body of a PROPFIND request. Without prop nor propname, which an
+// empty body lacks as well, all properties are requested.
+type propfindRequest struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	PropName *struct{} `xml:"DAV: propname"`
+	Prop     *struct {
+		Names []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+// propfind answers a PROPFIND request for the resolved target with a multistatus listing
+// its properties and, with "Depth: 1", those of its members. Archives are collections, as
+// are directories inside them. Infinite depth is refused, as RFC 4918 allows.
+func (s *Service) propfind(w http.ResponseWriter, r *http.Request, t target) {
+	depth := r.Header.Get("Depth")
+	if depth != "0" && depth != "1" {
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = io.WriteString(w, xml.Header+`<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`)
+		return
+	}
+	var request propfindRequest
+	if err := xml.NewDecoder(io.LimitReader(r.Body, maxPropfindBody)).Decode(&request); err != nil && err != io.EOF {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	href := s.basePath + "/" + escapePath(t.urlPath)
+	var resources []davResource
+	var ok bool
+	switch {
+	case t.archivePath != "":
+		metrics.SetSource(r, metrics.SourceArchive)
+		resources, ok = s.archiveResources(w, r, t, href, depth == "1")
+	case t.path == "":
+		s.notFound(w, r, t.lastDir, "")
+		return
+	case t.isDir:
+		resources, ok = s.directoryResources(w, r, t, href, depth == "1")
+	default:
+		stat, err := os.Stat(t.path)
+		if err != nil {
+			s.notFound(w, r, t.lastDir, "")
+			return
+		}
+		resources, ok = []davResource{davFile(href, stat.Name(), stat.Size(), stat.ModTime())}, true
+	}
+	if !ok {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<D:multistatus xmlns:D="DAV:">`)
+	for _, res := range resources {
+		writeDavResponse(&b, res, request)
+	}
+	b.WriteString("</D:multistatus>\n")
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	_, _ = io.WriteString(w, b.String())
+}
+
+// directoryResources describes a directory and, with members, what it contains: its files
+// and directories and, as collections named without their extension, the archives that no
+// directory shadows. Hidden and ignored names are left out, as in listings.
+func (s *Service) directoryResources(w http.ResponseWriter, r *http.Request, t target, href string, members bool) ([]davResource, bool) {
+	href = strings.TrimSuffix(href, "/") + "/"
+	stat, err := os.Stat(t.path)
+	if err != nil {
+		s.notFound(w, r, t.lastDir, "")
+		return nil, false
+	}
+	resources := []davResource{{href: href, collection: true, modTime: stat.ModTime()}}
+	if !members {
+		return resources, true
+	}
+	dirEntries, err := os.ReadDir(t.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrPermission) {
+			s.forbidden(w, r, t.path, err)
+			return nil, false
+		}
+		s.logger.ErrorContext(r.Context(), "Failed to read directory", "path", t.path, "error", err)
+		http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+		return nil, false
+	}
+	entries := s.visibleEntries(t.urlPath, s.filesystemIndexEntries(t.path, dirEntries))
+	sortIndexEntries(entries, "name", false)
+	dirs := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.isDir {
+			dirs[entry.name] = true
+		}
+	}
+	for _, entry := range entries {
+		switch {
+		case entry.isDir:
+			resources = append(resources, davResource{href: href + url.PathEscape(entry.name) + "/", collection: true, modTime: entry.modTime})
+			continue
+		case entry.isArchive:
+			if name := strings.TrimSuffix(entry.name, ".zip"); !dirs[name] {
+				resources = append(resources, davResource{href: href + url.PathEscape(name) + "/", collection: true, modTime: entry.modTime})
+			}
+			if s.noArchiveDownload {
+				continue
+			}
+		}
+		resources = append(resources, davFile(href+url.PathEscape(entry.name), entry.name, entry.size, entry.modTime))
+	}
+	return resources, true
+}
+
+// archiveResources describes an entry of an archive, or a directory inside it along with,
+// with members, its entries. The archive itself is the collection of its root entries.
+func (s *Service) archiveResources(w http.ResponseWriter, r *http.Request, t target, href string, members bool) ([]davResource, bool) {
+	entry := t.entry
+	if s.caseInsensitive {
+		resolved, err := s.foldArchivePath(r.Context(), t.archivePath, entry)
+		if err != nil {
+			if !s.canceled(r, t.archivePath, entry) {
+				s.notFound(w, r, filepath.Dir(t.archivePath), t.archivePath)
+			}
+			return nil, false
+		}
+		entry = resolved
+	}
+	if entry != "" && !strings.HasSuffix(entry, "/") {
+		info, err := s.zipReader.Stat(r.Context(), t.archivePath, entry)
+		if err == nil {
+			return []davResource{davFile(href, info.Name, int64(info.UncompressedSize), info.Modified)}, true
+		}
+		if !errors.Is(err, zipfast.ErrNotFound) {
+			s.archiveError(w, r, t.archivePath, entry, err)
+			return nil, false
+		}
+		// The path may name a directory inside the archive
+		entry += "/"
+	}
+
+	dirEntries, err := s.zipReader.ReadDir(r.Context(), t.archivePath, entry)
+	if err != nil {
+		if errors.Is(err, zipfast.ErrNotFound) {
+			s.notFound(w, r, filepath.Dir(t.archivePath), t.archivePath)
+		} else {
+			s.archiveError(w, r, t.archivePath, entry, err)
+		}
+		return nil, false
+	}
+	href = strings.TrimSuffix(href, "/") + "/"
+	var modTime time.Time
+	if entry == "" {
+		if stat, err := os.Stat(t.archivePath); err == nil {
+			modTime = stat.ModTime()
+		}
+	}
+	resources := []davResource{{href: href, collection: true, modTime: modTime}}
+	if !members {
+		return resources, true
+	}
+	entries := make([]indexEntry, 0, len(dirEntries))
+	for _, e := range dirEntries {
+		entries = append(entries, indexEntry{name: e.Name, isDir: e.IsDir, size: int64(e.Size), modTime: e.Modified})
+	}
+	entries = s.visibleEntries(t.urlPath, entries)
+	sortIndexEntries(entries, "name", false)
+	for _, e := range entries {
+		if e.isDir {
+			resources = append(resources, davResource{href: href + url.PathEscape(e.name) + "/", collection: true})
+		} else {
+			resources = append(resources, davFile(href+url.PathEscape(e.name), e.name, e.size, e.modTime))
+		}
+	}
+	return resources, true
+}
+
+// archiveError answers a failure reading the index of an archive, unless the request was
+// canceled.
+func (s *Service) archiveError(w http.ResponseWriter, r *http.Request, archivePath, entry string, err error) {
+	if s.canceled(r, archivePath, entry) {
+		return
+	}
+	s.logger.ErrorContext(r.Context(), "Failed to read archive directory", "archive", archivePath, "dir", entry, "error", err)
+	http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+}
+
+// writeDavResponse writes the response element of a resource, with its requested
+// properties, or only their names for propname requests. Properties it lacks, or that
+// aren't known, are reported as not found.
+func writeDavResponse(b *strings.Builder, res davResource, request propfindRequest) {
+	b.WriteString("<D:response><D:href>")
+	b.WriteString(xmlEscape(res.href))
+	b.WriteString("</D:href>")
+
+	var found, missing strings.Builder
+	switch {
+	case request.PropName != nil:
+		for _, name := range davProperties {
+			if _, ok := res.property(name); ok {
+				found.WriteString("<D:" + name + "/>")
+			}
+		}
+	case request.Prop != nil:
+		for _, prop := range request.Prop.Names {
+			var value string
+			ok := false
+			if prop.XMLName.Space == "DAV:" {
+				value, ok = res.property(prop.XMLName.Local)
+			}
+			if !ok {
+				writeEmptyProperty(&missing, prop.XMLName)
+				continue
+			}
+			found.WriteString("<D:" + prop.XMLName.Local + ">" + value + "</D:" + prop.XMLName.Local + ">")
+		}
+	default:
+		for _, name := range davProperties {
+			if value, ok := res.property(name); ok {
+				found.WriteString("<D:" + name + ">" + value + "</D:" + name + ">")
+			}
+		}
+	}
+	if found.Len() > 0 {
+		b.WriteString("<D:propstat><D:prop>" + found.String() + "</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>")
+	}
+	if missing.Len() > 0 {
+		b.WriteString("<D:propstat><D:prop>" + missing.String() + "</D:prop><D:status>HTTP/1.1 404 Not Found</D:status></D:propstat>")
+	}
+	b.WriteString("</D:response>")
+}
+
+// writeEmptyProperty writes an empty element for the property name, in its namespace.
+func writeEmptyProperty(b *strings.Builder, name xml.Name) {
+	if name.Space == "DAV:" {
+		b.WriteString("<D:" + name.Local + "/>")
+		return
+	}
+	b.WriteString("<R:" + name.Local + ` xmlns:R="` + xmlEscape(name.Space) + `"/>`)
+}
+
+// escapePath percent-encodes the segments of a slash-separated path.
+func escapePath(name string) string {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// xmlEscape escapes text for XML character data and attribute values.
+func xmlEscape(text string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(text))
+	return b.String()
+}
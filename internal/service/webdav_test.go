@@ -0,0 +1,244 @@
+package service
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// davProp holds the properties of a propstat element, as a client decodes them.
+type davProp struct {
+	ResourceType *struct {
+		Collection *struct{} `xml:"DAV: collection"`
+	} `xml:"DAV: resourcetype"`
+	ContentLength *string `xml:"DAV: getcontentlength"`
+	LastModified  *string `xml:"DAV: getlastmodified"`
+	ContentType   *string `xml:"DAV: getcontenttype"`
+	Names         []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name `xml:"DAV: multistatus"`
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Prop   davProp `xml:"DAV: prop"`
+			Status string  `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// davFixture is what a client decodes of the response for one resource: its properties
+// found, and the names of those that weren't.
+type davFixture struct {
+	collection bool
+	length     string
+	modified   string
+	typ        string
+	missing    []string
+}
+
+func propfind(t *testing.T, s http.Handler, target, depth, body string) (*httptest.ResponseRecorder, map[string]davFixture) {
+	t.Helper()
+	req := httptest.NewRequest(methodPropfind, target, strings.NewReader(body))
+	if depth != "" {
+		req.Header.Set("Depth", depth)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMultiStatus {
+		return rec, nil
+	}
+	assert.Equal(t, "application/xml; charset=utf-8", rec.Header().Get("Content-Type"))
+	var multistatus davMultistatus
+	require.NoError(t, xml.Unmarshal(rec.Body.Bytes(), &multistatus), rec.Body.String())
+	resources := make(map[string]davFixture)
+	for _, response := range multistatus.Responses {
+		var fixture davFixture
+		for _, propstat := range response.Propstats {
+			prop := propstat.Prop
+			switch propstat.Status {
+			case "HTTP/1.1 200 OK":
+				fixture.collection = prop.ResourceType != nil && prop.ResourceType.Collection != nil
+				for _, value := range []struct {
+					field *string
+					to    *string
+				}{{prop.ContentLength, &fixture.length}, {prop.LastModified, &fixture.modified}, {prop.ContentType, &fixture.typ}} {
+					if value.field != nil {
+						*value.to = *value.field
+					}
+				}
+			case "HTTP/1.1 404 Not Found":
+				for _, name := range prop.Names {
+					fixture.missing = append(fixture.missing, name.XMLName.Space+" "+name.XMLName.Local)
+				}
+				if prop.ContentLength != nil {
+					fixture.missing = append(fixture.missing, "DAV: getcontentlength")
+				}
+			default:
+				t.Errorf("unexpected status %q for %s", propstat.Status, response.Href)
+			}
+		}
+		_, duplicate := resources[response.Href]
+		assert.False(t, duplicate, response.Href)
+		resources[response.Href] = fixture
+	}
+	return rec, resources
+}
+
+func webdavFixture(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"plain.txt":           "plain",
+		"100% & more.txt":     "escaped",
+		"dir with space/a.md": "a",
+		".hidden":             "hidden",
+		"site/index.html":     "real directory",
+	})
+	require.NoError(t, createTestZipFile(filepath.Join(root, "bundle.zip"), map[string]string{
+		"index.html":     "<html>index</html>",
+		"docs/guide.txt": "guide text",
+		".secret":        "hidden entry",
+	}))
+	// Shadowed by the directory of the same name
+	require.NoError(t, createTestZipFile(filepath.Join(root, "site.zip"), map[string]string{"other.txt": "other"}))
+	modified := time.Date(2026, time.March, 4, 5, 6, 7, 0, time.UTC)
+	require.NoError(t, os.Chtimes(filepath.Join(root, "plain.txt"), modified, modified))
+	return root
+}
+
+func TestWebDAVDisabled(t *testing.T) {
+	s := newTestService(t, webdavFixture(t), Options{})
+	rec, _ := propfind(t, s, "/", "1", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "GET, HEAD, OPTIONS", rec.Header().Get("Allow"))
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodOptions, "/", nil))
+	assert.Empty(t, rec.Header().Get("DAV"))
+}
+
+func TestWebDAVMethods(t *testing.T) {
+	s := newTestService(t, webdavFixture(t), Options{WebDAV: true})
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodOptions, "/bundle/", nil))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("DAV"))
+	assert.Equal(t, "GET, HEAD, OPTIONS, PROPFIND", rec.Header().Get("Allow"))
+
+	for _, method := range []string{http.MethodPut, "MKCOL", http.MethodDelete, "MOVE", "COPY", "PROPPATCH", "LOCK"} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(method, "/plain.txt", strings.NewReader("data")))
+		assert.Equal(t, http.StatusForbidden, rec.Code, method)
+	}
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/plain.txt", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "plain", get(s, "/plain.txt").Body.String())
+}
+
+func TestPropfindDirectory(t *testing.T) {
+	s := newTestService(t, webdavFixture(t), Options{WebDAV: true})
+
+	_, resources := propfind(t, s, "/", "1", "")
+	assert.Equal(t, map[string]davFixture{
+		"/":                      {collection: true, modified: resources["/"].modified},
+		"/100%25%20&%20more.txt": {length: "7", modified: resources["/100%25%20&%20more.txt"].modified, typ: "text/plain; charset=utf-8"},
+		"/bundle/":               {collection: true, modified: resources["/bundle/"].modified},
+		"/bundle.zip":            {length: resources["/bundle.zip"].length, modified: resources["/bundle.zip"].modified, typ: "application/zip"},
+		"/dir%20with%20space/":   {collection: true, modified: resources["/dir%20with%20space/"].modified},
+		"/plain.txt":             {length: "5", modified: "Wed, 04 Mar 2026 05:06:07 GMT", typ: "text/plain; charset=utf-8"},
+		"/site/":                 {collection: true, modified: resources["/site/"].modified},
+		"/site.zip":              {length: resources["/site.zip"].length, modified: resources["/site.zip"].modified, typ: "application/zip"},
+	}, resources)
+	_, err := http.ParseTime(resources["/bundle/"].modified)
+	assert.NoError(t, err)
+
+	// The escaped names are those of the XML, before entity decoding
+	rec, _ := propfind(t, s, "/", "1", "")
+	assert.Contains(t, rec.Body.String(), "<D:href>/100%25%20&amp;%20more.txt</D:href>")
+
+	// Directories requested without a trailing slash aren't redirected
+	_, resources = propfind(t, s, "/dir%20with%20space", "0", "")
+	assert.Equal(t, []string{"/dir%20with%20space/"}, keys(resources))
+	_, resources = propfind(t, s, "/dir%20with%20space/", "1", "")
+	assert.Equal(t, []string{"/dir%20with%20space/", "/dir%20with%20space/a.md"}, keys(resources))
+	_, resources = propfind(t, s, "/plain.txt", "1", "")
+	assert.Equal(t, []string{"/plain.txt"}, keys(resources))
+
+	// Archives are left out as files when they can't be downloaded
+	s = newTestService(t, webdavFixture(t), Options{WebDAV: true, NoArchiveDownload: true, Ignore: []string{"/plain.txt"}})
+	_, resources = propfind(t, s, "/", "1", "")
+	assert.Equal(t, []string{"/", "/100%25%20&%20more.txt", "/bundle/", "/dir%20with%20space/", "/site/"}, keys(resources))
+	rec, _ = propfind(t, s, "/plain.txt", "0", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestPropfindArchive(t *testing.T) {
+	s := newTestService(t, webdavFixture(t), Options{WebDAV: true, BasePath: "/files"})
+
+	_, resources := propfind(t, s, "/files/bundle", "1", "")
+	assert.Equal(t, map[string]davFixture{
+		"/files/bundle/":           {collection: true, modified: resources["/files/bundle/"].modified},
+		"/files/bundle/docs/":      {collection: true},
+		"/files/bundle/index.html": {length: "18", modified: resources["/files/bundle/index.html"].modified, typ: "text/html; charset=utf-8"},
+	}, resources)
+	assert.NotEmpty(t, resources["/files/bundle/"].modified)
+
+	_, resources = propfind(t, s, "/files/bundle/docs", "1", "")
+	assert.Equal(t, []string{"/files/bundle/docs/", "/files/bundle/docs/guide.txt"}, keys(resources))
+	_, resources = propfind(t, s, "/files/bundle/docs/guide.txt", "0", "")
+	assert.Equal(t, "10", resources["/files/bundle/docs/guide.txt"].length)
+	assert.False(t, resources["/files/bundle/docs/guide.txt"].collection)
+
+	rec, _ := propfind(t, s, "/files/bundle/missing.txt", "0", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec, _ = propfind(t, s, "/files/missing/", "1", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestPropfindRequests(t *testing.T) {
+	s := newTestService(t, webdavFixture(t), Options{WebDAV: true})
+
+	// Named properties, unknown ones reported as not found
+	_, resources := propfind(t, s, "/bundle/", "1", `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:" xmlns:A="http://apple.com/ns/"><D:prop><D:getcontentlength/><A:quota/><D:resourcetype/></D:prop></D:propfind>`)
+	assert.Equal(t, davFixture{collection: true, missing: []string{"http://apple.com/ns/ quota", "DAV: getcontentlength"}}, resources["/bundle/"])
+	assert.Equal(t, davFixture{length: "18", missing: []string{"http://apple.com/ns/ quota"}}, resources["/bundle/index.html"])
+
+	// Property names only
+	rec, resources := propfind(t, s, "/plain.txt", "0", `<propfind xmlns="DAV:"><propname/></propfind>`)
+	assert.Equal(t, davFixture{length: "", typ: ""}, resources["/plain.txt"])
+	for _, name := range davProperties {
+		assert.Contains(t, rec.Body.String(), "<D:"+name+"/>")
+	}
+
+	rec, _ = propfind(t, s, "/", "", "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<D:propfind-finite-depth/>")
+	rec, _ = propfind(t, s, "/", "infinity", "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec, _ = propfind(t, s, "/", "1", "<propfind")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func keys(resources map[string]davFixture) []string {
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,53 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// NewACMEManager returns a manager obtaining and renewing certificates for domains from
+// Let's Encrypt, caching them in cacheDir. Certificates for any other host are refused.
+func NewACMEManager(domains []string, cacheDir string) (*autocert.Manager, error) {
+	if len(domains) == 0 {
+		return nil, errors.New("no ACME domains given")
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+	}, nil
+}
+
+// NewACME returns the TLS configuration of New with certificates from manager, also
+// answering TLS-ALPN-01 challenges.
+func NewACME(manager *autocert.Manager) *tls.Config {
+	config := New(manager.GetCertificate)
+	config.NextProtos = manager.TLSConfig().NextProtos
+	return config
+}
+
+// ACMEChallengeHandler answers HTTP-01 challenges for manager and redirects every other
+// request to HTTPS on httpsPort.
+func ACMEChallengeHandler(manager *autocert.Manager, httpsPort string) http.Handler {
+	return manager.HTTPHandler(RedirectHandler(httpsPort))
+}
+
+// CheckACMEPorts fails unless HTTPS is served on 443 and HTTP on 80, the only ports
+// certificate authorities validate challenges on, unless acceptNonstandard is set (e.g.
+// when a proxy forwards those ports).
+func CheckACMEPorts(httpsPort, httpPort string, acceptNonstandard bool) error {
+	if acceptNonstandard {
+		return nil
+	}
+	if httpsPort != "443" {
+		return fmt.Errorf("ACME challenges are only validated on port 443, not %s", httpsPort)
+	}
+	if httpPort != "80" {
+		return fmt.Errorf("ACME HTTP challenges are only validated on port 80, not %s", httpPort)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestNewACMEManager(t *testing.T) {
+	_, err := NewACMEManager(nil, t.TempDir())
+	assert.Error(t, err)
+
+	cacheDir := filepath.Join(t.TempDir(), "acme")
+	manager, err := NewACMEManager([]string{"example.com", "www.example.com"}, cacheDir)
+	require.NoError(t, err)
+	assert.Equal(t, autocert.DirCache(cacheDir), manager.Cache)
+	assert.NoError(t, manager.HostPolicy(context.Background(), "www.example.com"))
+	assert.Error(t, manager.HostPolicy(context.Background(), "attacker.example"))
+
+	config := NewACME(manager)
+	assert.Equal(t, uint16(tls.VersionTLS12), config.MinVersion)
+	assert.Contains(t, config.NextProtos, acme.ALPNProto)
+	assert.NotNil(t, config.GetCertificate)
+}
+
+func TestACMEChallengeHandler(t *testing.T) {
+	manager, err := NewACMEManager([]string{"example.com"}, t.TempDir())
+	require.NoError(t, err)
+	handler := ACMEChallengeHandler(manager, "443")
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/docs/?q=1", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+	assert.Equal(t, "https://example.com/docs/?q=1", rec.Header().Get("Location"))
+
+	// Challenge paths are answered by the manager, not redirected
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/.well-known/acme-challenge/token", nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Empty(t, rec.Header().Get("Location"))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestCheckACMEPorts(t *testing.T) {
+	assert.NoError(t, CheckACMEPorts("443", "80", false))
+	assert.Error(t, CheckACMEPorts("8443", "80", false))
+	assert.Error(t, CheckACMEPorts("443", "8080", false))
+	assert.NoError(t, CheckACMEPorts("8443", "8080", true))
+}
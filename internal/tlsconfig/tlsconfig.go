@@ -0,0 +1,127 @@
+// Package tlsconfig provides the TLS settings of the server and keeps its certificate
+// up to date with the files on disk.
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// New returns a TLS configuration accepting TLS 1.2 and later with the Go default cipher
+// suites, which only include AEAD ciphers with forward secrecy.
+func New(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: getCertificate,
+	}
+}
+
+// CertReloader serves a certificate and key pair loaded from disk, re-reading the files
+// when they change so that renewed certificates are picked up without a restart.
+type CertReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewCertReloader loads the pair, failing if the files can't be read or don't match.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload re-reads the pair. On failure the previously loaded certificate stays in use.
+func (c *CertReloader) Reload() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate %s and key %s: %w", c.certFile, c.keyFile, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// GetCertificate returns the current certificate, for use as tls.Config.GetCertificate.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Watch reloads the pair whenever a signal arrives on reload, and every interval if either
+// file has been modified since it was last loaded, until ctx is done.
+func (c *CertReloader) Watch(ctx context.Context, reload <-chan os.Signal, interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+		case <-ticker.C:
+			modTime, err := c.filesModTime()
+			c.mu.RLock()
+			unchanged := err == nil && !modTime.After(c.modTime)
+			c.mu.RUnlock()
+			if unchanged {
+				continue
+			}
+		}
+		if err := c.Reload(); err != nil {
+			logger.Error("Failed to reload TLS certificate", "error", err)
+			continue
+		}
+		logger.Info("Reloaded TLS certificate", "cert", c.certFile)
+	}
+}
+
+// filesModTime returns the latest modification time of the certificate and key files.
+func (c *CertReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to read TLS file: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// RedirectHandler answers every request with a permanent redirect to the same URL over
+// HTTPS on the given port.
+func RedirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,147 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCertificate writes a self-signed certificate for commonName and its key to dir.
+func writeCertificate(t *testing.T, dir, commonName string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func commonName(t *testing.T, c *CertReloader) string {
+	t.Helper()
+	cert, err := c.GetCertificate(nil)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir, "first")
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, "first", commonName(t, reloader))
+
+	writeCertificate(t, dir, "second")
+	require.NoError(t, reloader.Reload())
+	assert.Equal(t, "second", commonName(t, reloader))
+
+	// A broken pair keeps the previous certificate in use
+	require.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0o600))
+	assert.Error(t, reloader.Reload())
+	assert.Equal(t, "second", commonName(t, reloader))
+}
+
+func TestCertReloaderRejectsMismatchedKey(t *testing.T) {
+	certFile, _ := writeCertificate(t, t.TempDir(), "cert")
+	_, keyFile := writeCertificate(t, t.TempDir(), "other")
+
+	_, err := NewCertReloader(certFile, keyFile)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "private key does not match public key")
+
+	_, err = NewCertReloader(filepath.Join(t.TempDir(), "missing.pem"), keyFile)
+	assert.Error(t, err)
+}
+
+func TestCertReloaderWatch(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir, "first")
+	reloader, err := NewCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	reload := make(chan os.Signal, 1)
+	go reloader.Watch(ctx, reload, 10*time.Millisecond, slog.New(slog.DiscardHandler))
+
+	// Renewed files are picked up on the next tick
+	writeCertificate(t, dir, "renewed")
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	assert.Eventually(t, func() bool { return commonName(t, reloader) == "renewed" }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConfig(t *testing.T) {
+	certFile, keyFile := writeCertificate(t, t.TempDir(), "127.0.0.1")
+	reloader, err := NewCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("secure"))
+	}))
+	server.TLS = New(reloader.GetCertificate)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS11,
+	}}}
+	_, err = client.Get(server.URL)
+	assert.Error(t, err, "TLS 1.1 must be refused")
+
+	client.Transport.(*http.Transport).TLSClientConfig.MaxVersion = tls.VersionTLS13
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestRedirectHandler(t *testing.T) {
+	for _, tc := range []struct {
+		port, host, target, location string
+	}{
+		{"443", "example.com", "/a/b?q=1", "https://example.com/a/b?q=1"},
+		{"443", "example.com:80", "/", "https://example.com/"},
+		{"8443", "example.com:8080", "/docs/", "https://example.com:8443/docs/"},
+		{"443", "[::1]:8080", "/", "https://[::1]/"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		req.Host = tc.host
+		rec := httptest.NewRecorder()
+		RedirectHandler(tc.port).ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusMovedPermanently, rec.Code, tc.host)
+		assert.Equal(t, tc.location, rec.Header().Get("Location"), tc.host)
+	}
+}
@@ -0,0 +1,149 @@
+// Package vhost routes requests to document roots by their Host header.
+package vhost
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Host maps a host name to a document root.
+type Host struct {
+	// Pattern is a host name, or "*." followed by one matching any single label in its place.
+	Pattern string
+	// Root is the document root. For wildcard patterns, $1 is replaced by the matched label.
+	Root string
+}
+
+// ParseHost parses a virtual host such as "docs.example.com=/srv/docs" or
+// "*.preview.example.com=/srv/previews/$1".
+func ParseHost(spec string) (Host, error) {
+	pattern, root, ok := strings.Cut(spec, "=")
+	pattern = normalizeHost(strings.TrimSpace(pattern))
+	root = strings.TrimSpace(root)
+	if !ok || pattern == "" || root == "" {
+		return Host{}, fmt.Errorf("invalid virtual host %q, use <host>=<root>", spec)
+	}
+	suffix, wildcard := strings.CutPrefix(pattern, "*.")
+	if suffix == "" || strings.Contains(suffix, "*") {
+		return Host{}, fmt.Errorf("invalid virtual host %q: only a leading *. wildcard is supported", spec)
+	}
+	if !wildcard && strings.Contains(root, "$1") {
+		return Host{}, fmt.Errorf("invalid virtual host %q: $1 needs a *. wildcard", spec)
+	}
+	return Host{Pattern: pattern, Root: root}, nil
+}
+
+// Opener returns the handler serving a document root.
+type Opener func(root string) (http.Handler, error)
+
+// Router serves every request with the handler of the document root its Host header
+// maps to. Host names compare case-insensitively and without the port.
+type Router struct {
+	exact     map[string]http.Handler
+	wildcards []wildcard
+	fallback  http.Handler
+	open      Opener
+	logger    *slog.Logger
+}
+
+type wildcard struct {
+	suffix string
+	root   string
+}
+
+// NewRouter opens the roots of the exact hosts and fallbackRoot, if not empty, which
+// serves hosts matching none of them. Without it, those get 404. The roots of wildcard
+// hosts depend on the matched label, so they are opened on each request.
+func NewRouter(hosts []Host, fallbackRoot string, open Opener, logger *slog.Logger) (*Router, error) {
+	router := &Router{exact: make(map[string]http.Handler), open: open, logger: logger}
+	for _, host := range hosts {
+		if suffix, ok := strings.CutPrefix(host.Pattern, "*."); ok {
+			if slices.ContainsFunc(router.wildcards, func(w wildcard) bool { return w.suffix == "."+suffix }) {
+				return nil, fmt.Errorf("virtual host %s given twice", host.Pattern)
+			}
+			router.wildcards = append(router.wildcards, wildcard{suffix: "." + suffix, root: host.Root})
+			continue
+		}
+		if _, exists := router.exact[host.Pattern]; exists {
+			return nil, fmt.Errorf("virtual host %s given twice", host.Pattern)
+		}
+		handler, err := open(host.Root)
+		if err != nil {
+			return nil, fmt.Errorf("virtual host %s: %w", host.Pattern, err)
+		}
+		router.exact[host.Pattern] = handler
+	}
+	// The longest suffix is the most specific match
+	sort.SliceStable(router.wildcards, func(i, j int) bool {
+		return len(router.wildcards[i].suffix) > len(router.wildcards[j].suffix)
+	})
+	if fallbackRoot != "" {
+		handler, err := open(fallbackRoot)
+		if err != nil {
+			return nil, fmt.Errorf("default virtual host: %w", err)
+		}
+		router.fallback = handler
+	}
+	return router, nil
+}
+
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler := router.handler(r.Host); handler != nil {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// handler returns the handler for a Host header, or nil if there is none.
+func (router *Router) handler(hostHeader string) http.Handler {
+	host := hostHeader
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = normalizeHost(host)
+
+	if handler, ok := router.exact[host]; ok {
+		return handler
+	}
+	for _, w := range router.wildcards {
+		label, ok := strings.CutSuffix(host, w.suffix)
+		if !ok || !validLabel(label) {
+			continue
+		}
+		handler, err := router.open(strings.ReplaceAll(w.root, "$1", label))
+		if err != nil {
+			router.logger.Debug("No document root for virtual host", "host", host, "error", err)
+			return nil
+		}
+		return handler
+	}
+	return router.fallback
+}
+
+// normalizeHost lowercases a host name and drops the brackets of an IPv6 address and
+// the trailing dot of a fully qualified name.
+func normalizeHost(host string) string {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// validLabel reports whether label is a single DNS label, so that it can't reach outside
+// the directory it is substituted into.
+func validLabel(label string) bool {
+	if label == "" || len(label) > 63 || label[0] == '-' {
+		return false
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,127 @@
+package vhost
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openDir serves the name of the root for existing directories.
+func openDir(root string) (http.Handler, error) {
+	if stat, err := os.Stat(root); err != nil || !stat.IsDir() {
+		return nil, errors.New("invalid service directory")
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, root)
+	}), nil
+}
+
+func newTestRouter(t *testing.T, fallback string, specs ...string) *Router {
+	t.Helper()
+	var hosts []Host
+	for _, spec := range specs {
+		host, err := ParseHost(spec)
+		require.NoError(t, err, spec)
+		hosts = append(hosts, host)
+	}
+	router, err := NewRouter(hosts, fallback, openDir, slog.New(slog.DiscardHandler))
+	require.NoError(t, err)
+	return router
+}
+
+func serve(router http.Handler, host string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = host
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRouter(t *testing.T) {
+	base := t.TempDir()
+	for _, dir := range []string{"docs", "app", "default", "previews/feature-1", "previews/pr-2", "etc"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(base, dir), 0o755))
+	}
+	router := newTestRouter(t, "",
+		"docs.example.com="+filepath.Join(base, "docs"),
+		"APP.example.com="+filepath.Join(base, "app"),
+		"*.preview.example.com="+filepath.Join(base, "previews", "$1"),
+		"*.example.com="+filepath.Join(base, "default"),
+	)
+
+	for host, root := range map[string]string{
+		"docs.example.com":              "docs",
+		"DOCS.Example.COM":              "docs",
+		"docs.example.com:8080":         "docs",
+		"docs.example.com.":             "docs",
+		"app.example.com":               "app",
+		"feature-1.preview.example.com": "previews/feature-1",
+		"PR-2.preview.example.com:443":  "previews/pr-2",
+		"other.example.com":             "default",
+	} {
+		rec := serve(router, host)
+		assert.Equal(t, http.StatusOK, rec.Code, host)
+		assert.Equal(t, filepath.Join(base, root), rec.Body.String(), host)
+	}
+
+	for _, host := range []string{
+		"example.com",
+		"unknown.test",
+		"",
+		// A label without a directory doesn't fall back to the less specific wildcard
+		"missing.preview.example.com",
+		// Captures are single labels, which can't climb out of the previews
+		"a.b.preview.example.com",
+		"...preview.example.com",
+		"..%2Fetc.preview.example.com",
+		"../etc.preview.example.com",
+		`..\etc.preview.example.com`,
+		"-x.preview.example.com",
+		".preview.example.com",
+	} {
+		assert.Equal(t, http.StatusNotFound, serve(router, host).Code, host)
+	}
+
+	// Unknown hosts go to the default root when there is one
+	router = newTestRouter(t, filepath.Join(base, "default"), "docs.example.com="+filepath.Join(base, "docs"))
+	assert.Equal(t, filepath.Join(base, "docs"), serve(router, "docs.example.com").Body.String())
+	assert.Equal(t, filepath.Join(base, "default"), serve(router, "unknown.test").Body.String())
+	assert.Equal(t, filepath.Join(base, "default"), serve(router, "[::1]:8080").Body.String())
+}
+
+func TestRouterIPv6(t *testing.T) {
+	base := t.TempDir()
+	router := newTestRouter(t, "", "[::1]="+base)
+	assert.Equal(t, base, serve(router, "[::1]:8080").Body.String())
+	assert.Equal(t, base, serve(router, "[::1]").Body.String())
+}
+
+func TestParseHost(t *testing.T) {
+	host, err := ParseHost(" *.Preview.Example.com = /srv/previews/$1 ")
+	require.NoError(t, err)
+	assert.Equal(t, Host{Pattern: "*.preview.example.com", Root: "/srv/previews/$1"}, host)
+
+	for _, spec := range []string{"", "docs.example.com", "=/srv", "docs.example.com=", "*=/srv", "*.=/srv", "a.*.example.com=/srv", "docs.example.com=/srv/$1"} {
+		_, err := ParseHost(spec)
+		assert.Error(t, err, spec)
+	}
+
+	// Roots of exact hosts are checked at startup
+	_, err = NewRouter([]Host{{Pattern: "docs.example.com", Root: filepath.Join(t.TempDir(), "missing")}}, "", openDir, slog.New(slog.DiscardHandler))
+	assert.Error(t, err)
+	_, err = NewRouter(nil, filepath.Join(t.TempDir(), "missing"), openDir, slog.New(slog.DiscardHandler))
+	assert.Error(t, err)
+	dir := t.TempDir()
+	_, err = NewRouter([]Host{{Pattern: "docs.example.com", Root: dir}, {Pattern: "docs.example.com", Root: dir}}, "", openDir, slog.New(slog.DiscardHandler))
+	assert.Error(t, err)
+	_, err = NewRouter([]Host{{Pattern: "*.example.com", Root: dir}, {Pattern: "*.example.com", Root: dir + "/$1"}}, "", openDir, slog.New(slog.DiscardHandler))
+	assert.EqualError(t, err, "virtual host *.example.com given twice")
+}
@@ -1,13 +1,35 @@
 package main
 
 import (
-	"cmpserve/internal/service"
+	"cmp"
+	"cmpserve/internal/auth"
+	"cmpserve/internal/metrics"
+	"cmpserve/internal/middleware"
+	"cmpserve/internal/tlsconfig"
+	"cmpserve/internal/vhost"
+	"cmpserve/pkg/cmpserve"
+	"context"
 	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/time/rate"
 )
 
 // getEnvWithDefault fetches an environment variable or falls back to a default value
@@ -18,31 +40,856 @@ func getEnvWithDefault(envKey, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvDurationWithDefault fetches a duration from an environment variable or falls back to a default value
+func getEnvDurationWithDefault(envKey string, defaultValue time.Duration) time.Duration {
+	val, exists := os.LookupEnv(envKey)
+	if !exists {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(val)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid duration %q for %s\n", val, envKey)
+		os.Exit(2)
+	}
+	return duration
+}
+
+// getEnvIntWithDefault fetches an integer from an environment variable or falls back to a default value
+func getEnvIntWithDefault(envKey string, defaultValue int) int {
+	val, exists := os.LookupEnv(envKey)
+	if !exists {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid integer %q for %s\n", val, envKey)
+		os.Exit(2)
+	}
+	return n
+}
+
+// archiveLimitFlags defines the flags bounding the archives indexed on flags, and returns a
+// function building the limits they set once parsed
+func archiveLimitFlags(flags *flag.FlagSet) func() cmpserve.ArchiveLimits {
+	maxEntries := flags.Int("archive-max-entries", getEnvIntWithDefault("CMPSERVE_ARCHIVE_MAX_ENTRIES", cmpserve.DefaultArchiveMaxEntries), "Reject archives with more entries, -1 for no limit")
+	maxTotalGB := flags.Int("archive-max-total-gb", getEnvIntWithDefault("CMPSERVE_ARCHIVE_MAX_TOTAL_GB", cmpserve.DefaultArchiveMaxTotalSize>>30), "Reject archives whose entries declare more GiB uncompressed in total, -1 for no limit")
+	maxEntryGB := flags.Int("archive-max-entry-gb", getEnvIntWithDefault("CMPSERVE_ARCHIVE_MAX_ENTRY_GB", cmpserve.DefaultArchiveMaxEntrySize>>30), "Leave out archive entries declaring more GiB uncompressed, -1 for no limit")
+	maxRatio := flags.Int("archive-max-ratio", getEnvIntWithDefault("CMPSERVE_ARCHIVE_MAX_RATIO", cmpserve.DefaultArchiveMaxCompressionRatio), "Leave out archive entries over 1 MiB declaring a higher compression ratio, -1 for no limit")
+	rejectWhole := flags.Bool("archive-reject-whole", os.Getenv("CMPSERVE_ARCHIVE_REJECT_WHOLE") == "true", "Reject the whole archive for an entry beyond -archive-max-entry-gb or -archive-max-ratio, rather than leaving the entry out")
+	return func() cmpserve.ArchiveLimits {
+		return cmpserve.ArchiveLimits{
+			MaxEntries:          *maxEntries,
+			MaxTotalSize:        int64(*maxTotalGB) << 30,
+			MaxEntrySize:        int64(*maxEntryGB) << 30,
+			MaxCompressionRatio: *maxRatio,
+			RejectArchive:       *rejectWhole,
+		}
+	}
+}
+
+// isSet reports whether a flag was given on the command line or through its environment variable
+func isSet(name, envKey string) bool {
+	_, set := os.LookupEnv(envKey)
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// splitList splits a comma-separated flag value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// defaultTrustedProxies are the loopback and private networks
+const defaultTrustedProxies = "127.0.0.0/8,::1/128,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7"
+
+// parsePrefixes parses CIDRs, accepting single addresses as host networks
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(value)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", value, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// parseRate parses a request rate such as 10r/s, 600r/m or 1000r/h
+func parseRate(value string) (rate.Limit, error) {
+	count, unit, ok := strings.Cut(value, "r/")
+	n, err := strconv.ParseFloat(count, 64)
+	if !ok || err != nil || !(n > 0) || math.IsInf(n, 0) {
+		return 0, fmt.Errorf("invalid rate %q, use e.g. 10r/s", value)
+	}
+	switch unit {
+	case "s":
+		return rate.Limit(n), nil
+	case "m":
+		return rate.Limit(n / 60), nil
+	case "h":
+		return rate.Limit(n / 3600), nil
+	}
+	return 0, fmt.Errorf("invalid rate %q, use r/s, r/m or r/h", value)
+}
+
+// stringList is a repeatable flag, seeded from an environment variable. The values given
+// on the command line, or by the configuration file, replace the seeded ones rather than
+// adding to them
+type stringList struct {
+	values []string
+	set    bool
+}
+
+func (l *stringList) String() string {
+	return strings.Join(l.values, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	if !l.set {
+		l.values, l.set = nil, true
+	}
+	l.values = append(l.values, value)
+	return nil
+}
+
+// splitLines splits a newline-separated environment variable, dropping empty lines
+func splitLines(value string) []string {
+	var lines []string
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// newLogger builds the process logger for the given level and output format, adding the
+// request ID to the lines logged for a request
+func newLogger(out io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	handlerOptions := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "text":
+		return slog.New(middleware.LogRequestIDs(slog.NewTextHandler(out, handlerOptions))), nil
+	case "json":
+		return slog.New(middleware.LogRequestIDs(slog.NewJSONHandler(out, handlerOptions))), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+}
+
+// withMetricsEndpoint serves the metrics at /metrics and everything else through next
+func withMetricsEndpoint(next, metricsHandler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" {
+			metricsHandler.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// boundServer pairs a server with the listener it serves on.
+type boundServer struct {
+	srv      *http.Server
+	listener net.Listener
+}
+
+func (b boundServer) serve() error {
+	if b.srv.TLSConfig != nil {
+		return b.srv.ServeTLS(b.listener, "", "")
+	}
+	return b.srv.Serve(b.listener)
+}
+
+// serverTimeouts holds the timeouts applied to every listener
+type serverTimeouts struct {
+	read, readHeader, write, idle time.Duration
+}
+
+// newHTTPServer returns a server with the given timeouts
+func newHTTPServer(addr string, handler http.Handler, timeouts serverTimeouts, logger *slog.Logger) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       timeouts.read,
+		ReadHeaderTimeout: timeouts.readHeader,
+		WriteTimeout:      timeouts.write,
+		IdleTimeout:       timeouts.idle,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+}
+
+// runServer serves every server until a signal arrives, then stops accepting connections
+// and waits up to timeout for in-flight requests to complete. A second signal cuts the
+// wait short, closing the remaining connections.
+func runServer(servers []boundServer, signals <-chan os.Signal, timeout time.Duration, logger *slog.Logger) error {
+	serveErr := make(chan error, len(servers))
+	for _, server := range servers {
+		go func() { serveErr <- server.serve() }()
+	}
+
+	select {
+	case err := <-serveErr:
+		for _, server := range servers {
+			_ = server.srv.Close()
+		}
+		return err
+	case sig := <-signals:
+		logger.Info("Shutting down", "signal", sig.String(), "timeout", timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-signals:
+			logger.Warn("Forcing shutdown", "signal", sig.String())
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	shutdownErr := make(chan error, len(servers))
+	for _, server := range servers {
+		go func() {
+			err := server.srv.Shutdown(ctx)
+			if err != nil {
+				_ = server.srv.Close()
+			}
+			shutdownErr <- err
+		}()
+	}
+	var interrupted error
+	for range servers {
+		if err := <-shutdownErr; err != nil && interrupted == nil {
+			interrupted = fmt.Errorf("in-flight requests were interrupted: %w", err)
+		}
+	}
+	return interrupted
+}
+
+// checkReport receives the report of "cmpserve config check": a line for each part of the
+// configuration startup validated, then the failure ending it, if any. It is nil when
+// serving, so that both run the same startup.
+var checkReport io.Writer
+
+// checked reports a part of the configuration that startup validated
+func checked(what, detail string) {
+	if checkReport != nil {
+		fmt.Fprintf(checkReport, "ok    %s: %s\n", what, detail)
+	}
+}
+
+// fatal logs msg at error level and exits
+func fatal(logger *slog.Logger, msg string, err error) {
+	if checkReport != nil {
+		fmt.Fprintf(checkReport, "FAIL  %s: %v\n", msg, err)
+	}
+	logger.Error(msg, "error", err)
+	os.Exit(1)
+}
+
 func main() {
-	dir := flag.String("dir", getEnvWithDefault("CMPSERVE_DIR", "."), "Service directory")
+	args := os.Args[1:]
+	// "cmpserve verify [flags] [archive...]" checks the archive index against the archives
+	if len(args) >= 1 && args[0] == "verify" {
+		os.Exit(runVerify(args[1:], os.Stdout, os.Stderr))
+	}
+	// "cmpserve config check [flags]", or "cmpserve check [flags]", goes through startup
+	// without binding listeners, reporting what it validated
+	checkConfig := len(args) >= 2 && args[0] == "config" && args[1] == "check"
+	if checkConfig {
+		args = args[2:]
+	} else if len(args) >= 1 && args[0] == "check" {
+		checkConfig = true
+		args = args[1:]
+	}
+	if checkConfig {
+		checkReport = os.Stdout
+	}
+
+	configFile := flag.String("config", os.Getenv("CMPSERVE_CONFIG"), "YAML file setting options by flag name; flags and environment variables take precedence")
+	dir := flag.String("dir", getEnvWithDefault("CMPSERVE_DIR", "."), "Service directory, or a ZIP archive to serve the contents of at /")
+	vhostSpecs := stringList{values: splitList(os.Getenv("CMPSERVE_VHOSTS"))}
+	flag.Var(&vhostSpecs, "vhost", "Serve requests for this host from another directory, e.g. docs.example.com=/srv/docs or *.preview.example.com=/srv/previews/$1 (repeatable)")
+	vhostDefault := flag.String("vhost-default", os.Getenv("CMPSERVE_VHOST_DEFAULT"), "Directory serving hosts matching no -vhost; without it they get 404")
+	basePath := flag.String("base-path", os.Getenv("CMPSERVE_BASE_PATH"), "URL path prefix to serve under, e.g. /artifacts, for proxies that don't strip it")
 	cacheDir := flag.String("cache-dir", getEnvWithDefault("CMPSERVE_CACHE_DIR", "."), "Cache directory")
+	cacheMaxArchives := flag.Int("cache-max-archives", getEnvIntWithDefault("CMPSERVE_CACHE_MAX_ARCHIVES", 0), "Maximum archives kept in the index, evicting the least recently used, 0 for no limit")
+	cacheCheckpointMB := flag.Int("cache-checkpoint-mb", getEnvIntWithDefault("CMPSERVE_CACHE_CHECKPOINT_MB", 0), "Record a checkpoint in the index every this many MiB of deflated entries served in ranges, for later ranges to resume from, 0 for none")
+	cacheValidate := flag.String("cache-validate", getEnvWithDefault("CMPSERVE_CACHE_VALIDATE", "stat"), "How requests check that archives haven't changed since they were indexed: stat (size and modification time), strict (also a fingerprint of the last 64 KiB, reading it every request) or none")
+	archiveNameEncoding := flag.String("archive-name-encoding", getEnvWithDefault("CMPSERVE_ARCHIVE_NAME_ENCODING", "cp437"), "Encoding of archive entry names lacking the UTF-8 flag, e.g. cp866 or shift_jis; utf-8 keeps them as stored")
+	archiveLimits := archiveLimitFlags(flag.CommandLine)
 	addr := flag.String("addr", getEnvWithDefault("CMPSERVE_ADDR", "0.0.0.0"), "Bind address")
 	port := flag.String("port", getEnvWithDefault("CMPSERVE_PORT", "8080"), "Port number")
+	unixSocket := flag.String("unix-socket", os.Getenv("CMPSERVE_UNIX_SOCKET"), "Listen on this Unix domain socket instead of -addr and -port")
+	socketMode := flag.String("socket-mode", getEnvWithDefault("CMPSERVE_SOCKET_MODE", "0660"), "Permissions of the Unix domain socket")
 	createIndexes := flag.Bool("indexes", os.Getenv("CMPSERVE_INDEXES") == "true", "Display indexes for directories")
 	exposeHiddenFiles := flag.Bool("show-hidden-files", os.Getenv("CMPSERVE_SHOW_HIDDEN_FILES") == "true", "Display and serve hidden files")
+	indexFiles := flag.String("index-files", getEnvWithDefault("CMPSERVE_INDEX_FILES", "index.html"), "Comma-separated index document names, tried in order")
+	spa := flag.Bool("spa", os.Getenv("CMPSERVE_SPA") == "true", "Serve the archive index document for missing extensionless paths")
+	spaFilesystem := flag.Bool("spa-filesystem", os.Getenv("CMPSERVE_SPA_FILESYSTEM") == "true", "Apply the SPA fallback to plain directories too")
+	precompressed := flag.Bool("precompressed", os.Getenv("CMPSERVE_PRECOMPRESSED") == "true", "Serve the .br or .gz sibling of a file or archive entry to clients accepting that encoding")
+	noArchiveDownload := flag.Bool("no-archive-download", os.Getenv("CMPSERVE_NO_ARCHIVE_DOWNLOAD") == "true", "Answer requests for archive files themselves with 404, still serving their contents")
+	ignorePatterns := stringList{values: splitList(os.Getenv("CMPSERVE_IGNORE"))}
+	flag.Var(&ignorePatterns, "ignore", "gitignore-style pattern of paths to hide and refuse, e.g. *.map or /private/** (repeatable, adds to the .cmpserveignore file of -dir)")
+	caseInsensitive := flag.Bool("case-insensitive", os.Getenv("CMPSERVE_CASE_INSENSITIVE") == "true", "Resolve paths missing as requested to the one name matching regardless of case")
+	webdav := flag.Bool("webdav", os.Getenv("CMPSERVE_WEBDAV") == "true", "Answer read-only WebDAV requests (PROPFIND), so WebDAV clients can mount the tree")
+	noRobots := flag.Bool("no-robots", os.Getenv("CMPSERVE_NO_ROBOTS") == "true", "Send X-Robots-Tag: noindex, nofollow and answer a missing /robots.txt with one disallowing everything")
+	charsets := stringList{values: splitList(os.Getenv("CMPSERVE_CHARSET"))}
+	flag.Var(&charsets, "charset", "Charset of the archive entries matching a glob, e.g. *.csv=iso-8859-1, for legacy text (repeatable); other text gets that of its byte order mark, or utf-8")
+	checksums := flag.Bool("checksums", os.Getenv("CMPSERVE_CHECKSUMS") == "true", "Answer <path>.sha256, unless it exists, and <path>?checksum=sha256 with the SHA-256 digest of the file or archive entry, cached in the index")
+	stripJSONBOM := flag.Bool("strip-json-bom", os.Getenv("CMPSERVE_STRIP_JSON_BOM") == "true", "Leave the byte order mark of JSON archive entries out of responses")
+	rootSymlinkMode := flag.String("root-symlink-mode", getEnvWithDefault("CMPSERVE_ROOT_SYMLINK_MODE", "static"), "How a -dir that is a symbolic link is resolved: static (once) or follow (again every second, each request served from one target)")
+	symlinks := flag.String("symlinks", getEnvWithDefault("CMPSERVE_SYMLINKS", "all"), "Symbolic links to follow: all, internal (resolving under -dir) or deny")
+	indexTemplate := flag.String("index-template", os.Getenv("CMPSERVE_INDEX_TEMPLATE"), "html/template file for directory indexes. Receives .Path, .Breadcrumbs (Name, Href), .Parent and "+
+		".Entries (Name, Href, DownloadHref, IsDir, IsArchive, IsSymlink, Size, ModTime); provides formatSize, formatModTime and .SortHref \"name|size|time\"")
+	indexTemplateReload := flag.Bool("index-template-reload", os.Getenv("CMPSERVE_INDEX_TEMPLATE_RELOAD") == "true", "Re-parse the index template on every request (development)")
+	compress := flag.Bool("compress", os.Getenv("CMPSERVE_COMPRESS") == "true", "Gzip responses for clients accepting it")
+	compressTypes := flag.String("compress-types", getEnvWithDefault("CMPSERVE_COMPRESS_TYPES", strings.Join(middleware.DefaultCompressTypes, ",")), "Comma-separated media types compressed by -compress; type/* matches all subtypes")
+	compressMinSize := flag.Int("compress-min-size", getEnvIntWithDefault("CMPSERVE_COMPRESS_MIN_SIZE", 1024), "Smallest response body compressed by -compress, in bytes")
+	cacheRuleSpecs := stringList{values: splitLines(os.Getenv("CMPSERVE_CACHE_RULE"))}
+	flag.Var(&cacheRuleSpecs, "cache-rule", "Cache-Control for matching request paths, e.g. \"glob=**/*.js,**/*.css;max-age=31536000;immutable\" (repeatable, first match wins)")
+	defaultCache := flag.String("default-cache", os.Getenv("CMPSERVE_DEFAULT_CACHE"), "Cache-Control for paths matching no -cache-rule, e.g. max-age=60")
+	headerSpecs := stringList{values: splitLines(os.Getenv("CMPSERVE_HEADERS"))}
+	flag.Var(&headerSpecs, "header", "Add this \"Name: value\" header to every response, unless the server sets it (repeatable)")
+	headerOverrideSpecs := stringList{values: splitLines(os.Getenv("CMPSERVE_HEADER_OVERRIDES"))}
+	flag.Var(&headerOverrideSpecs, "header-override", "Like -header, but replacing the value set by the server (repeatable)")
+	accessLog := flag.Bool("access-log", os.Getenv("CMPSERVE_ACCESS_LOG") == "true", "Write an access log to stdout")
+	accessLogFile := flag.String("access-log-file", os.Getenv("CMPSERVE_ACCESS_LOG_FILE"), "Write an access log to this file")
+	trustProxy := flag.Bool("trust-proxy", os.Getenv("CMPSERVE_TRUST_PROXY") == "true", "Trust X-Forwarded-For from -trusted-proxies for the client address")
+	trustedProxies := flag.String("trusted-proxies", getEnvWithDefault("CMPSERVE_TRUSTED_PROXIES", defaultTrustedProxies), "Comma-separated CIDRs of the proxies trusted with -trust-proxy")
+	allowCIDRs := stringList{values: splitList(os.Getenv("CMPSERVE_ALLOW_CIDR"))}
+	flag.Var(&allowCIDRs, "allow-cidr", "Only accept clients from this CIDR (repeatable)")
+	denyCIDRs := stringList{values: splitList(os.Getenv("CMPSERVE_DENY_CIDR"))}
+	flag.Var(&denyCIDRs, "deny-cidr", "Refuse clients from this CIDR, even if allowed (repeatable)")
+	rateLimit := flag.String("rate-limit", os.Getenv("CMPSERVE_RATE_LIMIT"), "Limit each client to this request rate, e.g. 10r/s or 600r/m")
+	rateBurst := flag.Int("rate-burst", getEnvIntWithDefault("CMPSERVE_RATE_BURST", 0), "Requests a client may make at once above -rate-limit (default: one second's worth)")
+	rateLimitExempt := stringList{values: splitList(os.Getenv("CMPSERVE_RATE_LIMIT_EXEMPT"))}
+	flag.Var(&rateLimitExempt, "rate-limit-exempt", "Don't rate limit clients from this CIDR (repeatable)")
+	maxExtractions := flag.Int("max-extractions", getEnvIntWithDefault("CMPSERVE_MAX_EXTRACTIONS", runtime.NumCPU()+2), "Maximum archive requests decompressing at once, 0 for no limit")
+	extractionQueueTimeout := flag.Duration("extraction-queue-timeout", getEnvDurationWithDefault("CMPSERVE_EXTRACTION_QUEUE_TIMEOUT", 10*time.Second), "How long archive requests wait for a free extraction slot before getting 503")
+	notFoundCacheTTL := flag.Duration("not-found-cache-ttl", getEnvDurationWithDefault("CMPSERVE_NOT_FOUND_CACHE_TTL", 3*time.Second), "How long paths that resolved to nothing keep getting 404 without probing the filesystem, 0 to turn off")
+	maxPathSegments := flag.Int("max-path-segments", getEnvIntWithDefault("CMPSERVE_MAX_PATH_SEGMENTS", cmpserve.DefaultMaxPathSegments), "Answer request paths with more segments with 414, -1 for no limit")
+	maxSegmentLength := flag.Int("max-segment-length", getEnvIntWithDefault("CMPSERVE_MAX_SEGMENT_LENGTH", cmpserve.DefaultMaxSegmentLength), "Answer request paths with a longer decoded segment, in bytes, with 404, -1 for no limit")
+	maxPathLength := flag.Int("max-path-length", getEnvIntWithDefault("CMPSERVE_MAX_PATH_LENGTH", cmpserve.DefaultMaxPathLength), "Answer longer decoded request paths, in bytes, with 414, -1 for no limit")
+	pinArchives := stringList{values: splitList(os.Getenv("CMPSERVE_PIN_ARCHIVE"))}
+	flag.Var(&pinArchives, "pin-archive", "Keep the index of this archive, e.g. /bundle.zip, in memory so its entries are looked up without the database (repeatable)")
+	htpasswdFile := flag.String("htpasswd", os.Getenv("CMPSERVE_HTPASSWD"), "Require HTTP Basic authentication against this htpasswd file (bcrypt or SHA-crypt)")
+	authRealm := flag.String("auth-realm", getEnvWithDefault("CMPSERVE_AUTH_REALM", "cmpserve"), "Realm presented to clients by HTTP Basic authentication")
+	authExempt := flag.String("auth-exempt", os.Getenv("CMPSERVE_AUTH_EXEMPT"), "Comma-separated paths served without authentication, e.g. /metrics")
+	authTokens := stringList{values: splitList(os.Getenv("CMPSERVE_AUTH_TOKEN"))}
+	flag.Var(&authTokens, "auth-token", "Accept this bearer token (repeatable)")
+	authTokenFile := flag.String("auth-token-file", os.Getenv("CMPSERVE_AUTH_TOKEN_FILE"), "Accept the bearer tokens listed in this file, one per line; reloaded on change")
+	authQueryToken := flag.Bool("auth-query-token", os.Getenv("CMPSERVE_AUTH_QUERY_TOKEN") == "true", "Also accept bearer tokens as a ?token= query parameter, which is removed before logging")
+	logLevel := flag.String("log-level", getEnvWithDefault("CMPSERVE_LOG_LEVEL", "info"), "Log level: debug, info, warn or error")
+	logFormat := flag.String("log-format", getEnvWithDefault("CMPSERVE_LOG_FORMAT", "text"), "Log format: text or json")
+	enableMetrics := flag.Bool("metrics", os.Getenv("CMPSERVE_METRICS") == "true", "Export Prometheus metrics at /metrics")
+	metricsAddr := flag.String("metrics-addr", os.Getenv("CMPSERVE_METRICS_ADDR"), "Serve /metrics on this address (host:port) instead of the main listener")
+	otelEndpoint := flag.String("otel-endpoint", os.Getenv("CMPSERVE_OTEL_ENDPOINT"), "Export OpenTelemetry traces to this OTLP/HTTP collector, e.g. http://localhost:4318")
+	adminAddr := flag.String("admin-addr", os.Getenv("CMPSERVE_ADMIN_ADDR"), "Serve the /admin/ archive index endpoints on this address (host:port); keep it private")
+	statusPath := flag.String("status-path", os.Getenv("CMPSERVE_STATUS_PATH"), "Serve a status page of the index and runtime, in HTML or JSON, at this URL path, e.g. /.status, ahead of the files")
+	readTimeout := flag.Duration("read-timeout", getEnvDurationWithDefault("CMPSERVE_READ_TIMEOUT", 30*time.Second), "Maximum time to read a request, including its body")
+	readHeaderTimeout := flag.Duration("read-header-timeout", getEnvDurationWithDefault("CMPSERVE_READ_HEADER_TIMEOUT", 10*time.Second), "Maximum time to read request headers")
+	writeTimeout := flag.Duration("write-timeout", getEnvDurationWithDefault("CMPSERVE_WRITE_TIMEOUT", 30*time.Second), "Maximum time a response may make no progress before the connection is dropped")
+	idleTimeout := flag.Duration("idle-timeout", getEnvDurationWithDefault("CMPSERVE_IDLE_TIMEOUT", 120*time.Second), "Maximum time to keep an idle keep-alive connection open")
+	shutdownTimeout := flag.Duration("shutdown-timeout", getEnvDurationWithDefault("CMPSERVE_SHUTDOWN_TIMEOUT", 30*time.Second), "How long to wait for in-flight requests on SIGINT/SIGTERM")
+	tlsCert := flag.String("tls-cert", os.Getenv("CMPSERVE_TLS_CERT"), "TLS certificate file; serves HTTPS on -port together with -tls-key")
+	tlsKey := flag.String("tls-key", os.Getenv("CMPSERVE_TLS_KEY"), "TLS private key file")
+	httpPort := flag.String("http-port", os.Getenv("CMPSERVE_HTTP_PORT"), "With TLS, also serve plain HTTP on this port")
+	acmeDomains := flag.String("acme-domains", os.Getenv("CMPSERVE_ACME_DOMAINS"), "Comma-separated domains to obtain certificates for via ACME (Let's Encrypt)")
+	acmeCacheDir := flag.String("acme-cache-dir", os.Getenv("CMPSERVE_ACME_CACHE_DIR"), "Directory for ACME certificates (default <cache-dir>/acme)")
+	acmeNonstandardPort := flag.Bool("acme-accept-nonstandard-port", os.Getenv("CMPSERVE_ACME_ACCEPT_NONSTANDARD_PORT") == "true", "Allow ACME mode on ports other than 443 and 80")
+	redirectHTTP := flag.Bool("redirect-http", os.Getenv("CMPSERVE_REDIRECT_HTTP") == "true", "Answer plain-HTTP requests on -http-port with a redirect to HTTPS")
 
-	flag.Parse()
+	_ = flag.CommandLine.Parse(args)
+	if *configFile != "" {
+		if err := loadConfig(flag.CommandLine, *configFile); err != nil {
+			if checkReport != nil {
+				fmt.Fprintf(checkReport, "FAIL  Invalid configuration file: %v\n", err)
+			}
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		checked("configuration file", *configFile)
+	}
 
-	server, err := service.NewService(*dir, *cacheDir, *createIndexes, *exposeHiddenFiles)
+	logger, err := newLogger(os.Stderr, *logLevel, *logFormat)
 	if err != nil {
-		log.Fatalf("Failed to initialize server: %v", err)
+		if checkReport != nil {
+			fmt.Fprintf(checkReport, "FAIL  Invalid logging configuration: %v\n", err)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
+	slog.SetDefault(logger)
 
-	srv := &http.Server{
-		Addr:         *addr + ":" + *port,
-		Handler:      server,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  120 * time.Second,
+	// An archive served as the tree keeps its index next to it by default
+	rootIsArchive := false
+	if stat, err := os.Stat(*dir); err == nil && stat.Mode().IsRegular() {
+		rootIsArchive = true
+		if !isSet("cache-dir", "CMPSERVE_CACHE_DIR") {
+			*cacheDir = filepath.Dir(*dir)
+		}
 	}
 
-	log.Printf("Service running on %s:%s", *addr, *port)
-	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		log.Fatalf("Service failed: %v", err)
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fatal(logger, "Invalid TLS configuration", errors.New("-tls-cert and -tls-key must be set together"))
+	}
+	if *unixSocket != "" {
+		if isSet("addr", "CMPSERVE_ADDR") || isSet("port", "CMPSERVE_PORT") {
+			fatal(logger, "Invalid listener configuration", errors.New("-unix-socket can't be combined with -addr or -port"))
+		}
+		if *tlsCert != "" || *acmeDomains != "" || *httpPort != "" {
+			fatal(logger, "Invalid listener configuration", errors.New("-unix-socket can't be combined with TLS; terminate TLS in the proxy in front"))
+		}
+	}
+	if *authQueryToken && len(authTokens.values) == 0 && *authTokenFile == "" {
+		fatal(logger, "Invalid authentication configuration", errors.New("-auth-query-token requires -auth-token or -auth-token-file"))
+	}
+	mode, err := parseSocketMode(*socketMode)
+	if err != nil {
+		fatal(logger, "Invalid listener configuration", err)
+	}
+	if *unixSocket != "" {
+		checked("listener", fmt.Sprintf("Unix domain socket %s, mode %04o", *unixSocket, mode))
+	} else {
+		checked("listener", net.JoinHostPort(*addr, *port))
+	}
+
+	var proxies middleware.TrustedProxies
+	if *trustProxy {
+		proxies, err = parsePrefixes(splitList(*trustedProxies))
+		if err != nil {
+			fatal(logger, "Invalid -trusted-proxies", err)
+		}
+	}
+	allowed, err := parsePrefixes(allowCIDRs.values)
+	if err != nil {
+		fatal(logger, "Invalid -allow-cidr", err)
+	}
+	denied, err := parsePrefixes(denyCIDRs.values)
+	if err != nil {
+		fatal(logger, "Invalid -deny-cidr", err)
+	}
+
+	var requestRate rate.Limit
+	if *rateLimit != "" {
+		requestRate, err = parseRate(*rateLimit)
+		if err != nil {
+			fatal(logger, "Invalid -rate-limit", err)
+		}
+	}
+	rateExempt, err := parsePrefixes(rateLimitExempt.values)
+	if err != nil {
+		fatal(logger, "Invalid -rate-limit-exempt", err)
+	}
+	if len(proxies) > 0 || len(allowed) > 0 || len(denied) > 0 {
+		checked("networks", fmt.Sprintf("%d trusted proxies, %d allowed, %d denied", len(proxies), len(allowed), len(denied)))
+	}
+	if requestRate > 0 {
+		checked("rate limit", fmt.Sprintf("%s, %d networks exempt", *rateLimit, len(rateExempt)))
+	}
+
+	var cacheRules []middleware.CacheRule
+	for _, spec := range cacheRuleSpecs.values {
+		rule, err := middleware.ParseCacheRule(spec)
+		if err != nil {
+			fatal(logger, "Invalid -cache-rule", err)
+		}
+		cacheRules = append(cacheRules, rule)
+	}
+	if *rootSymlinkMode != "static" && *rootSymlinkMode != "follow" {
+		fatal(logger, "Invalid -root-symlink-mode", fmt.Errorf("%q, use static or follow", *rootSymlinkMode))
+	}
+	symlinkPolicy, err := cmpserve.ParseSymlinkPolicy(*symlinks)
+	if err != nil {
+		fatal(logger, "Invalid -symlinks", err)
+	}
+	cacheValidation, err := cmpserve.ParseCacheValidation(*cacheValidate)
+	if err != nil {
+		fatal(logger, "Invalid -cache-validate", err)
+	}
+
+	fallbackCache, err := middleware.ParseCacheDirectives(*defaultCache)
+	if err != nil {
+		fatal(logger, "Invalid -default-cache", err)
+	}
+	if len(cacheRules) > 0 || fallbackCache != "" {
+		checked("cache rules", fmt.Sprintf("%d rules", len(cacheRules)))
+	}
+
+	var vhosts []vhost.Host
+	for _, spec := range vhostSpecs.values {
+		host, err := vhost.ParseHost(spec)
+		if err != nil {
+			fatal(logger, "Invalid -vhost", err)
+		}
+		vhosts = append(vhosts, host)
+	}
+
+	var customHeaders []middleware.Header
+	for _, spec := range headerSpecs.values {
+		header, err := middleware.ParseHeader(spec, false)
+		if err != nil {
+			fatal(logger, "Invalid -header", err)
+		}
+		if middleware.ServerHeader(header.Name) {
+			logger.Warn("Skipping -header the server sets itself, use -header-override to replace it", "header", header.Name)
+			continue
+		}
+		customHeaders = append(customHeaders, header)
+	}
+	for _, spec := range headerOverrideSpecs.values {
+		header, err := middleware.ParseHeader(spec, true)
+		if err != nil {
+			fatal(logger, "Invalid -header-override", err)
+		}
+		customHeaders = append(customHeaders, header)
+	}
+	if len(customHeaders) > 0 {
+		checked("headers", fmt.Sprintf("%d headers", len(customHeaders)))
+	}
+
+	var acmeManager *autocert.Manager
+	if *acmeDomains != "" {
+		if *tlsCert != "" {
+			fatal(logger, "Invalid TLS configuration", errors.New("-acme-domains can't be combined with -tls-cert"))
+		}
+		if *httpPort == "" {
+			*httpPort = "80"
+		}
+		if err := tlsconfig.CheckACMEPorts(*port, *httpPort, *acmeNonstandardPort); err != nil {
+			fatal(logger, "Invalid ACME configuration", err)
+		}
+		if *acmeCacheDir == "" {
+			*acmeCacheDir = filepath.Join(*cacheDir, "acme")
+		}
+		acmeManager, err = tlsconfig.NewACMEManager(splitList(*acmeDomains), *acmeCacheDir)
+		if err != nil {
+			fatal(logger, "Invalid ACME configuration", err)
+		}
+		checked("ACME", fmt.Sprintf("%s, certificates in %s", strings.Join(splitList(*acmeDomains), ", "), *acmeCacheDir))
+	}
+	if *httpPort != "" && *tlsCert == "" && acmeManager == nil {
+		fatal(logger, "Invalid TLS configuration", errors.New("-http-port requires -tls-cert and -tls-key, or -acme-domains"))
+	}
+	var certReloader *tlsconfig.CertReloader
+	if *tlsCert != "" {
+		certReloader, err = tlsconfig.NewCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			fatal(logger, "Failed to load TLS certificate", err)
+		}
+		checked("TLS certificate", *tlsCert)
+	}
+
+	var serverMetrics *metrics.Metrics
+	var observer cmpserve.IndexObserver
+	var extractionObserver cmpserve.ExtractionObserver
+	if *enableMetrics || *metricsAddr != "" {
+		serverMetrics = metrics.New()
+		observer = serverMetrics
+		extractionObserver = serverMetrics
+	}
+
+	var tracerProvider trace.TracerProvider
+	stopTracing := func() {}
+	if *otelEndpoint != "" {
+		provider, err := newTracerProvider(context.Background(), *otelEndpoint)
+		if err != nil {
+			fatal(logger, "Failed to set up tracing", err)
+		}
+		tracerProvider = provider
+		checked("tracing", *otelEndpoint)
+		stopTracing = func() {
+			// Flush the spans still batched
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := provider.Shutdown(ctx); err != nil {
+				logger.Warn("Failed to export traces", "error", err)
+			}
+		}
+	}
+
+	server, err := cmpserve.New(cmpserve.Options{
+		Root:              *dir,
+		CacheDir:          *cacheDir,
+		Indexes:           *createIndexes,
+		ShowHiddenFiles:   *exposeHiddenFiles,
+		IndexFiles:        splitList(*indexFiles),
+		SPA:               *spa,
+		SPAFilesystem:     *spaFilesystem,
+		Precompressed:     *precompressed,
+		NoArchiveDownload: *noArchiveDownload,
+		BasePath:          *basePath,
+		Symlinks:          symlinkPolicy,
+		Ignore:            ignorePatterns.values,
+		CaseInsensitive:   *caseInsensitive,
+		WebDAV:            *webdav,
+		NoRobots:          *noRobots,
+		Charsets:          charsets.values,
+		StripJSONBOM:      *stripJSONBOM,
+		Checksums:         *checksums,
+
+		FollowRootSymlink: *rootSymlinkMode == "follow",
+
+		IndexTemplate:       *indexTemplate,
+		IndexTemplateReload: *indexTemplateReload,
+
+		MaxExtractions:          *maxExtractions,
+		CacheMaxArchives:        *cacheMaxArchives,
+		CacheCheckpointInterval: int64(*cacheCheckpointMB) << 20,
+		ArchiveNameEncoding:     *archiveNameEncoding,
+		CacheValidation:         cacheValidation,
+		ArchiveLimits:           archiveLimits(),
+		ExtractionQueueTimeout:  *extractionQueueTimeout,
+		NotFoundCacheTTL:        *notFoundCacheTTL,
+		MaxPathSegments:         *maxPathSegments,
+		MaxSegmentLength:        *maxSegmentLength,
+		MaxPathLength:           *maxPathLength,
+
+		Logger:             logger,
+		IndexObserver:      observer,
+		ExtractionObserver: extractionObserver,
+		TracerProvider:     tracerProvider,
+	})
+	if err != nil {
+		fatal(logger, "Failed to initialize server", err)
+	}
+	if *rootSymlinkMode == "follow" {
+		checked("service directory", *dir+", followed every second")
+	} else if rootIsArchive {
+		checked("service directory", *dir+", served as an archive")
+	} else {
+		checked("service directory", *dir)
+	}
+	if len(ignorePatterns.values) > 0 {
+		checked("ignore patterns", fmt.Sprintf("%d patterns", len(ignorePatterns.values)))
+	}
+	if len(charsets.values) > 0 {
+		checked("charset rules", fmt.Sprintf("%d rules", len(charsets.values)))
+	}
+	if *indexTemplate != "" {
+		checked("index template", *indexTemplate)
+	}
+	if len(pinArchives.values) > 0 {
+		total, size := 0, int64(0)
+		for _, name := range pinArchives.values {
+			entries, bytes, err := server.Pin(context.Background(), strings.TrimPrefix(name, "/"))
+			if err != nil {
+				fatal(logger, "Failed to pin archive", err)
+			}
+			total, size = total+entries, size+bytes
+		}
+		checked("pinned archives", fmt.Sprintf("%d archives, %d entries, about %d KiB", len(pinArchives.values), total, size>>10))
+	}
+	if checkReport != nil {
+		stats, err := server.IndexStats(context.Background())
+		if err != nil {
+			fatal(logger, "Failed to read archive index", err)
+		}
+		checked("cache directory", *cacheDir+", writable")
+		checked("archive index", fmt.Sprintf("%d archives", stats.Archives))
+	}
+
+	var root http.Handler = server
+	if len(vhosts) > 0 || *vhostDefault != "" {
+		root, err = vhost.NewRouter(vhosts, *vhostDefault, func(dir string) (http.Handler, error) {
+			return server.WithRoot(dir)
+		}, logger)
+		if err != nil {
+			fatal(logger, "Invalid virtual host configuration", err)
+		}
+		checked("virtual hosts", fmt.Sprintf("%d hosts, default %q", len(vhosts), *vhostDefault))
+	}
+
+	var servers []boundServer
+	bind := func(srv *http.Server) {
+		if checkConfig {
+			return
+		}
+		listener, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			fatal(logger, "Service failed", err)
+		}
+		servers = append(servers, boundServer{srv: srv, listener: listener})
+	}
+
+	timeouts := serverTimeouts{read: *readTimeout, readHeader: *readHeaderTimeout, write: *writeTimeout, idle: *idleTimeout}
+
+	var handler http.Handler = middleware.WriteDeadline(*writeTimeout)(root)
+	if len(cacheRules) > 0 || fallbackCache != "" {
+		handler = middleware.CacheControl(cacheRules, fallbackCache)(handler)
+	}
+	if *compress {
+		handler = middleware.Compress(middleware.CompressOptions{Types: splitList(strings.ToLower(*compressTypes)), MinSize: *compressMinSize})(handler)
+	}
+	if serverMetrics != nil {
+		handler = middleware.Metrics(serverMetrics)(handler)
+		if *metricsAddr == "" {
+			handler = withMetricsEndpoint(handler, serverMetrics.Handler())
+		} else {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", serverMetrics.Handler())
+			bind(newHTTPServer(*metricsAddr, mux, timeouts, logger))
+			logger.Info("Metrics running", "addr", *metricsAddr)
+		}
+		checked("metrics", cmp.Or(*metricsAddr, "/metrics"))
+	}
+	if *statusPath != "" {
+		if !strings.HasPrefix(*statusPath, "/") {
+			fatal(logger, "Invalid status path", fmt.Errorf("%q doesn't start with /", *statusPath))
+		}
+		handler = newStatusPage(*statusPath, server, logger).wrap(handler)
+		checked("status page", *statusPath)
+	}
+	if *adminAddr != "" {
+		bind(newHTTPServer(*adminAddr, middleware.RequestID(proxies)(newAdminHandler(server, logger)), timeouts, logger))
+		logger.Info("Admin running", "addr", *adminAddr)
+		checked("admin endpoints", *adminAddr)
+	}
+	if *htpasswdFile != "" || len(authTokens.values) > 0 || *authTokenFile != "" {
+		authOptions := middleware.AuthOptions{Realm: *authRealm, Exempt: splitList(*authExempt), Logger: logger}
+		if *htpasswdFile != "" {
+			htpasswd, err := auth.NewHtpasswd(*htpasswdFile, logger)
+			if err != nil {
+				fatal(logger, "Failed to load htpasswd file", err)
+			}
+			checked("htpasswd file", *htpasswdFile)
+			authOptions.Basic = htpasswd
+		}
+		if len(authTokens.values) > 0 || *authTokenFile != "" {
+			tokens, err := auth.NewTokens(authTokens.values, *authTokenFile, logger)
+			if err != nil {
+				fatal(logger, "Failed to load auth tokens", err)
+			}
+			checked("auth tokens", cmp.Or(*authTokenFile, fmt.Sprintf("%d tokens", len(authTokens.values))))
+			authOptions.Tokens = tokens
+		}
+		handler = middleware.Auth(authOptions)(handler)
+	}
+	if requestRate > 0 {
+		burst := *rateBurst
+		if burst <= 0 {
+			burst = max(int(math.Ceil(float64(requestRate))), 1)
+		}
+		handler = middleware.RateLimit(middleware.RateLimitOptions{
+			Rate: requestRate, Burst: burst, Exempt: rateExempt, Proxies: proxies, Metrics: serverMetrics,
+		})(handler)
+	}
+	if len(allowed) > 0 || len(denied) > 0 {
+		handler = middleware.IPFilter(middleware.IPFilterOptions{Allow: allowed, Deny: denied, Proxies: proxies, Logger: logger})(handler)
+	}
+	// The access log is flushed and closed explicitly, as fatal exits without running defers
+	closeAccessLog := func() {}
+	if *accessLog || *accessLogFile != "" {
+		var out io.Writer = os.Stdout
+		closeOut := func() {}
+		if *accessLogFile != "" {
+			file, err := os.OpenFile(*accessLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+			if err != nil {
+				fatal(logger, "Failed to open access log", err)
+			}
+			checked("access log", *accessLogFile)
+			closeOut = func() { file.Close() }
+			out = file
+		}
+		logWriter := middleware.NewAsyncWriter(out, 4096, time.Second)
+		closeAccessLog = func() {
+			logWriter.Close()
+			closeOut()
+		}
+		handler = middleware.AccessLog(logWriter, proxies)(handler)
+	}
+	if *authQueryToken {
+		// Around the access log, so the token is gone before it sees the request
+		handler = middleware.QueryToken("token")(handler)
+	}
+	handler = middleware.Headers(customHeaders)(handler)
+	// Outside the access log and everything else logging requests, so they all see the ID
+	handler = middleware.RequestID(proxies)(handler)
+	if tracerProvider != nil {
+		handler = middleware.Tracing(tracerProvider.Tracer(cmpserve.TracerName))(handler)
+	}
+
+	if checkConfig {
+		closeAccessLog()
+		stopTracing()
+		if err := server.Close(); err != nil {
+			logger.Warn("Failed to close archive index", "error", err)
+		}
+		logger.Info("Configuration is valid")
+		return
+	}
+
+	srv := newHTTPServer(net.JoinHostPort(*addr, *port), handler, timeouts, logger)
+	if certReloader != nil {
+		srv.TLSConfig = tlsconfig.New(certReloader.GetCertificate)
+
+		ctx, stopWatching := context.WithCancel(context.Background())
+		defer stopWatching()
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go certReloader.Watch(ctx, reload, time.Minute, logger)
+
+		if *httpPort != "" {
+			plainHandler := handler
+			if *redirectHTTP {
+				plainHandler = tlsconfig.RedirectHandler(*port)
+			}
+			bind(newHTTPServer(net.JoinHostPort(*addr, *httpPort), plainHandler, timeouts, logger))
+			logger.Info("Service running", "addr", net.JoinHostPort(*addr, *httpPort), "tls", false, "redirect", *redirectHTTP)
+		}
+	}
+	if acmeManager != nil {
+		srv.TLSConfig = tlsconfig.NewACME(acmeManager)
+		httpAddr := net.JoinHostPort(*addr, *httpPort)
+		bind(newHTTPServer(httpAddr, tlsconfig.ACMEChallengeHandler(acmeManager, *port), timeouts, logger))
+		logger.Info("Service running", "addr", httpAddr, "tls", false, "redirect", true)
+	}
+	if *unixSocket != "" {
+		listener, err := listenUnix(*unixSocket, mode)
+		if err != nil {
+			closeAccessLog()
+			fatal(logger, "Service failed", err)
+		}
+		srv.Addr = "unix:" + *unixSocket
+		servers = append(servers, boundServer{srv: srv, listener: listener})
+	} else {
+		bind(srv)
+	}
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	logger.Info("Service running", "addr", srv.Addr, "tls", srv.TLSConfig != nil)
+	err = runServer(servers, signals, *shutdownTimeout, logger)
+	closeAccessLog()
+	stopTracing()
+	if closeErr := server.Close(); closeErr != nil {
+		logger.Warn("Failed to close archive index", "error", closeErr)
+	}
+	if err != nil {
+		fatal(logger, "Service failed", err)
 	}
+	logger.Info("Service stopped")
 }
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+// slowHandler sends the headers and the first half of the body, then the rest once released.
+func slowHandler(release <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("first half,"))
+		http.NewResponseController(w).Flush()
+		<-release
+		_, _ = w.Write([]byte("second half"))
+	})
+}
+
+func startServer(t *testing.T, handler http.Handler, timeout time.Duration) (string, chan os.Signal, <-chan error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	signals := make(chan os.Signal, 2)
+	done := make(chan error, 1)
+	go func() {
+		done <- runServer([]boundServer{{srv: &http.Server{Handler: handler}, listener: listener}}, signals, timeout, slog.New(slog.DiscardHandler))
+	}()
+	return "http://" + listener.Addr().String(), signals, done
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	release := make(chan struct{})
+	url, signals, done := startServer(t, slowHandler(release), 5*time.Second)
+
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	signals <- syscall.SIGTERM
+	// New connections are refused while the download drains
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", url[len("http://"):])
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+
+	close(release)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "first half,second half", string(body))
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+}
+
+func TestForcedShutdown(t *testing.T) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	url, signals, done := startServer(t, slowHandler(release), time.Minute)
+
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	signals <- syscall.SIGTERM
+	signals <- syscall.SIGINT
+
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("second signal did not force the shutdown")
+	}
+	_, err = io.ReadAll(resp.Body)
+	assert.Error(t, err)
+}
+
+func TestParsePrefixes(t *testing.T) {
+	prefixes, err := parsePrefixes([]string{"192.0.2.0/24", "2001:db8::/32", "198.51.100.7", "fd00::1", "10.1.2.3/8"})
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("192.0.2.0/24"),
+		netip.MustParsePrefix("2001:db8::/32"),
+		netip.MustParsePrefix("198.51.100.7/32"),
+		netip.MustParsePrefix("fd00::1/128"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+	}, prefixes)
+
+	_, err = parsePrefixes(strings.Split(defaultTrustedProxies, ","))
+	assert.NoError(t, err)
+
+	for _, value := range []string{"192.0.2.0/33", "2001:db8::/129", "office", "192.0.2.0/", ""} {
+		_, err := parsePrefixes([]string{value})
+		assert.Error(t, err, value)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for value, want := range map[string]rate.Limit{"10r/s": 10, "0.5r/s": 0.5, "600r/m": 10, "3600r/h": 1} {
+		limit, err := parseRate(value)
+		require.NoError(t, err, value)
+		assert.InDelta(t, float64(want), float64(limit), 1e-9, value)
+	}
+	for _, value := range []string{"", "10", "10/s", "10r/d", "0r/s", "-1r/s", "xr/s", "Infr/s", "NaNr/s"} {
+		_, err := parseRate(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestParseOTelEndpoint(t *testing.T) {
+	for value, want := range map[string]string{
+		"http://localhost:4318":                "http://localhost:4318/v1/traces",
+		"https://collector.example.com/":       "https://collector.example.com/v1/traces",
+		"https://collector.example.com/traces": "https://collector.example.com/traces",
+	} {
+		endpoint, err := parseOTelEndpoint(value)
+		require.NoError(t, err, value)
+		assert.Equal(t, want, endpoint, value)
+	}
+	for _, value := range []string{"", "localhost:4318", "grpc://localhost:4317", "http://"} {
+		_, err := parseOTelEndpoint(value)
+		assert.Error(t, err, value)
+	}
+}
+
+// TestMain runs main instead of the tests in the child processes started by runMain.
+func TestMain(m *testing.M) {
+	if os.Getenv("CMPSERVE_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// mainCommand returns the command running main with args in a child process, without the
+// CMPSERVE_ variables of the test environment.
+func mainCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], args...)
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, "CMPSERVE_") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	cmd.Env = append(cmd.Env, "CMPSERVE_TEST_MAIN=1")
+	return cmd
+}
+
+// runMain runs the command with args in a child process, as mainCommand does, and returns
+// its stdout and exit status.
+func runMain(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+	cmd := mainCommand(args...)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return stdout.String(), exitErr.ExitCode()
+	}
+	require.NoError(t, err)
+	return stdout.String(), 0
+}
+
+func TestConfigCheck(t *testing.T) {
+	root, cacheDir := t.TempDir(), t.TempDir()
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, os.WriteFile(htpasswd, []byte("alice:$2y$05$p0ZmbTQ6q2nGmd5g7kCEZOzBxTYf0rhOm/WIHHuM8YQo1rtNSMUjK\n"), 0o644))
+	template := filepath.Join(t.TempDir(), "index.html")
+	require.NoError(t, os.WriteFile(template, []byte("<ul>{{range .Entries}}<li>{{.Name}}{{end}}</ul>"), 0o644))
+	valid := []string{"-dir", root, "-cache-dir", cacheDir, "-port", "1", "-htpasswd", htpasswd, "-index-template", template, "-allow-cidr", "10.0.0.0/8", "-vhost", "docs.example.com=" + root}
+
+	// Nothing listens on port 1, which checking never binds
+	output, status := runMain(t, append([]string{"check"}, valid...)...)
+	assert.Equal(t, 0, status, output)
+	for _, line := range []string{
+		"ok    listener: 0.0.0.0:1\n",
+		"ok    networks: 0 trusted proxies, 1 allowed, 0 denied\n",
+		"ok    service directory: " + root + "\n",
+		"ok    index template: " + template + "\n",
+		"ok    cache directory: " + cacheDir + ", writable\n",
+		"ok    archive index: 0 archives\n",
+		"ok    virtual hosts: 1 hosts, default \"\"\n",
+		"ok    htpasswd file: " + htpasswd + "\n",
+	} {
+		assert.Contains(t, output, line)
+	}
+	assert.NotContains(t, output, "FAIL")
+	output, status = runMain(t, append([]string{"config", "check"}, valid...)...)
+	assert.Equal(t, 0, status, output)
+
+	badTemplate := filepath.Join(t.TempDir(), "index.html")
+	require.NoError(t, os.WriteFile(badTemplate, []byte("<ul>{{range .Entries}}</ul>"), 0o644))
+	config := writeConfig(t, "dir: "+root+"\nindexs: true\n")
+	for _, tc := range []struct {
+		name string
+		args []string
+		fail string
+	}{
+		{"missing root", []string{"-dir", filepath.Join(root, "missing")}, "FAIL  Failed to initialize server: invalid service directory: " + filepath.Join(root, "missing")},
+		{"cache dir is a file", []string{"-cache-dir", htpasswd}, "FAIL  Failed to initialize server: invalid cache directory: " + htpasswd},
+		{"template syntax", []string{"-index-template", badTemplate}, "FAIL  Failed to initialize server: failed to parse index template: template: index.html:1: unexpected EOF"},
+		{"CIDR", []string{"-deny-cidr", "192.0.2.0/33"}, `FAIL  Invalid -deny-cidr: invalid CIDR "192.0.2.0/33"`},
+		{"vhosts", []string{"-vhost", "*.example.com=" + root, "-vhost", "*.example.com=/srv"}, "FAIL  Invalid virtual host configuration: virtual host *.example.com given twice"},
+		{"htpasswd", []string{"-htpasswd", filepath.Join(root, "missing")}, "FAIL  Failed to load htpasswd file: "},
+		{"config file", []string{"-config", config}, `FAIL  Invalid configuration file: ` + config + `:2: unknown option "indexs"`},
+	} {
+		output, status := runMain(t, append(append([]string{"check"}, valid...), tc.args...)...)
+		assert.NotZero(t, status, tc.name)
+		assert.Contains(t, output, tc.fail, tc.name)
+	}
+
+	if os.Geteuid() != 0 {
+		readOnly := t.TempDir()
+		require.NoError(t, os.Chmod(readOnly, 0o555))
+		output, status := runMain(t, "check", "-dir", root, "-cache-dir", readOnly)
+		assert.Equal(t, 1, status)
+		assert.Contains(t, output, "FAIL  Failed to initialize server: invalid cache directory: "+readOnly+": ")
+	}
+}
+
+func TestArchiveRootCheck(t *testing.T) {
+	dir := t.TempDir()
+	zipPath := filepath.Join(dir, "site-bundle.zip")
+	writeZip(t, zipPath, time.Now(), map[string]string{"index.html": "home"})
+
+	// The index is kept next to the archive unless -cache-dir says otherwise
+	output, status := runMain(t, "check", "-dir", zipPath, "-port", "1")
+	assert.Equal(t, 0, status, output)
+	assert.Contains(t, output, "ok    service directory: "+zipPath+", served as an archive\n")
+	assert.Contains(t, output, "ok    cache directory: "+dir+", writable\n")
+	cacheDir := t.TempDir()
+	output, status = runMain(t, "check", "-dir", zipPath, "-port", "1", "-cache-dir", cacheDir)
+	assert.Equal(t, 0, status, output)
+	assert.Contains(t, output, "ok    cache directory: "+cacheDir+", writable\n")
+}
+
+func TestAccessLogFlushedOnFailure(t *testing.T) {
+	root, cacheDir := t.TempDir(), t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "page.txt"), []byte("page"), 0o644))
+	socket := filepath.Join(t.TempDir(), "cmpserve.sock")
+	accessLog := filepath.Join(t.TempDir(), "access.log")
+	cmd := mainCommand("-dir", root, "-cache-dir", cacheDir, "-unix-socket", socket, "-access-log-file", accessLog, "-shutdown-timeout", "100ms")
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() { _ = cmd.Process.Kill() })
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(socket)
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+
+	resp, err := unixClient(socket).Get("http://cmpserve/page.txt")
+	require.NoError(t, err)
+	resp.Body.Close()
+	// A request that never completes makes the shutdown fail, and the server exit with 1
+	conn, err := net.Dial("unix", socket)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /page.txt HTTP/1.1\r\n"))
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	var exitErr *exec.ExitError
+	require.ErrorAs(t, cmd.Wait(), &exitErr)
+	assert.Equal(t, 1, exitErr.ExitCode())
+
+	// The line of the request served before is written all the same
+	data, err := os.ReadFile(accessLog)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "GET /page.txt")
+}
@@ -0,0 +1,405 @@
+// Package cmpserve serves a directory over HTTP, along with the contents of the ZIP archives
+// in it, which are indexed on first use and streamed without being extracted to disk.
+//
+// A request for /docs/guide.html is answered with docs/guide.html if it exists, and
+// otherwise with the guide.html entry of docs.zip. A .cmpserve-aliases.json file in the root
+// serves archives under other paths, such as the newest docs-v*.zip under /docs/latest/.
+// A root that is a ZIP archive itself is served as the whole tree, so / is its index.html.
+// Only GET, HEAD and OPTIONS are served.
+// The handler can be mounted in any http.ServeMux or middleware chain:
+//
+//	handler, err := cmpserve.New(cmpserve.Options{Root: "/srv/artifacts", CacheDir: "/var/cache/cmpserve"})
+//	if err != nil {
+//		return err
+//	}
+//	defer handler.Close()
+//	mux.Handle("/artifacts/", http.StripPrefix("/artifacts", handler))
+package cmpserve
+
+import (
+	"context"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"cmpserve/internal/readers/zipfast"
+	"cmpserve/internal/service"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// ErrInvalidRoot is returned by New and WithRoot when the root is neither an existing
+	// directory nor a ZIP archive.
+	ErrInvalidRoot = service.ErrInvalidRoot
+	// ErrInvalidCacheDir is returned by New when CacheDir isn't an existing, writable
+	// directory.
+	ErrInvalidCacheDir = service.ErrInvalidCacheDir
+	// ErrArchiveIndex is returned by New when the archive index in CacheDir can't be opened
+	// or created.
+	ErrArchiveIndex = service.ErrArchiveIndex
+	// ErrArchiveRejected is returned by Reindex, ReindexIfChanged and Pin for archives
+	// rejected for exceeding the ArchiveLimits.
+	ErrArchiveRejected = zipfast.ErrRejected
+)
+
+// TracerName names the tracer of the spans of a Handler.
+const TracerName = "cmpserve"
+
+const (
+	// DefaultMaxPathSegments is the number of segments request paths may have by default.
+	DefaultMaxPathSegments = service.DefaultMaxPathSegments
+	// DefaultMaxSegmentLength is the length in bytes path segments may have by default.
+	DefaultMaxSegmentLength = service.DefaultMaxSegmentLength
+	// DefaultMaxPathLength is the length in bytes decoded request paths may have by default.
+	DefaultMaxPathLength = service.DefaultMaxPathLength
+)
+
+// SymlinkPolicy decides which symbolic links under the root are followed.
+type SymlinkPolicy = service.SymlinkPolicy
+
+const (
+	// SymlinksAll follows every symbolic link, wherever it points.
+	SymlinksAll = service.SymlinksAll
+	// SymlinksInternal follows symbolic links whose resolved target stays under the root.
+	SymlinksInternal = service.SymlinksInternal
+	// SymlinksDeny answers paths going through a symbolic link with 404.
+	SymlinksDeny = service.SymlinksDeny
+)
+
+// ParseSymlinkPolicy parses a policy name: all, internal or deny.
+func ParseSymlinkPolicy(name string) (SymlinkPolicy, error) {
+	return service.ParseSymlinkPolicy(name)
+}
+
+// CacheValidation decides how requests check that archives haven't changed since they
+// were indexed, reindexing those that did.
+type CacheValidation = zipfast.Validation
+
+const (
+	// CacheValidateStat compares the size and modification time of archives, to the
+	// nanosecond, on every request. It is the default.
+	CacheValidateStat = zipfast.ValidateStat
+	// CacheValidateStrict also compares a fingerprint of the last 64 KiB of archives,
+	// catching replacements of the same size and modification time, as copies preserving
+	// timestamps make.
+	CacheValidateStrict = zipfast.ValidateStrict
+	// CacheValidateNone trusts the index until Reindex or Invalidate.
+	CacheValidateNone = zipfast.ValidateNone
+)
+
+// ParseCacheValidation parses a validation name: none, stat or strict.
+func ParseCacheValidation(name string) (CacheValidation, error) {
+	return zipfast.ParseValidation(name)
+}
+
+// WithCacheValidation returns a context whose requests check archives at least as
+// strictly as v, e.g. to serve some requests with CacheValidateStrict.
+func WithCacheValidation(ctx context.Context, v CacheValidation) context.Context {
+	return zipfast.WithValidation(ctx, v)
+}
+
+// ArchiveLimits bound the archives indexed, against uploads crafted to take the memory and
+// disk of the server, as zip bombs are. Entries declaring more than MaxEntrySize
+// uncompressed, or a compression ratio over MaxCompressionRatio, are left out of the index
+// unless RejectArchive is set, which rejects their archive instead, as archives with more
+// than MaxEntries entries or MaxTotalSize declared uncompressed are. Rejections are
+// recorded in the index, so rejected archives aren't read again until they change or the
+// limits do, and their requests get 404. Reads of an entry stop at the size it declares.
+// Zero fields mean their defaults, and negative ones no limit.
+type ArchiveLimits = zipfast.Limits
+
+const (
+	// DefaultArchiveMaxEntries is the number of entries archives may have by default.
+	DefaultArchiveMaxEntries = zipfast.DefaultMaxEntries
+	// DefaultArchiveMaxTotalSize is the total uncompressed size the entries of archives may
+	// declare by default, 1 TiB.
+	DefaultArchiveMaxTotalSize = zipfast.DefaultMaxTotalSize
+	// DefaultArchiveMaxEntrySize is the uncompressed size entries may declare by default,
+	// 64 GiB.
+	DefaultArchiveMaxEntrySize = zipfast.DefaultMaxEntrySize
+	// DefaultArchiveMaxCompressionRatio is the compression ratio entries over 1 MiB may
+	// declare by default, above what deflate can reach.
+	DefaultArchiveMaxCompressionRatio = zipfast.DefaultMaxCompressionRatio
+)
+
+// ArchiveInfo describes an indexed archive, with its slash-separated path relative to the
+// root.
+type ArchiveInfo = zipfast.ArchiveInfo
+
+// IndexStats summarizes the archive index and its use, as reported by Handler.IndexStats.
+type IndexStats = zipfast.Stats
+
+// IndexedArchive describes the last indexing of an archive.
+type IndexedArchive = zipfast.IndexedArchive
+
+// Options configures a Handler. Only Root and CacheDir are required; the zero value of
+// every other field keeps the corresponding feature off or at its default.
+type Options struct {
+	// Root is the directory to serve, or a ZIP archive whose entries are served as the
+	// tree. The ignore and access files of the directory holding it don't apply.
+	Root string
+	// FollowRootSymlink resolves a Root that is a symbolic link, such as /srv/current,
+	// again every second instead of once, and serves each request wholly from the directory
+	// it then points at. Flipping the link publishes a new tree for the requests that follow,
+	// while those in flight finish from the old one. Archives are indexed by their path in
+	// the directory the link points at.
+	FollowRootSymlink bool
+	// CacheDir holds the archive index, a SQLite database shared by every Handler using it.
+	CacheDir string
+	// CacheMaxArchives bounds the number of archives in the index. Indexing one more evicts
+	// the least recently used ones, which get indexed again when next requested. Zero means
+	// no limit.
+	CacheMaxArchives int
+	// CacheCheckpointInterval is how much decompressed data separates the checkpoints
+	// recorded in the index while serving ranges of deflated entries, from which later
+	// ranges resume instead of decompressing the entry from its start. Each checkpoint takes
+	// 32 KiB. Zero records none.
+	CacheCheckpointInterval int64
+	// ArchiveNameEncoding is the IANA name of the encoding of archive entry names lacking
+	// the UTF-8 flag, such as cp866 or shift_jis, which are served under their UTF-8 name.
+	// Defaults to cp437; utf-8 keeps names as they are stored.
+	ArchiveNameEncoding string
+	// CacheValidation decides how requests check that archives haven't changed since they
+	// were indexed. Defaults to CacheValidateStat.
+	CacheValidation CacheValidation
+	// ArchiveLimits bound the entries of the archives indexed. Zero fields mean their
+	// defaults.
+	ArchiveLimits ArchiveLimits
+
+	// Indexes lists directories, and directories inside archives, without an index document.
+	Indexes bool
+	// ShowHiddenFiles serves and lists dot-prefixed names.
+	ShowHiddenFiles bool
+	// IndexFiles are the index document names tried in order for directory requests.
+	// Defaults to index.html.
+	IndexFiles []string
+	// SPA serves an archive's index document for missing extensionless entries.
+	SPA bool
+	// SPAFilesystem applies the SPA fallback to plain directories as well.
+	SPAFilesystem bool
+	// Precompressed serves the .br or .gz sibling of a file or archive entry to clients
+	// accepting it.
+	Precompressed bool
+	// NoArchiveDownload answers requests for archive files themselves with 404.
+	NoArchiveDownload bool
+	// BasePath is a URL path prefix, such as /artifacts, that requests arrive with. It is
+	// stripped for routing and added to generated links and redirects. Leave it empty
+	// behind http.StripPrefix, whose redirects and listings then lack the prefix.
+	BasePath string
+	// Symlinks decides which symbolic links are followed. Defaults to SymlinksAll.
+	Symlinks SymlinkPolicy
+	// Ignore are gitignore-style patterns, such as *.map or /private/**, of paths relative to
+	// the root, archive entries included, that get 404 and are left out of listings. A
+	// .cmpserveignore file in the root adds more, and is never served itself.
+	Ignore []string
+	// CaseInsensitive resolves paths that don't exist as requested, such as /Docs/README.MD,
+	// to the one file, directory or archive entry matching regardless of case. Paths
+	// matching several names, such as README.md and readme.md, get 404.
+	CaseInsensitive bool
+	// WebDAV answers PROPFIND requests, so that WebDAV clients can mount the tree read-only,
+	// and refuses the WebDAV methods writing to it with 403.
+	WebDAV bool
+	// NoRobots keeps crawlers away: every response gets X-Robots-Tag: noindex, nofollow,
+	// and /robots.txt, unless the root has one, disallows everything.
+	NoRobots bool
+	// Charsets are rules of the form glob=charset, such as *.csv=iso-8859-1, setting the
+	// charset of the archive entries they match, for legacy text. Other text entries get
+	// the charset of their byte order mark, or utf-8.
+	Charsets []string
+	// StripJSONBOM leaves the byte order mark of JSON archive entries out of the body.
+	StripJSONBOM bool
+	// Checksums answers path.sha256, unless such a file exists, and path?checksum=sha256
+	// with the SHA-256 digest of the file or archive entry at path, in sha256sum format.
+	// Digests are recorded in the archive index.
+	Checksums bool
+	// IndexTemplate is an html/template file rendering directory listings in place of the
+	// default one.
+	IndexTemplate string
+	// IndexTemplateReload re-parses IndexTemplate on every listing, for development.
+	IndexTemplateReload bool
+
+	// MaxExtractions bounds the archive requests served at once. Zero means no limit.
+	MaxExtractions int
+	// ExtractionQueueTimeout is how long archive requests wait for a free slot before
+	// being answered with 503.
+	ExtractionQueueTimeout time.Duration
+	// NotFoundCacheTTL is how long paths that resolved to nothing are remembered, so that
+	// repeated requests for them get 404 without probing the filesystem. Files created
+	// meanwhile are found once it expires, and archives right after Reindex or Invalidate.
+	// Zero turns the cache off.
+	NotFoundCacheTTL time.Duration
+	// MaxPathSegments, MaxSegmentLength and MaxPathLength bound the number of segments of
+	// request paths, archive entry paths included, the length in bytes of each decoded
+	// segment and that of the whole decoded path. Requests beyond them are refused before
+	// touching the filesystem, with 404 for a segment too long to name anything and 414
+	// otherwise. Zero means DefaultMaxPathSegments, DefaultMaxSegmentLength and
+	// DefaultMaxPathLength, and a negative value no limit.
+	MaxPathSegments  int
+	MaxSegmentLength int
+	MaxPathLength    int
+
+	// Logger receives request handling events. Defaults to slog.Default().
+	Logger *slog.Logger
+	// IndexObserver is notified of archive indexing and index database events.
+	IndexObserver IndexObserver
+	// ExtractionObserver is notified of running and waiting archive requests.
+	ExtractionObserver ExtractionObserver
+	// TracerProvider, if set, traces archive indexing, lookups and reads in spans that are
+	// children of those in request contexts, such as the server spans of otelhttp.
+	TracerProvider trace.TracerProvider
+}
+
+// IndexObserver receives events from the archive index, e.g. to export metrics.
+type IndexObserver interface {
+	// ArchiveIndexed is called after an archive has been (re)indexed.
+	ArchiveIndexed(entries int, duration time.Duration)
+	// IndexLookup is called on every archive lookup, reporting whether its index was cached.
+	IndexLookup(hit bool)
+	// DatabaseError is called when an operation on the index database fails.
+	DatabaseError(err error)
+	// ArchivesEvicted is called after archive indexes were evicted to stay within
+	// CacheMaxArchives.
+	ArchivesEvicted(count int)
+}
+
+// ExtractionObserver is told how many archive requests are running and waiting whenever
+// that changes, and of requests given up on.
+type ExtractionObserver interface {
+	// ExtractionsChanged reports the extractions running and those waiting for a slot.
+	ExtractionsChanged(inFlight, queued int)
+	// ExtractionRejected is called when a request gave up waiting for a slot.
+	ExtractionRejected()
+}
+
+// Handler serves a directory and the archives in it.
+type Handler struct {
+	service *service.Service
+	parent  bool
+}
+
+// New returns a Handler for options.Root, opening the archive index in options.CacheDir.
+// The errors it returns match ErrInvalidRoot, ErrInvalidCacheDir or ErrArchiveIndex with
+// errors.Is, or describe an invalid option.
+func New(options Options) (*Handler, error) {
+	serviceOptions := service.Options{
+		CreateIndexes:           options.Indexes,
+		ExposeHiddenFiles:       options.ShowHiddenFiles,
+		IndexFiles:              options.IndexFiles,
+		SPA:                     options.SPA,
+		SPAFilesystem:           options.SPAFilesystem,
+		Precompressed:           options.Precompressed,
+		NoArchiveDownload:       options.NoArchiveDownload,
+		BasePath:                options.BasePath,
+		Symlinks:                options.Symlinks,
+		Ignore:                  options.Ignore,
+		CaseInsensitive:         options.CaseInsensitive,
+		WebDAV:                  options.WebDAV,
+		NoRobots:                options.NoRobots,
+		Charsets:                options.Charsets,
+		StripJSONBOM:            options.StripJSONBOM,
+		Checksums:               options.Checksums,
+		FollowRootSymlink:       options.FollowRootSymlink,
+		IndexTemplate:           options.IndexTemplate,
+		IndexTemplateReload:     options.IndexTemplateReload,
+		MaxExtractions:          options.MaxExtractions,
+		ExtractionQueueTimeout:  options.ExtractionQueueTimeout,
+		NotFoundCacheTTL:        options.NotFoundCacheTTL,
+		MaxPathSegments:         options.MaxPathSegments,
+		MaxSegmentLength:        options.MaxSegmentLength,
+		MaxPathLength:           options.MaxPathLength,
+		CacheMaxArchives:        options.CacheMaxArchives,
+		CacheCheckpointInterval: options.CacheCheckpointInterval,
+		ArchiveNameEncoding:     options.ArchiveNameEncoding,
+		CacheValidation:         options.CacheValidation,
+		ArchiveLimits:           options.ArchiveLimits,
+		Logger:                  options.Logger,
+		Observer:                options.IndexObserver,
+		ExtractionObserver:      options.ExtractionObserver,
+	}
+	if options.TracerProvider != nil {
+		serviceOptions.Tracer = options.TracerProvider.Tracer(TracerName)
+	}
+	s, err := service.NewService(options.Root, options.CacheDir, serviceOptions)
+	if err != nil {
+		return nil, err
+	}
+	return &Handler{service: s, parent: true}, nil
+}
+
+// ServeHTTP serves the file, archive entry or listing the request path resolves to.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.service.ServeHTTP(w, r)
+}
+
+// WithRoot returns a Handler for another directory or archive that shares the options,
+// archive index and extraction limit of h, e.g. to serve several sites. It has nothing of
+// its own to close, and must not be used once h is closed.
+func (h *Handler) WithRoot(root string) (*Handler, error) {
+	s, err := h.service.WithRoot(root)
+	if err != nil {
+		return nil, err
+	}
+	return &Handler{service: s}, nil
+}
+
+// ArchiveFS returns the ZIP archive at the slash-separated path name, relative to the
+// root, as an fs.FS backed by the archive index, e.g. for template.ParseFS or
+// http.FileServerFS. Files of deflated entries can't seek. It holds all entries, hidden
+// ones included, and must not be used once h is closed.
+func (h *Handler) ArchiveFS(name string) (fs.FS, error) {
+	return h.service.ArchiveFS(name)
+}
+
+// Reindex indexes the ZIP archive at the slash-separated path name, relative to the root,
+// again and returns its number of entries, e.g. after it was replaced in place. Requests
+// reading its entries meanwhile are answered from the old index or the new one.
+func (h *Handler) Reindex(ctx context.Context, name string) (int, error) {
+	return h.service.ReindexArchive(ctx, name)
+}
+
+// ReindexIfChanged indexes the ZIP archive at the slash-separated path name, relative to
+// the root, again if it changed since it was indexed, checked as CacheValidateStrict does,
+// and returns its number of entries and whether it was indexed.
+func (h *Handler) ReindexIfChanged(ctx context.Context, name string) (int, bool, error) {
+	return h.service.ReindexArchiveIfChanged(ctx, name)
+}
+
+// Invalidate drops the index of the ZIP archive at the slash-separated path name,
+// relative to the root, and reports whether there was one. It is indexed again when next
+// requested.
+func (h *Handler) Invalidate(ctx context.Context, name string) (bool, error) {
+	return h.service.InvalidateArchive(ctx, name)
+}
+
+// Pin keeps the index of the ZIP archive at the slash-separated path name, relative to
+// the root, in memory, for hot archives: lookups of its entries then skip the database,
+// and it is never evicted. The index is loaded again once the archive is reindexed,
+// invalidated or found changed by CacheValidation. Pin returns the number of entries and
+// the approximate memory they take.
+func (h *Handler) Pin(ctx context.Context, name string) (entries int, bytes int64, err error) {
+	return h.service.PinArchive(ctx, name)
+}
+
+// Archives lists the indexed archives under the root.
+func (h *Handler) Archives(ctx context.Context) ([]ArchiveInfo, error) {
+	return h.service.IndexedArchives(ctx)
+}
+
+// IndexStats counts the archives and entries in the index, shared with the handlers
+// derived with WithRoot, and lists the most recently indexed archives, by path relative to
+// the root if they are under it. It runs a few aggregate queries on the database, so
+// callers polling it should cache the result.
+func (h *Handler) IndexStats(ctx context.Context) (IndexStats, error) {
+	return h.service.IndexStats(ctx)
+}
+
+// Close releases the archive index. It must only be called once no more requests are
+// handed to h or to the handlers derived from it with WithRoot.
+func (h *Handler) Close() error {
+	if !h.parent {
+		return nil
+	}
+	return h.service.Close()
+}
@@ -0,0 +1,283 @@
+package cmpserve_test
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"cmpserve/internal/middleware"
+	"cmpserve/pkg/cmpserve"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func writeZip(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	zipWriter := zip.NewWriter(file)
+	for name, content := range files {
+		w, err := zipWriter.Create(name)
+		require.NoError(t, err)
+		_, err = io.WriteString(w, content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, zipWriter.Close())
+	require.NoError(t, file.Close())
+}
+
+// newRoot returns a directory with a plain file and a site.zip archive.
+func newRoot(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "readme.txt"), []byte("plain file"), 0o644))
+	writeZip(t, filepath.Join(root, "site.zip"), map[string]string{
+		"index.html":     "<h1>site</h1>",
+		"docs/guide.txt": "guide",
+	})
+	return root
+}
+
+func newHandler(t *testing.T, options cmpserve.Options) *cmpserve.Handler {
+	t.Helper()
+	if options.CacheDir == "" {
+		options.CacheDir = t.TempDir()
+	}
+	if options.Logger == nil {
+		options.Logger = slog.New(slog.DiscardHandler)
+	}
+	handler, err := cmpserve.New(options)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, handler.Close()) })
+	return handler
+}
+
+func get(t *testing.T, handler http.Handler, target string) *http.Response {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec.Result()
+}
+
+func body(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestHandler(t *testing.T) {
+	handler := newHandler(t, cmpserve.Options{Root: newRoot(t)})
+
+	for target, want := range map[string]string{
+		"/readme.txt":          "plain file",
+		"/site/":               "<h1>site</h1>",
+		"/site/docs/guide.txt": "guide",
+	} {
+		resp := get(t, handler, target)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, target)
+		assert.Equal(t, want, body(t, resp), target)
+	}
+	resp := get(t, handler, "/site/docs/guide.txt")
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	// Listings are off by default
+	assert.Equal(t, http.StatusNotFound, get(t, handler, "/site/docs/").StatusCode)
+	assert.Equal(t, http.StatusNotFound, get(t, handler, "/missing.txt").StatusCode)
+	assert.Equal(t, http.StatusMovedPermanently, get(t, handler, "/site").StatusCode)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/readme.txt", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "GET, HEAD, OPTIONS", rec.Header().Get("Allow"))
+}
+
+func TestHandlerOptions(t *testing.T) {
+	root := newRoot(t)
+	require.NoError(t, os.WriteFile(filepath.Join(root, ".secret"), []byte("hidden"), 0o644))
+
+	handler := newHandler(t, cmpserve.Options{Root: root, Indexes: true, NoArchiveDownload: true, BasePath: "/files"})
+	assert.Equal(t, http.StatusNotFound, get(t, handler, "/files/site.zip").StatusCode)
+	assert.Equal(t, http.StatusNotFound, get(t, handler, "/files/.secret").StatusCode)
+	assert.Equal(t, http.StatusNotFound, get(t, handler, "/readme.txt").StatusCode)
+	assert.Equal(t, "plain file", body(t, get(t, handler, "/files/readme.txt")))
+
+	req := httptest.NewRequest(http.MethodGet, "/files/site/docs/", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var listing struct {
+		Entries []struct{ Name string } `json:"entries"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &listing))
+	require.Len(t, listing.Entries, 1)
+	assert.Equal(t, "guide.txt", listing.Entries[0].Name)
+
+	handler = newHandler(t, cmpserve.Options{Root: root, ShowHiddenFiles: true})
+	assert.Equal(t, "hidden", body(t, get(t, handler, "/.secret")))
+}
+
+type observer struct {
+	indexed, lookups, inFlight int
+}
+
+func (o *observer) ArchiveIndexed(entries int, duration time.Duration) { o.indexed += entries }
+func (o *observer) IndexLookup(hit bool)                               { o.lookups++ }
+func (o *observer) DatabaseError(err error)                            {}
+func (o *observer) ArchivesEvicted(count int)                          {}
+func (o *observer) ExtractionsChanged(inFlight, queued int)            { o.inFlight = max(o.inFlight, inFlight) }
+func (o *observer) ExtractionRejected()                                {}
+
+func TestHandlerObservers(t *testing.T) {
+	o := &observer{}
+	handler := newHandler(t, cmpserve.Options{Root: newRoot(t), MaxExtractions: 1, IndexObserver: o, ExtractionObserver: o})
+	assert.Equal(t, "guide", body(t, get(t, handler, "/site/docs/guide.txt")))
+	assert.Equal(t, 2, o.indexed)
+	assert.Positive(t, o.lookups)
+	assert.Equal(t, 1, o.inFlight)
+}
+
+func TestNewErrors(t *testing.T) {
+	root := newRoot(t)
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	_, err := cmpserve.New(cmpserve.Options{Root: missing, CacheDir: t.TempDir()})
+	assert.ErrorIs(t, err, cmpserve.ErrInvalidRoot)
+	_, err = cmpserve.New(cmpserve.Options{Root: filepath.Join(root, "readme.txt"), CacheDir: t.TempDir()})
+	assert.ErrorIs(t, err, cmpserve.ErrInvalidRoot)
+	_, err = cmpserve.New(cmpserve.Options{Root: root, CacheDir: missing})
+	assert.ErrorIs(t, err, cmpserve.ErrInvalidCacheDir)
+	if os.Geteuid() != 0 {
+		readOnly := t.TempDir()
+		require.NoError(t, os.Chmod(readOnly, 0o555))
+		_, err = cmpserve.New(cmpserve.Options{Root: root, CacheDir: readOnly})
+		assert.ErrorIs(t, err, cmpserve.ErrInvalidCacheDir)
+	}
+
+	// A directory where the index database belongs can't be opened as one
+	cacheDir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(cacheDir, ".zip_reader_cache.db"), 0o755))
+	_, err = cmpserve.New(cmpserve.Options{Root: root, CacheDir: cacheDir})
+	assert.ErrorIs(t, err, cmpserve.ErrArchiveIndex)
+
+	_, err = cmpserve.New(cmpserve.Options{Root: root, CacheDir: t.TempDir(), BasePath: "/a/../b"})
+	require.Error(t, err)
+	for _, sentinel := range []error{cmpserve.ErrInvalidRoot, cmpserve.ErrInvalidCacheDir, cmpserve.ErrArchiveIndex} {
+		assert.False(t, errors.Is(err, sentinel))
+	}
+}
+
+func TestWithRoot(t *testing.T) {
+	cacheDir := t.TempDir()
+	handler := newHandler(t, cmpserve.Options{Root: newRoot(t), CacheDir: cacheDir})
+
+	other := t.TempDir()
+	writeZip(t, filepath.Join(other, "site.zip"), map[string]string{"index.html": "other site"})
+	derived, err := handler.WithRoot(other)
+	require.NoError(t, err)
+	assert.Equal(t, "other site", body(t, get(t, derived, "/site/")))
+	assert.Equal(t, "<h1>site</h1>", body(t, get(t, handler, "/site/")))
+	assert.Equal(t, http.StatusNotFound, get(t, derived, "/readme.txt").StatusCode)
+
+	// Stats cover the shared index, with paths outside the root left as they are
+	stats, err := handler.IndexStats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Archives)
+	assert.Equal(t, 3, stats.Entries)
+	require.Len(t, stats.Recent, 2)
+	assert.Equal(t, "site.zip", stats.Recent[0].Path)
+	assert.Equal(t, filepath.Join(other, "site.zip"), stats.Recent[1].Path)
+
+	// Derived handlers share the index, which only the original handler closes
+	assert.NoError(t, derived.Close())
+	assert.Equal(t, "<h1>site</h1>", body(t, get(t, handler, "/site/")))
+
+	_, err = handler.WithRoot(filepath.Join(other, "missing"))
+	assert.ErrorIs(t, err, cmpserve.ErrInvalidRoot)
+}
+
+func TestArchiveFS(t *testing.T) {
+	handler := newHandler(t, cmpserve.Options{Root: newRoot(t)})
+
+	fsys, err := handler.ArchiveFS("site.zip")
+	require.NoError(t, err)
+	data, err := fs.ReadFile(fsys, "docs/guide.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "guide", string(data))
+	entries, err := fs.ReadDir(fsys, ".")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "docs", entries[0].Name())
+	assert.True(t, entries[0].IsDir())
+
+	for _, name := range []string{"readme.txt", "../site.zip", "/site.zip"} {
+		_, err := handler.ArchiveFS(name)
+		assert.ErrorIs(t, err, fs.ErrInvalid, name)
+	}
+	_, err = handler.ArchiveFS("missing.zip")
+	assert.Error(t, err)
+}
+
+func TestHandlerTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	handler := newHandler(t, cmpserve.Options{Root: newRoot(t), TracerProvider: provider})
+	traced := middleware.Tracing(provider.Tracer(cmpserve.TracerName))(handler)
+
+	resp := get(t, traced, "/site/docs/guide.txt")
+	assert.Equal(t, "guide", body(t, resp))
+
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+	}
+	require.Len(t, spans["GET"], 1)
+	server := spans["GET"][0]
+	childOf := func(span, parent sdktrace.ReadOnlySpan) {
+		t.Helper()
+		assert.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID(), span.Name())
+		assert.Equal(t, parent.SpanContext().TraceID(), span.SpanContext().TraceID(), span.Name())
+	}
+
+	// The first lookup of the archive indexes it, the later ones hit the index
+	require.NotEmpty(t, spans["archive.lookup"])
+	lookup := spans["archive.lookup"][0]
+	childOf(lookup, server)
+	assert.Contains(t, lookup.Attributes(), attribute.Bool("cmpserve.archive.index_hit", false))
+	require.Len(t, spans["archive.index"], 1)
+	index := spans["archive.index"][0]
+	childOf(index, lookup)
+	assert.Contains(t, index.Attributes(), attribute.Int("cmpserve.archive.entries", 2))
+	for _, later := range spans["archive.lookup"][1:] {
+		childOf(later, server)
+		assert.Contains(t, later.Attributes(), attribute.Bool("cmpserve.archive.index_hit", true))
+	}
+
+	var found sdktrace.ReadOnlySpan
+	for _, span := range spans["archive.entry.lookup"] {
+		childOf(span, server)
+		if slices.Contains(span.Attributes(), attribute.String("cmpserve.entry.name", "docs/guide.txt")) {
+			found = span
+		}
+	}
+	require.NotNil(t, found)
+	assert.Contains(t, found.Attributes(), attribute.Int64("cmpserve.entry.size", 5))
+	require.Len(t, spans["archive.entry.copy"], 1)
+	childOf(spans["archive.entry.copy"][0], server)
+}
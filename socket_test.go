@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unixClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cmpserve.sock")
+	listener, err := listenUnix(path, 0o660)
+	require.NoError(t, err)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o660), info.Mode().Perm())
+
+	// A second server can't take over a socket that is in use
+	_, err = listenUnix(path, 0o660)
+	assert.ErrorContains(t, err, "in use")
+
+	signals := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("over unix"))
+	})
+	go func() {
+		done <- runServer([]boundServer{{srv: &http.Server{Handler: handler}, listener: listener}}, signals, time.Second, slog.New(slog.DiscardHandler))
+	}()
+
+	client := unixClient(path)
+	resp, err := client.Get("http://cmpserve/")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "over unix", string(body))
+	client.CloseIdleConnections()
+
+	signals <- syscall.SIGTERM
+	require.NoError(t, <-done)
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist, "socket must be removed on shutdown")
+}
+
+func TestUnixSocketStaleFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "stale.sock")
+
+	// Leave a socket file behind without anything listening on it
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+	require.FileExists(t, path)
+
+	listener, err := listenUnix(path, 0o600)
+	require.NoError(t, err)
+	require.NoError(t, listener.Close())
+
+	// Regular files are never removed
+	regular := filepath.Join(dir, "regular")
+	require.NoError(t, os.WriteFile(regular, []byte("data"), 0o644))
+	_, err = listenUnix(regular, 0o600)
+	assert.ErrorContains(t, err, "not a socket")
+	assert.FileExists(t, regular)
+}
+
+func TestParseSocketMode(t *testing.T) {
+	mode, err := parseSocketMode("0660")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o660), mode)
+
+	for _, value := range []string{"", "660x", "0999", "01777", "rw-rw----"} {
+		_, err := parseSocketMode(value)
+		assert.Error(t, err, value)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"cmpserve/internal/negotiate"
+	"cmpserve/pkg/cmpserve"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statusCacheTTL is how long the status page reuses the index stats it queried, so that
+// polling it doesn't load the database
+const statusCacheTTL = 2 * time.Second
+
+// statusPage serves a snapshot of the server state at -status-path, counting the requests
+// in flight through it
+type statusPage struct {
+	path     string
+	server   *cmpserve.Handler
+	logger   *slog.Logger
+	started  time.Time
+	inFlight atomic.Int64
+
+	mu      sync.Mutex
+	stats   cmpserve.IndexStats
+	queried time.Time
+}
+
+// statusJSON is the status page as served to clients accepting application/json
+type statusJSON struct {
+	Started       time.Time `json:"started"`
+	UptimeSeconds float64   `json:"uptime_seconds"`
+	GoVersion     string    `json:"go_version"`
+	Goroutines    int       `json:"goroutines"`
+	InFlight      int64     `json:"in_flight"`
+	Archives      int       `json:"archives"`
+	Entries       int       `json:"entries"`
+	DatabaseSize  int64     `json:"database_size"`
+	IndexHits     int64     `json:"index_hits"`
+	IndexMisses   int64     `json:"index_misses"`
+	// IndexHitRate is left out until an archive was looked up
+	IndexHitRate *float64            `json:"index_hit_rate,omitempty"`
+	OpenArchives int64               `json:"open_archives"`
+	Recent       []recentArchiveJSON `json:"recently_indexed"`
+}
+
+type recentArchiveJSON struct {
+	Path            string    `json:"path"`
+	Entries         int       `json:"entries"`
+	IndexedAt       time.Time `json:"indexed_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>cmpserve status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.2em 1em 0.2em 0; }
+td.number { text-align: right; }
+</style>
+</head>
+<body>
+<h1>cmpserve status</h1>
+<table>
+<tr><th>Uptime</th><td>{{.Uptime}} (since {{.Started.Format "2006-01-02 15:04:05 MST"}})</td></tr>
+<tr><th>Go</th><td>{{.GoVersion}}, {{.Goroutines}} goroutines</td></tr>
+<tr><th>Requests in flight</th><td>{{.InFlight}}</td></tr>
+<tr><th>Archives indexed</th><td>{{.Archives}}</td></tr>
+<tr><th>Entries indexed</th><td>{{.Entries}}</td></tr>
+<tr><th>Index database</th><td>{{.DatabaseSize}}</td></tr>
+<tr><th>Index hit rate</th><td>{{if .HitRate}}{{.HitRate}} of {{.Lookups}} lookups{{else}}no lookups yet{{end}}</td></tr>
+<tr><th>Open archives</th><td>{{.OpenArchives}}</td></tr>
+</table>
+<h2>Recently indexed</h2>
+{{if .Recent}}<table>
+<tr><th>Archive</th><th>Entries</th><th>Indexed</th><th>Duration</th></tr>
+{{range .Recent}}<tr><td>{{.Path}}</td><td class="number">{{.Entries}}</td><td>{{.IndexedAt.Format "2006-01-02 15:04:05 MST"}}</td><td class="number">{{.Duration}}</td></tr>
+{{end}}</table>{{else}}<p>No archives indexed.</p>{{end}}
+</body>
+</html>
+`))
+
+// statusHTML is the status page as rendered by statusTemplate
+type statusHTML struct {
+	Uptime       time.Duration
+	Started      time.Time
+	GoVersion    string
+	Goroutines   int
+	InFlight     int64
+	Archives     int
+	Entries      int
+	DatabaseSize string
+	HitRate      string
+	Lookups      int64
+	OpenArchives int64
+	Recent       []cmpserve.IndexedArchive
+}
+
+func newStatusPage(path string, server *cmpserve.Handler, logger *slog.Logger) *statusPage {
+	return &statusPage{path: path, server: server, logger: logger, started: time.Now()}
+}
+
+// wrap serves the status page at its path, ahead of next, and everything else through next
+func (p *statusPage) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == p.path {
+			p.ServeHTTP(w, r)
+			return
+		}
+		p.inFlight.Add(1)
+		defer p.inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (p *statusPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats, err := p.indexStats(r)
+	if err != nil {
+		if r.Context().Err() == nil {
+			p.logger.ErrorContext(r.Context(), "Failed to collect index stats", "error", err)
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	uptime := time.Since(p.started)
+	lookups := stats.Hits + stats.Misses
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Vary", "Accept")
+	if negotiate.Accepts(r.Header.Get("Accept"), "application/json") {
+		status := statusJSON{
+			Started:       p.started,
+			UptimeSeconds: uptime.Seconds(),
+			GoVersion:     runtime.Version(),
+			Goroutines:    runtime.NumGoroutine(),
+			InFlight:      p.inFlight.Load(),
+			Archives:      stats.Archives,
+			Entries:       stats.Entries,
+			DatabaseSize:  stats.DatabaseSize,
+			IndexHits:     stats.Hits,
+			IndexMisses:   stats.Misses,
+			OpenArchives:  stats.OpenArchives,
+			Recent:        []recentArchiveJSON{},
+		}
+		if lookups > 0 {
+			rate := float64(stats.Hits) / float64(lookups)
+			status.IndexHitRate = &rate
+		}
+		for _, archive := range stats.Recent {
+			status.Recent = append(status.Recent, recentArchiveJSON{Path: archive.Path, Entries: archive.Entries, IndexedAt: archive.IndexedAt, DurationSeconds: archive.Duration.Seconds()})
+		}
+		writeJSON(w, status)
+		return
+	}
+
+	page := statusHTML{
+		Uptime:       uptime.Truncate(time.Second),
+		Started:      p.started,
+		GoVersion:    runtime.Version(),
+		Goroutines:   runtime.NumGoroutine(),
+		InFlight:     p.inFlight.Load(),
+		Archives:     stats.Archives,
+		Entries:      stats.Entries,
+		DatabaseSize: formatSize(stats.DatabaseSize),
+		Lookups:      lookups,
+		OpenArchives: stats.OpenArchives,
+		Recent:       stats.Recent,
+	}
+	if lookups > 0 {
+		page.HitRate = fmt.Sprintf("%.1f%%", 100*float64(stats.Hits)/float64(lookups))
+	}
+	for i := range page.Recent {
+		page.Recent[i].Duration = page.Recent[i].Duration.Round(time.Millisecond)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, page); err != nil && r.Context().Err() == nil {
+		p.logger.WarnContext(r.Context(), "Failed to render status page", "error", err)
+	}
+}
+
+// indexStats returns the index stats, querying them again once statusCacheTTL passed
+func (p *statusPage) indexStats(r *http.Request) (cmpserve.IndexStats, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.queried) < statusCacheTTL {
+		return p.copyStats(), nil
+	}
+	stats, err := p.server.IndexStats(r.Context())
+	if err != nil {
+		return cmpserve.IndexStats{}, err
+	}
+	p.stats, p.queried = stats, time.Now()
+	return p.copyStats(), nil
+}
+
+// copyStats returns the cached stats with a copy of their recent archives, which callers
+// may modify
+func (p *statusPage) copyStats() cmpserve.IndexStats {
+	stats := p.stats
+	stats.Recent = append([]cmpserve.IndexedArchive(nil), stats.Recent...)
+	return stats
+}
+
+// formatSize renders a byte count with a binary unit suffix, as directory listings do
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"cmpserve/pkg/cmpserve"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusPage(t *testing.T) {
+	root := t.TempDir()
+	writeZip(t, filepath.Join(root, "docs.zip"), time.Now(), map[string]string{"index.html": "docs", "a.txt": "a"})
+	// A file at the status path is shadowed by the page
+	require.NoError(t, os.WriteFile(filepath.Join(root, "status"), []byte("file"), 0o644))
+	logger := slog.New(slog.DiscardHandler)
+	server, err := cmpserve.New(cmpserve.Options{Root: root, CacheDir: t.TempDir(), Logger: logger})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, server.Close()) })
+	page := newStatusPage("/status", server, logger)
+	handler := page.wrap(server)
+
+	serve := func(method, target, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	readStatus := func() statusJSON {
+		rec := serve(http.MethodGet, "/status", "application/json")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		var status statusJSON
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+		return status
+	}
+
+	status := readStatus()
+	assert.Zero(t, status.Archives)
+	assert.Nil(t, status.IndexHitRate)
+	assert.Empty(t, status.Recent)
+	assert.Equal(t, "docs", serve(http.MethodGet, "/docs/", "").Body.String())
+	assert.Equal(t, "a", serve(http.MethodGet, "/docs/a.txt", "").Body.String())
+
+	// The index stats are reused for a while
+	status = readStatus()
+	assert.Zero(t, status.Archives)
+	page.queried = time.Time{}
+	status = readStatus()
+	assert.Equal(t, 1, status.Archives)
+	assert.Equal(t, 2, status.Entries)
+	assert.Positive(t, status.DatabaseSize)
+	assert.Equal(t, int64(1), status.IndexMisses)
+	assert.Positive(t, status.IndexHits)
+	require.NotNil(t, status.IndexHitRate)
+	assert.InDelta(t, float64(status.IndexHits)/float64(status.IndexHits+1), *status.IndexHitRate, 1e-9)
+	require.Len(t, status.Recent, 1)
+	assert.Equal(t, "docs.zip", status.Recent[0].Path)
+	assert.Positive(t, status.Recent[0].DurationSeconds)
+	assert.Positive(t, status.UptimeSeconds)
+
+	rec := serve(http.MethodGet, "/status", "text/html,*/*;q=0.8")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+	assert.Contains(t, rec.Body.String(), "<td>docs.zip</td>")
+	assert.Regexp(t, `\d+\.\d% of \d+ lookups`, rec.Body.String())
+	assert.NotEqual(t, "file", rec.Body.String())
+	rec = serve(http.MethodPost, "/status", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "GET, HEAD", rec.Header().Get("Allow"))
+
+	// Only the exact path is the page
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/status/", "").Code)
+
+	// Requests are in flight until the handler returns
+	inFlight := make(chan int64)
+	handler = page.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight <- page.inFlight.Load()
+	}))
+	go serve(http.MethodGet, "/docs/", "")
+	assert.Equal(t, int64(1), <-inFlight)
+}
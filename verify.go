@@ -0,0 +1,116 @@
+package main
+
+import (
+	"cmpserve/internal/readers/zipfast"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+// runVerify implements "cmpserve verify [flags] [archive...]", checking the archive index in
+// -cache-dir against the archives on disk, all of them unless some are given by the path
+// they are indexed under. It returns the exit status: 1 if any archive failed verification
+// or couldn't be checked, 2 for invalid arguments.
+func runVerify(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	cacheDir := flags.String("cache-dir", getEnvWithDefault("CMPSERVE_CACHE_DIR", "."), "Cache directory holding the archive index")
+	deep := flags.Bool("deep", false, "Also decompress every entry and validate its checksum")
+	fix := flags.Bool("fix", false, "Reindex the archives failing verification, dropping those that no longer exist")
+	archiveNameEncoding := flags.String("archive-name-encoding", getEnvWithDefault("CMPSERVE_ARCHIVE_NAME_ENCODING", "cp437"), "Encoding of archive entry names lacking the UTF-8 flag, for archives reindexed by -fix")
+	// Entries left out by the limits aren't expected in the index
+	archiveLimits := archiveLimitFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	nameEncoding, err := zipfast.ParseNameEncoding(*archiveNameEncoding)
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid -archive-name-encoding: %v\n", err)
+		return 2
+	}
+
+	// Opening a missing database would create an empty one
+	dbPath := filepath.Join(*cacheDir, zipfast.DatabaseName)
+	if _, err := os.Stat(dbPath); err != nil {
+		fmt.Fprintf(stderr, "no archive index in %s: %v\n", *cacheDir, err)
+		return 2
+	}
+	logger, _ := newLogger(stderr, "warn", "text")
+	reader, err := zipfast.NewFastZipReader(dbPath, zipfast.Options{Logger: logger, NameEncoding: nameEncoding, Limits: archiveLimits()})
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to open archive index: %v\n", err)
+		return 1
+	}
+	defer reader.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	paths := flags.Args()
+	if len(paths) == 0 {
+		archives, err := reader.Archives(ctx)
+		if err != nil {
+			fmt.Fprintf(stderr, "failed to list archives: %v\n", err)
+			return 1
+		}
+		for _, archive := range archives {
+			paths = append(paths, archive.Path)
+		}
+	}
+
+	failed := 0
+	for _, zipPath := range paths {
+		v, err := reader.Verify(ctx, filepath.Clean(zipPath), *deep)
+		if errors.Is(err, zipfast.ErrNotIndexed) {
+			fmt.Fprintf(stdout, "FAIL %s\n  not indexed\n", zipPath)
+			failed++
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "failed to verify %s: %v\n", zipPath, err)
+			return 1
+		}
+		if v.OK() && v.Rejected != "" {
+			fmt.Fprintf(stdout, "PASS %s (rejected: %s)\n", v.Path, v.Rejected)
+			continue
+		}
+		if v.OK() {
+			fmt.Fprintf(stdout, "PASS %s (%d entries)\n", v.Path, v.Entries)
+			continue
+		}
+		failed++
+		fmt.Fprintf(stdout, "FAIL %s\n", v.Path)
+		for _, problem := range v.Problems {
+			fmt.Fprintf(stdout, "  %s\n", problem)
+		}
+		if *fix {
+			fmt.Fprintf(stdout, "  %s\n", fixArchive(ctx, reader, v))
+		}
+	}
+	fmt.Fprintf(stdout, "%d archives verified, %d failed\n", len(paths), failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// fixArchive reindexes an archive that failed verification, or drops it from the index if
+// it no longer exists, and describes the outcome
+func fixArchive(ctx context.Context, reader *zipfast.FastZipReader, v zipfast.Verification) string {
+	if v.Missing {
+		if _, err := reader.Invalidate(ctx, v.Path); err != nil {
+			return fmt.Sprintf("fix failed: %v", err)
+		}
+		return "fixed: dropped from the index"
+	}
+	entries, err := reader.Reindex(ctx, v.Path)
+	if err != nil {
+		return fmt.Sprintf("fix failed: %v", err)
+	}
+	return fmt.Sprintf("fixed: reindexed %d entries", entries)
+}
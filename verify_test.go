@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"cmpserve/pkg/cmpserve"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyCommand(t *testing.T) {
+	root, cacheDir := t.TempDir(), t.TempDir()
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	docs := filepath.Join(root, "docs.zip")
+	site := filepath.Join(root, "site.zip")
+	writeZip(t, docs, modTime, map[string]string{"index.html": "docs"})
+	writeZip(t, site, modTime, map[string]string{"index.html": "site", "app.js": "app"})
+
+	// Index both archives by serving them
+	server, err := cmpserve.New(cmpserve.Options{Root: root, CacheDir: cacheDir, Logger: slog.New(slog.DiscardHandler)})
+	require.NoError(t, err)
+	for _, path := range []string{"/docs/", "/site/"} {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	require.NoError(t, server.Close())
+
+	verify := func(args ...string) (int, string) {
+		var stdout bytes.Buffer
+		status := runVerify(append([]string{"-cache-dir", cacheDir}, args...), &stdout, io.Discard)
+		return status, stdout.String()
+	}
+
+	status, out := verify()
+	assert.Equal(t, 0, status)
+	assert.Equal(t, "PASS "+docs+" (1 entries)\nPASS "+site+" (2 entries)\n2 archives verified, 0 failed\n", out)
+
+	// Data corrupted in place, keeping the central directory: only a deep check notices
+	data, err := os.ReadFile(docs)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(docs, bytes.Replace(data, []byte("docs"), []byte("DOCS"), 1), 0o644))
+	require.NoError(t, os.Chtimes(docs, modTime, modTime))
+	status, _ = verify()
+	assert.Equal(t, 0, status)
+	status, out = verify("--deep", docs)
+	assert.Equal(t, 1, status)
+	assert.Contains(t, out, "FAIL "+docs+"\n  entry index.html: data checksum is")
+	assert.Contains(t, out, "1 archives verified, 1 failed\n")
+
+	// Once the archive is whole again, -fix reindexes it; archives gone are dropped
+	writeZip(t, docs, modTime, map[string]string{"index.html": "DOCS"})
+	require.NoError(t, os.Remove(site))
+	status, out = verify("-deep", "-fix")
+	assert.Equal(t, 1, status)
+	assert.Contains(t, out, "  fixed: reindexed 1 entries\n")
+	assert.Contains(t, out, "FAIL "+site+"\n  archive no longer exists\n  fixed: dropped from the index\n")
+
+	status, out = verify("-deep")
+	assert.Equal(t, 0, status)
+	assert.Equal(t, "PASS "+docs+" (1 entries)\n1 archives verified, 0 failed\n", out)
+
+	status, out = verify(filepath.Join(root, "other.zip"))
+	assert.Equal(t, 1, status)
+	assert.Contains(t, out, "  not indexed\n")
+
+	assert.Equal(t, 2, runVerify([]string{"-cache-dir", t.TempDir()}, io.Discard, io.Discard))
+	assert.Equal(t, 2, runVerify([]string{"-unknown"}, io.Discard, io.Discard))
+}